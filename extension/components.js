@@ -1,6 +1,6 @@
 class BookmarkItem extends HTMLElement {
     static get observedAttributes() {
-        return ['bookmark-id', 'url', 'title', 'category', 'category-id', 'favicon', 'timestamp', 'last-visited', 'notes', 'order', 'watched', 'changed', 'changed-at', 'watch-interval', 'track-time', 'daily-time-limit'];
+        return ['bookmark-id', 'url', 'title', 'category', 'category-id', 'favicon', 'timestamp', 'last-visited', 'notes', 'order', 'watched', 'changed', 'changed-at', 'watch-interval', 'track-time', 'daily-time-limit', 'private', 'description', 'fallback-url', 'link-status', 'link-error', 'link-checked-at'];
     }
 
     constructor() {
@@ -64,7 +64,12 @@ class BookmarkItem extends HTMLElement {
         const url = this.getAttribute('url') || '';
         const title = this.getAttribute('title') || '';
         const category = this.getAttribute('category') || 'Uncategorized';
-        const favicon = this.getAttribute('favicon') || '';
+        const description = this.getAttribute('description') || '';
+        const fallbackUrl = this.getAttribute('fallback-url') || '';
+        const linkStatus = parseInt(this.getAttribute('link-status') || '0', 10);
+        const linkError = this.getAttribute('link-error') || '';
+        // the link checker found an error status or got no answer
+        const linkBroken = !!this.getAttribute('link-checked-at') && (linkStatus === 0 || linkStatus >= 400);
         const timestamp = this.getAttribute('timestamp') || '';
         const lastVisited = this.getAttribute('last-visited') || '';
         const watched = this.getAttribute('watched') === 'true';
@@ -84,22 +89,25 @@ class BookmarkItem extends HTMLElement {
         this.className = 'bookmark-item' + (changed ? ' changed' : watched ? ' watched' : '');
         this.draggable = true;
         this.innerHTML = `
-            <a href="${url}" target="_blank" class="bookmark-link" title="${this.escapeHtml(title)}&#10;${this.escapeHtml(url)}">
+            <a href="${url}" target="_blank" class="bookmark-link" title="${this.escapeHtml(title)}&#10;${this.escapeHtml(url)}${description ? '&#10;&#10;' + this.escapeHtml(description) : ''}${linkBroken ? '&#10;&#10;Broken link: ' + this.escapeHtml(linkStatus ? String(linkStatus) : linkError) : ''}">
                 <div class="bookmark-favicon-wrapper">
-                    <img src="${favicon}" class="bookmark-favicon" alt="">
+                    <img class="bookmark-favicon" alt="">
                 </div>
                 <div class="bookmark-info">
                     <span class="bookmark-title">${this.escapeHtml(title)}</span>
-                    <span class="bookmark-url">${hostname}</span>
+                    <span class="bookmark-url${linkBroken ? ' text-error' : ''}">${hostname}</span>
                 </div>
 
 
             </a>
             <div class="bookmark-actions">
+                ${fallbackUrl ? `<a href="${this.escapeHtml(fallbackUrl)}" target="_blank" class="btn btn-ghost btn-xs btn-square" title="The link is dead: open the archived copy">⟲</a>` : ''}
                 <button class="btn btn-ghost btn-xs btn-square edit-btn" title="Edit">✎</button>
             </div>
         `;
 
+        this.loadFavicon(this.querySelector('.bookmark-favicon'), id);
+
         const link = this.querySelector('.bookmark-link');
         link.addEventListener('click', () => {
             this.recordVisit();
@@ -170,6 +178,28 @@ class BookmarkItem extends HTMLElement {
         }
     }
 
+    // Favicons come from the server's cache rather than the bookmarked site.
+    loadFavicon(img, id) {
+        // rendered again once connected, with the list's server URL
+        if (!this.isConnected) return;
+        const config = this.getConfig();
+        const src = `${config.serverUrl}/favicons/${encodeURIComponent(id)}`;
+        if (!config.authHeader) {
+            img.src = src;
+            return;
+        }
+
+        // <img> can't send the token, so fetch the icon ourselves
+        fetch(src, { headers: { 'Authorization': config.authHeader } })
+            .then(res => res.ok ? res.blob() : null)
+            .then(blob => {
+                if (!blob) return;
+                img.addEventListener('load', () => URL.revokeObjectURL(img.src), { once: true });
+                img.src = URL.createObjectURL(blob);
+            })
+            .catch(() => {});
+    }
+
     recordVisit() {
         const id = this.getAttribute('bookmark-id');
         const config = this.getConfig();
@@ -194,6 +224,7 @@ class BookmarkItem extends HTMLElement {
         const trackTime = this.getAttribute('track-time') === 'true';
         const dailyTimeLimit = parseInt(this.getAttribute('daily-time-limit')) || 0;
         const watched = this.getAttribute('watched') === 'true';
+        const isPrivate = this.getAttribute('private') === 'true';
         const changed = this.getAttribute('changed') === 'true';
         const changedAt = this.getAttribute('changed-at') || '';
         const watchInterval = parseInt(this.getAttribute('watch-interval')) || 360;
@@ -268,6 +299,13 @@ class BookmarkItem extends HTMLElement {
                         </select>
                         <span class="edit-modal-changed-badge badge badge-error badge-sm hidden cursor-pointer">Changed</span>
                     </div>
+                    <div class="flex flex-wrap items-center gap-2 mt-2">
+                        <label class="flex items-center gap-2 cursor-pointer">
+                            <input type="checkbox" class="checkbox checkbox-sm checkbox-primary edit-modal-private" />
+                            <span class="label-text text-sm">Private</span>
+                            <span class="text-xs text-base-content/40">(hidden from visitors without credentials)</span>
+                        </label>
+                    </div>
                     
                     <div class="flex justify-between items-center mt-4">
                         <button class="btn btn-error btn-sm edit-modal-delete">Delete</button>
@@ -288,6 +326,7 @@ class BookmarkItem extends HTMLElement {
             const revertBtn = modal.querySelector('.edit-modal-revert');
             const trackTimeCheckbox = modal.querySelector('.edit-modal-track-time');
             const watchedCheckbox = modal.querySelector('.edit-modal-watched');
+            const privateCheckbox = modal.querySelector('.edit-modal-private');
             const intervalSelect = modal.querySelector('.edit-modal-watch-interval');
             const changedBadge = modal.querySelector('.edit-modal-changed-badge');
 
@@ -418,6 +457,14 @@ class BookmarkItem extends HTMLElement {
                 }
             });
 
+            privateCheckbox.addEventListener('change', async () => {
+                const isPrivate = privateCheckbox.checked;
+                if (await saveField('private', isPrivate)) {
+                    const item = document.querySelector(`bookmark-item[bookmark-id="${modal.dataset.bookmarkId}"]`);
+                    if (item) item.setAttribute('private', isPrivate.toString());
+                }
+            });
+
             intervalSelect.addEventListener('change', async () => {
                 const interval = parseInt(intervalSelect.value);
                 if (await saveField('watch_interval', interval)) {
@@ -568,16 +615,19 @@ class BookmarkItem extends HTMLElement {
 
             const faviconClickTarget = modal.querySelector('.edit-modal-favicon');
             faviconClickTarget.addEventListener('click', async () => {
-                const currentSrc = faviconClickTarget.src;
+                const currentSrc = faviconClickTarget.dataset.source;
                 const newUrl = prompt('Enter favicon URL:', currentSrc);
                 if (newUrl === null) return; // cancelled
 
                 const favicon = newUrl.trim();
                 if (!favicon) return;
                 if (await saveField('favicon', favicon)) {
-                    faviconClickTarget.src = favicon;
+                    faviconClickTarget.dataset.source = favicon;
                     const item = document.querySelector(`bookmark-item[bookmark-id="${modal.dataset.bookmarkId}"]`);
-                    if (item) item.setAttribute('favicon', favicon);
+                    if (item) {
+                        item.setAttribute('favicon', favicon);
+                        item.loadFavicon(faviconClickTarget, modal.dataset.bookmarkId);
+                    }
                 }
             });
         }
@@ -597,7 +647,9 @@ class BookmarkItem extends HTMLElement {
         modal.dataset.originalUrl = url;
         modal.dataset.originalNotes = notes;
 
-        faviconImg.src = favicon;
+        faviconImg.dataset.source = favicon;
+        faviconImg.removeAttribute('src');
+        this.loadFavicon(faviconImg, id);
         titleInput.value = title;
         urlInput.value = url;
         notesTextarea.value = notes;
@@ -642,6 +694,7 @@ class BookmarkItem extends HTMLElement {
         const changedBadge2 = modal.querySelector('.edit-modal-changed-badge');
         const intervalSelect2 = modal.querySelector('.edit-modal-watch-interval');
         watchedCheckbox2.checked = watched;
+        modal.querySelector('.edit-modal-private').checked = isPrivate;
         intervalSelect2.value = watchInterval.toString();
         intervalSelect2.classList.toggle('hidden', !watched);
         if (changed) {
@@ -931,6 +984,8 @@ class BookmarkList extends HTMLElement {
                     const bv = b.last_visited || 0;
                     return dir * (av - bv);
                 }
+                case 'visits':
+                    return dir * ((a.visit_count || 0) - (b.visit_count || 0));
                 case 'last-changed': {
                     const ac = a.changed_at || 0;
                     const bc = b.changed_at || 0;
@@ -999,10 +1054,12 @@ class BookmarkList extends HTMLElement {
                 const title = (item.getAttribute('title') || '').toLowerCase();
                 const url = (item.getAttribute('url') || '').toLowerCase();
                 const category = (item.getAttribute('category') || '').toLowerCase();
+                const meta = (item.dataset.meta || '').toLowerCase();
                 
                 const matches = title.includes(lowerQuery) || 
                                url.includes(lowerQuery) || 
-                               category.includes(lowerQuery);
+                               category.includes(lowerQuery) ||
+                               meta.includes(lowerQuery);
                 
                 item.style.display = matches ? '' : 'none';
                 if (matches) {
@@ -1194,8 +1251,15 @@ class BookmarkList extends HTMLElement {
                 item.setAttribute('timestamp', bm.timestamp || '');
                 item.setAttribute('last-visited', bm.last_visited || '');
                 item.setAttribute('notes', bm.notes || '');
+                item.setAttribute('description', bm.description || '');
+                item.setAttribute('fallback-url', bm.fallback_url || '');
+                item.setAttribute('link-status', bm.link_status || 0);
+                item.setAttribute('link-error', bm.link_error || '');
+                item.setAttribute('link-checked-at', bm.link_checked_at || '');
                 item.setAttribute('order', bm.order ?? 0);
+                if (bm.meta) item.dataset.meta = Object.entries(bm.meta).map(([k, v]) => `${k} ${v}`).join(' ');
                 item.setAttribute('watched', (bm.watched || false).toString());
+                item.setAttribute('private', (bm.private || false).toString());
                 item.setAttribute('changed', (bm.changed || false).toString());
                 if (bm.changed_at) item.setAttribute('changed-at', bm.changed_at);
                 item.setAttribute('watch-interval', bm.watch_interval || 360);
@@ -1449,6 +1513,7 @@ class BookmarkList extends HTMLElement {
                                 <option value="title">Title</option>
                                 <option value="date-added">Date added</option>
                                 <option value="date-visited">Last visited</option>
+                                <option value="visits">Most visited</option>
                                 <option value="last-changed">Last changed</option>
                             </select>
                             <button class="btn btn-xs btn-ghost category-modal-sort-dir" title="Toggle sort direction">↑</button>
@@ -2202,34 +2267,12 @@ class BookmarkList extends HTMLElement {
     }
 
     _persistBookmarkLiveLayout(draggedEl, targetCategoryId, container) {
-        // Read the final order from the DOM
+        // Read the final order from the DOM; the server moves the dragged
+        // bookmark into the target category if it came from another one
         const items = [...container.querySelectorAll('bookmark-item')];
-        const sourceCategoryId = draggedEl.getAttribute('category-id');
-        const isCrossCategory = sourceCategoryId !== targetCategoryId;
-
-        // Assign sequential order values based on DOM position
-        const orderUpdates = items.map((item, idx) => ({
-            id: item.getAttribute('bookmark-id'),
-            order: idx,
-        }));
+        const orderIds = items.map(item => item.getAttribute('bookmark-id'));
 
-        // Persist all order changes
-        const config = {
-            serverUrl: this.getAttribute('server-url') || '',
-            authHeader: this.getAttribute('auth-header') || ''
-        };
-        const headers = { 'Content-Type': 'application/json' };
-        if (config.authHeader) headers['Authorization'] = config.authHeader;
-
-        // Move the dragged bookmark to the target category (also sets order)
-        const draggedIdx = items.indexOf(draggedEl);
-        const newOrder = draggedIdx >= 0 ? draggedIdx : 0;
-
-        this._moveBookmark(
-            draggedEl.getAttribute('bookmark-id'),
-            targetCategoryId,
-            newOrder
-        );
+        this._reorderBookmarks(targetCategoryId, orderIds);
     }
 
     _ensureDropIndicator() {
@@ -2301,7 +2344,7 @@ class BookmarkList extends HTMLElement {
         }
     }
 
-    async _moveBookmark(id, categoryId, order) {
+    async _reorderBookmarks(categoryId, orderIds) {
         const config = {
             serverUrl: this.getAttribute('server-url') || '',
             authHeader: this.getAttribute('auth-header') || ''
@@ -2311,17 +2354,17 @@ class BookmarkList extends HTMLElement {
             const headers = { 'Content-Type': 'application/json' };
             if (config.authHeader) headers['Authorization'] = config.authHeader;
 
-            const res = await fetch(`${config.serverUrl}/api/bookmarks/${id}`, {
-                method: 'PATCH',
+            const res = await fetch(`${config.serverUrl}/api/categories/${encodeURIComponent(categoryId)}/bookmarks/reorder`, {
+                method: 'PUT',
                 headers,
-                body: JSON.stringify({ category_id: categoryId, order })
+                body: JSON.stringify({ order: orderIds })
             });
 
-            if (!res.ok) throw new Error('Failed to move bookmark');
+            if (!res.ok) throw new Error('Failed to reorder bookmarks');
 
             this.dispatchEvent(new CustomEvent('bookmark-moved', { bubbles: true }));
         } catch (err) {
-            console.error('Move failed:', err);
+            console.error('Reorder failed:', err);
             this.render();
         }
     }
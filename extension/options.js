@@ -62,7 +62,7 @@ document.addEventListener('DOMContentLoaded', () => {
     }
 
     // Restore and configure
-    chrome.storage.sync.get(['serverUrl', 'username', 'password', 'theme', 'customThemes'], (items) => {
+    chrome.storage.sync.get(['serverUrl', 'username', 'password', 'apiToken', 'theme', 'customThemes'], (items) => {
         // Load custom themes first
         const customThemes = items.customThemes || {};
         loadCustomThemes(customThemes);
@@ -75,10 +75,13 @@ document.addEventListener('DOMContentLoaded', () => {
         document.getElementById('serverUrl').value = serverUrl;
         document.getElementById('username').value = items.username || '';
         document.getElementById('password').value = items.password || '';
+        document.getElementById('apiToken').value = items.apiToken || '';
 
         // Configure import component
         importSection.setAttribute('server-url', serverUrl);
-        if (items.username && items.password) {
+        if (items.apiToken) {
+            importSection.setAttribute('auth-header', `Bearer ${items.apiToken}`);
+        } else if (items.username && items.password) {
             const credentials = btoa(`${items.username}:${items.password}`);
             importSection.setAttribute('auth-header', `Basic ${credentials}`);
         }
@@ -121,15 +124,18 @@ document.addEventListener('DOMContentLoaded', () => {
         const serverUrl = document.getElementById('serverUrl').value.replace(/\/$/, "");
         const username = document.getElementById('username').value;
         const password = document.getElementById('password').value;
+        const apiToken = document.getElementById('apiToken').value.trim();
 
-        chrome.storage.sync.set({ serverUrl, username, password }, () => {
+        chrome.storage.sync.set({ serverUrl, username, password, apiToken }, () => {
             const status = document.getElementById('status');
             status.textContent = 'Options saved.';
             setTimeout(() => status.textContent = '', 2000);
 
             // Update import component config
             importSection.setAttribute('server-url', serverUrl);
-            if (username && password) {
+            if (apiToken) {
+                importSection.setAttribute('auth-header', `Bearer ${apiToken}`);
+            } else if (username && password) {
                 const credentials = btoa(`${username}:${password}`);
                 importSection.setAttribute('auth-header', `Basic ${credentials}`);
             } else {
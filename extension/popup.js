@@ -458,9 +458,11 @@ async function fetchData(baseUrl, authHeader, storeCallback) {
 
 function getSettings() {
     return new Promise((resolve) => {
-        chrome.storage.sync.get(['serverUrl', 'username', 'password'], (items) => {
+        chrome.storage.sync.get(['serverUrl', 'username', 'password', 'apiToken'], (items) => {
             let authHeader = null;
-            if (items.username && items.password) {
+            if (items.apiToken) {
+                authHeader = `Bearer ${items.apiToken}`;
+            } else if (items.username && items.password) {
                 const credentials = btoa(`${items.username}:${items.password}`);
                 authHeader = `Basic ${credentials}`;
             }
@@ -1,27 +1,75 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
 	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/tls"
+	"embed"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"html"
+	"hash/fnv"
 	"html/template"
+	"image"
+	"image/color"
+	"image/jpeg"
+	_ "image/png"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"maps"
+	mrand "math/rand/v2"
+	"mime"
+	"net"
 	"net/http"
+	_ "net/http/pprof"
+	"net/netip"
 	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime/debug"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
 
-	_ "database/sql"
+	"database/sql"
 
 	"github.com/google/uuid"
+	nethtml "golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
 	"github.com/joho/godotenv"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
 	_ "modernc.org/sqlite"
 )
 
@@ -31,6 +79,9 @@ type Category struct {
 	Name  string `json:"name"`
 	Order int    `json:"order"`
 	Color string `json:"color,omitempty"`
+	Seq       uint64 `json:"seq,omitempty"`
+	Rev       int    `json:"rev"`
+	UpdatedAt int64  `json:"updated_at,omitempty"`
 }
 
 type Bookmark struct {
@@ -41,9 +92,25 @@ type Bookmark struct {
 	CategoryID  string `json:"category_id"`
 	Timestamp   int64  `json:"timestamp"`
 	Favicon     string `json:"favicon"`
+	// Open Graph metadata of the page, for rich cards
+	Description  string `json:"description,omitempty"`
+	Image        string `json:"image,omitempty"`
+	CanonicalURL string `json:"canonical_url,omitempty"`
+	ArchivedAt   int64  `json:"archived_at,omitempty"` // of the readable copy, see /archive
+	WaybackURL   string `json:"wayback_url,omitempty"` // snapshot in the Wayback Machine
+	FallbackURL  string `json:"fallback_url,omitempty"` // snapshot to offer while the link is dead
+	SourceURL    string `json:"source_url,omitempty"` // the link as saved, before its redirects were resolved
+	// the last link check: HTTP status (0 if there was no answer, see
+	// link_error) and where the link redirected to
+	LinkStatus    int    `json:"link_status,omitempty"`
+	LinkError     string `json:"link_error,omitempty"`
+	LinkRedirect  string `json:"link_redirect,omitempty"`
+	LinkCheckedAt int64  `json:"link_checked_at,omitempty"`
 	Order       int    `json:"order"`
 	LastVisited *int64 `json:"last_visited,omitempty"`
+	VisitCount  int    `json:"visit_count"`
 	Notes       string `json:"notes,omitempty"`
+	Private     bool   `json:"private,omitempty"` // hidden from requests without credentials
 	Watched       bool   `json:"watched,omitempty"`
 	WatchInterval int    `json:"watch_interval,omitempty"`
 	ContentHash string `json:"content_hash,omitempty"`
@@ -52,13 +119,76 @@ type Bookmark struct {
 	ChangedAt   *int64 `json:"changed_at,omitempty"`
 	TrackTime      bool   `json:"track_time,omitempty"`
 	DailyTimeLimit int    `json:"daily_time_limit,omitempty"`
+	Meta           map[string]string `json:"meta,omitempty"`
+	Tags           []string          `json:"tags,omitempty"`
+	UpdatedAt      int64             `json:"updated_at,omitempty"`
+	Seq            uint64            `json:"seq,omitempty"`
+	Rev            int               `json:"rev"`
+}
+
+// SavedSearch is a named search query ("smart category") that is evaluated
+// live whenever it is listed.
+type SavedSearch struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Query string `json:"query"`
 }
 
 type Database struct {
-	Categories []Category `json:"categories"`
-	Bookmarks  []Bookmark `json:"bookmarks"`
+	Categories    []Category    `json:"categories"`
+	Bookmarks     []Bookmark    `json:"bookmarks"`
+	SavedSearches []SavedSearch `json:"saved_searches,omitempty"`
+	Tombstones    []Tombstone   `json:"tombstones,omitempty"`
+	Unpublished   []Tombstone   `json:"unpublished,omitempty"`
+	Seq           uint64        `json:"seq,omitempty"`
+	PrunedSeq     uint64        `json:"pruned_seq,omitempty"`
+	Sync          *syncState    `json:"sync,omitempty"`
+	Activity      []Activity    `json:"activity,omitempty"`
+}
+
+// Tombstone records when a bookmark or category was deleted, so that sync
+// clients (GET /api/bookmarks?since=, GET /api/changes) learn about
+// deletions.
+type Tombstone struct {
+	ID        string `json:"id"`
+	Type      string `json:"type,omitempty"` // "category", or empty for bookmarks
+	DeletedAt int64  `json:"deleted_at"`
+	Seq       uint64 `json:"seq,omitempty"`
+	Private   bool   `json:"private,omitempty"` // of a private bookmark, hidden from public views
+}
+
+// Activity is an entry of a collection's activity log, the "recent
+// activity" timeline served by GET /api/activity. Names are recorded as they
+// were at the time.
+type Activity struct {
+	Time           int64  `json:"time"`
+	Type           string `json:"type"`
+	BookmarkID     string `json:"bookmark_id,omitempty"`
+	URL            string `json:"url,omitempty"`
+	Title          string `json:"title,omitempty"`
+	CategoryID     string `json:"category_id,omitempty"`
+	Category       string `json:"category,omitempty"`
+	FromCategoryID string `json:"from_category_id,omitempty"` // bookmark.moved
+	FromCategory   string `json:"from_category,omitempty"`
+	Private        bool   `json:"private,omitempty"` // of a private bookmark
 }
 
+const (
+	activityBookmarkAdded   = "bookmark.added"
+	activityBookmarkVisited = "bookmark.visited"
+	activityBookmarkMoved   = "bookmark.moved"
+	activityBookmarkDeleted = "bookmark.deleted"
+	activityCategoryCreated = "category.created"
+	activityCategoryDeleted = "category.deleted"
+)
+
+// activityLogSize is how many activity entries a collection keeps.
+const activityLogSize = 1000
+
+// tombstoneRetention is how long deletions are remembered; clients that
+// last synced before that have to fetch everything again.
+const tombstoneRetention = 90 * 24 * time.Hour
+
 type CustomTheme struct {
 	Name string
 	CSS  string
@@ -73,30 +203,81 @@ type DomainTimeData struct {
 	Entries []TimeEntry `json:"entries"`
 }
 
-const dbFile = "bookmarks.json"
+// Store holds the categories and bookmarks of a single collection together
+// with the file they are persisted to.
+type Store struct {
+	Name       string
+	Owner      string // ID of the user the collection belongs to, "" for the instance's own
+	path       string
+	mu         sync.RWMutex
+	categories map[string]Category
+	bookmarks  map[string]Bookmark
+	searches   []SavedSearch
+	index      *searchIndex
+	tombstones map[string]Tombstone
+
+	// unpublished holds, as tombstones for public views, the bookmarks
+	// that were made private
+	unpublished map[string]Tombstone
+
+	// seq numbers every change to the collection; each bookmark, category
+	// and tombstone carries the seq of its last change. prunedSeq is the
+	// highest seq of a tombstone dropped after tombstoneRetention.
+	seq       uint64
+	prunedSeq uint64
+
+	syncState *syncState
+
+	// activity is the activity log, oldest first
+	activity []Activity
+
+	// modTime is the file's modification time when last loaded or saved
+	modTime time.Time
+
+	// silent stores (dry-run copies) don't publish change events
+	silent bool
+
+	// public stores are read-only copies without private bookmarks, for
+	// requests that may not see them; view caches the copy of this store
+	// until its next save.
+	public bool
+	viewMu sync.Mutex
+	view   *Store
+}
+
+var dbFile = "bookmarks.json" // BOOKMARKD_DB overrides
+const collectionsDir = "collections"
+const defaultCollection = "default"
 const timeTrackingFile = "time_tracking.json"
+const xbsFile = "xbrowsersync.json"
+const webhooksFile = "webhooks.json"
+const tokensFile = "tokens.json"
+const usersFile = "users.json"
+const sessionsFile = "sessions.json"
+const usersDir = "users"
+const tenantsDir = "tenants"
 const uncategorizedID = "uncategorized"
 
 var (
-	categories   map[string]Category
-	bookmarks    map[string]Bookmark
-	customThemes []CustomTheme
+	stores       map[string]*Store
+	customThemes map[string][]CustomTheme // by tenant, "" for the instance's
 	timeTracking map[string]*DomainTimeData
-	mu           sync.RWMutex
+	storesMu     sync.RWMutex
 	timeMu       sync.RWMutex
 	themeMu      sync.RWMutex
 	tmpl         *template.Template
+	loginTmpl    *template.Template
 )
 
-func getCategoryName(categoryID string) string {
-	if cat, ok := categories[categoryID]; ok {
+func (s *Store) getCategoryName(categoryID string) string {
+	if cat, ok := s.categories[categoryID]; ok {
 		return cat.Name
 	}
 	return "Uncategorized"
 }
 
-func getCategoryByName(name string) *Category {
-	for _, cat := range categories {
+func (s *Store) getCategoryByName(name string) *Category {
+	for _, cat := range s.categories {
 		if cat.Name == name {
 			return &cat
 		}
@@ -106,16 +287,16 @@ func getCategoryByName(name string) *Category {
 
 // resolveOrCreateCategory returns the category ID for the given name,
 // creating a new category if one doesn't already exist.
-// Must be called with mu held.
-func resolveOrCreateCategory(name string) string {
+// Must be called with s.mu held.
+func (s *Store) resolveOrCreateCategory(name string) string {
 	if name == "" || name == "Uncategorized" {
 		return uncategorizedID
 	}
-	if existing := getCategoryByName(name); existing != nil {
+	if existing := s.getCategoryByName(name); existing != nil {
 		return existing.ID
 	}
 	maxOrder := 0
-	for _, cat := range categories {
+	for _, cat := range s.categories {
 		if cat.Order > maxOrder {
 			maxOrder = cat.Order
 		}
@@ -125,23 +306,30 @@ func resolveOrCreateCategory(name string) string {
 		Name:  name,
 		Order: maxOrder + 1,
 	}
-	categories[newCat.ID] = newCat
+	s.putCategory(newCat)
 	return newCat.ID
 }
 
-func bookmarksToSortedSlice() []Bookmark {
-	if len(bookmarks) == 0 {
+func (s *Store) bookmarksToSortedSlice() []Bookmark {
+	if len(s.bookmarks) == 0 {
 		return []Bookmark{}
 	}
 
-	result := make([]Bookmark, 0, len(bookmarks))
-	for _, bm := range bookmarks {
+	result := make([]Bookmark, 0, len(s.bookmarks))
+	for _, bm := range s.bookmarks {
 		result = append(result, bm)
 	}
 
+	s.sortByPosition(result)
+	return result
+}
+
+// sortByPosition orders bookmarks the way they are laid out in the UI:
+// by category order, then by their order within the category.
+func (s *Store) sortByPosition(result []Bookmark) {
 	sort.Slice(result, func(i, j int) bool {
-		catI := categories[result[i].CategoryID]
-		catJ := categories[result[j].CategoryID]
+		catI := s.categories[result[i].CategoryID]
+		catJ := s.categories[result[j].CategoryID]
 
 		if catI.ID == uncategorizedID && catJ.ID != uncategorizedID {
 			return true
@@ -160,17 +348,15 @@ func bookmarksToSortedSlice() []Bookmark {
 
 		return result[i].Timestamp > result[j].Timestamp
 	})
-
-	return result
 }
 
-func categoriesToSortedSlice() []Category {
-	if len(categories) == 0 {
+func (s *Store) categoriesToSortedSlice() []Category {
+	if len(s.categories) == 0 {
 		return []Category{}
 	}
 
-	result := make([]Category, 0, len(categories))
-	for _, cat := range categories {
+	result := make([]Category, 0, len(s.categories))
+	for _, cat := range s.categories {
 		result = append(result, cat)
 	}
 
@@ -204,51 +390,226 @@ func sliceToCategoryMap(slice []Category) map[string]Category {
 }
 
 func main() {
-	if err := godotenv.Load(); err != nil {
-		log.Printf("No .env file found, using environment variables")
+	parseFlags()
+	recordStartupEnv()
+	envErr := godotenv.Load()
+	configPath, configErr := loadConfigFile()
+	setupLogging()
+	if envErr != nil {
+		slog.Info("No .env file found, using environment variables")
+	}
+	if configErr != nil {
+		fatal("Could not load config file", "err", configErr)
+	}
+	if configPath != "" {
+		slog.Info("Loaded config file", "path", configPath)
 	}
+	loadAssets()
+	loadDataDir()
+	loadEncryptionKey()
+	loadTracing()
 
-	if err := loadDatabase(); err != nil {
-		log.Printf("Warning: Could not load bookmarks (creating new file on save): %v", err)
-		initializeDefaults()
+	if err := openStore("", defaultCollection, dbFile); err != nil {
+		fatal("Could not read data file", "file", dbFile, "err", err)
 	}
+	if err := loadCollections(""); err != nil {
+		fatal("Could not read data file", "err", err)
+	}
+	loadUsers()
+	loadTenantMode()
+	loadTenants()
 
+	loadCORSConfig()
+	loadURLSchemes()
+	loadTrackingParams()
+	loadRedirectHosts()
 	loadTimeTracking()
+	loadXBSSyncs()
+	loadWebhooks()
+	loadAuth()
+	loadTokens()
+	loadOIDCConfig()
+	loadProxyAuthConfig()
+	loadLDAPConfig()
+	loadSessions()
+	loadRateLimits()
+	loadBodyLimits()
+	loadReadOnly()
+	loadIPAllowlist()
+	loadSecurityHeaders()
+	loadAuthLog()
+	loadAccessLog()
+	loadProfiling()
+	loadBasePath()
+	loadThumbnails()
+	loadWayback()
+	loadFetchPool()
+	loadLinkCheck()
+	loadFaviconRefresh()
+	restoreArchivedFavicons()
 
-	tmpl = template.Must(template.ParseFiles("index.html"))
+	tmpl = template.Must(template.ParseFS(assetFS, "index.html"))
+	loginTmpl = template.Must(template.ParseFS(assetFS, "login.html"))
 
 	loadThemes()
 
 	startWatcher()
+	startScheduledExports()
+	startLinkChecker()
+	startFaviconRefresh()
+	startSync()
+	startWebhooks()
+	startMQTT()
+	startThumbnails()
+	startWayback()
+	startScheduler()
 
 	http.HandleFunc("/", handleIndex)
-	http.HandleFunc("/api/bookmarks", withCORS(handleAPI))
-	http.HandleFunc("/api/bookmarks/", withCORS(handleBookmarkAPI))
-	http.HandleFunc("/api/categories", withCORS(handleCategoriesAPI))
-	http.HandleFunc("/api/categories/reorder", withCORS(handleCategoriesReorder))
-	http.HandleFunc("/api/categories/", withCORS(handleCategoryAPI))
-	http.HandleFunc("/api/themes", withCORS(handleThemesAPI))
-	http.HandleFunc("/api/watch/check", withCORS(handleWatchCheck))
-	http.HandleFunc("/api/time-tracking/", withCORS(handleTimeTrackingAPI))
-
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
-
-	port := os.Getenv("BOOKMARKD_PORT")
-	host := os.Getenv("BOOKMARKD_HOST")
-	fmt.Printf("Bookmarkd server running on http://%s:%s\n", host, port)
-	log.Fatal(http.ListenAndServe(host+":"+port, nil))
-}
-
-func initializeDefaults() {
-	mu.Lock()
-	defer mu.Unlock()
-	categories = make(map[string]Category)
-	bookmarks = make(map[string]Bookmark)
-	categories[uncategorizedID] = Category{
+	handleAPIFunc("/api/bookmarks", withCORS(withStore(withLinkding(handleAPI))))
+	handleAPIFunc("/api/bookmarks/", withCORS(withStore(withLinkding(handleBookmarkAPI))))
+	http.HandleFunc("/api/tags/", withCORS(withStore(withLinkding(nil))))
+	handleAPIFunc("/api/categories", withCORS(withStore(handleCategoriesAPI)))
+	handleAPIFunc("/api/categories/reorder", withCORS(withStore(handleCategoriesReorder)))
+	handleAPIFunc("/api/categories/", withCORS(withStore(handleCategoryAPI)))
+	handleAPIFunc("/api/import", withCORS(withStore(handleImport)))
+	handleAPIFunc("/api/import/", withCORS(withStore(handleImport)))
+	handleAPIFunc("/api/export/html", withCORS(withStore(handleExportHTML)))
+	handleAPIFunc("/api/export/csv", withCORS(withStore(handleExportCSV)))
+	handleAPIFunc("/api/export/markdown", withCORS(withStore(handleExportMarkdown)))
+	handleAPIFunc("/api/export/opml", withCORS(withStore(handleExportOPML)))
+	handleAPIFunc("/api/export/archive", withCORS(handleExportArchive))
+	handleAPIFunc("/api/tags/cloud", withCORS(withStore(handleTagCloud)))
+	handleAPIFunc("/api/saved-searches", withCORS(withStore(handleSavedSearchesAPI)))
+	handleAPIFunc("/api/saved-searches/", withCORS(withStore(handleSavedSearchAPI)))
+	handleAPIFunc("/api/collections", withCORS(handleCollectionsAPI))
+	handleAPIFunc("/api/events", withCORS(withStore(handleEvents)))
+	handleAPIFunc("/api/changes", withCORS(withStore(handleChanges)))
+	handleAPIFunc("/api/activity", withCORS(withStore(handleActivity)))
+	handleAPIFunc("/api/sync", withCORS(withStore(handleSync)))
+	handleAPIFunc("/api/webhooks", withCORS(handleWebhooksAPI))
+	handleAPIFunc("/api/webhooks/", withCORS(handleWebhookAPI))
+	handleAPIFunc("/api/tokens", withCORS(handleTokensAPI))
+	handleAPIFunc("/api/tokens/", withCORS(handleTokenAPI))
+	handleAPIFunc("/api/signup", withCORS(handleSignup))
+	handleAPIFunc("/api/login", withCORS(handleLogin))
+	handleAPIFunc("/api/me", withCORS(handleMe))
+	handleAPIFunc("/api/users", withCORS(handleUsersAPI))
+	handleAPIFunc("/api/users/", withCORS(handleUserAPI))
+	handleAPIFunc("/api/collections/", withCORS(handleCollectionAPI))
+	handleAPIFunc("/api/themes", withCORS(handleThemesAPI))
+	handleAPIFunc("/api/watch/check", withCORS(withStore(handleWatchCheck)))
+	handleAPIFunc("/api/links/health", withCORS(withStore(handleLinksHealth)))
+	handleAPIFunc("/api/time-tracking/", withCORS(handleTimeTrackingAPI))
+	handleAPIFunc("/api/admin/reload", withCORS(withStore(handleAdminReload)))
+	handleAPIFunc("/api/admin/stats", withCORS(handleAdminStats))
+	handleAPIFunc("/api/admin/jobs", withCORS(handleAdminJobs))
+	handleAPIFunc("/api/admin/jobs/", withCORS(handleAdminJob))
+	handleAPIFunc("/api/favicon", withCORS(handleFaviconProxy))
+	handleAPIFunc("/api/openapi.json", withCORS(handleOpenAPI))
+	handleAPIFunc("/api/docs", handleAPIDocs)
+	http.HandleFunc("/favicons/", withStore(handleFavicon))
+	http.HandleFunc("/thumbnails/", withStore(handleThumbnail))
+	http.HandleFunc(grpcPathPrefix, handleGRPC)
+	http.HandleFunc("/healthz", handleHealthz)
+	http.HandleFunc("/readyz", handleReadyz)
+	http.HandleFunc("/auth/login", handleLoginPage)
+	http.HandleFunc("/auth/logout", handleLogout)
+	http.HandleFunc("/auth/oidc/login", handleOIDCLogin)
+	http.HandleFunc("/auth/oidc/callback", handleOIDCCallback)
+	http.HandleFunc("/ws", withStore(handleWebSocket))
+	http.HandleFunc("/pinboard/v1/", withCORS(withStore(handlePinboardAPI)))
+	http.HandleFunc("/xbrowsersync/", withCORS(handleXBrowserSyncAPI))
+	http.HandleFunc("/api/v1/info", withCORS(withStore(handleShaarliAPI)))
+	http.HandleFunc("/api/v1/links", withCORS(withStore(handleShaarliAPI)))
+	http.HandleFunc("/api/v1/links/", withCORS(withStore(handleShaarliAPI)))
+	http.HandleFunc("/api/v1/tags", withCORS(withStore(handleShaarliAPI)))
+	http.HandleFunc("/api/v1/tags/", withCORS(withStore(handleShaarliAPI)))
+
+	http.Handle("/static/", http.StripPrefix("/static/", http.FileServerFS(staticFS)))
+
+	port := strings.TrimPrefix(cmp.Or(os.Getenv("BOOKMARKD_PORT"), "8080"), ":")
+	host := cmp.Or(os.Getenv("BOOKMARKD_HOST"), "localhost")
+	addr := net.JoinHostPort(host, port)
+	server := &http.Server{Addr: addr, Handler: withSettings(withRequestID(withAccessLog(withBasePath(withTenant(withCollectionPrefix(withTracing(withSecurityHeaders(withIPAllowlist(withReadOnly(withBodyLimit(withAuth(withRateLimit(withProfiling(http.DefaultServeMux))))))))))))))}
+	server.Protocols = new(http.Protocols)
+	server.Protocols.SetHTTP1(true)
+	scheme := "http"
+	if server.TLSConfig = loadTLSConfig(); server.TLSConfig != nil {
+		scheme = "https"
+		server.Protocols.SetHTTP2(true)
+	} else {
+		// cleartext HTTP/2 lets gRPC clients connect without TLS
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	loadSystemdListeners()
+	ln := listen(addr)
+	url := scheme + "://" + addr + basePath
+	if ln.Addr().Network() == "unix" {
+		url = "unix:" + ln.Addr().String()
+	} else if systemdListeners["server"] != nil {
+		url = scheme + "://" + ln.Addr().String() + basePath
+	}
+	slog.Info("Bookmarkd server running", "url", url, "version", buildVersion())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		var err error
+		if server.TLSConfig != nil {
+			err = server.ServeTLS(ln, "", "")
+		} else {
+			err = server.Serve(ln)
+		}
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("Server failed", "err", err)
+		}
+	}()
+	servers := []*http.Server{server}
+	if tcp, ok := ln.Addr().(*net.TCPAddr); ok {
+		port = strconv.Itoa(tcp.Port)
+	}
+	if redirect := startHTTPSRedirect(server, port); redirect != nil {
+		servers = append(servers, redirect)
+	}
+	startReloader()
+	<-ctx.Done()
+	stop()
+	shutdown(servers...)
+}
+
+func (s *Store) initializeDefaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.categories = make(map[string]Category)
+	s.bookmarks = make(map[string]Bookmark)
+	s.tombstones = make(map[string]Tombstone)
+	s.categories[uncategorizedID] = Category{
 		ID:    uncategorizedID,
 		Name:  "Uncategorized",
 		Order: 0,
 	}
+	s.assignMissingSeqs()
+	s.rebuildIndex()
+}
+
+// assignMissingSeqs numbers categories and bookmarks saved before change
+// sequences existed, categories first and in ID order, so that reloading an
+// unsaved file hands out the same numbers. Callers must hold s.mu.
+func (s *Store) assignMissingSeqs() {
+	for _, id := range slices.Sorted(maps.Keys(s.categories)) {
+		if cat := s.categories[id]; cat.Seq == 0 {
+			s.seq++
+			cat.Seq = s.seq
+			s.categories[id] = cat
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(s.bookmarks)) {
+		if bm := s.bookmarks[id]; bm.Seq == 0 {
+			s.seq++
+			bm.Seq = s.seq
+			s.bookmarks[id] = bm
+		}
+	}
 }
 
 // --- Handlers ---
@@ -260,7 +621,7 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 	}
 
 	themeMu.RLock()
-	themes := customThemes
+	themes := customThemes[requestTenant(r)]
 	themeMu.RUnlock()
 
 	var themeCSS strings.Builder
@@ -272,14 +633,26 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 	data := struct {
 		CustomThemes    []CustomTheme
 		CustomThemeCSS  template.CSS
+		Auth            bool
+		SignedIn        bool
+		CSRFToken       string
+		ReadOnly        bool
+		Nonce           string
+		BasePath        string
 	}{
 		CustomThemes:   themes,
 		CustomThemeCSS: template.CSS(themeCSS.String()),
+		Auth:           authEnabled(),
+		ReadOnly:       readOnly,
+		Nonce:          cspNonce(r),
+		BasePath:       requestBase(r),
 	}
+	data.CSRFToken = requestCSRFToken(r)
+	data.SignedIn = data.CSRFToken != ""
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	if err := tmpl.Execute(w, data); err != nil {
-		log.Printf("Template execute error: %v", err)
+		slog.ErrorContext(r.Context(), "Could not render template", "err", err)
 	}
 }
 
@@ -287,30 +660,119 @@ func handleIndex(w http.ResponseWriter, r *http.Request) {
 
 
 
-func handleAPI(w http.ResponseWriter, r *http.Request) {
+func handleAPI(w http.ResponseWriter, r *http.Request, s *Store) {
 	if r.Method == "GET" {
-		getBookmarksJSON(w)
+		getBookmarksJSON(w, r, s)
 		return
 	}
 
 	if r.Method == "POST" {
-		createBookmark(w, r)
+		createBookmark(w, r, s)
+		return
+	}
+
+	if r.Method == "PATCH" {
+		bulkUpdateBookmarks(w, r, s)
 		return
 	}
 }
 
-func handleBookmarkAPI(w http.ResponseWriter, r *http.Request) {
+func handleBookmarkAPI(w http.ResponseWriter, r *http.Request, s *Store) {
 	path := strings.TrimPrefix(r.URL.Path, "/api/bookmarks/")
 	if path == "" {
 		http.Error(w, "Missing bookmark ID", http.StatusBadRequest)
 		return
 	}
 
+	if path == "batch" {
+		if r.Method == "POST" {
+			createBookmarksBatch(w, r, s)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if path == "query" {
+		if r.Method == "POST" {
+			queryBookmarks(w, r, s)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	// Handle /api/bookmarks/:id/visit
 	if strings.HasSuffix(path, "/visit") {
 		id := strings.TrimSuffix(path, "/visit")
 		if r.Method == "POST" {
-			visitBookmark(w, id)
+			visitBookmark(w, id, s)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Handle /api/bookmarks/:id/refresh-metadata
+	if strings.HasSuffix(path, "/refresh-metadata") {
+		id := strings.TrimSuffix(path, "/refresh-metadata")
+		if r.Method == "POST" {
+			refreshBookmarkMetadata(w, r, id, s)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Handle /api/bookmarks/:id/archive-content
+	if strings.HasSuffix(path, "/archive-content") {
+		id := strings.TrimSuffix(path, "/archive-content")
+		if r.Method == "POST" {
+			archiveBookmarkContent(w, r, id, s)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Handle /api/bookmarks/:id/archive
+	if strings.HasSuffix(path, "/archive") {
+		id := strings.TrimSuffix(path, "/archive")
+		if r.Method == "GET" {
+			getBookmarkArchive(w, r, id, s)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Handle /api/bookmarks/:id/wayback
+	if strings.HasSuffix(path, "/wayback") {
+		id := strings.TrimSuffix(path, "/wayback")
+		if r.Method == "POST" {
+			submitToWayback(w, id, s)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Handle /api/bookmarks/:id/fallback
+	if strings.HasSuffix(path, "/fallback") {
+		id := strings.TrimSuffix(path, "/fallback")
+		if r.Method == "POST" {
+			lookupFallback(w, r, id, s)
+			return
+		}
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Handle /api/bookmarks/:id/send/wallabag
+	if strings.HasSuffix(path, "/send/wallabag") {
+		id := strings.TrimSuffix(path, "/send/wallabag")
+		if r.Method == "POST" {
+			sendToWallabag(w, id, s)
 			return
 		}
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -320,21 +782,26 @@ func handleBookmarkAPI(w http.ResponseWriter, r *http.Request) {
 	id := path
 
 	if r.Method == "DELETE" {
-		deleteBookmark(w, id)
+		deleteBookmark(w, id, s)
 		return
 	}
 
 	if r.Method == "PATCH" {
-		updateBookmark(w, r, id)
+		updateBookmark(w, r, id, s)
+		return
+	}
+
+	if r.Method == "GET" {
+		getBookmarkJSON(w, id, s)
 		return
 	}
 
 	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
-func handleCategoriesAPI(w http.ResponseWriter, r *http.Request) {
+func handleCategoriesAPI(w http.ResponseWriter, r *http.Request, s *Store) {
 	if r.Method == "GET" {
-		getCategoriesJSON(w)
+		getCategoriesJSON(w, r, s)
 		return
 	}
 
@@ -345,7 +812,7 @@ func handleCategoriesAPI(w http.ResponseWriter, r *http.Request) {
 // NOTE: For high-frequency reordering or collaborative scenarios, consider
 // switching to lexical ranking (e.g., fractional-indexing) which only requires
 // updating the moved item's order string, eliminating batch updates entirely.
-func handleCategoriesReorder(w http.ResponseWriter, r *http.Request) {
+func handleCategoriesReorder(w http.ResponseWriter, r *http.Request, s *Store) {
 	if r.Method != "PUT" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
@@ -365,27 +832,110 @@ func handleCategoriesReorder(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	for i, id := range payload.Order {
-		if cat, exists := categories[id]; exists {
+		if cat, exists := s.categories[id]; exists {
 			cat.Order = i
-			categories[id] = cat
+			s.putCategory(cat)
+		}
+	}
+	s.emitReorder(eventCategoriesReordered, "", payload.Order)
+
+	s.saveDatabase()
+	w.WriteHeader(http.StatusOK)
+}
+
+// handleBookmarksReorder sets the order of the bookmarks in a category from
+// an ordered list of bookmark IDs. Listed bookmarks from other categories are
+// moved in, and bookmarks of the category left out of the list keep their
+// relative order after the listed ones.
+func handleBookmarksReorder(w http.ResponseWriter, r *http.Request, categoryID string, s *Store) {
+	if r.Method != "PUT" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload struct {
+		Order []string `json:"order"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if len(payload.Order) == 0 {
+		http.Error(w, "Order array is required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.categories[categoryID]; !exists && categoryID != uncategorizedID {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	var ordered []Bookmark
+	listed := make(map[string]bool, len(payload.Order))
+	for _, id := range payload.Order {
+		bm, exists := s.bookmarks[id]
+		if !exists {
+			http.Error(w, "Bookmark not found: "+id, http.StatusBadRequest)
+			return
+		}
+		if !listed[id] {
+			listed[id] = true
+			ordered = append(ordered, bm)
 		}
 	}
 
-	saveDatabase()
+	var rest []Bookmark
+	for id, bm := range s.bookmarks {
+		if bm.CategoryID == categoryID && !listed[id] {
+			rest = append(rest, bm)
+		}
+	}
+	slices.SortFunc(rest, func(a, b Bookmark) int { return cmp.Compare(a.Order, b.Order) })
+
+	left := map[string]bool{}
+	order := make([]string, 0, len(ordered)+len(rest))
+	for i, bm := range append(ordered, rest...) {
+		order = append(order, bm.ID)
+		if bm.CategoryID != categoryID {
+			left[bm.CategoryID] = true
+			bm.CategoryID = categoryID
+		} else if bm.Order == i {
+			continue
+		}
+		bm.Order = i
+		s.putBookmark(bm)
+	}
+	s.emitReorder(eventBookmarksReordered, categoryID, order)
+
+	for id := range left {
+		s.renumberCategory(id)
+	}
+
+	s.saveDatabase()
 	w.WriteHeader(http.StatusOK)
 }
 
-func handleCategoryAPI(w http.ResponseWriter, r *http.Request) {
+func handleCategoryAPI(w http.ResponseWriter, r *http.Request, s *Store) {
 	name := strings.TrimPrefix(r.URL.Path, "/api/categories/")
 	if name == "" {
 		http.Error(w, "Missing category name", http.StatusBadRequest)
 		return
 	}
 
+	if id, ok := strings.CutSuffix(name, "/bookmarks/reorder"); ok {
+		handleBookmarksReorder(w, r, id, s)
+		return
+	}
+
 	decodedName, err := url.PathUnescape(name)
 	if err != nil {
 		http.Error(w, "Invalid category name", http.StatusBadRequest)
@@ -393,32 +943,95 @@ func handleCategoryAPI(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if r.Method == "POST" {
-		createCategory(w, r, decodedName)
+		createCategory(w, r, decodedName, s)
 		return
 	}
 
 	if r.Method == "PUT" {
-		updateCategory(w, r, decodedName)
+		updateCategory(w, r, decodedName, s)
 		return
 	}
 
 	if r.Method == "DELETE" {
-		deleteCategory(w, decodedName)
+		deleteCategory(w, decodedName, s)
 		return
 	}
 
 	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 }
 
-func setCORSHeaders(w http.ResponseWriter) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// Cross-origin requests are refused unless their origin is listed in
+// BOOKMARKD_CORS_ORIGINS, e.g. "https://app.example.com,https://*.example.org"
+// ("*" allows any, which the bookmarklet needs). Browser extensions have
+// origins of their own (chrome-extension://<id>, moz-extension://<uuid>),
+// allowed all at once with BOOKMARKD_CORS_EXTENSIONS=true.
+type corsConfig struct {
+	Any        bool
+	Origins    []string // scheme://host[:port]
+	Wildcards  []string // scheme://.suffix, from scheme://*.suffix
+	Extensions bool
+}
+
+var corsCfg corsConfig
+
+var extensionSchemes = []string{"chrome-extension", "moz-extension", "safari-web-extension"}
+
+func loadCORSConfig() {
+	corsCfg = corsConfig{Extensions: os.Getenv("BOOKMARKD_CORS_EXTENSIONS") == "true"}
+	for _, origin := range strings.Split(os.Getenv("BOOKMARKD_CORS_ORIGINS"), ",") {
+		origin = strings.ToLower(strings.TrimSuffix(strings.TrimSpace(origin), "/"))
+		switch {
+		case origin == "":
+		case origin == "*":
+			corsCfg.Any = true
+		case strings.Contains(origin, "://*."):
+			corsCfg.Wildcards = append(corsCfg.Wildcards, strings.Replace(origin, "://*.", "://.", 1))
+		case strings.Contains(origin, "://"):
+			corsCfg.Origins = append(corsCfg.Origins, origin)
+		default:
+			slog.Warn("Ignoring CORS origin without scheme", "origin", origin)
+		}
+	}
+}
+
+func corsAllowed(origin string) bool {
+	if corsCfg.Any {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	scheme, _, _ := strings.Cut(origin, "://")
+	if corsCfg.Extensions && slices.Contains(extensionSchemes, scheme) {
+		return true
+	}
+	if slices.Contains(corsCfg.Origins, origin) {
+		return true
+	}
+	host := strings.TrimPrefix(origin, scheme+"://")
+	return slices.ContainsFunc(corsCfg.Wildcards, func(w string) bool {
+		suffix := strings.TrimPrefix(w, scheme+"://")
+		return suffix != w && strings.HasSuffix(host, suffix)
+	})
+}
+
+func setCORSHeaders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Vary", "Origin")
+	origin := r.Header.Get("Origin")
+	if origin == "" || !corsAllowed(origin) {
+		return
+	}
+	if corsCfg.Any {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
 	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, PUT, DELETE, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, If-Match")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Total-Count, ETag")
 }
 
 func withCORS(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		setCORSHeaders(w)
+		setCORSHeaders(w, r)
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
 			return
@@ -427,616 +1040,14840 @@ func withCORS(next http.HandlerFunc) http.HandlerFunc {
 	}
 }
 
-// --- Category Logic ---
+// --- Collections ---
 
-func getCategoriesJSON(w http.ResponseWriter) {
-	mu.RLock()
-	sortedCategories := categoriesToSortedSlice()
-	mu.RUnlock()
+type collectionKey struct{}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(sortedCategories)
-}
+var collectionNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
 
-func createCategory(w http.ResponseWriter, r *http.Request, name string) {
-	if name == "" {
-		http.Error(w, "Category name is required", http.StatusBadRequest)
-		return
+func collectionPath(name string) string {
+	if name == defaultCollection {
+		return dbFile
 	}
+	return filepath.Join(collectionsDir, name+".json")
+}
 
-	var payload struct {
-		Color string `json:"color"`
+// storePath is where a collection of the given owner is persisted; each
+// user's collections live in a directory of their own below usersDir, each
+// tenant's in its directory below tenantsDir.
+func storePath(owner, name string) string {
+	if owner == "" {
+		return collectionPath(name)
 	}
-	json.NewDecoder(r.Body).Decode(&payload)
-
-	mu.Lock()
-	defer mu.Unlock()
-
-	if existing := getCategoryByName(name); existing != nil {
-		http.Error(w, "Category already exists", http.StatusConflict)
-		return
+	if tenant, ok := ownerTenant(owner); ok {
+		return filepath.Join(tenantsDir, tenant, collectionPath(name))
 	}
+	return filepath.Join(usersDir, owner, collectionPath(name))
+}
 
-	maxOrder := 0
-	for _, cat := range categories {
-		if cat.Order > maxOrder {
-			maxOrder = cat.Order
-		}
-	}
+// bookmarkFileDirs are the directories, relative to the data directory, that
+// keep files for single bookmarks next to the collections, such as archived
+// pages and thumbnails.
+var bookmarkFileDirs = []string{archivesDir, thumbnailsDir}
 
-	newCat := Category{
-		ID:    uuid.New().String(),
-		Name:  name,
-		Order: maxOrder + 1,
-		Color: payload.Color,
+// ownerFilesDir is where the bookmark files in dir of an owner's collections
+// live, laid out like the collections themselves; bookmark IDs derive from
+// URLs only, so the same page saved by two owners must not share a file.
+func ownerFilesDir(dir, owner string) string {
+	if owner == "" {
+		return filepath.Join(dir, collectionsDir)
 	}
-	categories[newCat.ID] = newCat
-	saveDatabase()
-
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(newCat)
+	if tenant, ok := ownerTenant(owner); ok {
+		return filepath.Join(dir, tenantsDir, tenant)
+	}
+	return filepath.Join(dir, usersDir, owner)
 }
 
-func updateCategory(w http.ResponseWriter, r *http.Request, oldName string) {
-	var payload struct {
-		Name  *string `json:"name"`
-		Order *int    `json:"order"`
-		Color *string `json:"color"`
-	}
+// storeFilesDir is where the bookmark files in dir of a collection live.
+func storeFilesDir(dir, owner, name string) string {
+	return filepath.Join(ownerFilesDir(dir, owner), name)
+}
 
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
-		return
+// storeKey identifies a collection in stores.
+func storeKey(owner, name string) string {
+	if owner == "" {
+		return name
 	}
+	return owner + "/" + name
+}
 
-	mu.Lock()
-	defer mu.Unlock()
+func newStore(owner, name, path string) *Store {
+	s := &Store{Name: name, Owner: owner, path: path}
+	s.initializeDefaults()
+	return s
+}
 
-	cat := getCategoryByName(oldName)
-	if cat == nil {
-		http.Error(w, "Category not found", http.StatusNotFound)
-		return
+func registerStore(s *Store) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	if stores == nil {
+		stores = make(map[string]*Store)
 	}
+	stores[storeKey(s.Owner, s.Name)] = s
+}
 
-	if cat.ID == uncategorizedID && payload.Name != nil && *payload.Name != "Uncategorized" {
-		http.Error(w, "Cannot rename Uncategorized category", http.StatusForbidden)
-		return
+// openStore loads the collection persisted at path, falling back to an empty
+// collection if the file is missing or unreadable, and registers it. A file
+// that cannot be decrypted is left alone and its error returned, so it is
+// never replaced by an empty collection.
+func openStore(owner, name, path string) error {
+	s := &Store{Name: name, Owner: owner, path: path}
+	modTime := s.fileModTime()
+	if err := s.loadDatabase(); errors.Is(err, errEncrypted) {
+		return err
+	} else if err != nil {
+		slog.Warn("Could not load bookmarks, creating new file on save", "collection", name, "err", err)
+		s.initializeDefaults()
 	}
+	s.mu.Lock()
+	s.modTime = cmp.Or(s.modTime, modTime)
+	s.mu.Unlock()
+	registerStore(s)
+	return nil
+}
 
-	if payload.Name != nil && *payload.Name != cat.Name {
-		if existing := getCategoryByName(*payload.Name); existing != nil {
-			http.Error(w, "Category name already exists", http.StatusConflict)
-			return
+// loadCollections opens every collection file of owner found in its
+// collectionsDir. It stops at the first file that cannot be decrypted.
+func loadCollections(owner string) error {
+	dir := filepath.Dir(storePath(owner, "x"))
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Could not read collections directory", "err", err)
 		}
-		cat.Name = *payload.Name
+		return nil
 	}
 
-	if payload.Order != nil {
-		cat.Order = *payload.Order
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), ".json")
+		if file.IsDir() || name == file.Name() || name == defaultCollection || !collectionNameRe.MatchString(name) {
+			continue
+		}
+		path := filepath.Join(dir, file.Name())
+		if err := openStore(owner, name, path); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if owner == "" {
+			slog.Info("Loaded collection", "collection", name)
+		}
 	}
+	return nil
+}
 
-	if payload.Color != nil {
-		cat.Color = *payload.Color
+// openOwnerStores opens the default collection and all others of owner.
+func openOwnerStores(owner string) error {
+	path := storePath(owner, defaultCollection)
+	if err := openStore(owner, defaultCollection, path); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
 	}
+	return loadCollections(owner)
+}
 
-	categories[cat.ID] = *cat
-	saveDatabase()
+// getStore returns one of the instance's own collections.
+func getStore(name string) *Store {
+	return getOwnerStore("", name)
+}
 
-	w.WriteHeader(http.StatusOK)
+func getOwnerStore(owner, name string) *Store {
+	if name == "" {
+		name = defaultCollection
+	}
+	storesMu.RLock()
+	defer storesMu.RUnlock()
+	return stores[storeKey(owner, name)]
 }
 
-// deleteCategory removes a category and all its bookmarks.
-// The frontend shows a confirmation dialog warning users about bookmark deletion.
-func deleteCategory(w http.ResponseWriter, name string) {
-	mu.Lock()
-	defer mu.Unlock()
+// allStores returns every open collection of every owner; the instance's
+// come first, each owner's default first, then by name.
+func allStores() []*Store {
+	storesMu.RLock()
+	defer storesMu.RUnlock()
 
-	cat := getCategoryByName(name)
-	if cat == nil {
-		http.Error(w, "Category not found", http.StatusNotFound)
-		return
+	result := make([]*Store, 0, len(stores))
+	for _, s := range stores {
+		result = append(result, s)
 	}
-
-	if cat.ID == uncategorizedID {
-		http.Error(w, "Cannot delete Uncategorized category", http.StatusForbidden)
-		return
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Owner != result[j].Owner {
+			return result[i].Owner < result[j].Owner
+		}
+		if result[i].Name == defaultCollection {
+			return true
+		}
+		if result[j].Name == defaultCollection {
+			return false
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// ownerStores returns the collections of one owner, in allStores order.
+func ownerStores(owner string) []*Store {
+	return slices.DeleteFunc(allStores(), func(s *Store) bool { return s.Owner != owner })
+}
+
+// collectionFromRequest returns the collection selected by a /c/<name>/ path
+// prefix or, failing that, the ?collection= query parameter.
+func collectionFromRequest(r *http.Request) string {
+	if name, ok := r.Context().Value(collectionKey{}).(string); ok {
+		return name
 	}
+	return r.URL.Query().Get("collection")
+}
 
-	for id, bm := range bookmarks {
-		if bm.CategoryID == cat.ID {
-			delete(bookmarks, id)
+func withStore(next func(http.ResponseWriter, *http.Request, *Store)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s := getOwnerStore(requestOwner(r), collectionFromRequest(r))
+		if s == nil {
+			http.Error(w, "Collection not found", http.StatusNotFound)
+			return
 		}
+		next(w, r, s.visibleTo(r))
 	}
-
-	delete(categories, cat.ID)
-	saveDatabase()
-
-	w.WriteHeader(http.StatusNoContent)
 }
 
-// --- Favicon Logic ---
+// canSeePrivate reports whether a request may see private bookmarks: any
+// authenticated one, and all of them while no credentials are configured.
+// The compatibility APIs check their own tokens and use fullStore instead.
+func canSeePrivate(r *http.Request) bool {
+	_, ok := r.Context().Value(identityKey{}).(identity)
+	return ok || !authEnabled()
+}
 
-var faviconLinkRe = regexp.MustCompile(`(?i)<link\s[^>]*?>`)
-var faviconAttrRe = regexp.MustCompile(`(?i)(\w+)\s*=\s*"([^"]*)"`)
+// fullStore returns the request's store including private bookmarks, for
+// handlers that have verified the request's token themselves.
+func fullStore(r *http.Request) *Store {
+	return getOwnerStore(requestOwner(r), collectionFromRequest(r))
+}
 
-func fetchBestFavicon(pageURL string) string {
-	client := &http.Client{Timeout: 5 * time.Second}
-	resp, err := client.Get(pageURL)
-	if err != nil {
-		return ""
+// visibleTo returns s, or its public view for requests that may not see
+// private bookmarks.
+func (s *Store) visibleTo(r *http.Request) *Store {
+	if canSeePrivate(r) {
+		return s
 	}
-	defer resp.Body.Close()
+	return s.publicView()
+}
 
-	body, err := io.ReadAll(io.LimitReader(resp.Body, 256*1024))
-	if err != nil {
-		return ""
+// publicView returns a read-only copy of s without private bookmarks or
+// their activity.
+func (s *Store) publicView() *Store {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.viewMu.Lock()
+	defer s.viewMu.Unlock()
+	if s.view != nil {
+		return s.view
 	}
 
-	head := string(body)
-	if idx := strings.Index(strings.ToLower(head), "</head>"); idx != -1 {
-		head = head[:idx]
+	view := &Store{
+		Name:       s.Name,
+		Owner:      s.Owner,
+		categories: maps.Clone(s.categories),
+		bookmarks:  maps.Clone(s.bookmarks),
+		searches:   slices.Clone(s.searches),
+		tombstones: maps.Clone(s.tombstones),
+		seq:        s.seq,
+		prunedSeq:  s.prunedSeq,
+		silent:     true,
+		public:     true,
 	}
-
-	type iconCandidate struct {
-		href string
-		size int
+	maps.DeleteFunc(view.bookmarks, func(_ string, bm Bookmark) bool { return bm.Private })
+	// bookmark IDs derive from URLs, so even the deletion of a private one
+	// tells what it was
+	maps.DeleteFunc(view.tombstones, func(_ string, t Tombstone) bool { return t.Private })
+	for id, t := range s.unpublished {
+		if _, deleted := view.tombstones[id]; !deleted {
+			view.tombstones[id] = t
+		}
 	}
+	view.activity = slices.DeleteFunc(slices.Clone(s.activity), func(a Activity) bool {
+		return a.Private || s.bookmarks[a.BookmarkID].Private
+	})
+	view.rebuildIndex()
+	s.view = view
+	return view
+}
 
-	var candidates []iconCandidate
-	for _, match := range faviconLinkRe.FindAllString(head, -1) {
-		attrs := map[string]string{}
-		for _, a := range faviconAttrRe.FindAllStringSubmatch(match, -1) {
-			attrs[strings.ToLower(a[1])] = a[2]
+// withCollectionPrefix strips a leading /c/<name> from the request path and
+// records the collection name in the request context, so every route can
+// also be reached as e.g. /c/work/api/bookmarks.
+func withCollectionPrefix(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/c/") {
+			next.ServeHTTP(w, r)
+			return
 		}
 
-		rel := strings.ToLower(attrs["rel"])
-		if rel != "icon" && rel != "shortcut icon" && rel != "apple-touch-icon" && rel != "apple-touch-icon-precomposed" {
-			continue
+		name, rest, found := strings.Cut(strings.TrimPrefix(r.URL.Path, "/c/"), "/")
+		if !found {
+			http.Redirect(w, r, requestBase(r)+r.URL.Path+"/", http.StatusMovedPermanently)
+			return
 		}
 
-		href := attrs["href"]
-		if href == "" {
-			continue
-		}
+		r2 := r.WithContext(context.WithValue(r.Context(), collectionKey{}, name))
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/" + rest
+		r2.URL.RawPath = ""
+		next.ServeHTTP(w, r2)
+	})
+}
 
-		size := 0
-		if rel == "apple-touch-icon" || rel == "apple-touch-icon-precomposed" {
-			size = 180 // assume large if no sizes specified
-		}
-		if s := attrs["sizes"]; s != "" {
-			parts := strings.SplitN(strings.ToLower(s), "x", 2)
-			if len(parts) == 2 {
-				if n, err := strconv.Atoi(parts[0]); err == nil {
-					size = n
-				}
-			}
-		}
+// apiVersionPrefix is where the current version of the API is served.
+const apiVersionPrefix = "/api/v1/"
 
-		candidates = append(candidates, iconCandidate{href: href, size: size})
-	}
+// handleAPIFunc registers an /api/ route under apiVersionPrefix and keeps the
+// unversioned path as an alias for older clients. Handlers always see the
+// unversioned path.
+func handleAPIFunc(pattern string, handler http.HandlerFunc) {
+	http.HandleFunc(pattern, handler)
+	http.HandleFunc(apiVersionPrefix+strings.TrimPrefix(pattern, "/api/"), func(w http.ResponseWriter, r *http.Request) {
+		r2 := r.WithContext(r.Context())
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/api/" + strings.TrimPrefix(r.URL.Path, apiVersionPrefix)
+		r2.URL.RawPath = ""
+		handler(w, r2)
+	})
+}
 
-	if len(candidates) == 0 {
-		return ""
+type collectionInfo struct {
+	Name       string `json:"name"`
+	Categories int    `json:"categories"`
+	Bookmarks  int    `json:"bookmarks"`
+}
+
+func (s *Store) info() collectionInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return collectionInfo{
+		Name:       s.Name,
+		Categories: len(s.categories),
+		Bookmarks:  len(s.bookmarks),
 	}
+}
 
-	// pick the largest
-	best := candidates[0]
-	for _, c := range candidates[1:] {
-		if c.size > best.size {
-			best = c
-		}
+func handleCollectionsAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
 	}
 
-	// resolve relative URLs
-	href := best.href
-	if !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "https://") {
-		base, err := url.Parse(pageURL)
-		if err != nil {
-			return href
-		}
-		ref, err := url.Parse(href)
-		if err != nil {
-			return href
-		}
-		href = base.ResolveReference(ref).String()
+	result := []collectionInfo{}
+	for _, s := range ownerStores(requestOwner(r)) {
+		result = append(result, s.info())
 	}
 
-	return href
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
 
-// --- Bookmark Logic ---
+func handleCollectionAPI(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/collections/")
+	if name == "" {
+		http.Error(w, "Missing collection name", http.StatusBadRequest)
+		return
+	}
 
-func createBookmark(w http.ResponseWriter, r *http.Request) {
-	var payload struct {
-		URL        string `json:"url"`
-		Title      string `json:"title"`
-		Category   string `json:"category"`
-		CategoryID string `json:"category_id"`
-		Favicon    string `json:"favicon"`
+	owner := requestOwner(r)
+	if r.Method == "POST" {
+		createCollection(w, owner, name)
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	if r.Method == "PUT" {
+		renameCollection(w, r, owner, name)
 		return
 	}
 
-	faviconURL := fetchBestFavicon(payload.URL)
-	if faviconURL == "" {
-		faviconURL = payload.Favicon
+	if r.Method == "DELETE" {
+		deleteCollection(w, owner, name)
+		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
 
-	categoryID := payload.CategoryID
-	if categoryID == "" {
-		categoryID = resolveOrCreateCategory(payload.Category)
+func createCollection(w http.ResponseWriter, owner, name string) {
+	if !collectionNameRe.MatchString(name) {
+		http.Error(w, "Invalid collection name", http.StatusBadRequest)
+		return
 	}
 
-	newBM := Bookmark{
-		ID:         uuid.NewSHA1(uuid.NameSpaceURL, []byte(payload.URL)).String(),
-		URL:        payload.URL,
-		Title:      payload.Title,
-		CategoryID: categoryID,
-		Timestamp:  time.Now().Unix(),
-		Favicon:    faviconURL,
-		Order:      maxOrderInCategory(categoryID) + 1,
+	if getOwnerStore(owner, name) != nil {
+		http.Error(w, "Collection already exists", http.StatusConflict)
+		return
 	}
 
-	bookmarks[newBM.ID] = newBM
-	saveDatabase()
-
-	w.WriteHeader(http.StatusCreated)
-}
-
-func getBookmarksJSON(w http.ResponseWriter) {
-	mu.RLock()
-	sortedBookmarks := bookmarksToSortedSlice()
-	for i := range sortedBookmarks {
-		sortedBookmarks[i].Category = getCategoryName(sortedBookmarks[i].CategoryID)
+	path := storePath(owner, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		http.Error(w, "Could not create collections directory", http.StatusInternalServerError)
+		return
 	}
-	mu.RUnlock()
+
+	s := newStore(owner, name, path)
+	s.mu.Lock()
+	s.saveDatabase()
+	s.mu.Unlock()
+	registerStore(s)
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(sortedBookmarks)
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s.info())
 }
 
-func deleteBookmark(w http.ResponseWriter, id string) {
-	mu.Lock()
-	defer mu.Unlock()
+func renameCollection(w http.ResponseWriter, r *http.Request, owner, oldName string) {
+	var payload struct {
+		Name string `json:"name"`
+	}
 
-	if _, exists := bookmarks[id]; !exists {
-		http.Error(w, "Bookmark not found", http.StatusNotFound)
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
 		return
 	}
 
-	delete(bookmarks, id)
-	saveDatabase()
-	w.WriteHeader(http.StatusNoContent)
-}
+	if !collectionNameRe.MatchString(payload.Name) {
+		http.Error(w, "Invalid collection name", http.StatusBadRequest)
+		return
+	}
 
-func visitBookmark(w http.ResponseWriter, id string) {
-	mu.Lock()
-	defer mu.Unlock()
+	storesMu.Lock()
+	defer storesMu.Unlock()
 
-	bm, exists := bookmarks[id]
+	s, exists := stores[storeKey(owner, oldName)]
 	if !exists {
-		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		http.Error(w, "Collection not found", http.StatusNotFound)
 		return
 	}
 
-	now := time.Now().Unix()
-	bm.LastVisited = &now
-	bm.Changed = false
-	bm.ChangedAt = nil
-	bookmarks[id] = bm
-	saveDatabase()
-	w.WriteHeader(http.StatusNoContent)
-}
+	if s.Name == defaultCollection || payload.Name == defaultCollection {
+		http.Error(w, "Cannot rename the default collection", http.StatusForbidden)
+		return
+	}
 
-func updateBookmark(w http.ResponseWriter, r *http.Request, id string) {
-	var payload struct {
-		Title      *string `json:"title"`
-		URL        *string `json:"url"`
-		Category   *string `json:"category"`
-		CategoryID *string `json:"category_id"`
-		Order      *int    `json:"order"`
-		Notes      *string `json:"notes"`
-		Watched       *bool   `json:"watched"`
-		WatchInterval *int    `json:"watch_interval"`
-		Changed       *bool   `json:"changed"`
-		TrackTime      *bool   `json:"track_time"`
-		DailyTimeLimit *int   `json:"daily_time_limit"`
-		Favicon        *string `json:"favicon"`
+	if _, taken := stores[storeKey(owner, payload.Name)]; taken {
+		http.Error(w, "Collection name already exists", http.StatusConflict)
+		return
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+	s.mu.Lock()
+	newPath := storePath(owner, payload.Name)
+	if err := os.Rename(s.path, newPath); err != nil && !os.IsNotExist(err) {
+		s.mu.Unlock()
+		http.Error(w, "Could not rename collection file", http.StatusInternalServerError)
 		return
 	}
+	for _, dir := range bookmarkFileDirs {
+		if err := os.Rename(storeFilesDir(dir, owner, oldName), storeFilesDir(dir, owner, payload.Name)); err != nil && !os.IsNotExist(err) {
+			slog.Error("Could not move bookmark files of collection", "collection", oldName, "dir", dir, "err", err)
+		}
+	}
+	s.Name = payload.Name
+	s.path = newPath
+	s.mu.Unlock()
 
-	mu.Lock()
-	defer mu.Unlock()
+	delete(stores, storeKey(owner, oldName))
+	stores[storeKey(owner, payload.Name)] = s
 
-	bm, exists := bookmarks[id]
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteCollection removes a collection together with its database file.
+func deleteCollection(w http.ResponseWriter, owner, name string) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+
+	s, exists := stores[storeKey(owner, name)]
 	if !exists {
-		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		http.Error(w, "Collection not found", http.StatusNotFound)
 		return
 	}
 
-	if payload.Title != nil {
-		bm.Title = *payload.Title
+	if s.Name == defaultCollection {
+		http.Error(w, "Cannot delete the default collection", http.StatusForbidden)
+		return
 	}
 
-	if payload.URL != nil {
-		bm.URL = *payload.URL
+	s.mu.Lock()
+	if err := os.Remove(s.path); err != nil && !os.IsNotExist(err) {
+		s.mu.Unlock()
+		http.Error(w, "Could not delete collection file", http.StatusInternalServerError)
+		return
 	}
-
-	if payload.Notes != nil {
-		notes := *payload.Notes
-		if len(notes) > 1000 {
-			notes = notes[:1000]
+	// Requests still holding this store must not recreate the file.
+	s.path = ""
+	s.mu.Unlock()
+	for _, dir := range bookmarkFileDirs {
+		if err := os.RemoveAll(storeFilesDir(dir, owner, name)); err != nil {
+			slog.Error("Could not delete bookmark files of collection", "collection", name, "dir", dir, "err", err)
 		}
-		bm.Notes = notes
 	}
 
-	if payload.Watched != nil {
-		bm.Watched = *payload.Watched
-		if *payload.Watched && bm.ContentHash == "" {
-			go fetchAndStoreInitialHash(id)
-		}
+	delete(stores, storeKey(owner, name))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Change Events ---
+
+// changeEvent describes a single modification of a collection. Bookmark and
+// Category hold the new state and are nil for deletions.
+type changeEvent struct {
+	Seq        uint64    `json:"seq"`
+	Type       string    `json:"type"`
+	Collection string    `json:"collection"`
+	ID         string    `json:"id"`
+	Bookmark   *Bookmark `json:"bookmark,omitempty"`
+	Category   *Category `json:"category,omitempty"`
+	Order      []string  `json:"order,omitempty"`
+	Time       int64     `json:"time"`
+
+	// Owner is the Store.Owner of the collection. Streams only carry their
+	// client's own events; webhooks and MQTT only the instance's.
+	Owner string `json:"-"`
+
+	// private marks the deletion of a private bookmark, unpublished the
+	// change that made a bookmark private; see publicEvent.
+	private, unpublished bool
+}
+
+const (
+	eventBookmarkCreated = "bookmark.created"
+	eventBookmarkUpdated = "bookmark.updated"
+	eventBookmarkDeleted = "bookmark.deleted"
+	eventCategoryCreated = "category.created"
+	eventCategoryUpdated = "category.updated"
+	eventCategoryDeleted = "category.deleted"
+
+	// Reorders are published once per reorder request on top of the
+	// bookmark.updated or category.updated events of the moved items, with
+	// the new order in changeEvent.Order.
+	eventBookmarksReordered  = "bookmarks.reordered"  // ID is the category
+	eventCategoriesReordered = "categories.reordered"
+)
+
+// changeHub numbers change events and fans them out to subscribers. Slow
+// subscribers miss events rather than blocking writers. The most recent
+// events are kept so that reconnecting clients can catch up.
+type changeHub struct {
+	mu     sync.Mutex
+	subs   map[chan changeEvent]struct{}
+	seq    uint64
+	recent []changeEvent
+}
+
+// changeHistory is how many recent events the hub keeps for replay.
+const changeHistory = 1024
+
+var changes = &changeHub{subs: make(map[chan changeEvent]struct{})}
+
+// changesEpoch tells sequence numbers of this process from those handed
+// out before a restart.
+var changesEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+// subscribe returns a channel of events and a function that unsubscribes.
+func (h *changeHub) subscribe() (<-chan changeEvent, func()) {
+	ch, _, unsubscribe := h.subscribeSince(0)
+	return ch, unsubscribe
+}
+
+// subscribeSince subscribes and also returns the kept events with a
+// sequence number above seq, so nothing is lost between the two. The
+// backlog is nil if events after seq have already been dropped from the
+// history, or if seq is from before a restart.
+func (h *changeHub) subscribeSince(seq uint64) (<-chan changeEvent, []changeEvent, func()) {
+	ch := make(chan changeEvent, 64)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subs[ch] = struct{}{}
+
+	var backlog []changeEvent
+	switch {
+	case seq == 0 || seq > h.seq:
+	case seq == h.seq:
+		backlog = []changeEvent{}
+	case h.recent[0].Seq <= seq+1:
+		i := len(h.recent) - int(h.seq-seq)
+		backlog = slices.Clone(h.recent[i:])
 	}
 
-	if payload.WatchInterval != nil {
-		interval := *payload.WatchInterval
-		if interval < 30 {
-			interval = 30
+	return ch, backlog, func() {
+		h.mu.Lock()
+		delete(h.subs, ch)
+		h.mu.Unlock()
+	}
+}
+
+// lastSeq returns the sequence number of the latest event.
+func (h *changeHub) lastSeq() uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.seq
+}
+
+func (h *changeHub) publish(ev changeEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.seq++
+	ev.Seq = h.seq
+	if len(h.recent) == changeHistory {
+		h.recent = h.recent[1:]
+	}
+	h.recent = append(h.recent, ev)
+	for ch := range h.subs {
+		select {
+		case ch <- ev:
+		default:
 		}
-		bm.WatchInterval = interval
 	}
+}
 
-	if payload.Changed != nil {
-		bm.Changed = *payload.Changed
-		if !*payload.Changed {
-			bm.ChangedAt = nil
+// published returns ev as s's subscribers see it, reporting whether it is a
+// change of s at all. Public views see it as publicEvent returns it.
+func (s *Store) published(ev changeEvent) (changeEvent, bool) {
+	if ev.Collection != s.Name || ev.Owner != s.Owner {
+		return ev, false
+	}
+	if s.public {
+		return publicEvent(ev)
+	}
+	return ev, true
+}
+
+// publicEvent returns ev as readers who may not see private bookmarks get
+// it: changes and deletions of private bookmarks are left out, and the
+// change that made a bookmark private becomes its deletion.
+func publicEvent(ev changeEvent) (changeEvent, bool) {
+	switch {
+	case ev.unpublished:
+		return changeEvent{Seq: ev.Seq, Type: eventBookmarkDeleted, Collection: ev.Collection, ID: ev.ID, Time: ev.Time, Owner: ev.Owner}, true
+	case ev.private, ev.Bookmark != nil && ev.Bookmark.Private:
+		return ev, false
+	}
+	return ev, true
+}
+
+func (s *Store) emit(typ, id string, bm *Bookmark, cat *Category) {
+	s.publish(changeEvent{Type: typ, ID: id, Bookmark: bm, Category: cat})
+}
+
+// publish sends ev as a change of s.
+func (s *Store) publish(ev changeEvent) {
+	if s.silent {
+		return
+	}
+	ev.Collection, ev.Owner, ev.Time = s.Name, s.Owner, time.Now().Unix()
+	changes.publish(ev)
+}
+
+// emitReorder publishes the new order of a category's bookmarks (typ
+// eventBookmarksReordered) or of the categories.
+func (s *Store) emitReorder(typ, id string, order []string) {
+	if s.silent {
+		return
+	}
+	changes.publish(changeEvent{Type: typ, Collection: s.Name, ID: id, Order: order, Time: time.Now().Unix(), Owner: s.Owner})
+}
+
+// putBookmark stores bm with a fresh UpdatedAt and the next Rev, keeps the
+// search index current and publishes the change. Callers must hold s.mu.
+func (s *Store) putBookmark(bm Bookmark) {
+	s.putBookmarkAt(bm, time.Now().Unix())
+}
+
+// putBookmarkAt is putBookmark with a given UpdatedAt, for changes that
+// were made elsewhere (sync).
+func (s *Store) putBookmarkAt(bm Bookmark, updatedAt int64) {
+	typ := eventBookmarkUpdated
+	old, exists := s.bookmarks[bm.ID]
+	if !exists {
+		typ = eventBookmarkCreated
+	}
+	bm.Rev = old.Rev + 1
+	s.seq++
+	bm.UpdatedAt = updatedAt
+	bm.Seq = s.seq
+	s.bookmarks[bm.ID] = bm
+	delete(s.tombstones, bm.ID)
+	unpublished := exists && !old.Private && bm.Private
+	switch {
+	case unpublished:
+		if s.unpublished == nil {
+			s.unpublished = make(map[string]Tombstone)
 		}
+		s.unpublished[bm.ID] = Tombstone{ID: bm.ID, DeletedAt: updatedAt, Seq: bm.Seq}
+	case !bm.Private:
+		delete(s.unpublished, bm.ID)
 	}
+	s.index.add(bm.ID, s.bookmarkTokens(bm))
+	s.publish(changeEvent{Type: typ, ID: bm.ID, Bookmark: &bm, unpublished: unpublished})
 
-	if payload.TrackTime != nil {
-		bm.TrackTime = *payload.TrackTime
+	switch {
+	case !exists:
+		s.logBookmarkActivity(activityBookmarkAdded, bm, updatedAt)
+	case bm.CategoryID != old.CategoryID:
+		a := s.bookmarkActivity(activityBookmarkMoved, bm, updatedAt)
+		a.FromCategoryID = old.CategoryID
+		a.FromCategory = s.categories[old.CategoryID].Name
+		s.logActivity(a)
 	}
+	if bm.VisitCount > old.VisitCount {
+		s.logBookmarkActivity(activityBookmarkVisited, bm, updatedAt)
+	}
+}
 
-	if payload.DailyTimeLimit != nil {
-		bm.DailyTimeLimit = *payload.DailyTimeLimit
+// removeBookmark deletes a bookmark and reports whether it existed. Callers
+// must hold s.mu.
+func (s *Store) removeBookmark(id string) bool {
+	bm, exists := s.bookmarks[id]
+	if !exists {
+		return false
 	}
+	delete(s.bookmarks, id)
+	s.index.remove(id)
+	s.addTombstone(id, "", bm.Private)
+	s.publish(changeEvent{Type: eventBookmarkDeleted, ID: id, private: bm.Private})
+	s.logBookmarkActivity(activityBookmarkDeleted, bm, time.Now().Unix())
+	s.removeBookmarkFiles(id)
+	return true
+}
 
-	if payload.Favicon != nil && *payload.Favicon != "" {
-		bm.Favicon = *payload.Favicon
+// removeBookmarkFiles deletes the files kept for a bookmark: its archived
+// page and its thumbnail or failed capture. Scratch copies of a store share
+// its name and owner, so they leave the files alone.
+func (s *Store) removeBookmarkFiles(id string) {
+	if s.silent {
+		return
+	}
+	thumbnail := thumbnailPath(s, id)
+	for _, path := range []string{archivePath(s, id), thumbnail, strings.TrimSuffix(thumbnail, ".jpg") + ".miss"} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Error("Could not delete bookmark file", "collection", s.Name, "path", path, "err", err)
+		}
 	}
+}
 
-	newCategoryID := bm.CategoryID
-	if payload.CategoryID != nil {
-		newCategoryID = *payload.CategoryID
-	} else if payload.Category != nil {
-		newCategoryID = resolveOrCreateCategory(*payload.Category)
+func (s *Store) addTombstone(id, typ string, private bool) {
+	if s.tombstones == nil {
+		s.tombstones = make(map[string]Tombstone)
 	}
+	now := time.Now()
+	s.seq++
+	s.tombstones[id] = Tombstone{ID: id, Type: typ, DeletedAt: now.Unix(), Seq: s.seq, Private: private}
+	s.pruneTombstones(now)
+}
 
-	if payload.CategoryID != nil || payload.Category != nil || payload.Order != nil {
-		oldCategoryID := bm.CategoryID
-		oldOrder := bm.Order
-		newOrder := oldOrder
-		if payload.Order != nil {
-			newOrder = *payload.Order
+// pruneTombstones forgets deletions older than tombstoneRetention.
+func (s *Store) pruneTombstones(now time.Time) {
+	cutoff := now.Add(-tombstoneRetention).Unix()
+	prune := func(_ string, t Tombstone) bool {
+		if t.DeletedAt >= cutoff {
+			return false
 		}
+		s.prunedSeq = max(s.prunedSeq, t.Seq)
+		return true
+	}
+	maps.DeleteFunc(s.tombstones, prune)
+	maps.DeleteFunc(s.unpublished, prune)
+}
+
+// putCategory stores cat with a fresh UpdatedAt and the next Rev and
+// publishes the change. Callers must hold s.mu.
+func (s *Store) putCategory(cat Category) {
+	s.putCategoryAt(cat, time.Now().Unix())
+}
+
+// putCategoryAt is putCategory with a given UpdatedAt.
+func (s *Store) putCategoryAt(cat Category, updatedAt int64) {
+	typ := eventCategoryUpdated
+	old, exists := s.categories[cat.ID]
+	if !exists {
+		typ = eventCategoryCreated
+	}
+	cat.Rev = old.Rev + 1
+	cat.UpdatedAt = updatedAt
+	s.seq++
+	cat.Seq = s.seq
+	s.categories[cat.ID] = cat
+	delete(s.tombstones, cat.ID)
+	s.emit(typ, cat.ID, nil, &cat)
+	if !exists {
+		s.logActivity(Activity{Time: updatedAt, Type: activityCategoryCreated, CategoryID: cat.ID, Category: cat.Name})
+	}
+}
+
+// revETag is the entity tag of a bookmark or category revision.
+func revETag(rev int) string {
+	return `"` + strconv.Itoa(rev) + `"`
+}
+
+// ifMatch reports whether the request's If-Match header, if any, names the
+// given revision, so that an update based on an outdated copy is refused
+// instead of overwriting someone else's change.
+func ifMatch(r *http.Request, rev int) bool {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return true
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == revETag(rev) || tag == strconv.Itoa(rev) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeCategory deletes a category record only; callers deal with its
+// bookmarks. Callers must hold s.mu.
+func (s *Store) removeCategory(id string) {
+	name := s.categories[id].Name
+	delete(s.categories, id)
+	s.addTombstone(id, "category", false)
+	s.emit(eventCategoryDeleted, id, nil, nil)
+	s.logActivity(Activity{Time: time.Now().Unix(), Type: activityCategoryDeleted, CategoryID: id, Category: name})
+}
+
+// bookmarkActivity describes something that happened to bm.
+func (s *Store) bookmarkActivity(typ string, bm Bookmark, at int64) Activity {
+	return Activity{
+		Time:       at,
+		Type:       typ,
+		BookmarkID: bm.ID,
+		URL:        bm.URL,
+		Title:      bm.Title,
+		CategoryID: bm.CategoryID,
+		Category:   s.categories[bm.CategoryID].Name,
+		Private:    bm.Private,
+	}
+}
+
+func (s *Store) logBookmarkActivity(typ string, bm Bookmark, at int64) {
+	s.logActivity(s.bookmarkActivity(typ, bm, at))
+}
+
+// logActivity appends to the activity log, dropping the oldest entries
+// beyond activityLogSize. Callers must hold s.mu.
+func (s *Store) logActivity(a Activity) {
+	if s.silent {
+		return
+	}
+	s.activity = append(s.activity, a)
+	if n := len(s.activity) - activityLogSize; n > 0 {
+		s.activity = slices.Delete(s.activity, 0, n)
+	}
+}
+
+// --- Category Logic ---
+
+// smartCategory is how a saved search is listed alongside the categories
+// when GET /api/categories is called with ?include=saved_searches.
+type smartCategory struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Order int    `json:"order"`
+	Query string `json:"query"`
+	Smart bool   `json:"smart"`
+}
+
+func getCategoriesJSON(w http.ResponseWriter, r *http.Request, s *Store) {
+	s.mu.RLock()
+	sortedCategories := s.categoriesToSortedSlice()
+	searches := slices.Clone(s.searches)
+	s.mu.RUnlock()
+
+	if r.URL.Query().Get("include") != "saved_searches" {
+		encodeList(w, r, sortedCategories)
+		return
+	}
+
+	result := make([]any, 0, len(sortedCategories)+len(searches))
+	for _, cat := range sortedCategories {
+		result = append(result, cat)
+	}
+	next := len(sortedCategories)
+	if next > 0 {
+		next = sortedCategories[len(sortedCategories)-1].Order + 1
+	}
+	for i, ss := range searches {
+		result = append(result, smartCategory{
+			ID:    ss.ID,
+			Name:  ss.Name,
+			Order: next + i,
+			Query: ss.Query,
+			Smart: true,
+		})
+	}
+	encodeList(w, r, result)
+}
+
+func createCategory(w http.ResponseWriter, r *http.Request, name string, s *Store) {
+	if name == "" {
+		http.Error(w, "Category name is required", http.StatusBadRequest)
+		return
+	}
+
+	var payload struct {
+		Color string `json:"color"`
+	}
+	json.NewDecoder(r.Body).Decode(&payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing := s.getCategoryByName(name); existing != nil {
+		http.Error(w, "Category already exists", http.StatusConflict)
+		return
+	}
+
+	maxOrder := 0
+	for _, cat := range s.categories {
+		if cat.Order > maxOrder {
+			maxOrder = cat.Order
+		}
+	}
+
+	newCat := Category{
+		ID:    uuid.New().String(),
+		Name:  name,
+		Order: maxOrder + 1,
+		Color: payload.Color,
+	}
+	s.putCategory(newCat)
+	s.saveDatabase()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(newCat)
+}
+
+func updateCategory(w http.ResponseWriter, r *http.Request, oldName string, s *Store) {
+	var payload struct {
+		Name  *string `json:"name"`
+		Order *int    `json:"order"`
+		Color *string `json:"color"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cat := s.getCategoryByName(oldName)
+	if cat == nil {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	if !ifMatch(r, cat.Rev) {
+		http.Error(w, "Category was changed by someone else", http.StatusPreconditionFailed)
+		return
+	}
+
+	if cat.ID == uncategorizedID && payload.Name != nil && *payload.Name != "Uncategorized" {
+		http.Error(w, "Cannot rename Uncategorized category", http.StatusForbidden)
+		return
+	}
+
+	renamed := false
+	if payload.Name != nil && *payload.Name != cat.Name {
+		if existing := s.getCategoryByName(*payload.Name); existing != nil {
+			http.Error(w, "Category name already exists", http.StatusConflict)
+			return
+		}
+		cat.Name = *payload.Name
+		renamed = true
+	}
+
+	if payload.Order != nil {
+		cat.Order = *payload.Order
+	}
+
+	if payload.Color != nil {
+		cat.Color = *payload.Color
+	}
+
+	s.putCategory(*cat)
+	if renamed {
+		s.reindexCategory(cat.ID)
+	}
+	s.saveDatabase()
+
+	w.Header().Set("ETag", revETag(s.categories[cat.ID].Rev))
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteCategory removes a category and all its bookmarks.
+// The frontend shows a confirmation dialog warning users about bookmark deletion.
+func deleteCategory(w http.ResponseWriter, name string, s *Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cat := s.getCategoryByName(name)
+	if cat == nil {
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+
+	if cat.ID == uncategorizedID {
+		http.Error(w, "Cannot delete Uncategorized category", http.StatusForbidden)
+		return
+	}
+
+	for id, bm := range s.bookmarks {
+		if bm.CategoryID == cat.ID {
+			s.removeBookmark(id)
+		}
+	}
+
+	s.removeCategory(cat.ID)
+	s.saveDatabase()
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Saved Searches ---
+
+func handleSavedSearchesAPI(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method == "GET" {
+		s.mu.RLock()
+		searches := slices.Clone(s.searches)
+		s.mu.RUnlock()
+		if searches == nil {
+			searches = []SavedSearch{}
+		}
+
+		encodeList(w, r, searches)
+		return
+	}
+
+	if r.Method == "POST" {
+		createSavedSearch(w, r, s)
+		return
+	}
+
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func handleSavedSearchAPI(w http.ResponseWriter, r *http.Request, s *Store) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/saved-searches/")
+	if id == "" {
+		http.Error(w, "Missing saved search ID", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "GET" {
+		listSavedSearch(w, r, id, s)
+		return
+	}
+
+	if r.Method == "PUT" {
+		updateSavedSearch(w, r, id, s)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		deleteSavedSearch(w, id, s)
+		return
+	}
+
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func (s *Store) savedSearchIndex(id string) int {
+	return slices.IndexFunc(s.searches, func(ss SavedSearch) bool { return ss.ID == id })
+}
+
+func createSavedSearch(w http.ResponseWriter, r *http.Request, s *Store) {
+	var payload struct {
+		Name  string `json:"name"`
+		Query string `json:"query"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if strings.TrimSpace(payload.Name) == "" || strings.TrimSpace(payload.Query) == "" {
+		http.Error(w, "Name and query are required", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss := SavedSearch{
+		ID:    uuid.New().String(),
+		Name:  strings.TrimSpace(payload.Name),
+		Query: strings.TrimSpace(payload.Query),
+	}
+	s.searches = append(s.searches, ss)
+	s.saveDatabase()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(ss)
+}
+
+// listSavedSearch evaluates the saved query live and responds like
+// GET /api/bookmarks, so ?limit=, ?sort= etc. apply as well. An additional
+// ?q= narrows the saved query further.
+func listSavedSearch(w http.ResponseWriter, r *http.Request, id string, s *Store) {
+	s.mu.RLock()
+	i := s.savedSearchIndex(id)
+	var query string
+	if i != -1 {
+		query = s.searches[i].Query
+	}
+	s.mu.RUnlock()
+
+	if i == -1 {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+
+	r2 := r.Clone(r.Context())
+	params := r2.URL.Query()
+	params.Set("q", strings.TrimSpace(query+" "+params.Get("q")))
+	r2.URL.RawQuery = params.Encode()
+	getBookmarksJSON(w, r2, s)
+}
+
+func updateSavedSearch(w http.ResponseWriter, r *http.Request, id string, s *Store) {
+	var payload struct {
+		Name  *string `json:"name"`
+		Query *string `json:"query"`
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.savedSearchIndex(id)
+	if i == -1 {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+
+	if payload.Name != nil && strings.TrimSpace(*payload.Name) != "" {
+		s.searches[i].Name = strings.TrimSpace(*payload.Name)
+	}
+
+	if payload.Query != nil && strings.TrimSpace(*payload.Query) != "" {
+		s.searches[i].Query = strings.TrimSpace(*payload.Query)
+	}
+
+	s.saveDatabase()
+	w.WriteHeader(http.StatusOK)
+}
+
+func deleteSavedSearch(w http.ResponseWriter, id string, s *Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.savedSearchIndex(id)
+	if i == -1 {
+		http.Error(w, "Saved search not found", http.StatusNotFound)
+		return
+	}
+
+	s.searches = slices.Delete(s.searches, i, i+1)
+	s.saveDatabase()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Outbound Fetches ---
+
+// Requests to bookmarked sites (page metadata, favicons, link checks,
+// watched pages and archived copies) go through fetch, so that the server
+// never runs more than BOOKMARKD_FETCH_CONCURRENCY of them at once and waits
+// BOOKMARKD_FETCH_HOST_DELAY between two requests to the same host.
+type fetchPoolConfig struct {
+	Concurrency int
+	HostDelay   time.Duration
+	Timeout     time.Duration // for requests that don't bring their own
+
+	slots chan struct{}
+}
+
+// fetchPool is replaced as a whole on reload; fetches that started before
+// keep the slots they took theirs from.
+var fetchPool atomic.Pointer[fetchPoolConfig]
+
+var (
+	fetchHostMu sync.Mutex
+	fetchHostAt = make(map[string]time.Time) // when the host may be asked next
+)
+
+// fetchClient is shared by all fetches, so connections to a host are reused.
+// publicFetchClient is for fetches marked publicOnly. It keeps connections of
+// its own, which all went through publicDialer, and connects directly rather
+// than through a proxy, whose address is all the dialer would see.
+var (
+	fetchClient = &http.Client{
+		Transport: newFetchTransport(http.ProxyFromEnvironment, (&net.Dialer{Timeout: 10 * time.Second}).DialContext),
+	}
+	publicFetchClient = &http.Client{
+		Transport: newFetchTransport(nil, publicDialer.DialContext),
+	}
+)
+
+func newFetchTransport(proxy func(*http.Request) (*url.URL, error), dial func(context.Context, string, string) (net.Conn, error)) *http.Transport {
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           dial,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		MaxIdleConns:          64,
+		MaxIdleConnsPerHost:   2,
+		IdleConnTimeout:       time.Minute,
+	}
+}
+
+var (
+	// publicDialer checks the address it connects to, after DNS resolution
+	// and for every redirect.
+	publicDialer = &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(addrPort.Addr()) {
+				return fmt.Errorf("%s: %w", addrPort.Addr(), errNotPublic)
+			}
+			return nil
+		},
+	}
+)
+
+type publicOnlyKey struct{}
+
+var errNotPublic = errors.New("address is not public")
+
+// publicOnly marks ctx so that fetches made with it only connect to public
+// addresses: not to the server itself, its network or cloud metadata
+// services. Bookmarks may well point there; URLs from anyone else mustn't.
+func publicOnly(ctx context.Context) context.Context {
+	return context.WithValue(ctx, publicOnlyKey{}, true)
+}
+
+// nonPublicPrefixes are the ranges isPublicAddr rejects besides those the
+// netip.Addr methods name.
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"), // carrier-grade NAT
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+}
+
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !prefixesContain(nonPublicPrefixes, addr)
+}
+
+func loadFetchPool() {
+	cfg := fetchPoolConfig{Concurrency: 8, HostDelay: time.Second, Timeout: 30 * time.Second}
+	if v := os.Getenv("BOOKMARKD_FETCH_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			cfg.Concurrency = n
+		} else {
+			slog.Warn("Invalid BOOKMARKD_FETCH_CONCURRENCY, using 8", "value", v)
+		}
+	}
+	if v := os.Getenv("BOOKMARKD_FETCH_HOST_DELAY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			cfg.HostDelay = d
+		} else {
+			slog.Warn("Invalid BOOKMARKD_FETCH_HOST_DELAY, using 1s", "value", v)
+		}
+	}
+	if v := os.Getenv("BOOKMARKD_FETCH_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			cfg.Timeout = d
+		} else {
+			slog.Warn("Invalid BOOKMARKD_FETCH_TIMEOUT, using 30s", "value", v)
+		}
+	}
+	cfg.slots = make(chan struct{}, cfg.Concurrency)
+	fetchPool.Store(&cfg)
+}
+
+// fetch sends req once its host's turn has come and a slot is free. The
+// request, including reading the body, then gets timeout
+// (the pool's Timeout if 0); waiting for the turn is only bounded by the
+// request's context. The slot is held until the body is closed. Redirects
+// are followed without waiting again.
+func fetch(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	pool := fetchPool.Load()
+	if timeout <= 0 {
+		timeout = pool.Timeout
+	}
+	if err := waitForHost(req.Context(), req.URL.Hostname(), pool.HostDelay); err != nil {
+		return nil, err
+	}
+	slots := pool.slots
+	select {
+	case slots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	release := sync.OnceFunc(func() {
+		<-slots
+		cancel()
+	})
+
+	req = req.WithContext(ctx)
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Bookmarkd/1.0)")
+	}
+	client := fetchClient
+	if req.Context().Value(publicOnlyKey{}) != nil {
+		client = publicFetchClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	resp.Body = &fetchBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+type fetchBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *fetchBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
+
+// waitForHost waits until host may be asked again and books the next turn,
+// delay later.
+func waitForHost(ctx context.Context, host string, delay time.Duration) error {
+	host = strings.ToLower(host)
+	fetchHostMu.Lock()
+	now := time.Now()
+	if len(fetchHostAt) > 1000 {
+		for h, at := range fetchHostAt {
+			if at.Before(now) {
+				delete(fetchHostAt, h)
+			}
+		}
+	}
+	at := fetchHostAt[host]
+	if at.Before(now) {
+		at = now
+	}
+	fetchHostAt[host] = at.Add(delay)
+	fetchHostMu.Unlock()
+
+	if wait := time.Until(at); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// --- Favicon Logic ---
+
+// faviconCacheDir holds favicons downloaded to be served locally, relative
+// to the data directory.
+const faviconCacheDir = "favicons"
+
+var faviconLinkRe = regexp.MustCompile(`(?i)<link\s[^>]*?>`)
+var faviconAttrRe = regexp.MustCompile(`(?i)(\w+)\s*=\s*"([^"]*)"`)
+var pageTitleRe = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+var pageMetaRe = regexp.MustCompile(`(?i)<meta\s[^>]*?>`)
+
+// Bounds for text taken from a page.
+const (
+	maxPageTitle       = 500
+	maxPageDescription = 1000
+)
+
+// pageInfo is what a page says about itself; fields are empty when it
+// couldn't be loaded or doesn't say.
+type pageInfo struct {
+	Title       string
+	Favicon     string
+	Loaded      bool   // the page answered with 2xx
+	Description string // og:description, or the description meta tag
+	Image       string // og:image
+	Canonical   string // rel=canonical link, or og:url
+	URL         string // where the page was found, after redirects
+}
+
+// fetchPageInfo loads the start of a page (5 seconds and 256 KB at most) for
+// its title and best favicon.
+func fetchPageInfo(pageURL string) pageInfo {
+	req, err := http.NewRequest("GET", pageURL, nil)
+	if err != nil {
+		return pageInfo{}
+	}
+	resp, err := fetch(req, 5*time.Second)
+	if err != nil {
+		return pageInfo{}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256*1024))
+	if err != nil {
+		return pageInfo{}
+	}
+
+	head := string(body)
+	if idx := strings.Index(strings.ToLower(head), "</head>"); idx != -1 {
+		head = head[:idx]
+	}
+
+	// relative links are relative to where redirects ended up
+	pageURL = resp.Request.URL.String()
+	info := pageInfo{Favicon: bestFavicon(head, pageURL), URL: pageURL}
+	// error pages have titles too
+	if resp.StatusCode/100 == 2 {
+		info.Loaded = true
+		if m := pageTitleRe.FindStringSubmatch(head); m != nil {
+			info.Title = pageText(m[1], maxPageTitle)
+		}
+		readOpenGraph(&info, head, pageURL)
+	}
+	return info
+}
+
+// pageText unescapes and tidies text from a page, cutting it at max bytes.
+func pageText(text string, max int) string {
+	text = strings.Join(strings.Fields(html.UnescapeString(strings.ToValidUTF8(text, ""))), " ")
+	if len(text) > max {
+		text = strings.ToValidUTF8(text[:max], "")
+	}
+	return text
+}
+
+// readOpenGraph fills in the description, image and canonical URL from the
+// Open Graph and plain meta tags and links of a page's head.
+func readOpenGraph(info *pageInfo, head, pageURL string) {
+	var description, ogURL string
+	for _, match := range pageMetaRe.FindAllString(head, -1) {
+		attrs := map[string]string{}
+		for _, a := range faviconAttrRe.FindAllStringSubmatch(match, -1) {
+			attrs[strings.ToLower(a[1])] = html.UnescapeString(a[2])
+		}
+		content := attrs["content"]
+		switch strings.ToLower(cmp.Or(attrs["property"], attrs["name"])) {
+		case "og:description":
+			info.Description = cmp.Or(info.Description, pageText(content, maxPageDescription))
+		case "description":
+			description = cmp.Or(description, pageText(content, maxPageDescription))
+		case "og:image", "og:image:url", "og:image:secure_url":
+			info.Image = cmp.Or(info.Image, pageLink(pageURL, content))
+		case "og:url":
+			ogURL = cmp.Or(ogURL, pageLink(pageURL, content))
+		}
+	}
+	for _, match := range faviconLinkRe.FindAllString(head, -1) {
+		attrs := map[string]string{}
+		for _, a := range faviconAttrRe.FindAllStringSubmatch(match, -1) {
+			attrs[strings.ToLower(a[1])] = html.UnescapeString(a[2])
+		}
+		if strings.EqualFold(attrs["rel"], "canonical") {
+			info.Canonical = cmp.Or(info.Canonical, pageLink(pageURL, attrs["href"]))
+		}
+	}
+	info.Description = cmp.Or(info.Description, description)
+	info.Canonical = cmp.Or(info.Canonical, ogURL)
+}
+
+// pageLink resolves a link found on a page, keeping only http(s) URLs.
+func pageLink(pageURL, href string) string {
+	base, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	ref, err := url.Parse(strings.TrimSpace(href))
+	if err != nil || href == "" {
+		return ""
+	}
+	u := base.ResolveReference(ref)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return ""
+	}
+	return u.String()
+}
+
+// titleOrFetched returns title, or else the title fetched from the page, or
+// else the URL's host name.
+func titleOrFetched(title, pageURL string, info pageInfo) string {
+	if title != "" {
+		return title
+	}
+	if info.Title != "" {
+		return info.Title
+	}
+	if u, err := url.Parse(pageURL); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return pageURL
+}
+
+// bestFavicon picks the largest icon linked from a page's head, as an
+// absolute URL.
+func bestFavicon(head, pageURL string) string {
+	type iconCandidate struct {
+		href string
+		size int
+	}
+
+	var candidates []iconCandidate
+	for _, match := range faviconLinkRe.FindAllString(head, -1) {
+		attrs := map[string]string{}
+		for _, a := range faviconAttrRe.FindAllStringSubmatch(match, -1) {
+			attrs[strings.ToLower(a[1])] = a[2]
+		}
+
+		rel := strings.ToLower(attrs["rel"])
+		if rel != "icon" && rel != "shortcut icon" && rel != "apple-touch-icon" && rel != "apple-touch-icon-precomposed" {
+			continue
+		}
+
+		href := attrs["href"]
+		if href == "" {
+			continue
+		}
+
+		size := 0
+		if rel == "apple-touch-icon" || rel == "apple-touch-icon-precomposed" {
+			size = 180 // assume large if no sizes specified
+		}
+		if s := attrs["sizes"]; s != "" {
+			parts := strings.SplitN(strings.ToLower(s), "x", 2)
+			if len(parts) == 2 {
+				if n, err := strconv.Atoi(parts[0]); err == nil {
+					size = n
+				}
+			}
+		}
+
+		candidates = append(candidates, iconCandidate{href: href, size: size})
+	}
+
+	if len(candidates) == 0 {
+		return ""
+	}
+
+	// pick the largest
+	best := candidates[0]
+	for _, c := range candidates[1:] {
+		if c.size > best.size {
+			best = c
+		}
+	}
+
+	// resolve relative URLs
+	href := best.href
+	if !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "https://") {
+		base, err := url.Parse(pageURL)
+		if err != nil {
+			return href
+		}
+		ref, err := url.Parse(href)
+		if err != nil {
+			return href
+		}
+		href = base.ResolveReference(ref).String()
+	}
+
+	return href
+}
+
+// Favicons are downloaded by the server and served from /favicons/:id, so
+// browsers never ask the bookmarked sites (or anyone else) for them. A
+// favicon is cached under a hash of its source URL; a failed download leaves
+// a ".miss" file and isn't retried for faviconMissTTL.
+const (
+	maxFaviconBytes = 512 * 1024
+	faviconMissTTL  = 24 * time.Hour
+)
+
+// faviconTypes maps the image types served as favicons to file extensions.
+var faviconTypes = map[string]string{
+	"image/png":                ".png",
+	"image/x-icon":             ".ico",
+	"image/vnd.microsoft.icon": ".ico",
+	"image/svg+xml":            ".svg",
+	"image/jpeg":               ".jpg",
+	"image/gif":                ".gif",
+	"image/webp":               ".webp",
+}
+
+// faviconSource is where a bookmark's favicon is downloaded from: the URL it
+// names, or else /favicon.ico of its site.
+func faviconSource(bm Bookmark) string {
+	if u, err := url.Parse(bm.Favicon); err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" {
+		return bm.Favicon
+	}
+	u, err := url.Parse(bm.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return ""
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: "/favicon.ico"}).String()
+}
+
+// cachedFavicon returns the cache file of the favicon at src, cached under
+// key, downloading it first if needed; "" if there is none.
+func cachedFavicon(ctx context.Context, src, key string) string {
+	// one download per icon, however many ask for it at once
+	defer lockFaviconDownload(key)()
+	if path := faviconCacheFile(key); path != "" {
+		if filepath.Ext(path) != ".miss" {
+			return path
+		}
+		if info, err := os.Stat(path); err == nil && time.Since(info.ModTime()) < faviconMissTTL {
+			return ""
+		}
+	}
+	return fetchFavicon(ctx, src, key)
+}
+
+// faviconDownloads holds a mutex per cache key while anyone uses it.
+var (
+	faviconDownloadsMu sync.Mutex
+	faviconDownloads   = make(map[string]*faviconDownload)
+)
+
+type faviconDownload struct {
+	sync.Mutex
+	users int
+}
+
+// lockFaviconDownload locks the mutex of key and returns its unlock
+// function, which forgets the mutex once no one else waits for it.
+func lockFaviconDownload(key string) (unlock func()) {
+	faviconDownloadsMu.Lock()
+	d := faviconDownloads[key]
+	if d == nil {
+		d = new(faviconDownload)
+		faviconDownloads[key] = d
+	}
+	d.users++
+	faviconDownloadsMu.Unlock()
+
+	d.Lock()
+	return func() {
+		d.Unlock()
+		faviconDownloadsMu.Lock()
+		if d.users--; d.users == 0 {
+			delete(faviconDownloads, key)
+		}
+		faviconDownloadsMu.Unlock()
+	}
+}
+
+// faviconKey names the cache files of the favicon at src.
+func faviconKey(src string) string {
+	sum := sha256.Sum256([]byte(src))
+	return hex.EncodeToString(sum[:16])
+}
+
+// proxyFaviconKey names the cache files of the image at src fetched for
+// /api/favicon. They are kept apart from bookmarks' icons, which may come
+// from addresses the proxy mustn't reach.
+func proxyFaviconKey(src string) string {
+	return faviconKey("proxy " + src)
+}
+
+// faviconCacheFile returns the cached icon with the given key, else its
+// ".miss" file, else "".
+func faviconCacheFile(key string) string {
+	matches, _ := filepath.Glob(filepath.Join(faviconCacheDir, key+".*"))
+	miss := ""
+	for _, path := range matches {
+		if filepath.Ext(path) != ".miss" {
+			return path
+		}
+		miss = path
+	}
+	return miss
+}
+
+// fetchFavicon downloads the favicon at src into the cache, replacing what
+// was cached under key, and returns its file. If that fails, it leaves a
+// ".miss" file (and an icon cached before) and returns "".
+func fetchFavicon(ctx context.Context, src, key string) string {
+	path, err := downloadFavicon(ctx, src, key)
+	if err != nil {
+		slog.Debug("Could not download favicon", "url", src, "err", err)
+		// a refused address may still be fine for a bookmark's icon
+		if errors.Is(err, errNotPublic) || ctx.Err() != nil {
+			return ""
+		}
+		if err := os.MkdirAll(faviconCacheDir, 0755); err == nil {
+			os.WriteFile(filepath.Join(faviconCacheDir, key+".miss"), nil, 0644)
+		}
+		return ""
+	}
+	// the icon may have come as another type before
+	matches, _ := filepath.Glob(filepath.Join(faviconCacheDir, key+".*"))
+	for _, other := range matches {
+		if other != path {
+			os.Remove(other)
+		}
+	}
+	return path
+}
+
+func downloadFavicon(ctx context.Context, src, key string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", src, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := fetch(req, 5*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxFaviconBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) == 0 || len(data) > maxFaviconBytes {
+		return "", fmt.Errorf("size of %d bytes", len(data))
+	}
+	// servers often get icon types wrong, so sniff what they don't name
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	ext, ok := faviconTypes[mediaType]
+	if !ok {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+		if ext, ok = faviconTypes[mediaType]; !ok {
+			return "", fmt.Errorf("type %q", mediaType)
+		}
+	}
+
+	if err := os.MkdirAll(faviconCacheDir, 0755); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(faviconCacheDir, "."+key+".tmp*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(faviconCacheDir, key+ext)
+	return path, os.Rename(f.Name(), path)
+}
+
+// setFaviconHeaders prepares a favicon response. Icons can be SVG, which
+// mustn't run scripts when opened directly.
+func setFaviconHeaders(w http.ResponseWriter, etag, cacheControl string) {
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Cache-Control", cacheControl)
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; sandbox")
+}
+
+// handleFavicon serves a bookmark's favicon: inline data: URIs as they are,
+// anything else from the cache.
+func handleFavicon(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.RLock()
+	bm, exists := s.bookmarks[strings.TrimPrefix(r.URL.Path, "/favicons/")]
+	s.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	if mediaType, data, ok := decodeDataURI(bm.Favicon); ok {
+		mediaType, _, _ = mime.ParseMediaType(mediaType)
+		if _, ok := faviconTypes[mediaType]; ok {
+			sum := sha256.Sum256(data)
+			w.Header().Set("Content-Type", mediaType)
+			setFaviconHeaders(w, hex.EncodeToString(sum[:16]), "private, no-cache")
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+			return
+		}
+	}
+
+	path := ""
+	if src := faviconSource(bm); src != "" {
+		path = cachedFavicon(context.WithoutCancel(r.Context()), src, faviconKey(src))
+	}
+	if path == "" {
+		http.Error(w, "No favicon", http.StatusNotFound)
+		return
+	}
+
+	// the cache file changes name with the favicon's source
+	setFaviconHeaders(w, filepath.Base(path), "private, no-cache")
+	http.ServeFile(w, r, path)
+}
+
+// handleFaviconProxy serves the image at ?url= through the favicon cache, for
+// icons that would otherwise be loaded from third-party hosts. It needs
+// credentials whenever auth is on, and only fetches from public addresses.
+func handleFaviconProxy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	src := r.URL.Query().Get("url")
+	if u, err := url.Parse(src); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "Invalid url", http.StatusBadRequest)
+		return
+	}
+	path := cachedFavicon(publicOnly(context.WithoutCancel(r.Context())), src, proxyFaviconKey(src))
+	if path == "" {
+		http.Error(w, "No favicon", http.StatusNotFound)
+		return
+	}
+
+	// the URL names the image, so it can be kept a while
+	setFaviconHeaders(w, filepath.Base(path), "private, max-age=86400")
+	http.ServeFile(w, r, path)
+}
+
+// restoreArchivedFavicons moves the favicons an unpacked export archive left
+// in each collection's directory below the cache (see writeZipFavicon) into
+// the cache, so they aren't downloaded again. Copies of inline icons, and of
+// icons cached already, are deleted.
+func restoreArchivedFavicons() {
+	restored := 0
+	for _, s := range allStores() {
+		dir := storeFilesDir(faviconCacheDir, s.Owner, s.Name)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		s.mu.RLock()
+		bookmarks := maps.Clone(s.bookmarks)
+		s.mu.RUnlock()
+
+		for _, entry := range entries {
+			ext := filepath.Ext(entry.Name())
+			bm, ok := bookmarks[strings.TrimSuffix(entry.Name(), ext)]
+			if !ok || !entry.Type().IsRegular() {
+				continue
+			}
+			path := filepath.Join(dir, entry.Name())
+			src := faviconSource(bm)
+			if _, _, inline := decodeDataURI(bm.Favicon); inline || src == "" {
+				continue
+			}
+			key := faviconKey(src)
+			cached := faviconCacheFile(key)
+			if cached != "" && filepath.Ext(cached) != ".miss" || !slices.Contains(slices.Collect(maps.Values(faviconTypes)), ext) {
+				continue
+			}
+			if err := os.Rename(path, filepath.Join(faviconCacheDir, key+ext)); err != nil {
+				slog.Warn("Could not restore favicon", "file", path, "err", err)
+				continue
+			}
+			if cached != "" {
+				os.Remove(cached)
+			}
+			restored++
+		}
+
+		// what is left was inline, cached already or isn't an icon
+		os.RemoveAll(dir)
+		for parent := filepath.Dir(dir); parent != faviconCacheDir; parent = filepath.Dir(parent) {
+			if os.Remove(parent) != nil {
+				break
+			}
+		}
+	}
+	if restored > 0 {
+		slog.Info("Restored favicons from an export archive", "count", restored)
+	}
+}
+
+// faviconMaxAge is how old a cached favicon may get before the
+// "favicon_refresh" job downloads it again (BOOKMARKD_FAVICON_MAX_AGE_DAYS;
+// 0 keeps them until they're unused).
+var faviconMaxAge time.Duration
+
+func loadFaviconRefresh() {
+	faviconMaxAge = 30 * 24 * time.Hour
+	if v := os.Getenv("BOOKMARKD_FAVICON_MAX_AGE_DAYS"); v != "" {
+		if days, err := strconv.Atoi(v); err == nil && days >= 0 {
+			faviconMaxAge = time.Duration(days) * 24 * time.Hour
+		} else {
+			slog.Warn("Invalid BOOKMARKD_FAVICON_MAX_AGE_DAYS, using 30", "value", v)
+		}
+	}
+}
+
+func startFaviconRefresh() {
+	registerJob("favicon_refresh", "@daily", refreshFavicons)
+}
+
+// refreshFavicons downloads the favicons of every collection that aren't
+// cached, failed to download or are older than faviconMaxAge. When a
+// download fails, the bookmark's page is asked for its icon again, as sites
+// move them. Afterwards cached icons no bookmark uses are deleted.
+func refreshFavicons(ctx context.Context) error {
+	used := make(map[string]bool)
+	refreshed, replaced := 0, 0
+	for _, s := range allStores() {
+		s.mu.RLock()
+		bookmarks := slices.Collect(maps.Values(s.bookmarks))
+		s.mu.RUnlock()
+
+		changed := false
+		for _, bm := range bookmarks {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			src := faviconSource(bm)
+			if _, _, inline := decodeDataURI(bm.Favicon); inline || src == "" || used[faviconKey(src)] {
+				continue
+			}
+			key := faviconKey(src)
+			used[key] = true
+			if path := faviconCacheFile(key); path != "" && filepath.Ext(path) != ".miss" {
+				info, err := os.Stat(path)
+				if err == nil && (faviconMaxAge == 0 || time.Since(info.ModTime()) < faviconMaxAge) {
+					continue
+				}
+			}
+			if fetchFavicon(ctx, src, key) != "" {
+				refreshed++
+				continue
+			}
+
+			page := fetchPageInfo(bm.URL)
+			if page.Favicon == "" || page.Favicon == bm.Favicon {
+				continue
+			}
+			newSrc := faviconSource(Bookmark{URL: bm.URL, Favicon: page.Favicon})
+			if fetchFavicon(ctx, newSrc, faviconKey(newSrc)) == "" {
+				continue
+			}
+			used[faviconKey(newSrc)] = true
+			s.mu.Lock()
+			if current, exists := s.bookmarks[bm.ID]; exists && current.Favicon == bm.Favicon {
+				current.Favicon = page.Favicon
+				s.putBookmark(current)
+				changed = true
+				replaced++
+			}
+			s.mu.Unlock()
+		}
+		if changed {
+			s.mu.Lock()
+			s.saveDatabase()
+			s.mu.Unlock()
+		}
+	}
+
+	removed := removeUnusedFavicons(used)
+	slog.Info("Favicons refreshed", "downloaded", refreshed, "replaced", replaced, "removed", removed)
+	return nil
+}
+
+// removeUnusedFavicons deletes the cache files whose key isn't in used. Icons
+// cached for /api/favicon aren't tied to bookmarks, so files younger than a
+// day are kept; older ones are simply downloaded again when asked for.
+func removeUnusedFavicons(used map[string]bool) int {
+	entries, err := os.ReadDir(faviconCacheDir)
+	if err != nil {
+		return 0
+	}
+	removed := 0
+	for _, entry := range entries {
+		key, _, _ := strings.Cut(entry.Name(), ".")
+		if key == "" || used[key] || !entry.Type().IsRegular() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > faviconMissTTL {
+			if os.Remove(filepath.Join(faviconCacheDir, entry.Name())) == nil {
+				removed++
+			}
+		}
+	}
+	return removed
+}
+
+// --- Thumbnails ---
+
+// thumbnailsDir holds screenshots of bookmarked pages, relative to the data
+// directory, as <bookmark id>.jpg in the directory of their collection (see
+// storeFilesDir). Like favicons, a failed capture leaves a ".miss" file and
+// isn't retried for faviconMissTTL.
+const thumbnailsDir = "thumbnails"
+
+const (
+	thumbnailWidth     = 400
+	thumbnailHeight    = 300
+	thumbnailTimeout   = time.Minute
+	maxScreenshotBytes = 20 << 20
+	thumbnailQueueSize = 256
+)
+
+// Screenshots come from a capture service, a URL with {url} where the page's
+// address goes that answers with a PNG or JPEG, or from a command (say a
+// script driving a headless browser) run with the address as last argument
+// that prints one. Thumbnails are off when neither is set.
+var (
+	thumbnailService string
+	thumbnailCommand []string
+)
+
+func loadThumbnails() {
+	thumbnailService = os.Getenv("BOOKMARKD_THUMBNAIL_URL")
+	thumbnailCommand = strings.Fields(os.Getenv("BOOKMARKD_THUMBNAIL_COMMAND"))
+	if thumbnailService != "" && len(thumbnailCommand) > 0 {
+		fatal("Set only one of BOOKMARKD_THUMBNAIL_URL and BOOKMARKD_THUMBNAIL_COMMAND")
+	}
+	if thumbnailService != "" && !strings.Contains(thumbnailService, "{url}") {
+		fatal("BOOKMARKD_THUMBNAIL_URL needs a {url} placeholder", "url", thumbnailService)
+	}
+}
+
+func thumbnailsEnabled() bool {
+	return thumbnailService != "" || len(thumbnailCommand) > 0
+}
+
+// thumbnailJob captures the page at url into the thumbnail of bookmark id in
+// dir, a collection's directory below thumbnailsDir.
+type thumbnailJob struct {
+	dir, id, url string
+}
+
+// thumbnailPath is where the thumbnail of a bookmark in s is stored.
+func thumbnailPath(s *Store, id string) string {
+	return filepath.Join(storeFilesDir(thumbnailsDir, s.Owner, s.Name), id+".jpg")
+}
+
+// Captures run one at a time, as browsers are heavy; thumbnailPending keeps
+// a bookmark from being queued twice.
+var (
+	thumbnailQueue   = make(chan thumbnailJob, thumbnailQueueSize)
+	thumbnailPending sync.Map
+)
+
+// startThumbnails captures a screenshot of every new bookmark.
+func startThumbnails() {
+	if !thumbnailsEnabled() {
+		return
+	}
+
+	slog.Info("Thumbnails: capturing screenshots of new bookmarks")
+	events, _ := changes.subscribe()
+	go func() {
+		for ev := range events {
+			if ev.Type == eventBookmarkCreated && ev.Bookmark != nil {
+				queueThumbnail(storeFilesDir(thumbnailsDir, ev.Owner, ev.Collection), ev.Bookmark.ID, ev.Bookmark.URL)
+			}
+		}
+	}()
+	go func() {
+		for job := range thumbnailQueue {
+			captureThumbnail(job)
+			thumbnailPending.Delete(filepath.Join(job.dir, job.id))
+		}
+	}()
+}
+
+// queueThumbnail asks for a screenshot of a page, unless one is on its way
+// or the queue is full.
+func queueThumbnail(dir, id, pageURL string) {
+	if u, err := url.Parse(pageURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return
+	}
+	key := filepath.Join(dir, id)
+	if _, queued := thumbnailPending.LoadOrStore(key, struct{}{}); queued {
+		return
+	}
+	select {
+	case thumbnailQueue <- thumbnailJob{dir: dir, id: id, url: pageURL}:
+	default:
+		thumbnailPending.Delete(key)
+	}
+}
+
+func captureThumbnail(job thumbnailJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), thumbnailTimeout)
+	defer cancel()
+
+	data, err := captureScreenshot(ctx, job.url)
+	if err == nil {
+		data, err = shrinkScreenshot(data)
+	}
+	if err == nil {
+		err = os.MkdirAll(job.dir, 0755)
+	}
+	if err == nil {
+		err = writeThumbnail(filepath.Join(job.dir, job.id+".jpg"), data)
+	}
+	miss := filepath.Join(job.dir, job.id+".miss")
+	if err != nil {
+		slog.Warn("Could not capture thumbnail", "url", job.url, "err", err)
+		if os.MkdirAll(job.dir, 0755) == nil {
+			os.WriteFile(miss, nil, 0644)
+		}
+		return
+	}
+	os.Remove(miss)
+}
+
+// captureScreenshot gets a screenshot of a page from the service or command.
+func captureScreenshot(ctx context.Context, pageURL string) ([]byte, error) {
+	if len(thumbnailCommand) > 0 {
+		cmd := exec.CommandContext(ctx, thumbnailCommand[0], append(thumbnailCommand[1:], pageURL)...)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.ReplaceAll(thumbnailService, "{url}", url.QueryEscape(pageURL)), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("capture service answered %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxScreenshotBytes+1))
+	if err == nil && len(data) > maxScreenshotBytes {
+		err = errors.New("screenshot too large")
+	}
+	return data, err
+}
+
+// shrinkScreenshot scales a screenshot down to thumbnailWidth, keeping the
+// top of the page at the thumbnail's aspect ratio, as a JPEG.
+func shrinkScreenshot(data []byte) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	b := src.Bounds()
+	if b.Empty() {
+		return nil, errors.New("empty screenshot")
+	}
+	srcH := min(b.Dy(), b.Dx()*thumbnailHeight/thumbnailWidth)
+	dstW := min(b.Dx(), thumbnailWidth)
+	dstH := max(1, srcH*dstW/b.Dx())
+
+	// average the source pixels under each thumbnail pixel
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := range dstH {
+		y0 := b.Min.Y + y*srcH/dstH
+		y1 := max(y0+1, b.Min.Y+(y+1)*srcH/dstH)
+		for x := range dstW {
+			x0 := b.Min.X + x*b.Dx()/dstW
+			x1 := max(x0+1, b.Min.X+(x+1)*b.Dx()/dstW)
+			var r, g, bl, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, _ := src.At(sx, sy).RGBA()
+					r, g, bl, n = r+uint64(cr), g+uint64(cg), bl+uint64(cb), n+1
+				}
+			}
+			dst.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), 0xff})
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeThumbnail replaces a thumbnail atomically.
+func writeThumbnail(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(data)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), 0644)
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// handleThumbnail serves a bookmark's screenshot. A missing one is queued
+// for capture; until it is there, the answer is 404.
+func handleThumbnail(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.RLock()
+	bm, exists := s.bookmarks[strings.TrimPrefix(r.URL.Path, "/thumbnails/")]
+	path := thumbnailPath(s, bm.ID)
+	s.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	if _, err := os.Stat(path); err != nil {
+		info, err := os.Stat(strings.TrimSuffix(path, ".jpg") + ".miss")
+		if thumbnailsEnabled() && (err != nil || time.Since(info.ModTime()) >= faviconMissTTL) {
+			queueThumbnail(filepath.Dir(path), bm.ID, bm.URL)
+		}
+		http.Error(w, "No thumbnail", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeFile(w, r, path)
+}
+
+// --- Page Archive ---
+
+// archivesDir holds readable copies of bookmarked pages, relative to the
+// data directory, as <bookmark id>.json data files in the directory of their
+// collection (see storeFilesDir).
+const archivesDir = "archives"
+
+const (
+	archiveTimeout       = time.Minute
+	maxArchivePageBytes  = 5 << 20
+	maxArchiveImages     = 30
+	maxArchiveImageBytes = 2 << 20
+)
+
+// pageArchive is the article of a page, as simplified HTML with its images
+// inlined as data: URIs and as plain text.
+type pageArchive struct {
+	URL        string `json:"url"`
+	Title      string `json:"title"`
+	Text       string `json:"text"`
+	HTML       string `json:"html"`
+	Images     int    `json:"images"`
+	ArchivedAt int64  `json:"archived_at"`
+}
+
+var (
+	// archiveDropTags never hold article content.
+	archiveDropTags = map[string]bool{
+		"script": true, "style": true, "noscript": true, "nav": true, "header": true, "footer": true,
+		"aside": true, "form": true, "iframe": true, "svg": true, "button": true, "input": true,
+		"select": true, "textarea": true, "template": true, "object": true, "embed": true, "canvas": true,
+		"dialog": true, "link": true, "meta": true,
+	}
+	// archiveKeepTags survive in the archived HTML; other elements are
+	// replaced by their content.
+	archiveKeepTags = map[string]bool{
+		"p": true, "br": true, "hr": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+		"ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true, "blockquote": true, "pre": true,
+		"code": true, "em": true, "i": true, "strong": true, "b": true, "u": true, "s": true, "sub": true,
+		"sup": true, "mark": true, "small": true, "a": true, "img": true, "figure": true, "figcaption": true,
+		"table": true, "caption": true, "thead": true, "tbody": true, "tr": true, "th": true, "td": true,
+	}
+	archiveBlockTags = map[string]bool{
+		"p": true, "div": true, "section": true, "article": true, "h1": true, "h2": true, "h3": true, "h4": true,
+		"h5": true, "h6": true, "ul": true, "ol": true, "li": true, "dl": true, "dt": true, "dd": true,
+		"blockquote": true, "pre": true, "figure": true, "figcaption": true, "table": true, "tr": true, "br": true, "hr": true,
+	}
+	archivePositiveRe = regexp.MustCompile(`(?i)article|body|content|entry|main|page|post|story|text|blog`)
+	archiveNegativeRe = regexp.MustCompile(`(?i)\bad\b|ad-|banner|combx|comment|community|cookie|disqus|footer|menu|meta|nav|popup|promo|related|share|sidebar|social|sponsor|subscribe|widget`)
+)
+
+// archivePage fetches a page and extracts its article, much like Firefox's
+// reader view: paragraphs score their parents by length and commas, the
+// best scored element (less its links) wins, together with siblings that
+// score nearly as well.
+func archivePage(ctx context.Context, pageURL string) (*pageArchive, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", pageURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := fetch(req, archiveTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("page answered %s", resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "" && mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, fmt.Errorf("not an HTML page but %s", mediaType)
+	}
+	body, err := charset.NewReader(io.LimitReader(resp.Body, maxArchivePageBytes), contentType)
+	if err != nil {
+		return nil, err
+	}
+	doc, err := nethtml.Parse(body)
+	if err != nil {
+		return nil, err
+	}
+
+	base, _ := url.Parse(pageURL)
+	if href := findBaseHref(doc); href != "" {
+		if ref, err := url.Parse(href); err == nil {
+			base = base.ResolveReference(ref)
+		}
+	}
+
+	archive := &pageArchive{URL: pageURL, Title: archiveTitle(doc), ArchivedAt: time.Now().Unix()}
+	pruneArchiveNodes(doc)
+	nodes := articleNodes(doc)
+	if len(nodes) == 0 {
+		return nil, errors.New("no article found")
+	}
+
+	out := archiveWriter{ctx: ctx, base: base}
+	for _, n := range nodes {
+		out.render(n)
+	}
+	archive.HTML = out.html.String()
+	archive.Text = strings.TrimSpace(multiNewlineRe.ReplaceAllString(out.text.String(), "\n\n"))
+	archive.Images = out.images
+	return archive, nil
+}
+
+var multiNewlineRe = regexp.MustCompile(`\s*\n\s*\n\s*`)
+
+func findBaseHref(n *nethtml.Node) string {
+	if n.Type == nethtml.ElementNode && n.Data == "base" {
+		return nodeAttr(n, "href")
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if href := findBaseHref(c); href != "" {
+			return href
+		}
+	}
+	return ""
+}
+
+func nodeAttr(n *nethtml.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// nodeText is the text inside n with whitespace collapsed.
+func nodeText(n *nethtml.Node) string {
+	var b strings.Builder
+	var walk func(*nethtml.Node)
+	walk = func(n *nethtml.Node) {
+		if n.Type == nethtml.TextNode {
+			b.WriteString(n.Data)
+			b.WriteByte(' ')
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// archiveTitle prefers og:title, which leaves out the site's name, over
+// <title>.
+func archiveTitle(doc *nethtml.Node) string {
+	var og, title string
+	var walk func(*nethtml.Node)
+	walk = func(n *nethtml.Node) {
+		if n.Type == nethtml.ElementNode {
+			switch {
+			case n.Data == "meta" && nodeAttr(n, "property") == "og:title" && og == "":
+				og = nodeAttr(n, "content")
+			case n.Data == "title" && title == "":
+				title = nodeText(n)
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return pageText(cmp.Or(og, title), maxPageTitle)
+}
+
+// pruneArchiveNodes removes what can't be article content: scripts,
+// navigation, forms, hidden elements and ones whose class or id sounds like
+// a sidebar, ad or comment section.
+func pruneArchiveNodes(n *nethtml.Node) {
+	for c := n.FirstChild; c != nil; {
+		next := c.NextSibling
+		if c.Type == nethtml.CommentNode {
+			n.RemoveChild(c)
+		} else if c.Type == nethtml.ElementNode {
+			names := nodeAttr(c, "class") + " " + nodeAttr(c, "id")
+			unlikely := c.Data != "body" && c.Data != "article" && c.Data != "main" &&
+				archiveNegativeRe.MatchString(names) && !archivePositiveRe.MatchString(names)
+			hidden := nodeAttr(c, "aria-hidden") == "true" || slices.ContainsFunc(c.Attr, func(a nethtml.Attribute) bool { return a.Key == "hidden" })
+			if archiveDropTags[c.Data] || unlikely || hidden {
+				n.RemoveChild(c)
+			} else {
+				pruneArchiveNodes(c)
+			}
+		}
+		c = next
+	}
+}
+
+// articleNodes picks the elements that make up the article.
+func articleNodes(doc *nethtml.Node) []*nethtml.Node {
+	scores := map[*nethtml.Node]float64{}
+	score := func(n *nethtml.Node, add float64) {
+		if _, ok := scores[n]; !ok {
+			scores[n] = archiveNodeWeight(n)
+		}
+		scores[n] += add
+	}
+
+	var body *nethtml.Node
+	var fallback *nethtml.Node
+	var walk func(*nethtml.Node)
+	walk = func(n *nethtml.Node) {
+		if n.Type == nethtml.ElementNode {
+			switch n.Data {
+			case "body":
+				body = n
+			case "article", "main":
+				if fallback == nil {
+					fallback = n
+				}
+			case "p", "pre", "td", "blockquote":
+				text := nodeText(n)
+				if len(text) >= 25 && n.Parent != nil && n.Parent.Type == nethtml.ElementNode {
+					add := 1 + float64(strings.Count(text, ",")) + min(float64(len(text))/100, 3)
+					score(n.Parent, add)
+					if gp := n.Parent.Parent; gp != nil && gp.Type == nethtml.ElementNode {
+						score(gp, add/2)
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	var top *nethtml.Node
+	for n, sc := range scores {
+		sc *= 1 - linkDensity(n)
+		scores[n] = sc
+		if top == nil || sc > scores[top] {
+			top = n
+		}
+	}
+	if top == nil {
+		top = cmp.Or(fallback, body)
+		if top == nil {
+			return nil
+		}
+		return []*nethtml.Node{top}
+	}
+	if top.Parent == nil {
+		return []*nethtml.Node{top}
+	}
+
+	// articles split into several blocks have them side by side
+	threshold := max(10, scores[top]*0.2)
+	var nodes []*nethtml.Node
+	for c := top.Parent.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != nethtml.ElementNode {
+			continue
+		}
+		sc, scored := scores[c]
+		text := nodeText(c)
+		switch {
+		case c == top,
+			scored && sc >= threshold,
+			c.Data == "p" && len(text) > 80 && linkDensity(c) < 0.25:
+			nodes = append(nodes, c)
+		}
+	}
+	return nodes
+}
+
+// archiveNodeWeight is a candidate's score before its paragraphs count.
+func archiveNodeWeight(n *nethtml.Node) float64 {
+	var w float64
+	switch n.Data {
+	case "article":
+		w += 10
+	case "div":
+		w += 5
+	case "pre", "td", "blockquote":
+		w += 3
+	case "form", "ol", "ul", "dl", "dd", "dt", "li":
+		w -= 3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		w -= 5
+	}
+	names := nodeAttr(n, "class") + " " + nodeAttr(n, "id")
+	if archivePositiveRe.MatchString(names) {
+		w += 25
+	}
+	if archiveNegativeRe.MatchString(names) {
+		w -= 25
+	}
+	return w
+}
+
+// linkDensity is the share of n's text that is inside links.
+func linkDensity(n *nethtml.Node) float64 {
+	text := len(nodeText(n))
+	if text == 0 {
+		return 0
+	}
+	links := 0
+	var walk func(*nethtml.Node)
+	walk = func(n *nethtml.Node) {
+		if n.Type == nethtml.ElementNode && n.Data == "a" {
+			links += len(nodeText(n))
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return float64(links) / float64(text)
+}
+
+// archiveWriter renders article nodes as simplified HTML and plain text,
+// inlining images.
+type archiveWriter struct {
+	ctx    context.Context
+	base   *url.URL
+	html   strings.Builder
+	text   strings.Builder
+	images int
+}
+
+func (w *archiveWriter) render(n *nethtml.Node) {
+	switch n.Type {
+	case nethtml.TextNode:
+		text := n.Data
+		if !w.inPre(n) {
+			text = collapseSpaceRe.ReplaceAllString(text, " ")
+		}
+		w.html.WriteString(html.EscapeString(text))
+		w.text.WriteString(text)
+		return
+	case nethtml.ElementNode:
+	default:
+		return
+	}
+
+	tag := n.Data
+	if archiveBlockTags[tag] {
+		w.text.WriteString("\n")
+	}
+	if !archiveKeepTags[tag] {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			w.render(c)
+		}
+		if archiveBlockTags[tag] {
+			w.text.WriteString("\n")
+		}
+		return
+	}
+
+	switch tag {
+	case "img":
+		w.renderImage(n)
+		return
+	case "br", "hr":
+		w.html.WriteString("<" + tag + ">")
+		return
+	case "a":
+		if href := w.link(nodeAttr(n, "href")); href != "" {
+			w.html.WriteString(`<a href="` + html.EscapeString(href) + `">`)
+		} else {
+			w.html.WriteString("<a>")
+		}
+	default:
+		w.html.WriteString("<" + tag + ">")
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.render(c)
+	}
+	w.html.WriteString("</" + tag + ">")
+	if archiveBlockTags[tag] {
+		w.text.WriteString("\n")
+	}
+}
+
+var collapseSpaceRe = regexp.MustCompile(`\s+`)
+
+func (w *archiveWriter) inPre(n *nethtml.Node) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Type == nethtml.ElementNode && p.Data == "pre" {
+			return true
+		}
+	}
+	return false
+}
+
+// link resolves a link of the page, keeping only http(s) ones.
+func (w *archiveWriter) link(href string) string {
+	return pageLink(w.base.String(), href)
+}
+
+// renderImage inlines an image, or leaves it out if it can't be fetched:
+// the archive never loads anything from elsewhere.
+func (w *archiveWriter) renderImage(n *nethtml.Node) {
+	// lazy loading scripts keep the real source in data-src
+	src := w.link(cmp.Or(nodeAttr(n, "data-src"), nodeAttr(n, "src")))
+	if src == "" || w.images >= maxArchiveImages {
+		return
+	}
+	req, err := http.NewRequestWithContext(w.ctx, "GET", src, nil)
+	if err != nil {
+		return
+	}
+	resp, err := fetch(req, archiveTimeout)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxArchiveImageBytes+1))
+	if err != nil || resp.StatusCode != http.StatusOK || len(data) > maxArchiveImageBytes {
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if _, ok := faviconTypes[mediaType]; !ok {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+		if _, ok := faviconTypes[mediaType]; !ok {
+			return
+		}
+	}
+
+	w.images++
+	fmt.Fprintf(&w.html, `<img src="data:%s;base64,%s" alt="%s">`, mediaType, base64.StdEncoding.EncodeToString(data), html.EscapeString(nodeAttr(n, "alt")))
+}
+
+// archivePath is where the archived page of a bookmark in s is stored.
+func archivePath(s *Store, id string) string {
+	return filepath.Join(storeFilesDir(archivesDir, s.Owner, s.Name), id+".json")
+}
+
+// archiveBookmarkContent stores a readable copy of the bookmark's page and
+// answers with the bookmark.
+func archiveBookmarkContent(w http.ResponseWriter, r *http.Request, id string, s *Store) {
+	s.mu.RLock()
+	bm, exists := s.bookmarks[id]
+	s.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), archiveTimeout)
+	defer cancel()
+	archive, err := archivePage(ctx, bm.URL)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Could not archive page", "url", bm.URL, "err", err)
+		http.Error(w, "Could not archive the page", http.StatusBadGateway)
+		return
+	}
+	s.mu.RLock()
+	path := archivePath(s, id)
+	s.mu.RUnlock()
+	data, err := json.Marshal(archive)
+	if err == nil {
+		err = os.MkdirAll(filepath.Dir(path), 0700)
+	}
+	if err == nil {
+		err = writeDataFile(path, data, 0600)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Could not save archived page", "url", bm.URL, "err", err)
+		http.Error(w, "Could not save the archived page", http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the bookmark may have changed or gone while the page loaded
+	bm, exists = s.bookmarks[id]
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+	bm.ArchivedAt = archive.ArchivedAt
+	s.putBookmark(bm)
+	s.saveDatabase()
+
+	bm = s.bookmarks[id]
+	bm.Category = s.getCategoryName(bm.CategoryID)
+	writeJSON(w, http.StatusCreated, bm)
+}
+
+var archivePageTmpl = template.Must(template.New("archive").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { max-width: 42rem; margin: 2rem auto; padding: 0 1rem; font: 1.1rem/1.6 Georgia, serif; }
+img { max-width: 100%; height: auto; }
+pre { overflow: auto; }
+.archived { font: 0.85rem sans-serif; color: #777; border-bottom: 1px solid #ccc; padding-bottom: 0.5rem; }
+</style>
+</head>
+<body>
+<p class="archived">Archived copy of <a href="{{.URL}}">{{.URL}}</a> from {{.Date}}</p>
+<h1>{{.Title}}</h1>
+{{.Content}}
+</body>
+</html>
+`))
+
+// getBookmarkArchive serves the archived copy of a bookmark's page, as a
+// page of its own or, for Accept: application/json, as a pageArchive.
+func getBookmarkArchive(w http.ResponseWriter, r *http.Request, id string, s *Store) {
+	s.mu.RLock()
+	_, exists := s.bookmarks[id]
+	path := archivePath(s, id)
+	s.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	data, err := readDataFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "No archived copy", http.StatusNotFound)
+		return
+	}
+	var archive pageArchive
+	if err == nil {
+		err = json.Unmarshal(data, &archive)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Could not read archived page", "id", id, "err", err)
+		http.Error(w, "Could not read the archived page", http.StatusInternalServerError)
+		return
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		writeJSON(w, http.StatusOK, archive)
+		return
+	}
+	// the archive shows images it carries and nothing else
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src data:; style-src 'unsafe-inline'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	archivePageTmpl.Execute(w, map[string]any{
+		"URL":     archive.URL,
+		"Title":   archive.Title,
+		"Date":    time.Unix(archive.ArchivedAt, 0).UTC().Format("2 January 2006"),
+		"Content": template.HTML(archive.HTML),
+	})
+}
+
+// --- Wayback Machine ---
+
+// New bookmarks can be submitted to the Wayback Machine's Save Page Now:
+// all of them with BOOKMARKD_WAYBACK_SAVE=true (except private ones, whose
+// URLs shouldn't be published), or single ones created with "wayback": true
+// or sent to POST /api/bookmarks/:id/wayback. The snapshot's address ends up
+// in the bookmark's wayback_url. With an archive.org access key, the
+// authenticated API is used, which is faster and allows more captures.
+var waybackConfig struct {
+	BaseURL   string
+	SaveAll   bool
+	AccessKey string
+	SecretKey string
+}
+
+const (
+	waybackTimeout   = 5 * time.Minute
+	waybackPollEvery = 5 * time.Second
+)
+
+func loadWayback() {
+	waybackConfig.BaseURL = strings.TrimSuffix(cmp.Or(os.Getenv("BOOKMARKD_WAYBACK_URL"), "https://web.archive.org"), "/")
+	waybackConfig.SaveAll = os.Getenv("BOOKMARKD_WAYBACK_SAVE") == "true"
+	waybackConfig.AccessKey = os.Getenv("BOOKMARKD_WAYBACK_ACCESS_KEY")
+	waybackConfig.SecretKey = os.Getenv("BOOKMARKD_WAYBACK_SECRET_KEY")
+	if (waybackConfig.AccessKey == "") != (waybackConfig.SecretKey == "") {
+		fatal("Set both BOOKMARKD_WAYBACK_ACCESS_KEY and BOOKMARKD_WAYBACK_SECRET_KEY, or neither")
+	}
+}
+
+type waybackJob struct {
+	owner, collection, id, url string
+}
+
+// Captures are submitted one at a time; waybackPending keeps a bookmark from
+// being queued twice.
+var (
+	waybackQueue   = make(chan waybackJob, 256)
+	waybackPending sync.Map
+)
+
+// startWayback submits new bookmarks when BOOKMARKD_WAYBACK_SAVE is on and
+// works through the queue.
+func startWayback() {
+	if waybackConfig.SaveAll {
+		slog.Info("Wayback Machine: saving new bookmarks", "url", waybackConfig.BaseURL)
+		events, _ := changes.subscribe()
+		go func() {
+			for ev := range events {
+				if ev.Type == eventBookmarkCreated && ev.Bookmark != nil && !ev.Bookmark.Private {
+					queueWayback(ev.Owner, ev.Collection, *ev.Bookmark)
+				}
+			}
+		}()
+	}
+	go func() {
+		for job := range waybackQueue {
+			saveToWayback(job)
+			waybackPending.Delete(job)
+		}
+	}()
+}
+
+// queueWayback asks for a snapshot of a bookmark's page and reports whether
+// it was queued.
+func queueWayback(owner, collection string, bm Bookmark) bool {
+	if u, err := url.Parse(bm.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	job := waybackJob{owner: owner, collection: cmp.Or(collection, defaultCollection), id: bm.ID, url: bm.URL}
+	if _, queued := waybackPending.LoadOrStore(job, struct{}{}); queued {
+		return true
+	}
+	select {
+	case waybackQueue <- job:
+		return true
+	default:
+		waybackPending.Delete(job)
+		return false
+	}
+}
+
+func saveToWayback(job waybackJob) {
+	ctx, cancel := context.WithTimeout(context.Background(), waybackTimeout)
+	defer cancel()
+	snapshot, err := waybackSave(ctx, job.url)
+	if err != nil {
+		slog.Warn("Wayback Machine: saving failed", "url", job.url, "err", err)
+		return
+	}
+
+	s := getOwnerStore(job.owner, job.collection)
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bm, exists := s.bookmarks[job.id]
+	if !exists || bm.URL != job.url {
+		return
+	}
+	bm.WaybackURL = snapshot
+	s.putBookmark(bm)
+	s.saveDatabase()
+	slog.Info("Wayback Machine: saved", "url", job.url, "snapshot", snapshot)
+}
+
+// waybackSave captures a page and returns the snapshot's address.
+func waybackSave(ctx context.Context, pageURL string) (string, error) {
+	client := &http.Client{}
+	if waybackConfig.AccessKey == "" {
+		// the anonymous endpoint answers once the capture is done, naming it
+		// in Content-Location or by redirecting to it
+		req, err := http.NewRequestWithContext(ctx, "GET", waybackConfig.BaseURL+"/save/"+pageURL, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("save answered %s", resp.Status)
+		}
+		if loc := resp.Header.Get("Content-Location"); strings.HasPrefix(loc, "/web/") {
+			return waybackConfig.BaseURL + loc, nil
+		}
+		if strings.HasPrefix(resp.Request.URL.Path, "/web/") {
+			return resp.Request.URL.String(), nil
+		}
+		return "", errors.New("no snapshot in the answer")
+	}
+
+	var job struct {
+		JobID   string `json:"job_id"`
+		Message string `json:"message"`
+	}
+	if err := waybackCall(ctx, client, "POST", "/save", url.Values{"url": {pageURL}}, &job); err != nil {
+		return "", err
+	}
+	if job.JobID == "" {
+		return "", fmt.Errorf("save refused: %s", job.Message)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(waybackPollEvery):
+		}
+		var status struct {
+			Status      string `json:"status"`
+			Timestamp   string `json:"timestamp"`
+			OriginalURL string `json:"original_url"`
+			Message     string `json:"message"`
+		}
+		if err := waybackCall(ctx, client, "GET", "/save/status/"+url.PathEscape(job.JobID), nil, &status); err != nil {
+			return "", err
+		}
+		switch status.Status {
+		case "pending":
+		case "success":
+			return waybackConfig.BaseURL + "/web/" + status.Timestamp + "/" + cmp.Or(status.OriginalURL, pageURL), nil
+		default:
+			return "", fmt.Errorf("capture failed: %s", cmp.Or(status.Message, status.Status))
+		}
+	}
+}
+
+// waybackCall makes an authenticated Save Page Now API request.
+func waybackCall(ctx context.Context, client *http.Client, method, path string, form url.Values, v any) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, waybackConfig.BaseURL+path, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "LOW "+waybackConfig.AccessKey+":"+waybackConfig.SecretKey)
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s answered %s", method, path, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// waybackClosest returns the Wayback Machine snapshot of a page closest to
+// a time, "" if it has none.
+func waybackClosest(ctx context.Context, pageURL string, at time.Time) (string, error) {
+	q := url.Values{"url": {pageURL}, "timestamp": {at.UTC().Format("20060102150405")}}
+	req, err := http.NewRequestWithContext(ctx, "GET", waybackConfig.BaseURL+"/wayback/available?"+q.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("availability API answered %s", resp.Status)
+	}
+	var result struct {
+		ArchivedSnapshots struct {
+			Closest struct {
+				Available bool   `json:"available"`
+				URL       string `json:"url"`
+			} `json:"closest"`
+		} `json:"archived_snapshots"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&result); err != nil {
+		return "", err
+	}
+	closest := result.ArchivedSnapshots.Closest
+	if !closest.Available {
+		return "", nil
+	}
+	// the API names snapshots with http:// URLs
+	if rest, ok := strings.CutPrefix(closest.URL, "http://web.archive.org/"); ok {
+		return "https://web.archive.org/" + rest, nil
+	}
+	return closest.URL, nil
+}
+
+// findFallback looks up the snapshot of a dead bookmark's page closest to
+// when it was bookmarked, for fallback_url.
+func findFallback(ctx context.Context, bm Bookmark) (string, error) {
+	return waybackClosest(ctx, bm.URL, time.Unix(bm.Timestamp, 0))
+}
+
+// lookupFallback sets a bookmark's fallback_url to its closest snapshot
+// and answers with the bookmark.
+func lookupFallback(w http.ResponseWriter, r *http.Request, id string, s *Store) {
+	s.mu.RLock()
+	bm, exists := s.bookmarks[id]
+	s.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	fallback, err := findFallback(r.Context(), bm)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Wayback Machine: lookup failed", "url", bm.URL, "err", err)
+		http.Error(w, "Could not ask the Wayback Machine", http.StatusBadGateway)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bm, exists = s.bookmarks[id]
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+	if bm.FallbackURL != fallback {
+		bm.FallbackURL = fallback
+		s.putBookmark(bm)
+		s.saveDatabase()
+	}
+
+	bm = s.bookmarks[id]
+	bm.Category = s.getCategoryName(bm.CategoryID)
+	writeJSON(w, http.StatusOK, bm)
+}
+
+// submitToWayback queues a bookmark for the Wayback Machine.
+func submitToWayback(w http.ResponseWriter, id string, s *Store) {
+	s.mu.RLock()
+	bm, exists := s.bookmarks[id]
+	s.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+	if !queueWayback(s.Owner, s.Name, bm) {
+		http.Error(w, "Could not queue the bookmark, try again later", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// --- Bookmark Logic ---
+
+type bookmarkCreateRequest struct {
+	URL        string `json:"url"`
+	Title      string `json:"title"`
+	Category   string `json:"category"`
+	CategoryID string `json:"category_id"`
+	Favicon    string `json:"favicon"`
+	Meta       map[string]string `json:"meta"`
+	Tags       []string          `json:"tags"`
+	Private    bool              `json:"private"`
+	Wayback    bool              `json:"wayback"` // submit to the Wayback Machine
+}
+
+// urlSchemes are the schemes bookmark URLs may have, so that e.g.
+// javascript: URLs never end up as links. BOOKMARKD_URL_SCHEMES replaces
+// them, e.g. with "http,https,ftp,gemini".
+var urlSchemes []string
+
+func loadURLSchemes() {
+	urlSchemes = nil
+	for _, scheme := range strings.Split(cmp.Or(os.Getenv("BOOKMARKD_URL_SCHEMES"), "http,https"), ",") {
+		if scheme = strings.ToLower(strings.TrimSpace(scheme)); scheme != "" {
+			urlSchemes = append(urlSchemes, scheme)
+		}
+	}
+}
+
+// validBookmarkURL reports whether raw is an absolute URL with an allowed
+// scheme.
+func validBookmarkURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && slices.Contains(urlSchemes, strings.ToLower(u.Scheme)) && (u.Host != "" || u.Opaque != "")
+}
+
+// invalidURLMessage explains which URLs are accepted.
+func invalidURLMessage() string {
+	return "Invalid URL: must be absolute and use one of the schemes " + strings.Join(urlSchemes, ", ")
+}
+
+// trackingParams are the query parameters canonicalURL strips; a trailing
+// "*" matches every parameter with that prefix. BOOKMARKD_TRACKING_PARAMS
+// replaces them, and "none" keeps every parameter.
+var trackingParams []string
+
+func loadTrackingParams() {
+	trackingParams = nil
+	list := cmp.Or(os.Getenv("BOOKMARKD_TRACKING_PARAMS"), "utm_*,fbclid,gclid,dclid,msclkid,mc_cid,mc_eid,igshid,yclid,_hsenc,_hsmi,ref_src,mkt_tok")
+	if strings.EqualFold(strings.TrimSpace(list), "none") {
+		return
+	}
+	for _, param := range strings.Split(list, ",") {
+		if param = strings.ToLower(strings.TrimSpace(param)); param != "" {
+			trackingParams = append(trackingParams, param)
+		}
+	}
+}
+
+func isTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	for _, param := range trackingParams {
+		if prefix, ok := strings.CutSuffix(param, "*"); ok && strings.HasPrefix(name, prefix) || param == name {
+			return true
+		}
+	}
+	return false
+}
+
+// canonicalURL normalizes a bookmark URL so that the same page always gets
+// the same ID: the scheme and host are lowercased, default ports, tracking
+// parameters and fragments are dropped. Fragments that look like client-side
+// routes ("#/inbox", "#!page") are kept, since they pick a different page.
+// URLs that don't parse are returned unchanged for validation to refuse.
+func canonicalURL(raw string) string {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Opaque != "" || u.Host == "" {
+		return raw
+	}
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if port := u.Port(); u.Scheme == "http" && port == "80" || u.Scheme == "https" && port == "443" {
+		u.Host = strings.TrimSuffix(u.Host, ":"+port)
+	}
+	if u.Path == "" && (u.Scheme == "http" || u.Scheme == "https") {
+		u.Path = "/"
+	}
+	if u.RawQuery != "" {
+		var kept []string
+		for _, pair := range strings.Split(u.RawQuery, "&") {
+			name, _, _ := strings.Cut(pair, "=")
+			if name, err := url.QueryUnescape(name); pair != "" && (err != nil || !isTrackingParam(name)) {
+				kept = append(kept, pair)
+			}
+		}
+		u.RawQuery = strings.Join(kept, "&")
+	}
+	u.ForceQuery = false
+	if !strings.HasPrefix(u.Fragment, "/") && !strings.HasPrefix(u.Fragment, "!") {
+		u.Fragment, u.RawFragment = "", ""
+	}
+	return u.String()
+}
+
+// redirectHosts are the hosts (and their subdomains) whose links are
+// replaced by where they redirect to when bookmarked, typically URL
+// shorteners; "*" resolves every redirect. BOOKMARKD_RESOLVE_REDIRECTS sets
+// them, and nothing is resolved by default.
+var redirectHosts []string
+
+func loadRedirectHosts() {
+	redirectHosts = nil
+	for _, host := range strings.Split(os.Getenv("BOOKMARKD_RESOLVE_REDIRECTS"), ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			redirectHosts = append(redirectHosts, host)
+		}
+	}
+}
+
+// resolvedURL returns the canonical URL pageURL redirected to, according to
+// the page fetched from it, if its host is one of redirectHosts. It returns
+// "" to keep pageURL as it is.
+func resolvedURL(pageURL string, info pageInfo) string {
+	u, err := url.Parse(pageURL)
+	if err != nil || info.URL == "" {
+		return ""
+	}
+	host := strings.ToLower(u.Hostname())
+	if !slices.ContainsFunc(redirectHosts, func(h string) bool {
+		return h == "*" || h == host || strings.HasSuffix(host, "."+h)
+	}) {
+		return ""
+	}
+	if final := canonicalURL(info.URL); final != pageURL && validBookmarkURL(final) {
+		return final
+	}
+	return ""
+}
+
+func createBookmark(w http.ResponseWriter, r *http.Request, s *Store) {
+	var payload bookmarkCreateRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if !validBookmarkURL(payload.URL) {
+		http.Error(w, invalidURLMessage(), http.StatusUnprocessableEntity)
+		return
+	}
+	payload.URL = canonicalURL(payload.URL)
+
+	info := fetchPageInfo(payload.URL)
+	sourceURL := ""
+	if final := resolvedURL(payload.URL, info); final != "" {
+		sourceURL, payload.URL = payload.URL, final
+	}
+	faviconURL := info.Favicon
+	if faviconURL == "" {
+		faviconURL = payload.Favicon
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	categoryID := payload.CategoryID
+	if categoryID == "" {
+		categoryID = s.resolveOrCreateCategory(payload.Category)
+	}
+
+	newBM := Bookmark{
+		ID:           uuid.NewSHA1(uuid.NameSpaceURL, []byte(payload.URL)).String(),
+		URL:          payload.URL,
+		Title:        titleOrFetched(payload.Title, payload.URL, info),
+		CategoryID:   categoryID,
+		Timestamp:    time.Now().Unix(),
+		Favicon:      faviconURL,
+		Order:        s.maxOrderInCategory(categoryID) + 1,
+		Description:  info.Description,
+		Image:        info.Image,
+		CanonicalURL: info.Canonical,
+		SourceURL:    sourceURL,
+		Meta:         cleanMeta(payload.Meta),
+		Tags:         cleanTags(payload.Tags),
+		Private:      payload.Private,
+	}
+
+	s.putBookmark(newBM)
+	s.saveDatabase()
+	if payload.Wayback {
+		queueWayback(s.Owner, s.Name, newBM)
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+type batchResult struct {
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status"` // "created", "exists" or "error"
+	Error  string `json:"error,omitempty"`
+}
+
+// maxBatchFaviconFetches bounds concurrent favicon lookups for a batch.
+const maxBatchFaviconFetches = 8
+
+// createBookmarksBatch creates many bookmarks under one lock and one save.
+// Unlike a single POST, URLs that are already bookmarked are left untouched
+// and reported as "exists".
+func createBookmarksBatch(w http.ResponseWriter, r *http.Request, s *Store) {
+	var payload []bookmarkCreateRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	for i := range payload {
+		payload[i].URL = canonicalURL(payload[i].URL)
+	}
+
+	pages := make([]pageInfo, len(payload))
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxBatchFaviconFetches)
+	for i, item := range payload {
+		if !validBookmarkURL(item.URL) {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			pages[i] = fetchPageInfo(item.URL)
+		}()
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]batchResult, len(payload))
+	created := 0
+	for i, item := range payload {
+		results[i].Index = i
+		if item.URL == "" {
+			results[i].Status, results[i].Error = "error", "missing url"
+			continue
+		}
+		if !validBookmarkURL(item.URL) {
+			results[i].Status, results[i].Error = "error", "invalid url"
+			continue
+		}
+		if _, exists := s.categories[item.CategoryID]; item.CategoryID != "" && !exists {
+			results[i].Status, results[i].Error = "error", "unknown category_id"
+			continue
+		}
+		sourceURL := ""
+		if final := resolvedURL(item.URL, pages[i]); final != "" {
+			sourceURL, item.URL = item.URL, final
+		}
+
+		id := uuid.NewSHA1(uuid.NameSpaceURL, []byte(item.URL)).String()
+		results[i].ID = id
+		if _, exists := s.bookmarks[id]; exists {
+			results[i].Status = "exists"
+			continue
+		}
+
+		categoryID := item.CategoryID
+		if categoryID == "" {
+			categoryID = s.resolveOrCreateCategory(item.Category)
+		}
+		favicon := pages[i].Favicon
+		if favicon == "" {
+			favicon = item.Favicon
+		}
+
+		s.putBookmark(Bookmark{
+			ID:           id,
+			URL:          item.URL,
+			Title:        titleOrFetched(item.Title, item.URL, pages[i]),
+			CategoryID:   categoryID,
+			Timestamp:    time.Now().Unix(),
+			Favicon:      favicon,
+			Order:        s.maxOrderInCategory(categoryID) + 1,
+			Description:  pages[i].Description,
+			Image:        pages[i].Image,
+			CanonicalURL: pages[i].Canonical,
+			SourceURL:    sourceURL,
+			Meta:         cleanMeta(item.Meta),
+			Tags:         cleanTags(item.Tags),
+			Private:      item.Private,
+		})
+		if item.Wayback {
+			queueWayback(s.Owner, s.Name, s.bookmarks[id])
+		}
+		results[i].Status = "created"
+		created++
+	}
+
+	if created > 0 {
+		s.saveDatabase()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"created": created, "results": results})
+}
+
+func getBookmarksJSON(w http.ResponseWriter, r *http.Request, s *Store) {
+	if since := r.URL.Query().Get("since"); since != "" {
+		getBookmarksDelta(w, since, s)
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseBookmarkFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sortBy, sortDir := r.URL.Query().Get("sort"), r.URL.Query().Get("dir")
+	if !validSort(sortBy, sortDir) {
+		http.Error(w, "Invalid sort or dir", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.RLock()
+	sortedBookmarks := []Bookmark{}
+	for _, bm := range s.searchCandidates(query) {
+		if filter.matches(bm) {
+			bm.Category = s.getCategoryName(bm.CategoryID)
+			sortedBookmarks = append(sortedBookmarks, bm)
+		}
+	}
+	s.mu.RUnlock()
+
+	if query != "" {
+		sortedBookmarks = searchBookmarks(sortedBookmarks, query)
+	}
+
+	if sortBy != "" {
+		sortBookmarks(sortedBookmarks, sortBy, sortDir)
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(sortedBookmarks)))
+	sortedBookmarks = paginate(sortedBookmarks, limit, offset)
+
+	encodeList(w, r, sortedBookmarks)
+}
+
+// bookmarkDelta is the response of GET /api/bookmarks?since=. Clients pass
+// the returned ServerTime as since on their next sync.
+type bookmarkDelta struct {
+	Bookmarks  []Bookmark  `json:"bookmarks"`
+	Deleted    []Tombstone `json:"deleted"`
+	ServerTime int64       `json:"server_time"`
+}
+
+// getBookmarksDelta returns the bookmarks created or updated and the
+// tombstones of those deleted at or after since. The comparison is
+// inclusive because times have second resolution, so clients may see a
+// change twice but never miss one.
+func getBookmarksDelta(w http.ResponseWriter, since string, s *Store) {
+	t, ok := parseSince(since)
+	if !ok {
+		http.Error(w, "Invalid since", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	if t < now.Add(-tombstoneRetention).Unix() {
+		http.Error(w, "Since is older than the deletion history; fetch all bookmarks instead", http.StatusGone)
+		return
+	}
+
+	delta := bookmarkDelta{Bookmarks: []Bookmark{}, Deleted: []Tombstone{}, ServerTime: now.Unix()}
+
+	s.mu.RLock()
+	for _, bm := range s.bookmarks {
+		if max(bm.UpdatedAt, bm.Timestamp) >= t {
+			bm.Category = s.getCategoryName(bm.CategoryID)
+			delta.Bookmarks = append(delta.Bookmarks, bm)
+		}
+	}
+	for _, ts := range tombstoneSlice(s.tombstones) {
+		if ts.Type == "" && ts.DeletedAt >= t {
+			delta.Deleted = append(delta.Deleted, ts)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(delta.Bookmarks, func(a, b Bookmark) int { return cmp.Compare(a.UpdatedAt, b.UpdatedAt) })
+	writeJSON(w, http.StatusOK, delta)
+}
+
+// changeRecord is the latest state of one bookmark or category in the
+// change feed, or its deletion.
+type changeRecord struct {
+	Seq      uint64    `json:"seq"`
+	Type     string    `json:"type"` // "bookmark" or "category"
+	ID       string    `json:"id"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	DeletedAt int64     `json:"deleted_at,omitempty"`
+	Bookmark  *Bookmark `json:"bookmark,omitempty"`
+	Category  *Category `json:"category,omitempty"`
+}
+
+type changeFeed struct {
+	Changes    []changeRecord `json:"changes"`
+	NextCursor uint64         `json:"next_cursor"`
+	HasMore    bool           `json:"has_more"`
+}
+
+const (
+	defaultChangesLimit = 1000
+	maxChangesLimit     = 10000
+)
+
+// handleChanges serves the change feed of a collection: every bookmark,
+// category and deletion whose last change has a seq above cursor, in seq
+// order. Only the latest change of each item is kept, so replaying the feed
+// from cursor 0 rebuilds the collection and following next_cursor never
+// misses a change. A cursor older than the pruned deletion history gets 410.
+func handleChanges(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var cursor uint64
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(v, 10, 64); err != nil {
+			http.Error(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	limit, _, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit == 0 {
+		limit = defaultChangesLimit
+	}
+	limit = min(limit, maxChangesLimit)
+
+	s.mu.RLock()
+	feed, err := s.changesSince(cursor, limit)
+	s.mu.RUnlock()
+
+	if errors.Is(err, errCursorPruned) {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, feed)
+}
+
+// defaultActivityLimit is how many entries GET /api/activity returns
+// without ?limit=.
+const defaultActivityLimit = 50
+
+// handleActivity serves the activity log, newest first.
+func handleActivity(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit, _, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit == 0 {
+		limit = defaultActivityLimit
+	}
+
+	s.mu.RLock()
+	n := min(limit, len(s.activity))
+	result := append([]Activity{}, s.activity[len(s.activity)-n:]...)
+	s.mu.RUnlock()
+
+	slices.Reverse(result)
+	writeJSON(w, http.StatusOK, result)
+}
+
+var errCursorPruned = errors.New("Cursor is older than the deletion history; replay from cursor 0")
+
+// changesSince collects one page of the change feed. Callers must hold s.mu.
+func (s *Store) changesSince(cursor uint64, limit int) (changeFeed, error) {
+	if cursor > s.seq {
+		return changeFeed{}, errors.New("Unknown cursor")
+	}
+	if cursor > 0 && cursor < s.prunedSeq {
+		return changeFeed{}, errCursorPruned
+	}
+
+	var records []changeRecord
+	for _, bm := range s.bookmarks {
+		if bm.Seq > cursor {
+			bm.Category = s.getCategoryName(bm.CategoryID)
+			records = append(records, changeRecord{Seq: bm.Seq, Type: "bookmark", ID: bm.ID, Bookmark: &bm})
+		}
+	}
+	for _, cat := range s.categories {
+		if cat.Seq > cursor {
+			records = append(records, changeRecord{Seq: cat.Seq, Type: "category", ID: cat.ID, Category: &cat})
+		}
+	}
+	for _, t := range s.tombstones {
+		if t.Seq > cursor {
+			records = append(records, changeRecord{Seq: t.Seq, Type: cmp.Or(t.Type, "bookmark"), ID: t.ID, Deleted: true, DeletedAt: t.DeletedAt})
+		}
+	}
+
+	slices.SortFunc(records, func(a, b changeRecord) int { return cmp.Compare(a.Seq, b.Seq) })
+
+	feed := changeFeed{Changes: records, NextCursor: s.seq}
+	if len(records) > limit {
+		feed.Changes, feed.HasMore = records[:limit], true
+		feed.NextCursor = records[limit-1].Seq
+	}
+	if feed.Changes == nil {
+		feed.Changes = []changeRecord{}
+	}
+	return feed, nil
+}
+
+// bookmarkFilter holds the simple listing filters accepted as query
+// parameters by GET /api/bookmarks.
+type bookmarkFilter struct {
+	categoryID   string
+	domain       string
+	hasNotes     *bool
+	private      *bool
+	visitedSince int64
+	addedSince   int64
+	link         string // link health, see linkHealth
+}
+
+func parseBookmarkFilter(r *http.Request) (bookmarkFilter, error) {
+	q := r.URL.Query()
+	f := bookmarkFilter{
+		categoryID: q.Get("category_id"),
+		domain:     q.Get("domain"),
+	}
+
+	if v := q.Get("has_notes"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("Invalid has_notes")
+		}
+		f.hasNotes = &b
+	}
+	if v := q.Get("private"); v != "" {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("Invalid private")
+		}
+		f.private = &b
+	}
+	if f.link = q.Get("link"); f.link != "" && !slices.Contains([]string{linkOK, linkRedirected, linkBroken, linkUnchecked}, f.link) {
+		return f, fmt.Errorf("Invalid link")
+	}
+
+	var ok bool
+	if v := q.Get("visited_since"); v != "" {
+		if f.visitedSince, ok = parseSince(v); !ok {
+			return f, fmt.Errorf("Invalid visited_since")
+		}
+	}
+	if v := q.Get("added_since"); v != "" {
+		if f.addedSince, ok = parseSince(v); !ok {
+			return f, fmt.Errorf("Invalid added_since")
+		}
+	}
+	return f, nil
+}
+
+// parseSince accepts a Unix timestamp or a YYYY[-MM[-DD]] date.
+func parseSince(value string) (int64, bool) {
+	if n, err := strconv.ParseInt(value, 10, 64); err == nil && len(value) > 4 {
+		return n, true
+	}
+	t, ok := parseQueryDate(value)
+	return t.Unix(), ok
+}
+
+func (f bookmarkFilter) matches(bm Bookmark) bool {
+	if f.categoryID != "" && bm.CategoryID != f.categoryID {
+		return false
+	}
+	if f.domain != "" && !hostMatches(bm.URL, f.domain) {
+		return false
+	}
+	if f.hasNotes != nil && (bm.Notes != "") != *f.hasNotes {
+		return false
+	}
+	if f.private != nil && bm.Private != *f.private {
+		return false
+	}
+	if f.visitedSince != 0 && (bm.LastVisited == nil || *bm.LastVisited < f.visitedSince) {
+		return false
+	}
+	if f.addedSince != 0 && bm.Timestamp < f.addedSince {
+		return false
+	}
+	if f.link != "" && linkHealth(bm) != f.link {
+		return false
+	}
+	return true
+}
+
+// bookmarkQuery is the body of POST /api/bookmarks/query.
+type bookmarkQuery struct {
+	Filter queryNode `json:"filter,omitempty"`
+	Sort   string    `json:"sort,omitempty"`
+	Dir    string    `json:"dir,omitempty"`
+	Limit  int       `json:"limit,omitempty"`
+	Offset int       `json:"offset,omitempty"`
+}
+
+// queryNode is one node of a query filter tree. A node matches when all of
+// its predicates and all of its And children match, at least one Or child
+// matches (if there are any) and Not does not match. An empty node matches
+// every bookmark.
+type queryNode struct {
+	And []queryNode `json:"and,omitempty"`
+	Or  []queryNode `json:"or,omitempty"`
+	Not *queryNode  `json:"not,omitempty"`
+
+	Category string      `json:"category,omitempty"` // name or ID
+	Tag      string      `json:"tag,omitempty"`
+	Domain   string      `json:"domain,omitempty"`
+	Text     string      `json:"text,omitempty"` // same syntax as ?q=
+	HasNotes *bool       `json:"has_notes,omitempty"`
+	Added    *queryRange `json:"added,omitempty"`
+	Visited  *queryRange `json:"visited,omitempty"`
+}
+
+// queryRange bounds a time with a Unix timestamp or a YYYY[-MM[-DD]] date;
+// After is inclusive, Before exclusive.
+type queryRange struct {
+	After  string `json:"after,omitempty"`
+	Before string `json:"before,omitempty"`
+}
+
+// compile turns the node into a predicate, validating dates up front.
+// Bookmarks passed to the predicate need their Category name filled in.
+func (n queryNode) compile() (func(Bookmark) bool, error) {
+	var preds []func(Bookmark) bool
+
+	if n.Category != "" {
+		preds = append(preds, func(bm Bookmark) bool {
+			return bm.CategoryID == n.Category || strings.EqualFold(bm.Category, n.Category)
+		})
+	}
+	if n.Tag != "" {
+		tag := strings.ToLower(strings.TrimSpace(n.Tag))
+		preds = append(preds, func(bm Bookmark) bool { return slices.Contains(bm.Tags, tag) })
+	}
+	if n.Domain != "" {
+		preds = append(preds, func(bm Bookmark) bool { return hostMatches(bm.URL, n.Domain) })
+	}
+	if n.Text != "" {
+		q := parseSearchQuery(n.Text)
+		preds = append(preds, func(bm Bookmark) bool { return q.matchesFilters(bm) && scoreBookmark(bm, q.terms) > 0 })
+	}
+	if n.HasNotes != nil {
+		want := *n.HasNotes
+		preds = append(preds, func(bm Bookmark) bool { return (bm.Notes != "") == want })
+	}
+	if n.Added != nil {
+		in, err := n.Added.compile("added")
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, func(bm Bookmark) bool { return in(bm.Timestamp) })
+	}
+	if n.Visited != nil {
+		in, err := n.Visited.compile("visited")
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, func(bm Bookmark) bool { return bm.LastVisited != nil && in(*bm.LastVisited) })
+	}
+
+	for _, child := range n.And {
+		pred, err := child.compile()
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, pred)
+	}
+	if len(n.Or) > 0 {
+		var alts []func(Bookmark) bool
+		for _, child := range n.Or {
+			pred, err := child.compile()
+			if err != nil {
+				return nil, err
+			}
+			alts = append(alts, pred)
+		}
+		preds = append(preds, func(bm Bookmark) bool {
+			return slices.ContainsFunc(alts, func(pred func(Bookmark) bool) bool { return pred(bm) })
+		})
+	}
+	if n.Not != nil {
+		pred, err := n.Not.compile()
+		if err != nil {
+			return nil, err
+		}
+		preds = append(preds, func(bm Bookmark) bool { return !pred(bm) })
+	}
+
+	return func(bm Bookmark) bool {
+		for _, pred := range preds {
+			if !pred(bm) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func (qr queryRange) compile(name string) (func(int64) bool, error) {
+	var after, before int64
+	var ok bool
+	if qr.After != "" {
+		if after, ok = parseSince(qr.After); !ok {
+			return nil, fmt.Errorf("Invalid %s.after", name)
+		}
+	}
+	if qr.Before != "" {
+		if before, ok = parseSince(qr.Before); !ok {
+			return nil, fmt.Errorf("Invalid %s.before", name)
+		}
+	}
+	return func(t int64) bool {
+		return (qr.After == "" || t >= after) && (qr.Before == "" || t < before)
+	}, nil
+}
+
+// queryBookmarks lists the bookmarks matching a JSON filter tree, for
+// filters that don't fit GET /api/bookmarks' query parameters. Results are
+// sorted, paginated and reduced with ?fields= like the plain listing.
+func queryBookmarks(w http.ResponseWriter, r *http.Request, s *Store) {
+	var payload bookmarkQuery
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	if payload.Limit < 0 || payload.Offset < 0 {
+		http.Error(w, "Invalid limit or offset", http.StatusBadRequest)
+		return
+	}
+	if !validSort(payload.Sort, payload.Dir) {
+		http.Error(w, "Invalid sort or dir", http.StatusBadRequest)
+		return
+	}
+
+	match, err := payload.Filter.compile()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.RLock()
+	list := []Bookmark{}
+	for _, bm := range s.bookmarks {
+		bm.Category = s.getCategoryName(bm.CategoryID)
+		if match(bm) {
+			list = append(list, bm)
+		}
+	}
+	s.mu.RUnlock()
+
+	// Sort by ID first so that pages are stable across equal sort keys.
+	slices.SortFunc(list, func(a, b Bookmark) int { return strings.Compare(a.ID, b.ID) })
+	sortBy := payload.Sort
+	if sortBy == "" {
+		sortBy = "added"
+	}
+	sortBookmarks(list, sortBy, payload.Dir)
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(list)))
+	encodeList(w, r, paginate(list, payload.Limit, payload.Offset))
+}
+
+func validSort(by, dir string) bool {
+	switch by {
+	case "", "title", "added", "last_visited", "visits":
+	default:
+		return false
+	}
+	return dir == "" || dir == "asc" || dir == "desc"
+}
+
+// sortBookmarks orders list by title, added, last_visited or visits. Without
+// an explicit dir, titles sort ascending and everything else descending, so
+// the newest or most used bookmarks come first.
+func sortBookmarks(list []Bookmark, by, dir string) {
+	desc := dir == "desc" || (dir == "" && by != "title")
+
+	key := func(bm Bookmark) int64 {
+		switch by {
+		case "added":
+			return bm.Timestamp
+		case "last_visited":
+			if bm.LastVisited != nil {
+				return *bm.LastVisited
+			}
+			return 0
+		case "visits":
+			return int64(bm.VisitCount)
+		}
+		return 0
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+		if desc {
+			a, b = b, a
+		}
+		if by == "title" {
+			return strings.ToLower(a.Title) < strings.ToLower(b.Title)
+		}
+		return key(a) < key(b)
+	})
+}
+
+// parsePagination reads the optional ?limit= and ?offset= parameters.
+// A limit of 0 means no limit.
+func parsePagination(r *http.Request) (limit, offset int, err error) {
+	if v := r.URL.Query().Get("limit"); v != "" {
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 0 {
+			return 0, 0, fmt.Errorf("Invalid limit")
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		offset, err = strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("Invalid offset")
+		}
+	}
+	return limit, offset, nil
+}
+
+func paginate[T any](list []T, limit, offset int) []T {
+	if offset >= len(list) {
+		return []T{}
+	}
+	list = list[offset:]
+	if limit > 0 && limit < len(list) {
+		list = list[:limit]
+	}
+	return list
+}
+
+// encodeList writes a JSON array, reduced to the comma-separated JSON keys
+// in the fields query parameter (e.g. fields=id,url,title) when given.
+// Unknown field names are ignored.
+func encodeList(w http.ResponseWriter, r *http.Request, list any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	fields := strings.FieldsFunc(r.URL.Query().Get("fields"), func(c rune) bool { return c == ',' || c == ' ' })
+	if len(fields) == 0 {
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	data, err := json.Marshal(list)
+	if err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	var items []map[string]json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		http.Error(w, "Failed to encode response", http.StatusInternalServerError)
+		return
+	}
+	for i, item := range items {
+		selected := make(map[string]json.RawMessage, len(fields))
+		for _, f := range fields {
+			if v, ok := item[f]; ok {
+				selected[f] = v
+			}
+		}
+		items[i] = selected
+	}
+	if items == nil {
+		items = []map[string]json.RawMessage{}
+	}
+	json.NewEncoder(w).Encode(items)
+}
+
+// cleanMeta trims keys and values and drops entries with an empty key.
+func cleanMeta(meta map[string]string) map[string]string {
+	if len(meta) == 0 {
+		return nil
+	}
+	result := make(map[string]string, len(meta))
+	for k, v := range meta {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+		result[k] = strings.TrimSpace(v)
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+func deleteBookmark(w http.ResponseWriter, id string, s *Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.removeBookmark(id) {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	s.saveDatabase()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func visitBookmark(w http.ResponseWriter, id string, s *Store) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bm, exists := s.bookmarks[id]
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	now := time.Now().Unix()
+	bm.LastVisited = &now
+	bm.VisitCount++
+	bm.Changed = false
+	bm.ChangedAt = nil
+	s.putBookmark(bm)
+	s.saveDatabase()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// refreshBookmarkMetadata fetches the page again and replaces the bookmark's
+// Open Graph description, image and canonical URL.
+func refreshBookmarkMetadata(w http.ResponseWriter, r *http.Request, id string, s *Store) {
+	s.mu.RLock()
+	bm, exists := s.bookmarks[id]
+	s.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	info := fetchPageInfo(bm.URL)
+	if !info.Loaded {
+		slog.WarnContext(r.Context(), "Could not fetch page metadata", "url", bm.URL)
+		http.Error(w, "Could not load the page", http.StatusBadGateway)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// the bookmark may have changed or gone while the page loaded
+	bm, exists = s.bookmarks[id]
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+	bm.Description = info.Description
+	bm.Image = info.Image
+	bm.CanonicalURL = info.Canonical
+	s.putBookmark(bm)
+	s.saveDatabase()
+
+	bm = s.bookmarks[id]
+	bm.Category = s.getCategoryName(bm.CategoryID)
+	writeJSON(w, http.StatusOK, bm)
+}
+
+// bookmarkUpdateRequest is a partial update; nil fields are left unchanged.
+type bookmarkUpdateRequest struct {
+	Title      *string `json:"title"`
+	URL        *string `json:"url"`
+	Category   *string `json:"category"`
+	CategoryID *string `json:"category_id"`
+	Order      *int    `json:"order"`
+	Notes      *string `json:"notes"`
+	Private    *bool   `json:"private"`
+	Watched       *bool   `json:"watched"`
+	WatchInterval *int    `json:"watch_interval"`
+	Changed       *bool   `json:"changed"`
+	TrackTime      *bool   `json:"track_time"`
+	DailyTimeLimit *int   `json:"daily_time_limit"`
+	Favicon        *string `json:"favicon"`
+	Meta           *map[string]string `json:"meta"`
+	Tags           *[]string          `json:"tags"`
+}
+
+// getBookmarkJSON returns one bookmark with its revision as ETag, for use
+// with If-Match on PATCH.
+func getBookmarkJSON(w http.ResponseWriter, id string, s *Store) {
+	s.mu.RLock()
+	bm, exists := s.bookmarks[id]
+	bm.Category = s.getCategoryName(bm.CategoryID)
+	s.mu.RUnlock()
+
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("ETag", revETag(bm.Rev))
+	writeJSON(w, http.StatusOK, bm)
+}
+
+func updateBookmark(w http.ResponseWriter, r *http.Request, id string, s *Store) {
+	var payload bookmarkUpdateRequest
+
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bm, exists := s.bookmarks[id]
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	if !ifMatch(r, bm.Rev) {
+		http.Error(w, "Bookmark was changed by someone else", http.StatusPreconditionFailed)
+		return
+	}
+
+	if payload.Title != nil {
+		bm.Title = *payload.Title
+	}
+
+	if payload.URL != nil {
+		if !validBookmarkURL(*payload.URL) {
+			http.Error(w, invalidURLMessage(), http.StatusUnprocessableEntity)
+			return
+		}
+		bm.URL = canonicalURL(*payload.URL)
+	}
+
+	if payload.Notes != nil {
+		notes := *payload.Notes
+		if len(notes) > 1000 {
+			notes = notes[:1000]
+		}
+		bm.Notes = notes
+	}
+
+	if payload.Private != nil {
+		bm.Private = *payload.Private
+	}
+
+	if payload.Watched != nil {
+		bm.Watched = *payload.Watched
+		if *payload.Watched && bm.ContentHash == "" {
+			go fetchAndStoreInitialHash(id, s)
+		}
+	}
+
+	if payload.WatchInterval != nil {
+		interval := *payload.WatchInterval
+		if interval < 30 {
+			interval = 30
+		}
+		bm.WatchInterval = interval
+	}
+
+	if payload.Changed != nil {
+		bm.Changed = *payload.Changed
+		if !*payload.Changed {
+			bm.ChangedAt = nil
+		}
+	}
+
+	if payload.TrackTime != nil {
+		bm.TrackTime = *payload.TrackTime
+	}
+
+	if payload.DailyTimeLimit != nil {
+		bm.DailyTimeLimit = *payload.DailyTimeLimit
+	}
+
+	if payload.Favicon != nil && *payload.Favicon != "" {
+		bm.Favicon = *payload.Favicon
+	}
+
+	if payload.Meta != nil {
+		bm.Meta = cleanMeta(*payload.Meta)
+	}
+
+	if payload.Tags != nil {
+		bm.Tags = cleanTags(*payload.Tags)
+	}
+
+	newCategoryID := bm.CategoryID
+	if payload.CategoryID != nil {
+		newCategoryID = *payload.CategoryID
+	} else if payload.Category != nil {
+		newCategoryID = s.resolveOrCreateCategory(*payload.Category)
+	}
+
+	if payload.CategoryID != nil || payload.Category != nil || payload.Order != nil {
+		oldCategoryID := bm.CategoryID
+		oldOrder := bm.Order
+		newOrder := oldOrder
+		if payload.Order != nil {
+			newOrder = *payload.Order
+		}
+
+		if oldCategoryID == newCategoryID {
+			s.shiftOrdersInCategory(oldCategoryID, oldOrder, newOrder, id)
+		} else {
+			s.shiftOrdersAfter(oldCategoryID, oldOrder, -1, id)
+			s.shiftOrdersFrom(newCategoryID, newOrder, 1, id)
+		}
+
+		bm.CategoryID = newCategoryID
+		bm.Order = newOrder
+	}
+
+	s.putBookmark(bm)
+	s.saveDatabase()
+
+	w.Header().Set("ETag", revETag(s.bookmarks[id].Rev))
+	w.WriteHeader(http.StatusOK)
+}
+
+// bookmarkBulkUpdate is the body of PATCH /api/bookmarks. Unset fields are
+// left alone; tags are added or removed rather than replaced, and meta keys
+// are merged, with an empty value deleting the key.
+type bookmarkBulkUpdate struct {
+	Category   *string           `json:"category"`
+	CategoryID *string           `json:"category_id"`
+	AddTags    []string          `json:"add_tags"`
+	RemoveTags []string          `json:"remove_tags"`
+	Meta       map[string]string `json:"meta"`
+	Private    *bool             `json:"private"`
+}
+
+// bulkUpdateBookmarks applies one change to every bookmark matching the
+// listing filters (q, category_id, domain, ...), e.g. moving everything
+// from domain=github.com into a category. Without a filter it refuses to
+// run unless all=true is given.
+func bulkUpdateBookmarks(w http.ResponseWriter, r *http.Request, s *Store) {
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+
+	filter, err := parseBookmarkFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query == "" && filter == (bookmarkFilter{}) && r.URL.Query().Get("all") != "true" {
+		http.Error(w, "A filter or all=true is required", http.StatusBadRequest)
+		return
+	}
+
+	var payload bookmarkBulkUpdate
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	removeTags := cleanTags(payload.RemoveTags)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if payload.CategoryID != nil {
+		if _, ok := s.categories[*payload.CategoryID]; !ok && *payload.CategoryID != uncategorizedID {
+			http.Error(w, "Category not found", http.StatusBadRequest)
+			return
+		}
+	}
+
+	matches := s.searchCandidates(query)
+	matches = slices.DeleteFunc(matches, func(bm Bookmark) bool { return !filter.matches(bm) })
+	if query != "" {
+		matches = searchBookmarks(matches, query)
+	}
+
+	newCategoryID := ""
+	if payload.CategoryID != nil {
+		newCategoryID = *payload.CategoryID
+	} else if payload.Category != nil && len(matches) > 0 {
+		newCategoryID = s.resolveOrCreateCategory(*payload.Category)
+	}
+
+	// Moved bookmarks keep their relative order and go to the end of the
+	// target category; the categories they leave are renumbered afterwards.
+	if newCategoryID != "" {
+		slices.SortStableFunc(matches, func(a, b Bookmark) int {
+			return cmp.Or(strings.Compare(a.CategoryID, b.CategoryID), cmp.Compare(a.Order, b.Order))
+		})
+	}
+	nextOrder := s.maxOrderInCategory(newCategoryID) + 1
+	left := map[string]bool{}
+
+	for _, bm := range matches {
+		if newCategoryID != "" && bm.CategoryID != newCategoryID {
+			left[bm.CategoryID] = true
+			bm.CategoryID = newCategoryID
+			bm.Order = nextOrder
+			nextOrder++
+		}
+		if len(payload.AddTags) > 0 {
+			bm.Tags = cleanTags(append(slices.Clone(bm.Tags), payload.AddTags...))
+		}
+		if len(removeTags) > 0 {
+			bm.Tags = slices.DeleteFunc(slices.Clone(bm.Tags), func(t string) bool { return slices.Contains(removeTags, t) })
+			if len(bm.Tags) == 0 {
+				bm.Tags = nil
+			}
+		}
+		if len(payload.Meta) > 0 {
+			meta := maps.Clone(bm.Meta)
+			if meta == nil {
+				meta = map[string]string{}
+			}
+			for k, v := range payload.Meta {
+				if v == "" {
+					delete(meta, strings.TrimSpace(k))
+				} else {
+					meta[k] = v
+				}
+			}
+			bm.Meta = cleanMeta(meta)
+		}
+		if payload.Private != nil {
+			bm.Private = *payload.Private
+		}
+		s.putBookmark(bm)
+	}
+
+	for categoryID := range left {
+		s.renumberCategory(categoryID)
+	}
+
+	if len(matches) > 0 {
+		s.saveDatabase()
+	}
+
+	writeJSON(w, http.StatusOK, map[string]int{"affected": len(matches)})
+}
+
+// renumberCategory closes gaps in the order of a category's bookmarks.
+// Must be called with s.mu held.
+func (s *Store) renumberCategory(categoryID string) {
+	var list []Bookmark
+	for _, bm := range s.bookmarks {
+		if bm.CategoryID == categoryID {
+			list = append(list, bm)
+		}
+	}
+	slices.SortFunc(list, func(a, b Bookmark) int { return cmp.Compare(a.Order, b.Order) })
+	for i, bm := range list {
+		if bm.Order != i {
+			bm.Order = i
+			s.putBookmark(bm)
+		}
+	}
+}
+
+func (s *Store) maxOrderInCategory(categoryID string) int {
+	maxOrder := -1
+	for _, bm := range s.bookmarks {
+		if bm.CategoryID == categoryID && bm.Order > maxOrder {
+			maxOrder = bm.Order
+		}
+	}
+	return maxOrder
+}
+
+func (s *Store) shiftOrdersInCategory(categoryID string, oldOrder, newOrder int, excludeID string) {
+	if oldOrder == newOrder {
+		return
+	}
+	for id, bm := range s.bookmarks {
+		if bm.CategoryID != categoryID || id == excludeID {
+			continue
+		}
+		if oldOrder < newOrder {
+			if bm.Order > oldOrder && bm.Order <= newOrder {
+				bm.Order--
+				s.putBookmark(bm)
+			}
+		} else {
+			if bm.Order >= newOrder && bm.Order < oldOrder {
+				bm.Order++
+				s.putBookmark(bm)
+			}
+		}
+	}
+}
+
+func (s *Store) shiftOrdersAfter(categoryID string, threshold, delta int, excludeID string) {
+	for id, bm := range s.bookmarks {
+		if bm.CategoryID != categoryID || id == excludeID {
+			continue
+		}
+		if bm.Order > threshold {
+			bm.Order += delta
+			s.putBookmark(bm)
+		}
+	}
+}
+
+func (s *Store) shiftOrdersFrom(categoryID string, threshold, delta int, excludeID string) {
+	for id, bm := range s.bookmarks {
+		if bm.CategoryID != categoryID || id == excludeID {
+			continue
+		}
+		if bm.Order >= threshold {
+			bm.Order += delta
+			s.putBookmark(bm)
+		}
+	}
+}
+
+// cleanTags lowercases and trims tags, dropping empty and duplicate ones.
+func cleanTags(tags []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		result = append(result, t)
+	}
+	return result
+}
+
+type tagUsage struct {
+	Tag      string `json:"tag"`
+	Count    int    `json:"count"`
+	LastUsed int64  `json:"last_used"`
+}
+
+// handleTagCloud returns every tag with its usage count and the timestamp of
+// the newest bookmark carrying it, most used first.
+func handleTagCloud(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usage := make(map[string]*tagUsage)
+	s.mu.RLock()
+	for _, bm := range s.bookmarks {
+		for _, tag := range bm.Tags {
+			u := usage[tag]
+			if u == nil {
+				u = &tagUsage{Tag: tag}
+				usage[tag] = u
+			}
+			u.Count++
+			u.LastUsed = max(u.LastUsed, bm.Timestamp)
+		}
+	}
+	s.mu.RUnlock()
+
+	result := make([]tagUsage, 0, len(usage))
+	for _, u := range usage {
+		result = append(result, *u)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].Tag < result[j].Tag
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// --- Search ---
+
+type scoredBookmark struct {
+	bm    Bookmark
+	score int
+}
+
+// searchQuery is a parsed search string. Free text ends up in terms, while
+// recognized operators become filters:
+//
+//	tag:go  category:Work  site:example.com  before:2023-01  after:2022
+//	is:unread  is:read  is:watched  is:changed
+//
+// Values may be quoted (category:"Reading List"). before: matches bookmarks
+// added before the start of the given year, month or day; after: matches
+// bookmarks added from its start on. Unknown operators are searched as text.
+type searchQuery struct {
+	terms      []string
+	tags       []string
+	categories []string
+	sites      []string
+	is         []string
+	before     int64
+	after      int64
+}
+
+func parseSearchQuery(query string) searchQuery {
+	var q searchQuery
+	for _, token := range tokenizeQuery(query) {
+		key, value, found := strings.Cut(token, ":")
+		if !found || value == "" {
+			q.terms = append(q.terms, strings.ToLower(token))
+			continue
+		}
+
+		value = strings.Trim(value, `"`)
+		switch strings.ToLower(key) {
+		case "tag":
+			q.tags = append(q.tags, strings.ToLower(value))
+		case "category":
+			q.categories = append(q.categories, strings.ToLower(value))
+		case "site":
+			q.sites = append(q.sites, strings.TrimPrefix(strings.ToLower(value), "www."))
+		case "is":
+			q.is = append(q.is, strings.ToLower(value))
+		case "before", "after":
+			t, ok := parseQueryDate(value)
+			if !ok {
+				q.terms = append(q.terms, strings.ToLower(token))
+				continue
+			}
+			if strings.ToLower(key) == "before" {
+				q.before = t.Unix()
+			} else {
+				q.after = t.Unix()
+			}
+		default:
+			q.terms = append(q.terms, strings.ToLower(token))
+		}
+	}
+	return q
+}
+
+// tokenizeQuery splits on whitespace, keeping double-quoted sections intact.
+func tokenizeQuery(query string) []string {
+	var tokens []string
+	var current strings.Builder
+	inQuotes := false
+	for _, r := range query {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !inQuotes:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	for i, t := range tokens {
+		if !strings.Contains(t, ":") {
+			tokens[i] = strings.Trim(t, `"`)
+		}
+	}
+	return tokens
+}
+
+// hostMatches reports whether rawURL's host is domain or one of its
+// subdomains, ignoring a leading "www.".
+func hostMatches(rawURL, domain string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	domain = strings.TrimPrefix(strings.ToLower(domain), "www.")
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func parseQueryDate(value string) (time.Time, bool) {
+	for _, layout := range []string{"2006-01-02", "2006-01", "2006"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// matchesFilters reports whether bm satisfies every operator of q.
+func (q searchQuery) matchesFilters(bm Bookmark) bool {
+	for _, tag := range q.tags {
+		if !slices.Contains(bm.Tags, tag) {
+			return false
+		}
+	}
+	for _, cat := range q.categories {
+		if strings.ToLower(bm.Category) != cat {
+			return false
+		}
+	}
+	for _, site := range q.sites {
+		if !hostMatches(bm.URL, site) {
+			return false
+		}
+	}
+	for _, is := range q.is {
+		switch is {
+		case "unread":
+			if bm.LastVisited != nil {
+				return false
+			}
+		case "read":
+			if bm.LastVisited == nil {
+				return false
+			}
+		case "watched":
+			if !bm.Watched {
+				return false
+			}
+		case "changed":
+			if !bm.Changed {
+				return false
+			}
+		}
+	}
+	if q.before != 0 && bm.Timestamp >= q.before {
+		return false
+	}
+	if q.after != 0 && bm.Timestamp < q.after {
+		return false
+	}
+	return true
+}
+
+// searchBookmarks returns the bookmarks matching query, best match first.
+// Bookmarks with equal scores keep their original order.
+func searchBookmarks(list []Bookmark, query string) []Bookmark {
+	q := parseSearchQuery(query)
+
+	var scored []scoredBookmark
+	for _, bm := range list {
+		if !q.matchesFilters(bm) {
+			continue
+		}
+		if score := scoreBookmark(bm, q.terms); score > 0 {
+			scored = append(scored, scoredBookmark{bm: bm, score: score})
+		}
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		return scored[i].score > scored[j].score
+	})
+
+	result := make([]Bookmark, len(scored))
+	for i, sb := range scored {
+		result[i] = sb.bm
+	}
+	return result
+}
+
+// scoreBookmark rates how well a bookmark matches all terms. Every term has
+// to match some field, either as a substring or fuzzily; hits in the title
+// weigh more than hits in the URL, which weigh more than the rest.
+// Returns 0 if any term does not match, and 1 if there are no terms.
+func scoreBookmark(bm Bookmark, terms []string) int {
+	if len(terms) == 0 {
+		return 1
+	}
+
+	type field struct {
+		text   string
+		weight int
+	}
+	fields := []field{
+		{strings.ToLower(bm.Title), 3},
+		{strings.ToLower(bm.URL), 2},
+		{strings.Join(bm.Tags, " "), 2},
+		{strings.ToLower(bm.Category), 1},
+		{strings.ToLower(bm.Notes), 1},
+	}
+	for k, v := range bm.Meta {
+		fields = append(fields, field{strings.ToLower(k + " " + v), 1})
+	}
+
+	total := 0
+	for _, term := range terms {
+		best := 0
+		for _, f := range fields {
+			if score := f.weight * termScore(f.text, term); score > best {
+				best = score
+			}
+		}
+		if best == 0 {
+			return 0
+		}
+		total += best
+	}
+	return total
+}
+
+// termScore returns 3 if term occurs in text, 1 if some word of text is
+// within a small edit distance of term (so "githb" finds "github"), else 0.
+func termScore(text, term string) int {
+	if strings.Contains(text, term) {
+		return 3
+	}
+
+	maxDist := maxTypos(term)
+	if maxDist == 0 {
+		return 0
+	}
+	for _, word := range tokenize(text) {
+		if fuzzyMatch(word, term, maxDist) {
+			return 1
+		}
+	}
+	return 0
+}
+
+// maxTypos returns how many edits a word may be away from term and still
+// match it; 0 for terms too short to match fuzzily.
+func maxTypos(term string) int {
+	switch {
+	case len(term) <= 3:
+		return 0
+	case len(term) <= 6:
+		return 1
+	}
+	return 2
+}
+
+// fuzzyMatch reports whether word is within maxDist edits of term.
+func fuzzyMatch(word, term string, maxDist int) bool {
+	if levenshtein(word, term) <= maxDist {
+		return true
+	}
+	// also accept typos in a word that is still being typed
+	wr := []rune(word)
+	return len(wr) > len(term) && levenshtein(string(wr[:len(term)]), term) <= maxDist
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev := make([]int, len(rb)+1)
+	curr := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(rb)]
+}
+
+// --- Search Index ---
+
+// searchIndex is an inverted index from lowercase word tokens to the IDs of
+// the bookmarks containing them. It narrows down the bookmarks a search has
+// to score, so queries don't have to scan every record. A second index from
+// the n-grams of each token to the tokens lets lookups find the tokens a
+// term matches without scanning the vocabulary either. It is guarded by the
+// owning store's mutex.
+type searchIndex struct {
+	tokens map[string]map[string]struct{}
+	docs   map[string][]string
+	grams  map[string]map[string]struct{}
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		tokens: make(map[string]map[string]struct{}),
+		docs:   make(map[string][]string),
+		grams:  make(map[string]map[string]struct{}),
+	}
+}
+
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// add (re)indexes a bookmark under the given tokens.
+func (ix *searchIndex) add(id string, tokens []string) {
+	ix.remove(id)
+	seen := make(map[string]bool, len(tokens))
+	for _, t := range tokens {
+		if seen[t] {
+			continue
+		}
+		seen[t] = true
+		if ix.tokens[t] == nil {
+			ix.tokens[t] = make(map[string]struct{})
+			for _, g := range tokenGrams(t) {
+				if ix.grams[g] == nil {
+					ix.grams[g] = make(map[string]struct{})
+				}
+				ix.grams[g][t] = struct{}{}
+			}
+		}
+		ix.tokens[t][id] = struct{}{}
+		ix.docs[id] = append(ix.docs[id], t)
+	}
+}
+
+func (ix *searchIndex) remove(id string) {
+	for _, t := range ix.docs[id] {
+		delete(ix.tokens[t], id)
+		if len(ix.tokens[t]) == 0 {
+			delete(ix.tokens, t)
+			for _, g := range tokenGrams(t) {
+				delete(ix.grams[g], t)
+				if len(ix.grams[g]) == 0 {
+					delete(ix.grams, g)
+				}
+			}
+		}
+	}
+	delete(ix.docs, id)
+}
+
+// lookup returns the IDs of bookmarks that may match every term. ok is false
+// if some term can't be answered from the index (it contains characters
+// that tokenizing would split on), in which case callers must scan.
+func (ix *searchIndex) lookup(terms []string) (ids map[string]struct{}, ok bool) {
+	for _, term := range terms {
+		if len(tokenize(term)) != 1 || tokenize(term)[0] != term {
+			return nil, false
+		}
+
+		matched := make(map[string]struct{})
+		for token := range ix.matchingTokens(term) {
+			for id := range ix.tokens[token] {
+				if ids == nil {
+					matched[id] = struct{}{}
+				} else if _, prev := ids[id]; prev {
+					matched[id] = struct{}{}
+				}
+			}
+		}
+		ids = matched
+		if len(ids) == 0 {
+			break
+		}
+	}
+	return ids, true
+}
+
+// matchingTokens returns the indexed tokens termScore would match term in:
+// those containing it, found through its n-grams, and those within a few
+// typos of it, among the tokens sharing enough start-padded trigrams.
+func (ix *searchIndex) matchingTokens(term string) map[string]struct{} {
+	r := []rune(term)
+	matched := make(map[string]struct{})
+	if len(r) <= 3 {
+		maps.Copy(matched, ix.grams[term])
+	} else {
+		// check the tokens with the rarest of term's trigrams
+		rarest := ix.grams[string(r[:3])]
+		for i := 1; i+3 <= len(r); i++ {
+			if tokens := ix.grams[string(r[i:i+3])]; len(tokens) < len(rarest) {
+				rarest = tokens
+			}
+		}
+		for token := range rarest {
+			if strings.Contains(token, term) {
+				matched[token] = struct{}{}
+			}
+		}
+	}
+
+	maxDist := maxTypos(term)
+	if maxDist == 0 {
+		return matched
+	}
+	// Each edit changes at most three of the trigrams, so a token within
+	// maxDist edits of term, or with a prefix that is, shares the rest.
+	grams := slices.Compact(slices.Sorted(slices.Values(paddedTrigrams(r))))
+	candidates := ix.tokens
+	if need := len(grams) - 3*maxDist; need > 0 {
+		shared := make(map[string]int)
+		for _, g := range grams {
+			for token := range ix.grams[g] {
+				shared[token]++
+			}
+		}
+		candidates = make(map[string]map[string]struct{})
+		for token, n := range shared {
+			if n >= need {
+				candidates[token] = nil
+			}
+		}
+	}
+	for token := range candidates {
+		if _, ok := matched[token]; !ok && fuzzyMatch(token, term, maxDist) {
+			matched[token] = struct{}{}
+		}
+	}
+	return matched
+}
+
+// tokenGrams returns the keys a token is found under in searchIndex.grams:
+// its substrings of one to three runes and its start-padded trigrams.
+func tokenGrams(token string) []string {
+	r := []rune(token)
+	grams := paddedTrigrams(r)
+	for i := range r {
+		for n := 1; n <= 3 && i+n <= len(r); n++ {
+			grams = append(grams, string(r[i:i+n]))
+		}
+	}
+	return slices.Compact(slices.Sorted(slices.Values(grams)))
+}
+
+// paddedTrigrams returns the trigrams of r preceded by two NUL runes, which
+// tokens never contain. Unlike plain trigrams, words of any length have
+// some, and a word has all of those of its prefixes.
+func paddedTrigrams(r []rune) []string {
+	padded := append([]rune{0, 0}, r...)
+	grams := make([]string, 0, len(r))
+	for i := 0; i+3 <= len(padded); i++ {
+		grams = append(grams, string(padded[i:i+3]))
+	}
+	return grams
+}
+
+// bookmarkTokens returns the tokens a bookmark is indexed under: the same
+// fields scoreBookmark looks at. Must be called with s.mu held.
+func (s *Store) bookmarkTokens(bm Bookmark) []string {
+	parts := []string{bm.Title, bm.URL, bm.Notes, s.getCategoryName(bm.CategoryID), strings.Join(bm.Tags, " ")}
+	for k, v := range bm.Meta {
+		parts = append(parts, k, v)
+	}
+	return tokenize(strings.Join(parts, " "))
+}
+
+// rebuildIndex indexes every bookmark from scratch. Must be called with s.mu
+// held for writing.
+func (s *Store) rebuildIndex() {
+	s.index = newSearchIndex()
+	for id, bm := range s.bookmarks {
+		s.index.add(id, s.bookmarkTokens(bm))
+	}
+}
+
+// reindexCategory refreshes the bookmarks of a renamed category. Must be
+// called with s.mu held for writing.
+func (s *Store) reindexCategory(categoryID string) {
+	for id, bm := range s.bookmarks {
+		if bm.CategoryID == categoryID {
+			s.index.add(id, s.bookmarkTokens(bm))
+		}
+	}
+}
+
+// searchCandidates returns the bookmarks, in position order, that may match
+// the free-text terms of query; all bookmarks if there are none or the index
+// can't answer the query. Must be called with s.mu held.
+func (s *Store) searchCandidates(query string) []Bookmark {
+	terms := parseSearchQuery(query).terms
+	if len(terms) == 0 {
+		return s.bookmarksToSortedSlice()
+	}
+
+	ids, ok := s.index.lookup(terms)
+	if !ok {
+		return s.bookmarksToSortedSlice()
+	}
+
+	result := make([]Bookmark, 0, len(ids))
+	for id := range ids {
+		result = append(result, s.bookmarks[id])
+	}
+	s.sortByPosition(result)
+	return result
+}
+
+// --- Import ---
+
+// importItem is a bookmark parsed from an external format, before it is
+// assigned an ID, category and position.
+type importItem struct {
+	URL       string
+	Title     string
+	Category  string
+	Notes     string
+	Favicon   string
+	Tags      []string
+	Meta      map[string]string
+	Timestamp int64
+
+	VisitCount  int
+	LastVisited int64
+}
+
+type importResult struct {
+	Imported          int              `json:"imported"`
+	Updated           int              `json:"updated"`
+	Skipped           int              `json:"skipped"`
+	CategoriesCreated int              `json:"categories_created"`
+	Errors            []importRowError `json:"errors,omitempty"`
+	Conflicts         []importConflict `json:"conflicts,omitempty"`
+	DryRun            bool             `json:"dry_run,omitempty"`
+	Bookmarks         []Bookmark       `json:"bookmarks,omitempty"`
+}
+
+// importConflict reports what happened to an imported URL that was already
+// bookmarked.
+type importConflict struct {
+	URL    string `json:"url"`
+	ID     string `json:"id"`
+	Action string `json:"action"` // skipped, overwritten, merged or kept_both
+}
+
+// Import strategies for URLs that are already bookmarked.
+const (
+	importSkip      = "skip"      // leave the existing bookmark alone
+	importOverwrite = "overwrite" // replace it with the imported fields
+	importMerge     = "merge"     // fill in empty fields, add tags and meta
+	importKeepBoth  = "keep-both" // add the import as a second bookmark
+)
+
+func validImportStrategy(strategy string) bool {
+	switch strategy {
+	case importSkip, importOverwrite, importMerge, importKeepBoth:
+		return true
+	}
+	return false
+}
+
+// importRowError reports an input row that could not be imported.
+type importRowError struct {
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// importItems adds items to the store under a single lock and save.
+// Bookmarks whose URL already exists are handled according to strategy.
+// With dryRun the import is carried out on a copy of the store and the
+// bookmarks that would have been created or changed are returned instead.
+func importItems(s *Store, items []importItem, strategy string, dryRun bool) importResult {
+	var result importResult
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	target := s
+	if dryRun {
+		target = &Store{
+			Name:       s.Name,
+			categories: maps.Clone(s.categories),
+			bookmarks:  maps.Clone(s.bookmarks),
+			index:      newSearchIndex(),
+			seq:        s.seq,
+			silent:     true,
+		}
+		result.DryRun = true
+	}
+
+	categoriesBefore := len(target.categories)
+	now := time.Now().Unix()
+	for _, item := range items {
+		if !validBookmarkURL(item.URL) {
+			result.Skipped++
+			continue
+		}
+		item.URL = canonicalURL(item.URL)
+
+		id := uuid.NewSHA1(uuid.NameSpaceURL, []byte(item.URL)).String()
+		if existing, exists := target.bookmarks[id]; exists {
+			conflict := importConflict{URL: item.URL, ID: id}
+			switch strategy {
+			case importOverwrite, importMerge:
+				var bm Bookmark
+				if strategy == importOverwrite {
+					bm, conflict.Action = target.overwriteFromImport(existing, item), "overwritten"
+				} else {
+					bm, conflict.Action = target.mergeFromImport(existing, item), "merged"
+				}
+				target.putBookmark(bm)
+				result.Updated++
+				if dryRun {
+					bm.Category = target.getCategoryName(bm.CategoryID)
+					result.Bookmarks = append(result.Bookmarks, bm)
+				}
+			case importKeepBoth:
+				id = uuid.New().String()
+				conflict.ID, conflict.Action = id, "kept_both"
+			default:
+				conflict.Action = "skipped"
+				result.Skipped++
+			}
+			result.Conflicts = append(result.Conflicts, conflict)
+			if strategy != importKeepBoth {
+				continue
+			}
+		}
+
+		categoryID := target.resolveOrCreateCategory(item.Category)
+		timestamp := item.Timestamp
+		if timestamp <= 0 {
+			timestamp = now
+		}
+
+		bm := Bookmark{
+			ID:         id,
+			URL:        item.URL,
+			Title:      item.Title,
+			CategoryID: categoryID,
+			Timestamp:  timestamp,
+			Favicon:    item.Favicon,
+			Order:      target.maxOrderInCategory(categoryID) + 1,
+			Notes:      item.Notes,
+			Tags:       cleanTags(item.Tags),
+			Meta:       cleanMeta(item.Meta),
+			VisitCount: item.VisitCount,
+		}
+		if item.LastVisited > 0 {
+			lastVisited := item.LastVisited
+			bm.LastVisited = &lastVisited
+		}
+		target.putBookmark(bm)
+		result.Imported++
+
+		if dryRun {
+			bm.Category = target.getCategoryName(categoryID)
+			result.Bookmarks = append(result.Bookmarks, bm)
+		}
+	}
+	result.CategoriesCreated = len(target.categories) - categoriesBefore
+
+	if !dryRun && result.Imported+result.Updated > 0 {
+		s.saveDatabase()
+	}
+	return result
+}
+
+// overwriteFromImport replaces a bookmark's fields with those of an imported
+// item, keeping its ID and visit history unless the item has its own.
+// Callers must hold s.mu.
+func (s *Store) overwriteFromImport(bm Bookmark, item importItem) Bookmark {
+	bm.Title = item.Title
+	bm.Notes = item.Notes
+	bm.Tags = cleanTags(item.Tags)
+	bm.Meta = cleanMeta(item.Meta)
+	if item.Favicon != "" {
+		bm.Favicon = item.Favicon
+	}
+	if item.Timestamp > 0 {
+		bm.Timestamp = item.Timestamp
+	}
+	if item.VisitCount > 0 {
+		bm.VisitCount = item.VisitCount
+	}
+	if item.LastVisited > 0 {
+		lastVisited := item.LastVisited
+		bm.LastVisited = &lastVisited
+	}
+	s.moveForImport(&bm, s.resolveOrCreateCategory(item.Category))
+	return bm
+}
+
+// mergeFromImport fills a bookmark's empty fields from an imported item and
+// adds its tags and missing meta keys. Callers must hold s.mu.
+func (s *Store) mergeFromImport(bm Bookmark, item importItem) Bookmark {
+	if bm.Title == "" || bm.Title == bm.URL {
+		bm.Title = cmp.Or(item.Title, bm.Title)
+	}
+	bm.Notes = cmp.Or(bm.Notes, item.Notes)
+	bm.Favicon = cmp.Or(bm.Favicon, item.Favicon)
+	bm.Tags = cleanTags(append(slices.Clone(bm.Tags), item.Tags...))
+	if meta := cleanMeta(item.Meta); len(meta) > 0 {
+		maps.Copy(meta, bm.Meta)
+		bm.Meta = meta
+	}
+	bm.VisitCount = max(bm.VisitCount, item.VisitCount)
+	if item.LastVisited > 0 && (bm.LastVisited == nil || item.LastVisited > *bm.LastVisited) {
+		lastVisited := item.LastVisited
+		bm.LastVisited = &lastVisited
+	}
+	if bm.CategoryID == uncategorizedID {
+		s.moveForImport(&bm, s.resolveOrCreateCategory(item.Category))
+	}
+	return bm
+}
+
+// moveForImport puts bm at the end of categoryID if it is elsewhere.
+func (s *Store) moveForImport(bm *Bookmark, categoryID string) {
+	if bm.CategoryID == categoryID {
+		return
+	}
+	s.shiftOrdersAfter(bm.CategoryID, bm.Order, -1, bm.ID)
+	bm.CategoryID = categoryID
+	bm.Order = s.maxOrderInCategory(categoryID) + 1
+}
+
+// normalizeImportTimestamp converts timestamps that some exporters write in
+// milliseconds or microseconds to seconds.
+func normalizeImportTimestamp(ts int64) int64 {
+	for ts > 1e11 {
+		ts /= 1000
+	}
+	return ts
+}
+
+var netscapeTokenRe = regexp.MustCompile(`(?is)<h3([^>]*)>(.*?)</h3>|<a\s([^>]*)>(.*?)</a>|<dd>([^<]*)|<dl[^>]*>|</dl>`)
+
+// parseNetscapeHTML parses the bookmark file format exported by Chrome,
+// Firefox and Safari. Each bookmark is filed under its innermost folder;
+// bookmarks directly in the toolbar folder or at the root stay
+// uncategorized.
+func parseNetscapeHTML(data string) []importItem {
+	var items []importItem
+	var stack []string
+	pendingFolder := ""
+	current := func() string {
+		if len(stack) == 0 {
+			return ""
+		}
+		return stack[len(stack)-1]
+	}
+
+	for _, m := range netscapeTokenRe.FindAllStringSubmatchIndex(data, -1) {
+		group := func(n int) string {
+			if m[2*n] < 0 {
+				return ""
+			}
+			return data[m[2*n]:m[2*n+1]]
+		}
+		token := strings.ToLower(data[m[0]:min(m[1], m[0]+4)])
+
+		switch {
+		case m[2] >= 0: // <H3>
+			attrs := parseHTMLAttrs(group(1))
+			if strings.EqualFold(attrs["personal_toolbar_folder"], "true") {
+				pendingFolder = ""
+			} else {
+				pendingFolder = strings.TrimSpace(html.UnescapeString(group(2)))
+			}
+		case m[6] >= 0: // <A>
+			attrs := parseHTMLAttrs(group(3))
+			ts, _ := strconv.ParseInt(attrs["add_date"], 10, 64)
+			item := importItem{
+				URL:       html.UnescapeString(attrs["href"]),
+				Title:     strings.TrimSpace(html.UnescapeString(group(4))),
+				Category:  current(),
+				Timestamp: normalizeImportTimestamp(ts),
+			}
+			if tags := attrs["tags"]; tags != "" {
+				item.Tags = strings.Split(html.UnescapeString(tags), ",")
+			}
+			if icon := attrs["icon_uri"]; strings.HasPrefix(icon, "http") {
+				item.Favicon = icon
+			}
+			items = append(items, item)
+		case m[10] >= 0: // <DD> describes the preceding bookmark
+			if len(items) > 0 {
+				items[len(items)-1].Notes = strings.TrimSpace(html.UnescapeString(group(5)))
+			}
+		case token == "</dl":
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		default: // <DL>
+			folder := pendingFolder
+			if folder == "" {
+				folder = current()
+			}
+			stack = append(stack, folder)
+			pendingFolder = ""
+		}
+	}
+	return items
+}
+
+func parseHTMLAttrs(s string) map[string]string {
+	attrs := map[string]string{}
+	for _, a := range faviconAttrRe.FindAllStringSubmatch(s, -1) {
+		attrs[strings.ToLower(a[1])] = a[2]
+	}
+	return attrs
+}
+
+func importHTML(u importUpload) ([]importItem, []importRowError, error) {
+	return parseNetscapeHTML(string(u.Data)), nil, nil
+}
+
+// csvColumns maps lowercase header names to their column index.
+func csvColumns(header []string) map[string]int {
+	cols := make(map[string]int, len(header))
+	for i, h := range header {
+		cols[strings.ToLower(strings.TrimSpace(strings.TrimPrefix(h, "\ufeff")))] = i
+	}
+	return cols
+}
+
+func csvField(record []string, cols map[string]int, name string) string {
+	if i, ok := cols[name]; ok && i < len(record) {
+		return strings.TrimSpace(record[i])
+	}
+	return ""
+}
+
+// parseRaindropCSV parses Raindrop.io's CSV export
+// (id,title,note,excerpt,url,folder,tags,created,cover,...). Nested
+// collections are written as "Parent/Child"; the innermost one becomes the
+// category. Covers are kept in the "cover" metadata field.
+func parseRaindropCSV(data io.Reader) ([]importItem, error) {
+	reader := csv.NewReader(data)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	cols := csvColumns(header)
+	if _, ok := cols["url"]; !ok {
+		return nil, fmt.Errorf("missing url column")
+	}
+
+	var items []importItem
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		item := importItem{
+			URL:   csvField(record, cols, "url"),
+			Title: csvField(record, cols, "title"),
+			Notes: csvField(record, cols, "note"),
+		}
+		if item.Notes == "" {
+			item.Notes = csvField(record, cols, "excerpt")
+		}
+		if folder := csvField(record, cols, "folder"); folder != "" && folder != "Unsorted" {
+			item.Category = folder[strings.LastIndex(folder, "/")+1:]
+		}
+		if tags := csvField(record, cols, "tags"); tags != "" {
+			item.Tags = strings.Split(tags, ",")
+		}
+		if created, err := time.Parse(time.RFC3339, csvField(record, cols, "created")); err == nil {
+			item.Timestamp = created.Unix()
+		}
+		if cover := csvField(record, cols, "cover"); cover != "" {
+			item.Meta = map[string]string{"cover": cover}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// importRaindrop accepts Raindrop's CSV export or its HTML backup, which is
+// in Netscape format.
+func importRaindrop(u importUpload) ([]importItem, []importRowError, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(u.Data), []byte("<")) {
+		return parseNetscapeHTML(string(u.Data)), nil, nil
+	}
+	items, err := parseRaindropCSV(bytes.NewReader(u.Data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid Raindrop CSV: %v", err)
+	}
+	return items, nil, nil
+}
+
+// shioriBookmark is the bookmark shape of Shiori's JSON API, which is what
+// `GET /api/bookmarks` on a Shiori instance returns.
+type shioriBookmark struct {
+	URL      string `json:"url"`
+	Title    string `json:"title"`
+	Excerpt  string `json:"excerpt"`
+	Author   string `json:"author"`
+	Modified string `json:"modified"`
+	ImageURL string      `json:"imageURL"`
+	Tags     []shioriTag `json:"tags"`
+}
+
+type shioriTag struct {
+	Name string `json:"name"`
+}
+
+func parseShioriTime(value string) int64 {
+	for _, layout := range []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Unix()
+		}
+	}
+	return 0
+}
+
+func (sb shioriBookmark) importItem() importItem {
+	item := importItem{
+		URL:       sb.URL,
+		Title:     sb.Title,
+		Notes:     sb.Excerpt,
+		Timestamp: parseShioriTime(sb.Modified),
+	}
+	for _, t := range sb.Tags {
+		item.Tags = append(item.Tags, t.Name)
+	}
+	meta := map[string]string{}
+	if sb.Author != "" {
+		meta["author"] = sb.Author
+	}
+	if sb.ImageURL != "" {
+		meta["cover"] = sb.ImageURL
+	}
+	if len(meta) > 0 {
+		item.Meta = meta
+	}
+	return item
+}
+
+// parseShioriJSON accepts either a bare array of Shiori bookmarks or the
+// paged {"bookmarks": [...]} envelope of its API.
+func parseShioriJSON(data []byte) ([]importItem, error) {
+	var list []shioriBookmark
+	if err := json.Unmarshal(data, &list); err != nil {
+		var envelope struct {
+			Bookmarks []shioriBookmark `json:"bookmarks"`
+		}
+		if err := json.Unmarshal(data, &envelope); err != nil {
+			return nil, err
+		}
+		list = envelope.Bookmarks
+	}
+
+	items := make([]importItem, len(list))
+	for i, sb := range list {
+		items[i] = sb.importItem()
+	}
+	return items, nil
+}
+
+// openSQLiteCopy writes an uploaded SQLite database to a temporary file and
+// opens it read-only. cleanup closes the database and removes the file.
+func openSQLiteCopy(data []byte) (db *sql.DB, cleanup func(), err error) {
+	f, err := os.CreateTemp("", "bookmarkd-import-*.db")
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	f.Close()
+
+	db, err = sql.Open("sqlite", "file:"+f.Name()+"?mode=ro")
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+	return db, func() {
+		db.Close()
+		os.Remove(f.Name())
+	}, nil
+}
+
+// parseShioriDB reads bookmarks and tags from a copy of Shiori's SQLite
+// database (shiori.db). Archived page content stays behind; everything that
+// maps onto bookmark fields is imported.
+func parseShioriDB(data []byte) ([]importItem, error) {
+	db, cleanup, err := openSQLiteCopy(data)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	// The timestamp column was renamed between Shiori releases.
+	columns := map[string]bool{}
+	info, err := db.Query("SELECT name FROM pragma_table_info('bookmark')")
+	if err != nil {
+		return nil, err
+	}
+	for info.Next() {
+		var name string
+		info.Scan(&name)
+		columns[name] = true
+	}
+	info.Close()
+
+	dateColumn := "''"
+	for _, c := range []string{"created_at", "modified_at", "modified"} {
+		if columns[c] {
+			dateColumn = c
+			break
+		}
+	}
+
+	tags := map[int64][]shioriTag{}
+	if tagRows, err := db.Query("SELECT bt.bookmark_id, t.name FROM bookmark_tag bt JOIN tag t ON t.id = bt.tag_id"); err == nil {
+		for tagRows.Next() {
+			var id int64
+			var t shioriTag
+			tagRows.Scan(&id, &t.Name)
+			tags[id] = append(tags[id], t)
+		}
+		tagRows.Close()
+	}
+
+	rows, err := db.Query("SELECT id, url, title, COALESCE(excerpt, ''), COALESCE(author, ''), COALESCE(" + dateColumn + ", '') FROM bookmark")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []importItem
+	for rows.Next() {
+		var id int64
+		var sb shioriBookmark
+		if err := rows.Scan(&id, &sb.URL, &sb.Title, &sb.Excerpt, &sb.Author, &sb.Modified); err != nil {
+			return nil, err
+		}
+		sb.Tags = tags[id]
+		items = append(items, sb.importItem())
+	}
+	return items, rows.Err()
+}
+
+// importShiori accepts Shiori's SQLite database, its JSON API output, or the
+// Netscape HTML file written by `shiori export`.
+func importShiori(u importUpload) ([]importItem, []importRowError, error) {
+	var items []importItem
+	var err error
+	trimmed := bytes.TrimSpace(u.Data)
+	switch {
+	case bytes.HasPrefix(u.Data, []byte("SQLite format 3\x00")):
+		items, err = parseShioriDB(u.Data)
+	case bytes.HasPrefix(trimmed, []byte("[")) || bytes.HasPrefix(trimmed, []byte("{")):
+		items, err = parseShioriJSON(trimmed)
+	default:
+		items = parseNetscapeHTML(string(u.Data))
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid Shiori data: %v", err)
+	}
+	return items, nil, nil
+}
+
+// csvImportFields are the bookmark fields a CSV column can be mapped to.
+// They match the columns written by GET /api/export/csv.
+var csvImportFields = map[string]bool{
+	"url": true, "title": true, "category": true, "tags": true, "notes": true, "created": true,
+}
+
+// parseBookmarkCSV parses a CSV file whose header names bookmark fields.
+// Columns are matched case-insensitively against csvImportFields unless
+// mapping, from source header to field, says otherwise; other columns are
+// ignored. "tags" is comma-separated, "created" is RFC 3339, YYYY-MM-DD or a
+// Unix timestamp. Rows that can't be used are reported instead of imported.
+func parseBookmarkCSV(data io.Reader, mapping map[string]string) ([]importItem, []importRowError, error) {
+	reader := csv.NewReader(data)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lowerMapping := make(map[string]string, len(mapping))
+	for from, to := range mapping {
+		lowerMapping[strings.ToLower(strings.TrimSpace(from))] = strings.ToLower(to)
+	}
+
+	cols := map[string]int{}
+	for name, i := range csvColumns(header) {
+		field := name
+		if mapped, ok := lowerMapping[name]; ok {
+			field = mapped
+		}
+		if csvImportFields[field] {
+			cols[field] = i
+		}
+	}
+	if _, ok := cols["url"]; !ok {
+		return nil, nil, fmt.Errorf("no column maps to url")
+	}
+
+	var items []importItem
+	var rowErrors []importRowError
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			rowErrors = append(rowErrors, importRowError{Row: parseErr.StartLine, Error: parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		row, _ := reader.FieldPos(0)
+
+		item := importItem{
+			URL:      csvField(record, cols, "url"),
+			Title:    csvField(record, cols, "title"),
+			Category: csvField(record, cols, "category"),
+			Notes:    csvField(record, cols, "notes"),
+		}
+
+		if u, err := url.Parse(item.URL); item.URL == "" || err != nil || u.Scheme == "" {
+			rowErrors = append(rowErrors, importRowError{Row: row, Error: "missing or invalid url"})
+			continue
+		}
+
+		if tags := csvField(record, cols, "tags"); tags != "" {
+			item.Tags = strings.Split(tags, ",")
+		}
+
+		if created := csvField(record, cols, "created"); created != "" {
+			if t, err := time.Parse(time.RFC3339, created); err == nil {
+				item.Timestamp = t.Unix()
+			} else if ts, ok := parseSince(created); ok {
+				item.Timestamp = ts
+			} else {
+				rowErrors = append(rowErrors, importRowError{Row: row, Error: "invalid created timestamp"})
+				continue
+			}
+		}
+
+		items = append(items, item)
+	}
+	return items, rowErrors, nil
+}
+
+// importCSV accepts a raw CSV upload with an optional "mapping" field, or a
+// JSON payload {"data": "<csv>", "mapping": {"Link": "url", ...}}.
+func importCSV(u importUpload) ([]importItem, []importRowError, error) {
+	data := string(u.Data)
+	var mapping map[string]string
+	if m := u.Values.Get("mapping"); m != "" {
+		if err := json.Unmarshal([]byte(m), &mapping); err != nil {
+			return nil, nil, fmt.Errorf("Invalid mapping")
+		}
+	} else if strings.HasPrefix(u.ContentType, "application/json") {
+		var payload struct {
+			Data    string            `json:"data"`
+			Mapping map[string]string `json:"mapping"`
+		}
+		if err := json.Unmarshal(u.Data, &payload); err != nil {
+			return nil, nil, fmt.Errorf("Invalid JSON")
+		}
+		data, mapping = payload.Data, payload.Mapping
+	}
+
+	items, rowErrors, err := parseBookmarkCSV(strings.NewReader(data), mapping)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid CSV: %v", err)
+	}
+	return items, rowErrors, nil
+}
+
+type historyEntry struct {
+	URL        string
+	Title      string
+	VisitCount int
+	LastVisit  int64
+}
+
+// Chrome stores times as microseconds since 1601-01-01.
+const chromeEpochOffset = 11644473600
+
+// parseHistoryDB reads a copy of Chrome's "History" or Firefox's
+// "places.sqlite" database.
+func parseHistoryDB(data []byte) ([]historyEntry, error) {
+	db, cleanup, err := openSQLiteCopy(data)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	query := "SELECT url, COALESCE(title, ''), visit_count, last_visit_time / 1000000 - " + strconv.Itoa(chromeEpochOffset) + " FROM urls"
+	var name string
+	if db.QueryRow("SELECT name FROM sqlite_master WHERE type = 'table' AND name = 'moz_places'").Scan(&name) == nil {
+		query = "SELECT url, COALESCE(title, ''), visit_count, COALESCE(last_visit_date, 0) / 1000000 FROM moz_places"
+	}
+
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []historyEntry
+	for rows.Next() {
+		var e historyEntry
+		if err := rows.Scan(&e.URL, &e.Title, &e.VisitCount, &e.LastVisit); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// parseHistoryJSON reads an array of history items as returned by the
+// chrome.history / browser.history extension APIs (lastVisitTime in ms).
+func parseHistoryJSON(data []byte) ([]historyEntry, error) {
+	var list []struct {
+		URL           string  `json:"url"`
+		Title         string  `json:"title"`
+		VisitCount    int     `json:"visitCount"`
+		LastVisitTime float64 `json:"lastVisitTime"`
+	}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, err
+	}
+
+	entries := make([]historyEntry, len(list))
+	for i, h := range list {
+		entries[i] = historyEntry{
+			URL:        h.URL,
+			Title:      h.Title,
+			VisitCount: h.VisitCount,
+			LastVisit:  int64(h.LastVisitTime / 1000),
+		}
+	}
+	return entries, nil
+}
+
+// topHistoryItems picks the limit most visited http(s) URLs.
+func topHistoryItems(entries []historyEntry, limit int, category string) []importItem {
+	byURL := make(map[string]historyEntry)
+	for _, e := range entries {
+		if !strings.HasPrefix(e.URL, "http://") && !strings.HasPrefix(e.URL, "https://") {
+			continue
+		}
+		if prev, ok := byURL[e.URL]; ok {
+			e.VisitCount += prev.VisitCount
+			e.LastVisit = max(e.LastVisit, prev.LastVisit)
+		}
+		byURL[e.URL] = e
+	}
+
+	top := slices.Collect(maps.Values(byURL))
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].VisitCount != top[j].VisitCount {
+			return top[i].VisitCount > top[j].VisitCount
+		}
+		return top[i].URL < top[j].URL
+	})
+	if len(top) > limit {
+		top = top[:limit]
+	}
+
+	items := make([]importItem, len(top))
+	for i, e := range top {
+		items[i] = importItem{
+			URL:         e.URL,
+			Title:       e.Title,
+			Category:    category,
+			VisitCount:  e.VisitCount,
+			LastVisited: e.LastVisit,
+		}
+	}
+	return items
+}
+
+// importHistory bootstraps a collection from browser history: the limit
+// (default 50) most visited URLs become bookmarks, filed under category if
+// given.
+func importHistory(u importUpload) ([]importItem, []importRowError, error) {
+	limit := 50
+	if v := u.Values.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, nil, fmt.Errorf("Invalid limit")
+		}
+		limit = n
+	}
+
+	var entries []historyEntry
+	var err error
+	if bytes.HasPrefix(u.Data, []byte("SQLite format 3\x00")) {
+		entries, err = parseHistoryDB(u.Data)
+	} else {
+		entries, err = parseHistoryJSON(u.Data)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid history data: %v", err)
+	}
+	return topHistoryItems(entries, limit, u.Values.Get("category")), nil, nil
+}
+
+// importUpload is the file being imported together with the request's
+// options. Options come from the query string and, for multipart uploads,
+// the form fields.
+type importUpload struct {
+	Data        []byte
+	ContentType string
+	Values      url.Values
+}
+
+// importFormats maps the format name used in /api/import/{format} and the
+// "format" form field to its parser.
+var importFormats = map[string]func(importUpload) ([]importItem, []importRowError, error){
+	"html":     importHTML,
+	"raindrop": importRaindrop,
+	"shiori":   importShiori,
+	"csv":      importCSV,
+	"history":  importHistory,
+}
+
+// maxImportMemory is how much of a multipart upload is kept in memory; the
+// rest is spooled to a temporary file.
+const maxImportMemory = 32 << 20
+
+var errUploadTooLarge = errors.New("Upload too large")
+
+// readImportUpload reads the file to import either from the raw request body
+// or from the "file" part of a multipart/form-data upload.
+func readImportUpload(r *http.Request) (importUpload, error) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		data, err := io.ReadAll(r.Body)
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			return importUpload{}, errUploadTooLarge
+		}
+		if err != nil {
+			return importUpload{}, fmt.Errorf("Could not read request body")
+		}
+		return importUpload{Data: data, ContentType: r.Header.Get("Content-Type"), Values: r.URL.Query()}, nil
+	}
+
+	if err := r.ParseMultipartForm(maxImportMemory); err != nil {
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			return importUpload{}, errUploadTooLarge
+		}
+		return importUpload{}, fmt.Errorf("Invalid multipart form")
+	}
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		return importUpload{}, fmt.Errorf("Missing file field")
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return importUpload{}, fmt.Errorf("Could not read uploaded file")
+	}
+	return importUpload{Data: data, ContentType: header.Header.Get("Content-Type"), Values: r.Form}, nil
+}
+
+// handleImport serves POST /api/import/{format} and POST /api/import with a
+// "format" field. With dry_run=true nothing is saved and the bookmarks that
+// would be created are returned.
+func handleImport(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	upload, err := readImportUpload(r)
+	if errors.Is(err, errUploadTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	format := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/import"), "/")
+	if format == "" {
+		format = upload.Values.Get("format")
+	}
+	parse, ok := importFormats[format]
+	if !ok {
+		http.Error(w, "Unknown import format", http.StatusBadRequest)
+		return
+	}
+
+	items, rowErrors, err := parse(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(items) == 0 && len(rowErrors) == 0 {
+		http.Error(w, "No bookmarks found in file", http.StatusBadRequest)
+		return
+	}
+
+	strategy := cmp.Or(upload.Values.Get("strategy"), importSkip)
+	if !validImportStrategy(strategy) {
+		http.Error(w, "Invalid strategy", http.StatusBadRequest)
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(upload.Values.Get("dry_run"))
+	result := importItems(s, items, strategy, dryRun)
+	result.Errors = rowErrors
+	result.Skipped += len(rowErrors)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// --- Export ---
+
+// categoryGroup is a category with its bookmarks in display order.
+type categoryGroup struct {
+	Category  Category
+	Bookmarks []Bookmark
+}
+
+// groupedBookmarks returns every category, in order, with its bookmarks.
+func (s *Store) groupedBookmarks() []categoryGroup {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var groups []categoryGroup
+	index := make(map[string]int)
+	for _, cat := range s.categoriesToSortedSlice() {
+		index[cat.ID] = len(groups)
+		groups = append(groups, categoryGroup{Category: cat})
+	}
+	for _, bm := range s.bookmarksToSortedSlice() {
+		bm.Category = s.getCategoryName(bm.CategoryID)
+		i, ok := index[bm.CategoryID]
+		if !ok {
+			i = index[uncategorizedID]
+		}
+		groups[i].Bookmarks = append(groups[i].Bookmarks, bm)
+	}
+	return groups
+}
+
+func setAttachment(w http.ResponseWriter, contentType, filename string) {
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+}
+
+// writeNetscapeHTML writes the bookmark file format understood by every
+// browser's import dialog. Categories become folders; uncategorized
+// bookmarks are placed at the top level.
+func writeNetscapeHTML(w io.Writer, groups []categoryGroup) {
+	fmt.Fprint(w, `<!DOCTYPE NETSCAPE-Bookmark-file-1>
+<!-- This is an automatically generated file.
+     It will be read and overwritten.
+     DO NOT EDIT! -->
+<META HTTP-EQUIV="Content-Type" CONTENT="text/html; charset=UTF-8">
+<TITLE>Bookmarks</TITLE>
+<H1>Bookmarks</H1>
+<DL><p>
+`)
+
+	writeBookmark := func(indent string, bm Bookmark) {
+		fmt.Fprintf(w, `%s<DT><A HREF="%s" ADD_DATE="%d"`, indent, html.EscapeString(bm.URL), bm.Timestamp)
+		if bm.LastVisited != nil {
+			fmt.Fprintf(w, ` LAST_VISIT="%d"`, *bm.LastVisited)
+		}
+		if len(bm.Tags) > 0 {
+			fmt.Fprintf(w, ` TAGS="%s"`, html.EscapeString(strings.Join(bm.Tags, ",")))
+		}
+		fmt.Fprintf(w, ">%s</A>\n", html.EscapeString(bm.Title))
+		if bm.Notes != "" {
+			fmt.Fprintf(w, "%s<DD>%s\n", indent, html.EscapeString(bm.Notes))
+		}
+	}
+
+	for _, g := range groups {
+		if g.Category.ID == uncategorizedID {
+			for _, bm := range g.Bookmarks {
+				writeBookmark("    ", bm)
+			}
+			continue
+		}
+		fmt.Fprintf(w, "    <DT><H3>%s</H3>\n    <DL><p>\n", html.EscapeString(g.Category.Name))
+		for _, bm := range g.Bookmarks {
+			writeBookmark("        ", bm)
+		}
+		fmt.Fprint(w, "    </DL><p>\n")
+	}
+	fmt.Fprint(w, "</DL><p>\n")
+}
+
+func handleExportHTML(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	setAttachment(w, "text/html; charset=utf-8", "bookmarks.html")
+	writeNetscapeHTML(w, s.groupedBookmarks())
+}
+
+// csvHeader is the column layout of CSV exports. Timestamps are RFC 3339,
+// tags are comma-separated.
+var csvHeader = []string{"url", "title", "category", "tags", "notes", "created", "last_visited", "visit_count"}
+
+func formatUnix(ts int64) string {
+	return time.Unix(ts, 0).UTC().Format(time.RFC3339)
+}
+
+func handleExportCSV(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	setAttachment(w, "text/csv; charset=utf-8", "bookmarks.csv")
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, g := range s.groupedBookmarks() {
+		for _, bm := range g.Bookmarks {
+			lastVisited := ""
+			if bm.LastVisited != nil {
+				lastVisited = formatUnix(*bm.LastVisited)
+			}
+			cw.Write([]string{
+				bm.URL,
+				bm.Title,
+				bm.Category,
+				strings.Join(bm.Tags, ","),
+				bm.Notes,
+				formatUnix(bm.Timestamp),
+				lastVisited,
+				strconv.Itoa(bm.VisitCount),
+			})
+		}
+	}
+	cw.Flush()
+}
+
+var markdownEscaper = strings.NewReplacer(`\`, `\\`, "[", `\[`, "]", `\]`, "*", `\*`, "_", `\_`, "`", "\\`")
+var markdownURLEscaper = strings.NewReplacer("(", "%28", ")", "%29", " ", "%20")
+
+// handleExportMarkdown renders each non-empty category as a heading followed
+// by a "- [title](url) — notes" list.
+func handleExportMarkdown(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	setAttachment(w, "text/markdown; charset=utf-8", "bookmarks.md")
+	fmt.Fprint(w, "# Bookmarks\n")
+	for _, g := range s.groupedBookmarks() {
+		if len(g.Bookmarks) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n## %s\n\n", markdownEscaper.Replace(g.Category.Name))
+		for _, bm := range g.Bookmarks {
+			title := bm.Title
+			if title == "" {
+				title = bm.URL
+			}
+			fmt.Fprintf(w, "- [%s](%s)", markdownEscaper.Replace(title), markdownURLEscaper.Replace(bm.URL))
+			if notes := strings.Join(strings.Fields(bm.Notes), " "); notes != "" {
+				fmt.Fprintf(w, " — %s", notes)
+			}
+			fmt.Fprint(w, "\n")
+		}
+	}
+}
+
+type opmlOutline struct {
+	Text        string        `xml:"text,attr"`
+	Type        string        `xml:"type,attr,omitempty"`
+	URL         string        `xml:"url,attr,omitempty"`
+	Created     string        `xml:"created,attr,omitempty"`
+	Category    string        `xml:"category,attr,omitempty"`
+	Description string        `xml:"description,attr,omitempty"`
+	Outlines    []opmlOutline `xml:"outline"`
+}
+
+type opmlDocument struct {
+	XMLName xml.Name `xml:"opml"`
+	Version string   `xml:"version,attr"`
+	Head    struct {
+		Title       string `xml:"title"`
+		DateCreated string `xml:"dateCreated"`
+	} `xml:"head"`
+	Body struct {
+		Outlines []opmlOutline `xml:"outline"`
+	} `xml:"body"`
+}
+
+// handleExportOPML writes an OPML 2.0 outline with one node per category and
+// a type="link" node per bookmark. Uncategorized bookmarks sit at the top
+// level, as in the HTML export.
+func handleExportOPML(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	doc := opmlDocument{Version: "2.0"}
+	doc.Head.Title = "Bookmarks"
+	doc.Head.DateCreated = time.Now().UTC().Format(time.RFC1123Z)
+
+	for _, g := range s.groupedBookmarks() {
+		var links []opmlOutline
+		for _, bm := range g.Bookmarks {
+			title := bm.Title
+			if title == "" {
+				title = bm.URL
+			}
+			links = append(links, opmlOutline{
+				Text:        title,
+				Type:        "link",
+				URL:         bm.URL,
+				Created:     time.Unix(bm.Timestamp, 0).UTC().Format(time.RFC1123Z),
+				Category:    strings.Join(bm.Tags, ","),
+				Description: bm.Notes,
+			})
+		}
+
+		if g.Category.ID == uncategorizedID {
+			doc.Body.Outlines = append(doc.Body.Outlines, links...)
+			continue
+		}
+		doc.Body.Outlines = append(doc.Body.Outlines, opmlOutline{Text: g.Category.Name, Outlines: links})
+	}
+
+	setAttachment(w, "text/x-opml; charset=utf-8", "bookmarks.opml")
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		slog.ErrorContext(r.Context(), "OPML export failed", "err", err)
+	}
+}
+
+// handleExportArchive streams a zip of the whole instance: every collection
+// file, time tracking data, custom themes and locally stored favicons. The
+// layout mirrors the data directory so it can be unpacked in place on
+// another machine.
+func handleExportArchive(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	setAttachment(w, "application/zip", "bookmarkd-"+time.Now().Format("2006-01-02")+".zip")
+	zw := zip.NewWriter(w)
+
+	// users get their own collections; the instance's archive has everything
+	owner := requestOwner(r)
+	list := allStores()
+	if owner != "" {
+		list = ownerStores(owner)
+	}
+	for _, s := range list {
+		s.mu.RLock()
+		db := s.database()
+		s.mu.RUnlock()
+
+		path := storePath(s.Owner, s.Name)
+		if owner != "" {
+			path = collectionPath(s.Name)
+		}
+		if err := writeZipJSON(zw, filepath.ToSlash(path), db); err != nil {
+			slog.ErrorContext(r.Context(), "Archive export failed", "err", err)
+			return
+		}
+		// bookmark IDs derive from URLs, so each collection needs its own
+		// directory for the icons
+		icons := storeFilesDir(faviconCacheDir, s.Owner, s.Name)
+		if owner != "" {
+			icons = storeFilesDir(faviconCacheDir, "", s.Name)
+		}
+		for _, bm := range db.Bookmarks {
+			if err := writeZipFavicon(zw, icons, bm); err != nil {
+				slog.ErrorContext(r.Context(), "Archive export failed", "err", err)
+				return
+			}
+		}
+	}
+
+	if owner == "" {
+		timeMu.RLock()
+		err := writeZipJSON(zw, timeTrackingFile, timeTracking)
+		timeMu.RUnlock()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Archive export failed", "err", err)
+			return
+		}
+
+		xbsMu.RLock()
+		err = writeZipJSON(zw, xbsFile, xbsSyncs)
+		xbsMu.RUnlock()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Archive export failed", "err", err)
+			return
+		}
+
+		webhooksMu.RLock()
+		err = writeZipJSON(zw, webhooksFile, webhooks)
+		webhooksMu.RUnlock()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Archive export failed", "err", err)
+			return
+		}
+
+		usersMu.RLock()
+		err = writeZipJSON(zw, usersFile, slices.Collect(maps.Values(users)))
+		usersMu.RUnlock()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Archive export failed", "err", err)
+			return
+		}
+	}
+
+	themeMu.RLock()
+	themes := customThemes[requestTenant(r)]
+	themeMu.RUnlock()
+	for _, t := range themes {
+		f, err := zw.Create("themes/" + t.Name + ".css")
+		if err == nil {
+			_, err = io.WriteString(f, t.CSS)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Archive export failed", "err", err)
+			return
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		slog.ErrorContext(r.Context(), "Archive export failed", "err", err)
+	}
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// decodeDataURI returns the media type and content of a data: URI.
+func decodeDataURI(uri string) (string, []byte, bool) {
+	rest, ok := strings.CutPrefix(uri, "data:")
+	if !ok {
+		return "", nil, false
+	}
+	meta, payload, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", nil, false
+	}
+
+	if base, isBase64 := strings.CutSuffix(meta, ";base64"); isBase64 {
+		decoded, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			return "", nil, false
+		}
+		return base, decoded, true
+	}
+	decoded, err := url.PathUnescape(payload)
+	if err != nil {
+		return "", nil, false
+	}
+	return meta, []byte(decoded), true
+}
+
+// writeZipFavicon stores a bookmark's favicon as <bookmark id> in dir, its
+// collection's directory below favicons/: the icon kept inline as a data:
+// URI, else the downloaded copy from the favicon cache, which
+// restoreArchivedFavicons takes back after unpacking.
+func writeZipFavicon(zw *zip.Writer, dir string, bm Bookmark) error {
+	var ext string
+	meta, data, ok := decodeDataURI(bm.Favicon)
+	if ok {
+		ext = ".ico"
+		if exts, _ := mime.ExtensionsByType(meta); len(exts) > 0 {
+			ext = exts[0]
+		}
+	} else {
+		src := faviconSource(bm)
+		if src == "" {
+			return nil
+		}
+		path := faviconCacheFile(faviconKey(src))
+		if path == "" || filepath.Ext(path) == ".miss" {
+			return nil
+		}
+		var err error
+		if data, err = os.ReadFile(path); os.IsNotExist(err) {
+			return nil // replaced meanwhile
+		} else if err != nil {
+			return err
+		}
+		ext = filepath.Ext(path)
+	}
+
+	f, err := zw.Create(filepath.ToSlash(filepath.Join(dir, bm.ID+ext)))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// --- Background Jobs ---
+
+// job is periodic work run by the scheduler. Features register their jobs
+// with registerJob before startScheduler; BOOKMARKD_JOBS_<NAME>_SCHEDULE,
+// _ENABLED and _JITTER (see loadJobs) decide when each one runs.
+type job struct {
+	Name            string
+	DefaultSchedule string // used without a configured schedule; "" leaves the job off
+	Run             func(ctx context.Context) error
+
+	// set by loadJobs
+	enabled  bool
+	schedule string
+	spec     *cronSchedule
+	jitter   time.Duration
+
+	// guarded by jobsMu
+	next     time.Time
+	running  bool
+	lastRun  time.Time     // when the last (or current) run started
+	finished time.Time     // when the last run finished, with
+	duration time.Duration // how long it took
+	lastErr  error         // and how it failed
+}
+
+var (
+	jobsMu   sync.Mutex
+	jobs     []*job
+	jobsWake = make(chan struct{}, 1)
+)
+
+// registerJob adds a job to the scheduler. run gets a context that is
+// cancelled when the server shuts down.
+func registerJob(name, defaultSchedule string, run func(ctx context.Context) error) {
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	jobs = append(jobs, &job{Name: name, DefaultSchedule: defaultSchedule, Run: run})
+}
+
+// jobEnv is the variable holding a job's setting, e.g.
+// BOOKMARKD_JOBS_LINK_CHECK_SCHEDULE.
+func jobEnv(name, setting string) string {
+	return "BOOKMARKD_JOBS_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_" + setting
+}
+
+// loadJobs reads the schedule of every registered job. A job runs when it
+// has a schedule (its own default or BOOKMARKD_JOBS_<NAME>_SCHEDULE) and
+// BOOKMARKD_JOBS_<NAME>_ENABLED isn't false. Each run is delayed by a random
+// part of BOOKMARKD_JOBS_<NAME>_JITTER, or of BOOKMARKD_JOBS_JITTER, so that
+// jobs and instances on the same schedule don't all start at once.
+func loadJobs() {
+	defaultJitter, err := time.ParseDuration(cmp.Or(os.Getenv("BOOKMARKD_JOBS_JITTER"), "0s"))
+	if err != nil || defaultJitter < 0 {
+		slog.Warn("Invalid BOOKMARKD_JOBS_JITTER, using none", "value", os.Getenv("BOOKMARKD_JOBS_JITTER"))
+		defaultJitter = 0
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	for _, j := range jobs {
+		j.enabled, j.spec, j.next = false, nil, time.Time{}
+		j.schedule = cmp.Or(strings.TrimSpace(os.Getenv(jobEnv(j.Name, "SCHEDULE"))), j.DefaultSchedule)
+		if enabled := os.Getenv(jobEnv(j.Name, "ENABLED")); j.schedule == "" || enabled == "false" || enabled == "0" {
+			continue
+		}
+		spec, err := parseCron(j.schedule)
+		if err != nil {
+			slog.Warn("Job disabled", "job", j.Name, "err", err)
+			continue
+		}
+		j.jitter = defaultJitter
+		if v := os.Getenv(jobEnv(j.Name, "JITTER")); v != "" {
+			if j.jitter, err = time.ParseDuration(v); err != nil || j.jitter < 0 {
+				slog.Warn("Invalid job jitter, using none", "job", j.Name, "value", v)
+				j.jitter = 0
+			}
+		}
+		j.spec = spec
+		if j.next = j.nextRun(time.Now()); j.next.IsZero() {
+			slog.Warn("Job disabled, its schedule never fires", "job", j.Name, "schedule", j.schedule)
+			continue
+		}
+		j.enabled = true
+		slog.Info("Job scheduled", "job", j.Name, "schedule", j.schedule, "next", j.next.Format(time.RFC3339))
+	}
+
+	select {
+	case jobsWake <- struct{}{}:
+	default:
+	}
+}
+
+// nextRun is when the job runs next after t, jitter included.
+func (j *job) nextRun(t time.Time) time.Time {
+	next := j.spec.next(t)
+	if j.jitter > 0 && !next.IsZero() {
+		next = next.Add(time.Duration(mrand.Int64N(int64(j.jitter))))
+	}
+	return next
+}
+
+// startScheduler runs the registered jobs on their schedules until the
+// server shuts down.
+func startScheduler() {
+	loadJobs()
+	go func() {
+		for {
+			jobsMu.Lock()
+			now := time.Now()
+			wait := time.Hour
+			for _, j := range jobs {
+				if !j.enabled || j.next.IsZero() {
+					continue
+				}
+				if !j.next.After(now) {
+					j.start("schedule")
+					j.next = j.nextRun(now)
+				}
+				if !j.next.IsZero() {
+					wait = min(wait, j.next.Sub(now))
+				}
+			}
+			jobsMu.Unlock()
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-jobsWake:
+				timer.Stop()
+			case <-shuttingDown:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+}
+
+// start runs the job in the background unless it is still running from
+// before, which it reports. jobsMu must be held.
+func (j *job) start(trigger string) bool {
+	if j.running {
+		slog.Warn("Job still running, skipping this run", "job", j.Name, "trigger", trigger, "since", j.lastRun.Format(time.RFC3339))
+		return false
+	}
+	j.running = true
+	j.lastRun = time.Now()
+	go func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			select {
+			case <-shuttingDown:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		slog.Info("Job started", "job", j.Name, "trigger", trigger)
+		err := j.Run(ctx)
+
+		jobsMu.Lock()
+		j.running = false
+		j.finished = time.Now()
+		duration := j.finished.Sub(j.lastRun)
+		j.duration, j.lastErr = duration, err
+		jobsMu.Unlock()
+		if err != nil {
+			slog.Error("Job failed", "job", j.Name, "duration", duration, "err", err)
+		} else {
+			slog.Info("Job finished", "job", j.Name, "duration", duration)
+		}
+	}()
+	return true
+}
+
+// jobStatus is a job as GET /api/admin/jobs shows it. Duration, result and
+// error are those of the last finished run.
+type jobStatus struct {
+	Name         string `json:"name"`
+	Schedule     string `json:"schedule,omitempty"`
+	Enabled      bool   `json:"enabled"`
+	Running      bool   `json:"running"`
+	LastRun      int64  `json:"last_run,omitempty"`
+	LastFinished int64  `json:"last_finished,omitempty"`
+	DurationMs   int64  `json:"duration_ms,omitempty"`
+	Result       string `json:"result,omitempty"` // "ok" or "failed"
+	Error        string `json:"error,omitempty"`
+	NextRun      int64  `json:"next_run,omitempty"`
+}
+
+// status describes the job. jobsMu must be held.
+func (j *job) status() jobStatus {
+	st := jobStatus{Name: j.Name, Schedule: j.schedule, Enabled: j.enabled, Running: j.running}
+	if !j.lastRun.IsZero() {
+		st.LastRun = j.lastRun.Unix()
+	}
+	if !j.finished.IsZero() {
+		st.LastFinished = j.finished.Unix()
+		st.DurationMs = j.duration.Milliseconds()
+		st.Result = "ok"
+		if j.lastErr != nil {
+			st.Result, st.Error = "failed", j.lastErr.Error()
+		}
+	}
+	if j.enabled && !j.next.IsZero() {
+		st.NextRun = j.next.Unix()
+	}
+	return st
+}
+
+func handleAdminJobs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	jobsMu.Lock()
+	result := make([]jobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		result = append(result, j.status())
+	}
+	jobsMu.Unlock()
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, result)
+}
+
+// handleAdminJob starts a job now, at POST /api/admin/jobs/:name/run, also
+// when it is disabled. It doesn't change when the job runs next.
+func handleAdminJob(w http.ResponseWriter, r *http.Request) {
+	name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/api/admin/jobs/"), "/run")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	jobsMu.Lock()
+	defer jobsMu.Unlock()
+	i := slices.IndexFunc(jobs, func(j *job) bool { return j.Name == name })
+	if i == -1 {
+		http.Error(w, "Job not found", http.StatusNotFound)
+		return
+	}
+	if !jobs[i].start("manual") {
+		http.Error(w, "Job is already running", http.StatusConflict)
+		return
+	}
+	slog.InfoContext(r.Context(), "Job started by hand", "job", name)
+	writeJSON(w, http.StatusAccepted, jobs[i].status())
+}
+
+// cronSchedule is a parsed schedule: five cron fields (minute, hour, day of
+// month, month, day of week) as bit sets, or a fixed interval for
+// "@every <duration>".
+type cronSchedule struct {
+	every                         time.Duration
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonths = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+var cronDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseCron parses a cron expression in local time, such as "30 3 * * *",
+// "*/15 8-18 * * mon-fri", "@daily" or "@every 6h". As in cron, a job runs
+// on days matching either the day of month or the day of week when both
+// are restricted.
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.ToLower(strings.TrimSpace(expr))
+	if rest, ok := strings.CutPrefix(expr, "@every "); ok {
+		d, err := time.ParseDuration(strings.TrimSpace(rest))
+		if err != nil || d < time.Minute {
+			return nil, fmt.Errorf("invalid schedule %q: @every needs a duration of at least 1m", expr)
+		}
+		return &cronSchedule{every: d}, nil
+	}
+	if macro, ok := cronMacros[expr]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid schedule %q: want 5 fields or a @macro", expr)
+	}
+
+	var c cronSchedule
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err == nil {
+		if c.hour, err = parseCronField(fields[1], 0, 23, nil); err == nil {
+			if c.dom, err = parseCronField(fields[2], 1, 31, nil); err == nil {
+				if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err == nil {
+					c.dow, err = parseCronField(fields[4], 0, 7, cronDays)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid schedule %q: %w", expr, err)
+	}
+	if c.dow&(1<<7) != 0 { // 7 is Sunday too
+		c.dow |= 1
+	}
+	c.domAny, c.dowAny = fields[2] == "*" || fields[2] == "?", fields[4] == "*" || fields[4] == "?"
+	return &c, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges ("1-5"),
+// "*" and steps ("*/10", "0-30/5") into a bit set. names, if given, spell
+// the values from min on.
+func parseCronField(field string, lo, hi int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		if i := slices.Index(names, s); i != -1 {
+			return lo + i, nil
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, lo, hi)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		span, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		start, end := lo, hi
+		if span != "*" && span != "?" {
+			first, last, isRange := strings.Cut(span, "-")
+			var err error
+			if start, err = value(first); err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				if end, err = value(last); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = hi
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range %q", span)
+			}
+		}
+		for n := start; n <= end; n += step {
+			bits |= 1 << n
+		}
+	}
+	return bits, nil
+}
+
+// next returns the first time after t the schedule fires, or the zero time
+// if it never does (e.g. on February 30).
+func (c *cronSchedule) next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every)
+	}
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom, dow := c.dom&(1<<t.Day()) != 0, c.dow&(1<<int(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// --- Scheduled Exports ---
+
+// backupConfig controls periodic off-instance exports. It is read from
+// BOOKMARKD_BACKUP_* environment variables; an empty interval disables it.
+type backupConfig struct {
+	Interval time.Duration
+	Format   string // "json" or "html"
+	Dir      string
+	URL      string // files are PUT to URL/<filename> instead of Dir
+	Keep     int    // number of files per collection kept in Dir, 0 keeps all
+}
+
+func loadBackupConfig() (backupConfig, error) {
+	cfg := backupConfig{
+		Format: os.Getenv("BOOKMARKD_BACKUP_FORMAT"),
+		Dir:    os.Getenv("BOOKMARKD_BACKUP_DIR"),
+		URL:    strings.TrimSuffix(os.Getenv("BOOKMARKD_BACKUP_URL"), "/"),
+		Keep:   7,
+	}
+	if v := os.Getenv("BOOKMARKD_BACKUP_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < time.Minute {
+			return cfg, fmt.Errorf("invalid BOOKMARKD_BACKUP_INTERVAL %q", v)
+		}
+		cfg.Interval = d
+	}
+	if cfg.Format == "" {
+		cfg.Format = "json"
+	}
+	if cfg.Format != "json" && cfg.Format != "html" {
+		return cfg, fmt.Errorf("invalid BOOKMARKD_BACKUP_FORMAT %q", cfg.Format)
+	}
+	if cfg.Dir == "" {
+		cfg.Dir = "backups"
+	}
+	if v := os.Getenv("BOOKMARKD_BACKUP_KEEP"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("invalid BOOKMARKD_BACKUP_KEEP %q", v)
+		}
+		cfg.Keep = n
+	}
+	return cfg, nil
+}
+
+// startScheduledExports registers the "backup" job, which runs every
+// BOOKMARKD_BACKUP_INTERVAL unless BOOKMARKD_JOBS_BACKUP_SCHEDULE says
+// otherwise.
+func startScheduledExports() {
+	cfg, err := loadBackupConfig()
+	if err != nil {
+		slog.Warn("Scheduled exports disabled", "err", err)
+		return
+	}
+	schedule := ""
+	if cfg.Interval > 0 {
+		schedule = "@every " + cfg.Interval.String()
+	}
+
+	registerJob("backup", schedule, func(ctx context.Context) error {
+		var errs []error
+		for _, s := range allStores() {
+			if err := writeScheduledExport(cfg, s); err != nil {
+				slog.Error("Backup: export failed", "collection", s.Name, "err", err)
+				errs = append(errs, fmt.Errorf("%s: %w", s.Name, err))
+			}
+		}
+		return errors.Join(errs...)
+	})
+}
+
+func writeScheduledExport(cfg backupConfig, s *Store) error {
+	var buf bytes.Buffer
+	if cfg.Format == "html" {
+		writeNetscapeHTML(&buf, s.groupedBookmarks())
+	} else {
+		s.mu.RLock()
+		db := s.database()
+		s.mu.RUnlock()
+		data, err := json.MarshalIndent(db, "", "  ")
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+
+	prefix := "bookmarkd-" + s.Name + "-"
+	if s.Owner != "" {
+		prefix = "bookmarkd-" + s.Owner + "-" + s.Name + "-"
+	}
+	filename := prefix + time.Now().UTC().Format("20060102-150405") + "." + cfg.Format
+	if dataCipher != nil {
+		sealed := sealData(buf.Bytes())
+		buf.Reset()
+		buf.Write(sealed)
+		filename += ".enc"
+	}
+
+	if cfg.URL != "" {
+		req, err := http.NewRequest("PUT", cfg.URL+"/"+url.PathEscape(filename), &buf)
+		if err != nil {
+			return err
+		}
+		resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("upload returned %s", resp.Status)
+		}
+		slog.Info("Backup: uploaded", "file", filename)
+		return nil
+	}
+
+	if err := os.MkdirAll(cfg.Dir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(cfg.Dir, filename), buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	slog.Info("Backup: wrote", "file", filename)
+	return pruneBackups(cfg, prefix)
+}
+
+// pruneBackups removes all but the newest cfg.Keep exports with the given
+// prefix. The timestamped names sort chronologically.
+func pruneBackups(cfg backupConfig, prefix string) error {
+	if cfg.Keep == 0 {
+		return nil
+	}
+	files, err := os.ReadDir(cfg.Dir)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, file := range files {
+		// checking the timestamp keeps collection "a" from matching "a-b"
+		rest, ok := strings.CutPrefix(file.Name(), prefix)
+		if file.IsDir() || !ok || len(rest) < 16 || rest[15] != '.' {
+			continue
+		}
+		if _, err := time.Parse("20060102-150405", rest[:15]); err == nil {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	for len(names) > cfg.Keep {
+		if err := os.Remove(filepath.Join(cfg.Dir, names[0])); err != nil {
+			return err
+		}
+		names = names[1:]
+	}
+	return nil
+}
+
+// --- Pinboard API ---
+
+// apiTokenValid reports whether token matches BOOKMARKD_API_TOKEN, which
+// guards the third-party compatibility APIs. They are disabled while no
+// token is configured.
+func apiTokenValid(token string) bool {
+	want := os.Getenv("BOOKMARKD_API_TOKEN")
+	return want != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+const pinboardTimeFormat = "2006-01-02T15:04:05Z"
+
+type pinboardPost struct {
+	XMLName     xml.Name `json:"-" xml:"post"`
+	Href        string   `json:"href" xml:"href,attr"`
+	Description string   `json:"description" xml:"description,attr"`
+	Extended    string   `json:"extended" xml:"extended,attr"`
+	Meta        string   `json:"meta" xml:"meta,attr"`
+	Hash        string   `json:"hash" xml:"hash,attr"`
+	Time        string   `json:"time" xml:"time,attr"`
+	Shared      string   `json:"shared" xml:"shared,attr"`
+	ToRead      string   `json:"toread" xml:"toread,attr"`
+	Tags        string   `json:"tags" xml:"tag,attr"`
+}
+
+func newPinboardPost(bm Bookmark) pinboardPost {
+	tags := strings.Join(bm.Tags, " ")
+	toRead := "no"
+	if bm.LastVisited == nil {
+		toRead = "yes"
+	}
+	shared := "yes"
+	if bm.Private {
+		shared = "no"
+	}
+	return pinboardPost{
+		Href:        bm.URL,
+		Description: bm.Title,
+		Extended:    bm.Notes,
+		Meta:        fmt.Sprintf("%x", md5.Sum([]byte(bm.Title+"\x00"+bm.Notes+"\x00"+tags))),
+		Hash:        fmt.Sprintf("%x", md5.Sum([]byte(bm.URL))),
+		Time:        time.Unix(bm.Timestamp, 0).UTC().Format(pinboardTimeFormat),
+		Shared:      shared,
+		ToRead:      toRead,
+		Tags:        tags,
+	}
+}
+
+type pinboardResult struct {
+	XMLName xml.Name `json:"-" xml:"result"`
+	Code    string   `json:"result_code" xml:"code,attr"`
+}
+
+type pinboardUpdate struct {
+	XMLName xml.Name `json:"-" xml:"update"`
+	Time    string   `json:"update_time" xml:"time,attr"`
+}
+
+type pinboardTag struct {
+	Count int    `xml:"count,attr"`
+	Tag   string `xml:"tag,attr"`
+}
+
+// writePinboard answers in Pinboard's default XML, or JSON with format=json.
+func writePinboard(w http.ResponseWriter, r *http.Request, v any) {
+	if r.Form.Get("format") == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(v)
+		return
+	}
+
+	switch list := v.(type) {
+	case map[string]int:
+		tags := make([]pinboardTag, 0, len(list))
+		for _, tag := range slices.Sorted(maps.Keys(list)) {
+			tags = append(tags, pinboardTag{Count: list[tag], Tag: tag})
+		}
+		v = struct {
+			XMLName xml.Name      `xml:"tags"`
+			Tags    []pinboardTag `xml:"tag"`
+		}{Tags: tags}
+	case []pinboardPost:
+		v = struct {
+			XMLName xml.Name       `xml:"posts"`
+			User    string         `xml:"user,attr"`
+			Posts   []pinboardPost `xml:"post"`
+		}{User: "bookmarkd", Posts: list}
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	io.WriteString(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		slog.ErrorContext(r.Context(), "Pinboard API: could not encode response", "err", err)
+	}
+}
+
+// handlePinboardAPI implements the subset of the Pinboard v1 API used by
+// clients and browser extensions: posts/update, posts/add, posts/all,
+// posts/delete and tags/get. Authentication is ?auth_token=user:TOKEN.
+func handlePinboardAPI(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Invalid form", http.StatusBadRequest)
+		return
+	}
+
+	token := r.Form.Get("auth_token")
+	if i := strings.LastIndex(token, ":"); i != -1 {
+		token = token[i+1:]
+	}
+	if !apiTokenValid(token) {
+		authFailed(r, "")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	s = fullStore(r)
+
+	switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/pinboard/v1/"), "/") {
+	case "posts/update":
+		updated := time.Now()
+		if info, err := os.Stat(s.path); err == nil {
+			updated = info.ModTime()
+		}
+		writePinboard(w, r, pinboardUpdate{Time: updated.UTC().Format(pinboardTimeFormat)})
+	case "posts/add":
+		pinboardAdd(w, r, s)
+	case "posts/all":
+		pinboardAll(w, r, s)
+	case "posts/delete":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		id := uuid.NewSHA1(uuid.NameSpaceURL, []byte(canonicalURL(r.Form.Get("url")))).String()
+		if !s.removeBookmark(id) {
+			writePinboard(w, r, pinboardResult{Code: "item not found"})
+			return
+		}
+		s.saveDatabase()
+		writePinboard(w, r, pinboardResult{Code: "done"})
+	case "tags/get":
+		s.mu.RLock()
+		counts := make(map[string]int)
+		for _, bm := range s.bookmarks {
+			for _, tag := range bm.Tags {
+				counts[tag]++
+			}
+		}
+		s.mu.RUnlock()
+		writePinboard(w, r, counts)
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func pinboardAdd(w http.ResponseWriter, r *http.Request, s *Store) {
+	pageURL := r.Form.Get("url")
+	if pageURL == "" {
+		writePinboard(w, r, pinboardResult{Code: "missing url"})
+		return
+	}
+	if !validBookmarkURL(pageURL) {
+		writePinboard(w, r, pinboardResult{Code: "invalid url"})
+		return
+	}
+	pageURL = canonicalURL(pageURL)
+	title := r.Form.Get("description")
+	if title == "" {
+		writePinboard(w, r, pinboardResult{Code: "must provide title"})
+		return
+	}
+
+	timestamp := time.Now().Unix()
+	if dt := r.Form.Get("dt"); dt != "" {
+		t, err := time.Parse(time.RFC3339, dt)
+		if err != nil {
+			writePinboard(w, r, pinboardResult{Code: "invalid dt"})
+			return
+		}
+		timestamp = t.Unix()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := uuid.NewSHA1(uuid.NameSpaceURL, []byte(pageURL)).String()
+	bm, exists := s.bookmarks[id]
+	if exists && r.Form.Get("replace") == "no" {
+		writePinboard(w, r, pinboardResult{Code: "item already exists"})
+		return
+	}
+	if !exists {
+		bm = Bookmark{
+			ID:         id,
+			URL:        pageURL,
+			CategoryID: uncategorizedID,
+			Order:      s.maxOrderInCategory(uncategorizedID) + 1,
+		}
+	}
+	bm.Title = title
+	bm.Notes = r.Form.Get("extended")
+	bm.Tags = cleanTags(strings.Fields(strings.ReplaceAll(r.Form.Get("tags"), ",", " ")))
+	bm.Timestamp = timestamp
+	if shared := r.Form.Get("shared"); shared != "" {
+		bm.Private = shared == "no"
+	}
+
+	s.putBookmark(bm)
+	s.saveDatabase()
+	writePinboard(w, r, pinboardResult{Code: "done"})
+}
+
+// pinboardAll lists posts newest first, filtered by up to three tags, a
+// fromdt/todt window and paged with start/results.
+func pinboardAll(w http.ResponseWriter, r *http.Request, s *Store) {
+	var from, to int64
+	for name, dst := range map[string]*int64{"fromdt": &from, "todt": &to} {
+		if v := r.Form.Get(name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+			*dst = t.Unix()
+		}
+	}
+	tags := strings.Fields(strings.ToLower(r.Form.Get("tag")))
+
+	s.mu.RLock()
+	var list []Bookmark
+	for _, bm := range s.bookmarks {
+		if (from != 0 && bm.Timestamp < from) || (to != 0 && bm.Timestamp > to) {
+			continue
+		}
+		if slices.ContainsFunc(tags, func(t string) bool { return !slices.Contains(bm.Tags, t) }) {
+			continue
+		}
+		list = append(list, bm)
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Timestamp != list[j].Timestamp {
+			return list[i].Timestamp > list[j].Timestamp
+		}
+		return list[i].URL < list[j].URL
+	})
+
+	start, _ := strconv.Atoi(r.Form.Get("start"))
+	if start > 0 {
+		list = list[min(start, len(list)):]
+	}
+	if n, err := strconv.Atoi(r.Form.Get("results")); err == nil && n >= 0 && n < len(list) {
+		list = list[:n]
+	}
+
+	posts := make([]pinboardPost, len(list))
+	for i, bm := range list {
+		posts[i] = newPinboardPost(bm)
+	}
+	writePinboard(w, r, posts)
+}
+
+// --- linkding API ---
+
+// withLinkding routes requests authenticated with linkding's
+// "Authorization: Token <token>" header to the linkding-compatible API,
+// which shares its /api/bookmarks/ and /api/tags/ paths with ours. Other
+// requests go to next, or get a 404 if next is nil.
+func withLinkding(next func(http.ResponseWriter, *http.Request, *Store)) func(http.ResponseWriter, *http.Request, *Store) {
+	return func(w http.ResponseWriter, r *http.Request, s *Store) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Token ")
+		if !ok {
+			if next == nil {
+				http.NotFound(w, r)
+				return
+			}
+			next(w, r, s)
+			return
+		}
+		if !apiTokenValid(token) {
+			authFailed(r, "")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handleLinkdingAPI(w, r, fullStore(r))
+	}
+}
+
+type linkdingBookmark struct {
+	ID                    int64    `json:"id"`
+	URL                   string   `json:"url"`
+	Title                 string   `json:"title"`
+	Description           string   `json:"description"`
+	Notes                 string   `json:"notes"`
+	WebArchiveSnapshotURL string   `json:"web_archive_snapshot_url"`
+	FaviconURL            string   `json:"favicon_url"`
+	PreviewImageURL       string   `json:"preview_image_url"`
+	WebsiteTitle          string   `json:"website_title"`
+	WebsiteDescription    string   `json:"website_description"`
+	IsArchived            bool     `json:"is_archived"`
+	Unread                bool     `json:"unread"`
+	Shared                bool     `json:"shared"`
+	TagNames              []string `json:"tag_names"`
+	DateAdded             string   `json:"date_added"`
+	DateModified          string   `json:"date_modified"`
+}
+
+type linkdingPage[T any] struct {
+	Count    int     `json:"count"`
+	Next     *string `json:"next"`
+	Previous *string `json:"previous"`
+	Results  []T     `json:"results"`
+}
+
+// intID maps a bookmark ID to the integer IDs that linkding and Shaarli
+// clients expect. It is a 53-bit hash so it survives JavaScript clients.
+func intID(id string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	return int64(h.Sum64() >> 11)
+}
+
+func newLinkdingBookmark(bm Bookmark) linkdingBookmark {
+	added := formatUnix(bm.Timestamp)
+	tags := bm.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return linkdingBookmark{
+		ID:              intID(bm.ID),
+		URL:             bm.URL,
+		Title:           bm.Title,
+		Description:     bm.Meta["description"],
+		Notes:           bm.Notes,
+		FaviconURL:      bm.Favicon,
+		PreviewImageURL: bm.Meta["cover"],
+		Unread:          bm.LastVisited == nil,
+		Shared:          !bm.Private,
+		TagNames:        tags,
+		DateAdded:       added,
+		DateModified:    added,
+	}
+}
+
+// linkdingPageLinks builds the next/previous URLs of a limit/offset page.
+func linkdingPageLinks(r *http.Request, total, limit, offset int) (next, previous *string) {
+	link := func(o int) *string {
+		u := *r.URL
+		u.Scheme, u.Host = "http", r.Host
+		u.Path, u.RawPath = requestBase(r)+u.Path, ""
+		if r.TLS != nil {
+			u.Scheme = "https"
+		}
+		q := u.Query()
+		q.Set("limit", strconv.Itoa(limit))
+		q.Set("offset", strconv.Itoa(o))
+		u.RawQuery = q.Encode()
+		s := u.String()
+		return &s
+	}
+	if offset+limit < total {
+		next = link(offset + limit)
+	}
+	if offset > 0 {
+		previous = link(max(offset-limit, 0))
+	}
+	return next, previous
+}
+
+// findByIntID resolves an ID produced by intID. Callers must hold s.mu.
+func (s *Store) findByIntID(idStr string) (Bookmark, bool) {
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return Bookmark{}, false
+	}
+	for _, bm := range s.bookmarks {
+		if intID(bm.ID) == id {
+			return bm, true
+		}
+	}
+	return Bookmark{}, false
+}
+
+// handleLinkdingAPI implements the part of linkding's REST API used by its
+// browser extension and mobile apps: listing, checking, creating, updating
+// and deleting bookmarks, and listing tags.
+func handleLinkdingAPI(w http.ResponseWriter, r *http.Request, s *Store) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/")
+
+	switch {
+	case path == "bookmarks" && r.Method == "GET":
+		linkdingList(w, r, s)
+	case path == "bookmarks" && r.Method == "POST":
+		linkdingSave(w, r, s, "")
+	case path == "bookmarks/archived" && r.Method == "GET":
+		writeJSON(w, http.StatusOK, linkdingPage[linkdingBookmark]{Results: []linkdingBookmark{}})
+	case path == "bookmarks/check" && r.Method == "GET":
+		linkdingCheck(w, r, s)
+	case path == "tags" && r.Method == "GET":
+		linkdingTags(w, r, s)
+	case strings.HasPrefix(path, "bookmarks/"):
+		id := strings.TrimPrefix(path, "bookmarks/")
+		switch r.Method {
+		case "GET":
+			s.mu.RLock()
+			bm, ok := s.findByIntID(id)
+			s.mu.RUnlock()
+			if !ok {
+				http.Error(w, "Bookmark not found", http.StatusNotFound)
+				return
+			}
+			writeJSON(w, http.StatusOK, newLinkdingBookmark(bm))
+		case "PUT", "PATCH":
+			linkdingSave(w, r, s, id)
+		case "DELETE":
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			bm, ok := s.findByIntID(id)
+			if !ok {
+				http.Error(w, "Bookmark not found", http.StatusNotFound)
+				return
+			}
+			s.removeBookmark(bm.ID)
+			s.saveDatabase()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.Error(w, "Not found", http.StatusNotFound)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// linkdingList supports linkding's q (with #tag terms), limit and offset.
+func linkdingList(w http.ResponseWriter, r *http.Request, s *Store) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit == 0 {
+		limit = 100
+	}
+
+	var terms []string
+	for _, term := range strings.Fields(r.URL.Query().Get("q")) {
+		if tag, ok := strings.CutPrefix(term, "#"); ok {
+			term = "tag:" + tag
+		}
+		terms = append(terms, term)
+	}
+	query := strings.Join(terms, " ")
+
+	s.mu.RLock()
+	list := s.searchCandidates(query)
+	s.mu.RUnlock()
+	if query != "" {
+		list = searchBookmarks(list, query)
+	} else {
+		sort.SliceStable(list, func(i, j int) bool { return list[i].Timestamp > list[j].Timestamp })
+	}
+
+	page := linkdingPage[linkdingBookmark]{Count: len(list), Results: []linkdingBookmark{}}
+	page.Next, page.Previous = linkdingPageLinks(r, len(list), limit, offset)
+	for _, bm := range paginate(list, limit, offset) {
+		page.Results = append(page.Results, newLinkdingBookmark(bm))
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func linkdingCheck(w http.ResponseWriter, r *http.Request, s *Store) {
+	pageURL := canonicalURL(r.URL.Query().Get("url"))
+	id := uuid.NewSHA1(uuid.NameSpaceURL, []byte(pageURL)).String()
+
+	s.mu.RLock()
+	bm, exists := s.bookmarks[id]
+	s.mu.RUnlock()
+
+	var result struct {
+		Bookmark *linkdingBookmark `json:"bookmark"`
+		Metadata struct {
+			URL         string `json:"url"`
+			Title       string `json:"title"`
+			Description string `json:"description"`
+		} `json:"metadata"`
+		AutoTags []string `json:"auto_tags"`
+	}
+	result.Metadata.URL = pageURL
+	result.AutoTags = []string{}
+	if exists {
+		lb := newLinkdingBookmark(bm)
+		result.Bookmark = &lb
+		result.Metadata.Title = bm.Title
+		result.Metadata.Description = bm.Meta["description"]
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// linkdingSave creates a bookmark (id == "") or updates the bookmark with the
+// given linkding ID. Creating an existing URL updates it, as linkding does.
+// Fields missing from the payload are left unchanged.
+func linkdingSave(w http.ResponseWriter, r *http.Request, s *Store, id string) {
+	var payload struct {
+		URL         *string   `json:"url"`
+		Title       *string   `json:"title"`
+		Description *string   `json:"description"`
+		Notes       *string   `json:"notes"`
+		Unread      *bool     `json:"unread"`
+		Shared      *bool     `json:"shared"`
+		TagNames    *[]string `json:"tag_names"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if payload.URL != nil {
+		*payload.URL = canonicalURL(*payload.URL)
+	}
+	title := ""
+	if payload.Title != nil {
+		title = *payload.Title
+	}
+
+	// new bookmarks get the page's metadata, fetched before locking
+	var info pageInfo
+	sourceURL := ""
+	if id == "" && payload.URL != nil && validBookmarkURL(*payload.URL) {
+		s.mu.RLock()
+		_, exists := s.bookmarks[uuid.NewSHA1(uuid.NameSpaceURL, []byte(*payload.URL)).String()]
+		s.mu.RUnlock()
+		if !exists {
+			info = fetchPageInfo(*payload.URL)
+			if final := resolvedURL(*payload.URL, info); final != "" {
+				sourceURL, *payload.URL = *payload.URL, final
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := http.StatusOK
+	var bm Bookmark
+	if id != "" {
+		var ok bool
+		if bm, ok = s.findByIntID(id); !ok {
+			http.Error(w, "Bookmark not found", http.StatusNotFound)
+			return
+		}
+	} else {
+		if payload.URL == nil || *payload.URL == "" {
+			http.Error(w, "Missing url", http.StatusBadRequest)
+			return
+		}
+		if !validBookmarkURL(*payload.URL) {
+			http.Error(w, invalidURLMessage(), http.StatusUnprocessableEntity)
+			return
+		}
+		var exists bool
+		bm, exists = s.bookmarks[uuid.NewSHA1(uuid.NameSpaceURL, []byte(*payload.URL)).String()]
+		if !exists {
+			status = http.StatusCreated
+			bm = Bookmark{
+				ID:           uuid.NewSHA1(uuid.NameSpaceURL, []byte(*payload.URL)).String(),
+				URL:          *payload.URL,
+				Title:        titleOrFetched(title, *payload.URL, info),
+				CategoryID:   uncategorizedID,
+				Timestamp:    time.Now().Unix(),
+				Favicon:      info.Favicon,
+				Order:        s.maxOrderInCategory(uncategorizedID) + 1,
+				Description:  info.Description,
+				Image:        info.Image,
+				CanonicalURL: info.Canonical,
+				SourceURL:    sourceURL,
+			}
+		}
+	}
+
+	if payload.URL != nil && *payload.URL != canonicalURL(bm.URL) {
+		http.Error(w, "Changing the url of a bookmark is not supported", http.StatusBadRequest)
+		return
+	}
+	if payload.Title != nil && status != http.StatusCreated {
+		bm.Title = *payload.Title
+	}
+	if payload.Notes != nil {
+		bm.Notes = *payload.Notes
+	}
+	if payload.Description != nil {
+		meta := maps.Clone(bm.Meta)
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta["description"] = *payload.Description
+		bm.Meta = cleanMeta(meta)
+	}
+	if payload.TagNames != nil {
+		bm.Tags = cleanTags(*payload.TagNames)
+	}
+	if payload.Shared != nil {
+		bm.Private = !*payload.Shared
+	}
+	if payload.Unread != nil {
+		if *payload.Unread {
+			bm.LastVisited = nil
+		} else if bm.LastVisited == nil {
+			now := time.Now().Unix()
+			bm.LastVisited = &now
+		}
+	}
+
+	s.putBookmark(bm)
+	s.saveDatabase()
+	writeJSON(w, status, newLinkdingBookmark(bm))
+}
+
+func linkdingTags(w http.ResponseWriter, r *http.Request, s *Store) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if limit == 0 {
+		limit = 100
+	}
+
+	// a tag's date_added is when its oldest bookmark was added
+	added := make(map[string]int64)
+	s.mu.RLock()
+	for _, bm := range s.bookmarks {
+		for _, tag := range bm.Tags {
+			if ts, ok := added[tag]; !ok || bm.Timestamp < ts {
+				added[tag] = bm.Timestamp
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	type linkdingTag struct {
+		ID        int64  `json:"id"`
+		Name      string `json:"name"`
+		DateAdded string `json:"date_added"`
+	}
+	tags := slices.Sorted(maps.Keys(added))
+	page := linkdingPage[linkdingTag]{Count: len(tags), Results: []linkdingTag{}}
+	page.Next, page.Previous = linkdingPageLinks(r, len(tags), limit, offset)
+	for _, tag := range paginate(tags, limit, offset) {
+		page.Results = append(page.Results, linkdingTag{ID: intID("tag:" + tag), Name: tag, DateAdded: formatUnix(added[tag])})
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// --- Shaarli API ---
+
+// shaarliTokenMaxAge is how far a JWT's iat may be from the current time,
+// matching Shaarli's own tolerance.
+const shaarliTokenMaxAge = 9 * time.Minute
+
+// shaarliTokenValid checks a Shaarli API JWT: HS512-signed with
+// BOOKMARKD_API_TOKEN as the secret and issued within shaarliTokenMaxAge.
+func shaarliTokenValid(token string) bool {
+	secret := os.Getenv("BOOKMARKD_API_TOKEN")
+	parts := strings.Split(token, ".")
+	if secret == "" || len(parts) != 3 {
+		return false
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	var claims struct {
+		Iat int64 `json:"iat"`
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(headerJSON, &header) != nil || header.Alg != "HS512" {
+		return false
+	}
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || json.Unmarshal(claimsJSON, &claims) != nil {
+		return false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return false
+	}
+
+	age := time.Since(time.Unix(claims.Iat, 0))
+	return age < shaarliTokenMaxAge && age > -shaarliTokenMaxAge
+}
+
+type shaarliLink struct {
+	ID          int64    `json:"id"`
+	URL         string   `json:"url"`
+	ShortURL    string   `json:"shorturl"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	Tags        []string `json:"tags"`
+	Private     bool     `json:"private"`
+	Created     string   `json:"created"`
+	Updated     string   `json:"updated"`
+}
+
+func newShaarliLink(bm Bookmark) shaarliLink {
+	id := intID(bm.ID)
+	tags := bm.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	return shaarliLink{
+		ID:          id,
+		URL:         bm.URL,
+		ShortURL:    strconv.FormatInt(id, 36),
+		Title:       bm.Title,
+		Description: bm.Notes,
+		Tags:        tags,
+		Private:     bm.Private,
+		Created:     time.Unix(bm.Timestamp, 0).Format(time.RFC3339),
+	}
+}
+
+// handleShaarliAPI implements Shaarli's REST API v1 (info, links and tags) so
+// Shaarli clients and share plugins can post to bookmarkd.
+func handleShaarliAPI(w http.ResponseWriter, r *http.Request, s *Store) {
+	if !shaarliTokenValid(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")) {
+		if r.Header.Get("Authorization") != "" {
+			authFailed(r, "")
+		}
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "Not authorized"})
+		return
+	}
+	s = fullStore(r)
+
+	resource, id, _ := strings.Cut(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/"), "/"), "/")
+
+	switch {
+	case resource == "info" && r.Method == "GET":
+		s.mu.RLock()
+		count, private := len(s.bookmarks), 0
+		for _, bm := range s.bookmarks {
+			if bm.Private {
+				private++
+			}
+		}
+		s.mu.RUnlock()
+		writeJSON(w, http.StatusOK, map[string]any{
+			"global_counter":  count,
+			"private_counter": private,
+			"settings": map[string]any{
+				"title":                 "bookmarkd",
+				"header_link":           "/",
+				"timezone":              time.Local.String(),
+				"enabled_plugins":       []string{},
+				"default_private_links": false,
+			},
+		})
+	case resource == "links" && id == "" && r.Method == "GET":
+		shaarliList(w, r, s)
+	case resource == "links" && id == "" && r.Method == "POST":
+		shaarliSave(w, r, s, "")
+	case resource == "links" && id != "" && r.Method == "GET":
+		s.mu.RLock()
+		bm, ok := s.findByIntID(id)
+		s.mu.RUnlock()
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Link not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, newShaarliLink(bm))
+	case resource == "links" && id != "" && r.Method == "PUT":
+		shaarliSave(w, r, s, id)
+	case resource == "links" && id != "" && r.Method == "DELETE":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		bm, ok := s.findByIntID(id)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Link not found"})
+			return
+		}
+		s.removeBookmark(bm.ID)
+		s.saveDatabase()
+		w.WriteHeader(http.StatusNoContent)
+	case resource == "tags" && r.Method == "GET":
+		shaarliTags(w, r, s, id)
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"message": "Not found"})
+	}
+}
+
+// shaarliList supports offset, limit (a number or "all", default 20),
+// searchterm and searchtags. Links are listed newest first.
+func shaarliList(w http.ResponseWriter, r *http.Request, s *Store) {
+	q := r.URL.Query()
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	limit := 20
+	if v := q.Get("limit"); v == "all" {
+		limit = 0
+	} else if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		limit = n
+	}
+
+	terms := strings.Fields(q.Get("searchterm"))
+	for _, tag := range strings.Fields(q.Get("searchtags")) {
+		terms = append(terms, "tag:"+tag)
+	}
+	query := strings.Join(terms, " ")
+
+	s.mu.RLock()
+	list := s.searchCandidates(query)
+	s.mu.RUnlock()
+	if query != "" {
+		list = searchBookmarks(list, query)
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Timestamp > list[j].Timestamp })
+
+	links := []shaarliLink{}
+	for _, bm := range paginate(list, limit, max(offset, 0)) {
+		links = append(links, newShaarliLink(bm))
+	}
+	writeJSON(w, http.StatusOK, links)
+}
+
+// shaarliSave creates a link (id == "") or replaces the link with the given
+// ID. Posting a URL that already exists returns 409 with the existing link.
+func shaarliSave(w http.ResponseWriter, r *http.Request, s *Store, id string) {
+	var payload struct {
+		URL         string   `json:"url"`
+		Title       string   `json:"title"`
+		Description string   `json:"description"`
+		Tags        []string `json:"tags"`
+		Private     bool     `json:"private"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Invalid JSON"})
+		return
+	}
+	payload.URL = canonicalURL(payload.URL)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := http.StatusOK
+	var bm Bookmark
+	if id != "" {
+		var ok bool
+		if bm, ok = s.findByIntID(id); !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Link not found"})
+			return
+		}
+		if payload.URL != "" && payload.URL != canonicalURL(bm.URL) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Changing the url of a link is not supported"})
+			return
+		}
+	} else {
+		if payload.URL == "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"message": "Missing url"})
+			return
+		}
+		if !validBookmarkURL(payload.URL) {
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]string{"message": invalidURLMessage()})
+			return
+		}
+		newID := uuid.NewSHA1(uuid.NameSpaceURL, []byte(payload.URL)).String()
+		if existing, exists := s.bookmarks[newID]; exists {
+			writeJSON(w, http.StatusConflict, newShaarliLink(existing))
+			return
+		}
+		status = http.StatusCreated
+		bm = Bookmark{
+			ID:         newID,
+			URL:        payload.URL,
+			CategoryID: uncategorizedID,
+			Timestamp:  time.Now().Unix(),
+			Order:      s.maxOrderInCategory(uncategorizedID) + 1,
+		}
+	}
+
+	bm.Title = payload.Title
+	if bm.Title == "" {
+		bm.Title = bm.URL
+	}
+	bm.Notes = payload.Description
+	bm.Tags = cleanTags(payload.Tags)
+	bm.Private = payload.Private
+
+	s.putBookmark(bm)
+	s.saveDatabase()
+	writeJSON(w, status, newShaarliLink(bm))
+}
+
+// shaarliTags lists tags by number of occurrences, or returns a single tag.
+func shaarliTags(w http.ResponseWriter, r *http.Request, s *Store, name string) {
+	type shaarliTag struct {
+		Name        string `json:"name"`
+		Occurrences int    `json:"occurrences"`
+	}
+
+	counts := make(map[string]int)
+	s.mu.RLock()
+	for _, bm := range s.bookmarks {
+		for _, tag := range bm.Tags {
+			counts[tag]++
+		}
+	}
+	s.mu.RUnlock()
+
+	if name != "" {
+		name, _ = url.PathUnescape(name)
+		if counts[name] == 0 {
+			writeJSON(w, http.StatusNotFound, map[string]string{"message": "Tag not found"})
+			return
+		}
+		writeJSON(w, http.StatusOK, shaarliTag{Name: name, Occurrences: counts[name]})
+		return
+	}
+
+	tags := make([]shaarliTag, 0, len(counts))
+	for tag, n := range counts {
+		tags = append(tags, shaarliTag{Name: tag, Occurrences: n})
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Occurrences != tags[j].Occurrences {
+			return tags[i].Occurrences > tags[j].Occurrences
+		}
+		return tags[i].Name < tags[j].Name
+	})
+
+	offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v == "all" {
+		limit = 0
+	} else if n, err := strconv.Atoi(v); err == nil && n > 0 {
+		limit = n
+	}
+	writeJSON(w, http.StatusOK, paginate(tags, limit, max(offset, 0)))
+}
+
+// --- xBrowserSync ---
+
+// xbsSync is one xBrowserSync sync. Bookmarks are encrypted by the client;
+// the server only stores the blob.
+type xbsSync struct {
+	Bookmarks   string    `json:"bookmarks"`
+	Version     string    `json:"version"`
+	LastUpdated time.Time `json:"lastUpdated"`
+	LastAccess  time.Time `json:"lastAccessed"`
+}
+
+const xbsAPIVersion = "1.1.13"
+
+// Timestamps are kept at millisecond precision because clients echo
+// lastUpdated back through JavaScript dates for conflict detection.
+
+// xbsMaxSyncSize is the largest encrypted payload accepted, in bytes.
+const xbsMaxSyncSize = 512000
+
+var (
+	xbsSyncs = make(map[string]*xbsSync)
+	xbsMu    sync.RWMutex
+)
+
+var xbsIDRe = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+func loadXBSSyncs() {
+	data, err := loadDataFile(xbsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Could not load xBrowserSync data", "err", err)
+		}
+		return
+	}
+
+	xbsMu.Lock()
+	defer xbsMu.Unlock()
+	if err := json.Unmarshal(data, &xbsSyncs); err != nil {
+		slog.Warn("Could not parse xBrowserSync data", "err", err)
+		xbsSyncs = make(map[string]*xbsSync)
+	}
+}
+
+// saveXBSSyncs persists all syncs. Callers must hold xbsMu.
+func saveXBSSyncs() {
+	data, err := json.MarshalIndent(xbsSyncs, "", "  ")
+	if err != nil {
+		slog.Error("Could not marshal xBrowserSync data", "err", err)
+		return
+	}
+	if err := writeDataFile(xbsFile, data, 0600); err != nil {
+		slog.Error("Could not save xBrowserSync data", "err", err)
+	}
+}
+
+func writeXBSError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, map[string]string{"code": code, "message": message})
+}
+
+// handleXBrowserSyncAPI implements the xBrowserSync service API under
+// /xbrowsersync/, so the xBrowserSync extensions can use bookmarkd as their
+// sync service. Set BOOKMARKD_XBS_NEW_SYNCS=false to stop new syncs from
+// being created.
+func handleXBrowserSyncAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/xbrowsersync/"), "/")
+	acceptNew := os.Getenv("BOOKMARKD_XBS_NEW_SYNCS") != "false"
+
+	if path == "info" && r.Method == "GET" {
+		message := ""
+		if !acceptNew {
+			message = "This service is not accepting new syncs."
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"maxSyncSize": xbsMaxSyncSize,
+			"message":     message,
+			"status":      1,
+			"version":     xbsAPIVersion,
+		})
+		return
+	}
+
+	if path == "bookmarks" && r.Method == "POST" {
+		if !acceptNew {
+			writeXBSError(w, http.StatusMethodNotAllowed, "NewSyncsForbiddenException", "The service is not accepting new syncs")
+			return
+		}
+		var payload struct {
+			Version string `json:"version"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeXBSError(w, http.StatusBadRequest, "InvalidArgumentException", "Invalid JSON")
+			return
+		}
+
+		id := strings.ReplaceAll(uuid.NewString(), "-", "")
+		now := time.Now().UTC().Truncate(time.Millisecond)
+		xbsMu.Lock()
+		xbsSyncs[id] = &xbsSync{Version: payload.Version, LastUpdated: now, LastAccess: now}
+		saveXBSSyncs()
+		xbsMu.Unlock()
+
+		writeJSON(w, http.StatusOK, map[string]any{"id": id, "lastUpdated": now, "version": payload.Version})
+		return
+	}
+
+	rest, ok := strings.CutPrefix(path, "bookmarks/")
+	if !ok {
+		writeXBSError(w, http.StatusNotFound, "NotImplementedException", "The requested route has not been implemented")
+		return
+	}
+	id, field, _ := strings.Cut(rest, "/")
+	if !xbsIDRe.MatchString(id) {
+		writeXBSError(w, http.StatusUnauthorized, "InvalidArgumentException", "Invalid sync ID")
+		return
+	}
+
+	xbsMu.Lock()
+	defer xbsMu.Unlock()
+
+	xs, exists := xbsSyncs[id]
+	if !exists {
+		writeXBSError(w, http.StatusUnauthorized, "SyncNotFoundException", "Sync does not exist")
+		return
+	}
+	xs.LastAccess = time.Now().UTC().Truncate(time.Millisecond)
+
+	switch {
+	case r.Method == "GET" && field == "":
+		writeJSON(w, http.StatusOK, map[string]any{"bookmarks": xs.Bookmarks, "lastUpdated": xs.LastUpdated, "version": xs.Version})
+	case r.Method == "GET" && field == "lastUpdated":
+		writeJSON(w, http.StatusOK, map[string]any{"lastUpdated": xs.LastUpdated})
+	case r.Method == "GET" && field == "version":
+		writeJSON(w, http.StatusOK, map[string]any{"version": xs.Version})
+	case r.Method == "PUT" && field == "":
+		var payload struct {
+			Bookmarks   string     `json:"bookmarks"`
+			LastUpdated *time.Time `json:"lastUpdated"`
+			Version     string     `json:"version"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			writeXBSError(w, http.StatusBadRequest, "InvalidArgumentException", "Invalid JSON")
+			return
+		}
+		if len(payload.Bookmarks) > xbsMaxSyncSize {
+			writeXBSError(w, http.StatusRequestEntityTooLarge, "SyncDataLimitExceededException", "Sync data limit exceeded")
+			return
+		}
+		// clients send the lastUpdated they last saw; a mismatch means
+		// another device synced in between
+		if payload.LastUpdated != nil && !payload.LastUpdated.Equal(xs.LastUpdated) {
+			writeXBSError(w, http.StatusConflict, "SyncConflictException", "A sync conflict was detected")
+			return
+		}
+
+		xs.Bookmarks = payload.Bookmarks
+		if payload.Version != "" {
+			xs.Version = payload.Version
+		}
+		xs.LastUpdated = time.Now().UTC().Truncate(time.Millisecond)
+		saveXBSSyncs()
+		writeJSON(w, http.StatusOK, map[string]any{"lastUpdated": xs.LastUpdated})
+	default:
+		writeXBSError(w, http.StatusMethodNotAllowed, "NotImplementedException", "The requested route has not been implemented")
+	}
+}
+
+// --- Wallabag ---
+
+// wallabagClient holds the OAuth token for the Wallabag instance configured
+// with the BOOKMARKD_WALLABAG_* variables.
+type wallabagClient struct {
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+var wallabag wallabagClient
+
+func wallabagURL() string {
+	return strings.TrimSuffix(os.Getenv("BOOKMARKD_WALLABAG_URL"), "/")
+}
+
+// accessToken returns a cached token or requests a new one with the
+// password grant.
+func (c *wallabagClient) accessToken() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token != "" && time.Now().Before(c.expires) {
+		return c.token, nil
+	}
+
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).PostForm(wallabagURL()+"/oauth/v2/token", url.Values{
+		"grant_type":    {"password"},
+		"client_id":     {os.Getenv("BOOKMARKD_WALLABAG_CLIENT_ID")},
+		"client_secret": {os.Getenv("BOOKMARKD_WALLABAG_CLIENT_SECRET")},
+		"username":      {os.Getenv("BOOKMARKD_WALLABAG_USERNAME")},
+		"password":      {os.Getenv("BOOKMARKD_WALLABAG_PASSWORD")},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("authentication failed: %s", resp.Status)
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	c.token = result.AccessToken
+	// renew a minute early so a token never expires mid-request
+	c.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return c.token, nil
+}
+
+// addEntry saves a URL to Wallabag and returns the new entry's ID.
+func (c *wallabagClient) addEntry(bm Bookmark) (int, error) {
+	token, err := c.accessToken()
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := json.Marshal(map[string]string{
+		"url":   bm.URL,
+		"title": bm.Title,
+		"tags":  strings.Join(bm.Tags, ","),
+	})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("POST", wallabagURL()+"/api/entries.json", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	// Wallabag fetches the article before answering, which can take a while
+	resp, err := (&http.Client{Timeout: time.Minute}).Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		if resp.StatusCode == http.StatusUnauthorized {
+			c.mu.Lock()
+			c.token = ""
+			c.mu.Unlock()
+		}
+		return 0, fmt.Errorf("wallabag returned %s", resp.Status)
+	}
+
+	var entry struct {
+		ID int `json:"id"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&entry); err != nil {
+		return 0, err
+	}
+	return entry.ID, nil
+}
+
+func sendToWallabag(w http.ResponseWriter, id string, s *Store) {
+	if wallabagURL() == "" {
+		http.Error(w, "Wallabag is not configured", http.StatusNotImplemented)
+		return
+	}
+
+	s.mu.RLock()
+	bm, exists := s.bookmarks[id]
+	s.mu.RUnlock()
+	if !exists {
+		http.Error(w, "Bookmark not found", http.StatusNotFound)
+		return
+	}
+
+	entryID, err := wallabag.addEntry(bm)
+	if err != nil {
+		slog.Error("Wallabag: sending failed", "url", bm.URL, "err", err)
+		http.Error(w, "Could not send to Wallabag", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"entry_id": entryID,
+		"url":      fmt.Sprintf("%s/view/%d", wallabagURL(), entryID),
+	})
+}
+
+// --- OpenAPI ---
+
+type apiParam struct {
+	Name        string
+	In          string // "query", "path" or "header"
+	Type        string
+	Description string
+	Enum        []string
+}
+
+// apiOperation describes one endpoint for the OpenAPI document. Body and
+// Response are zero values of the Go types the handler decodes and encodes;
+// their schemas are derived from the json struct tags.
+type apiOperation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Params      []apiParam
+	Body        any
+	Status      int
+	Response    any
+	ContentType string // response media type for non-JSON responses
+}
+
+var (
+	pathID       = apiParam{Name: "id", In: "path", Type: "string"}
+	pathName     = apiParam{Name: "name", In: "path", Type: "string"}
+	paramLimit   = apiParam{Name: "limit", In: "query", Type: "integer", Description: "Maximum number of results"}
+	paramOffset  = apiParam{Name: "offset", In: "query", Type: "integer", Description: "Number of results to skip"}
+	paramIfMatch = apiParam{Name: "If-Match", In: "header", Type: "string", Description: "Expected rev, e.g. \"3\""}
+	paramFields  = apiParam{Name: "fields", In: "query", Type: "string", Description: "Comma-separated JSON fields to return, e.g. id,url,title"}
+	paramQuery   = apiParam{Name: "q", In: "query", Type: "string", Description: "Search query; supports tag:, category:, site:, is:, before: and after:"}
+)
+
+// bookmarkFilterParams are the filters read by parseBookmarkFilter.
+var bookmarkFilterParams = []apiParam{
+	{Name: "category_id", In: "query", Type: "string"},
+	{Name: "domain", In: "query", Type: "string", Description: "Host, matching subdomains too"},
+	{Name: "has_notes", In: "query", Type: "boolean"},
+	{Name: "private", In: "query", Type: "boolean"},
+	{Name: "visited_since", In: "query", Type: "string", Description: "Date, RFC 3339 time or duration such as 7d"},
+	{Name: "added_since", In: "query", Type: "string", Description: "Date, RFC 3339 time or duration such as 7d"},
+	{Name: "link", In: "query", Type: "string", Description: "Health of the link at its last check", Enum: []string{linkOK, linkRedirected, linkBroken, linkUnchecked}},
+}
+
+var apiOperations = []apiOperation{
+	{Method: "GET", Path: "/bookmarks", Summary: "List and search bookmarks. The total before pagination is sent in X-Total-Count.", Params: append([]apiParam{
+		paramQuery, paramLimit, paramOffset, paramFields,
+		{Name: "since", In: "query", Type: "string", Description: "Delta sync: Unix timestamp (usually the last server_time). Returns {bookmarks, deleted, server_time} with what changed since then instead of a list; 410 if older than the 90 day deletion history"},
+		{Name: "sort", In: "query", Type: "string", Enum: []string{"title", "added", "last_visited", "visits"}},
+		{Name: "dir", In: "query", Type: "string", Enum: []string{"asc", "desc"}},
+	}, bookmarkFilterParams...), Response: []Bookmark{}},
+	{Method: "POST", Path: "/bookmarks/query", Summary: "Search bookmarks with a JSON filter tree of and/or/not nodes. The total before pagination is sent in X-Total-Count.", Params: []apiParam{paramFields}, Body: bookmarkQuery{}, Response: []Bookmark{}},
+	{Method: "PATCH", Path: "/bookmarks", Summary: "Change every bookmark matching the filters", Params: append([]apiParam{
+		paramQuery,
+		{Name: "all", In: "query", Type: "boolean", Description: "Required when no filter is given"},
+	}, bookmarkFilterParams...), Body: bookmarkBulkUpdate{}, Response: struct {
+		Affected int `json:"affected"`
+	}{}},
+	{Method: "POST", Path: "/bookmarks", Summary: "Create a bookmark", Body: bookmarkCreateRequest{}, Status: http.StatusCreated},
+	{Method: "POST", Path: "/bookmarks/batch", Summary: "Create many bookmarks at once; existing URLs are reported, not changed", Body: []bookmarkCreateRequest{}, Response: struct {
+		Created int           `json:"created"`
+		Results []batchResult `json:"results"`
+	}{}},
+	{Method: "GET", Path: "/bookmarks/{id}", Summary: "Get a bookmark; its rev is sent as ETag", Params: []apiParam{pathID}, Response: Bookmark{}},
+	{Method: "PATCH", Path: "/bookmarks/{id}", Summary: "Update fields of a bookmark. With If-Match, 412 if the bookmark's rev has changed.", Params: []apiParam{pathID, paramIfMatch}, Body: bookmarkUpdateRequest{}},
+	{Method: "DELETE", Path: "/bookmarks/{id}", Summary: "Delete a bookmark", Params: []apiParam{pathID}, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/bookmarks/{id}/visit", Summary: "Record a visit", Params: []apiParam{pathID}, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/bookmarks/{id}/archive-content", Summary: "Fetch the page and store a readable copy of its article (title, text and images); 502 if it can't be loaded", Params: []apiParam{pathID}, Status: http.StatusCreated, Response: Bookmark{}},
+	{Method: "GET", Path: "/bookmarks/{id}/archive", Summary: "The archived copy as a page, or with Accept: application/json as JSON", Params: []apiParam{pathID}, Response: pageArchive{}},
+	{Method: "POST", Path: "/bookmarks/{id}/wayback", Summary: "Queue the page for a Wayback Machine snapshot; its address is stored in wayback_url once taken", Params: []apiParam{pathID}, Status: http.StatusAccepted},
+	{Method: "POST", Path: "/bookmarks/{id}/fallback", Summary: "Set fallback_url to the Wayback Machine snapshot closest to when the bookmark was saved (empty if there is none)", Params: []apiParam{pathID}, Response: Bookmark{}},
+	{Method: "POST", Path: "/bookmarks/{id}/refresh-metadata", Summary: "Fetch the page again for its Open Graph description, image and canonical URL; 502 if it can't be loaded", Params: []apiParam{pathID}, Response: Bookmark{}},
+	{Method: "POST", Path: "/bookmarks/{id}/send/wallabag", Summary: "Save the bookmark to the configured Wallabag instance", Params: []apiParam{pathID}, Response: struct {
+		EntryID int    `json:"entry_id"`
+		URL     string `json:"url"`
+	}{}},
+	{Method: "GET", Path: "/categories", Summary: "List categories", Params: []apiParam{
+		{Name: "include", In: "query", Type: "string", Enum: []string{"saved_searches"}, Description: "Append saved searches as smart categories"},
+		paramFields,
+	}, Response: []Category{}},
+	{Method: "PUT", Path: "/categories/reorder", Summary: "Set the order of categories", Body: struct {
+		Order []string `json:"order"`
+	}{}},
+	{Method: "PUT", Path: "/categories/{id}/bookmarks/reorder", Summary: "Set the order of a category's bookmarks; listed bookmarks from other categories are moved in", Params: []apiParam{pathID}, Body: struct {
+		Order []string `json:"order"`
+	}{}},
+	{Method: "POST", Path: "/categories/{name}", Summary: "Create a category", Params: []apiParam{pathName}, Body: struct {
+		Color string `json:"color"`
+	}{}, Status: http.StatusCreated, Response: Category{}},
+	{Method: "PUT", Path: "/categories/{name}", Summary: "Rename, move or recolor a category. With If-Match, 412 if the category's rev has changed.", Params: []apiParam{pathName, paramIfMatch}, Body: struct {
+		Name  *string `json:"name"`
+		Order *int    `json:"order"`
+		Color *string `json:"color"`
+	}{}},
+	{Method: "DELETE", Path: "/categories/{name}", Summary: "Delete a category; its bookmarks become uncategorized", Params: []apiParam{pathName}, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/import/{format}", Summary: "Import bookmarks from a raw body or a multipart upload (file field)", Params: []apiParam{
+		{Name: "format", In: "path", Type: "string", Enum: slices.Sorted(maps.Keys(importFormats))},
+		{Name: "dry_run", In: "query", Type: "boolean", Description: "Return what would be created without saving"},
+		{Name: "strategy", In: "query", Type: "string", Enum: []string{importSkip, importOverwrite, importMerge, importKeepBoth}, Description: "What to do with URLs that are already bookmarked (default skip)"},
+		{Name: "limit", In: "query", Type: "integer", Description: "history: number of most visited URLs"},
+		{Name: "category", In: "query", Type: "string", Description: "history: category for the new bookmarks"},
+	}, Response: importResult{}},
+	{Method: "GET", Path: "/export/html", Summary: "Export as a Netscape bookmark file", ContentType: "text/html"},
+	{Method: "GET", Path: "/export/csv", Summary: "Export as CSV", ContentType: "text/csv"},
+	{Method: "GET", Path: "/export/markdown", Summary: "Export as Markdown", ContentType: "text/markdown"},
+	{Method: "GET", Path: "/export/opml", Summary: "Export as OPML", ContentType: "text/x-opml"},
+	{Method: "GET", Path: "/export/archive", Summary: "Download all collections, themes and favicons as a zip", ContentType: "application/zip"},
+	{Method: "GET", Path: "/tags/cloud", Summary: "Tag usage counts", Response: []tagUsage{}},
+	{Method: "GET", Path: "/events", Summary: "Stream change events as Server-Sent Events; resume with Last-Event-ID", Params: []apiParam{
+		{Name: "last_event_id", In: "query", Type: "string", Description: "Alternative to the Last-Event-ID header"},
+	}, ContentType: "text/event-stream"},
+	{Method: "GET", Path: "/changes", Summary: "Change feed: the latest change of every item after cursor, in seq order; continue from next_cursor while has_more. 410 if the cursor is older than the deletion history.", Params: []apiParam{
+		{Name: "cursor", In: "query", Type: "integer", Description: "next_cursor of the previous call; 0 or omitted for everything"},
+		{Name: "limit", In: "query", Type: "integer", Description: "Maximum number of changes (default 1000, at most 10000)"},
+	}, Response: changeFeed{}},
+	{Method: "GET", Path: "/activity", Summary: "Recent activity (bookmarks added, visited, moved or deleted, categories created or deleted), newest first", Params: []apiParam{
+		{Name: "limit", In: "query", Type: "integer", Description: "Maximum number of entries (default 50; the log keeps the latest 1000)"},
+	}, Response: []Activity{}},
+	{Method: "POST", Path: "/sync", Summary: "Apply change records pushed by a peer instance, resolving conflicts by last writer wins or field merge", Body: syncRequest{}, Response: syncReport{}},
+	{Method: "GET", Path: "/webhooks", Summary: "List webhooks", Response: []Webhook{}},
+	{Method: "POST", Path: "/webhooks", Summary: "Register a webhook; a secret is generated unless given", Body: Webhook{}, Status: http.StatusCreated, Response: Webhook{}},
+	{Method: "GET", Path: "/webhooks/{id}", Summary: "Get a webhook", Params: []apiParam{pathID}, Response: Webhook{}},
+	{Method: "PUT", Path: "/webhooks/{id}", Summary: "Replace a webhook's URL, events, collection and secret", Params: []apiParam{pathID}, Body: Webhook{}, Response: Webhook{}},
+	{Method: "DELETE", Path: "/webhooks/{id}", Summary: "Delete a webhook", Params: []apiParam{pathID}, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/tokens", Summary: "List API tokens (without the tokens themselves)", Response: []APIToken{}},
+	{Method: "POST", Path: "/tokens", Summary: "Create an API token; the token is only included in this response. A role limits the token below its owner's role.", Body: struct {
+		Name string `json:"name"`
+		Role string `json:"role,omitempty"`
+	}{}, Status: http.StatusCreated, Response: APIToken{}},
+	{Method: "DELETE", Path: "/tokens/{id}", Summary: "Revoke an API token", Params: []apiParam{pathID}, Status: http.StatusNoContent},
+	{Method: "POST", Path: "/signup", Summary: "Create a user account with collections of its own. Open to anyone with BOOKMARKD_SIGNUP=open, otherwise needs an admin. The first user becomes an admin.", Body: userCredentials{}, Status: http.StatusCreated, Response: loginResponse{}},
+	{Method: "POST", Path: "/login", Summary: "Get a token for a user account", Body: userCredentials{}, Response: loginResponse{}},
+	{Method: "GET", Path: "/me", Summary: "The user the request is authenticated as; 404 for the instance's credentials", Response: User{}},
+	{Method: "GET", Path: "/users", Summary: "List user accounts (admins only)", Response: []User{}},
+	{Method: "PATCH", Path: "/users/{id}", Summary: "Set a user's role: viewer, editor or admin (admins only)", Params: []apiParam{pathID}, Body: struct {
+		Role string `json:"role"`
+	}{}, Response: User{}},
+	{Method: "DELETE", Path: "/users/{id}", Summary: "Delete a user account with all its collections and tokens (admins only)", Params: []apiParam{pathID}, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/saved-searches", Summary: "List saved searches", Params: []apiParam{paramFields}, Response: []SavedSearch{}},
+	{Method: "POST", Path: "/saved-searches", Summary: "Create a saved search", Body: SavedSearch{}, Status: http.StatusCreated, Response: SavedSearch{}},
+	{Method: "GET", Path: "/saved-searches/{id}", Summary: "Run a saved search; accepts the GET /bookmarks parameters", Params: []apiParam{pathID}, Response: []Bookmark{}},
+	{Method: "PUT", Path: "/saved-searches/{id}", Summary: "Update a saved search", Params: []apiParam{pathID}, Body: SavedSearch{}},
+	{Method: "DELETE", Path: "/saved-searches/{id}", Summary: "Delete a saved search", Params: []apiParam{pathID}, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/collections", Summary: "List collections", Response: []collectionInfo{}},
+	{Method: "POST", Path: "/collections/{name}", Summary: "Create a collection", Params: []apiParam{pathName}, Status: http.StatusCreated, Response: collectionInfo{}},
+	{Method: "PUT", Path: "/collections/{name}", Summary: "Rename a collection", Params: []apiParam{pathName}, Body: struct {
+		Name string `json:"name"`
+	}{}},
+	{Method: "DELETE", Path: "/collections/{name}", Summary: "Delete a collection", Params: []apiParam{pathName}, Status: http.StatusNoContent},
+	{Method: "GET", Path: "/themes", Summary: "List custom themes", Response: []struct {
+		Name string `json:"name"`
+	}{}},
+	{Method: "POST", Path: "/themes", Summary: "Upload a custom theme", Body: struct {
+		CSS string `json:"css"`
+	}{}},
+	{Method: "POST", Path: "/admin/reload", Summary: "Read the collection's file again after it was changed outside bookmarkd; admins only", Response: reloadDiff{}},
+	{Method: "GET", Path: "/favicon", Summary: "Fetch an icon through the server's favicon cache, so browsers don't contact the host; only images are passed on", Params: []apiParam{
+		{Name: "url", In: "query", Type: "string", Description: "http(s) URL of the icon"},
+	}, ContentType: "image/*"},
+	{Method: "GET", Path: "/admin/stats", Summary: "Counts, disk usage and uptime of the instance; admins only", Response: adminStats{}},
+	{Method: "GET", Path: "/admin/jobs", Summary: "Background jobs with their schedule, last run and next run; admins only", Response: []jobStatus{}},
+	{Method: "POST", Path: "/admin/jobs/{name}/run", Summary: "Start a background job now, even if it is disabled; 409 while it is running; admins only", Params: []apiParam{
+		{Name: "name", In: "path", Type: "string"},
+	}, Status: http.StatusAccepted, Response: jobStatus{}},
+	{Method: "POST", Path: "/watch/check", Summary: "Check watched bookmarks for changes now", Response: map[string]string{}},
+	{Method: "GET", Path: "/links/health", Summary: "Counts of bookmarks by link health from the link checker, with the broken and redirected ones", Params: []apiParam{
+		{Name: "category_id", In: "query", Type: "string"},
+		{Name: "status", In: "query", Type: "string", Description: "List these instead of the broken and redirected ones", Enum: []string{linkOK, linkRedirected, linkBroken, linkUnchecked}},
+	}, Response: linkHealthReport{}},
+	{Method: "GET", Path: "/time-tracking/{domain}", Summary: "Time spent on a domain", Params: []apiParam{
+		{Name: "domain", In: "path", Type: "string"},
+	}, Response: DomainTimeData{}},
+	{Method: "POST", Path: "/time-tracking/{domain}", Summary: "Record time spent on a domain", Params: []apiParam{
+		{Name: "domain", In: "path", Type: "string"},
+	}, Body: TimeEntry{}},
+}
+
+// openAPISchemas collects the component schemas of named struct types while
+// the document is built.
+type openAPISchemas map[string]any
+
+func (c openAPISchemas) schema(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		return c.schema(t.Elem())
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": c.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": c.schema(t.Elem())}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Struct:
+		if t == reflect.TypeOf(time.Time{}) {
+			return map[string]any{"type": "string", "format": "date-time"}
+		}
+	default:
+		return map[string]any{}
+	}
+
+	if t.Name() != "" {
+		ref := map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+		if _, done := c[t.Name()]; done {
+			return ref
+		}
+		c[t.Name()] = nil // placeholder for recursive types
+	}
+
+	props := make(map[string]any)
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name, opts, _ := strings.Cut(tag, ",")
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = c.schema(f.Type)
+		if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+			required = append(required, name)
+		}
+	}
+	obj := map[string]any{"type": "object", "properties": props}
+	if len(required) > 0 {
+		obj["required"] = required
+	}
+
+	if t.Name() == "" {
+		return obj
+	}
+	c[t.Name()] = obj
+	return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+}
+
+// openAPIDocument builds the OpenAPI 3 description of apiOperations, served
+// below base.
+func openAPIDocument(base string) map[string]any {
+	schemas := openAPISchemas{}
+	paths := make(map[string]map[string]any)
+
+	for _, op := range apiOperations {
+		operation := map[string]any{"summary": op.Summary}
+
+		var params []map[string]any
+		for _, p := range op.Params {
+			schema := map[string]any{"type": p.Type}
+			if len(p.Enum) > 0 {
+				schema["enum"] = p.Enum
+			}
+			param := map[string]any{"name": p.Name, "in": p.In, "schema": schema, "required": p.In == "path"}
+			if p.Description != "" {
+				param["description"] = p.Description
+			}
+			params = append(params, param)
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		if op.Body != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content":  map[string]any{"application/json": map[string]any{"schema": schemas.schema(reflect.TypeOf(op.Body))}},
+			}
+		}
+
+		status := op.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		response := map[string]any{"description": http.StatusText(status)}
+		switch {
+		case op.Response != nil:
+			response["content"] = map[string]any{"application/json": map[string]any{"schema": schemas.schema(reflect.TypeOf(op.Response))}}
+		case op.ContentType != "":
+			response["content"] = map[string]any{op.ContentType: map[string]any{"schema": map[string]any{"type": "string", "format": "binary"}}}
+		}
+		operation["responses"] = map[string]any{strconv.Itoa(status): response}
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = make(map[string]any)
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":       "bookmarkd API",
+			"version":     "1",
+			"description": "Every path can also be prefixed with /c/{collection} to address a collection other than the default one.",
+		},
+		"servers":    []map[string]any{{"url": base + strings.TrimSuffix(apiVersionPrefix, "/")}},
+		"paths":      paths,
+		"components": map[string]any{"schemas": schemas},
+	}
+}
+
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, openAPIDocument(requestBase(r)))
+}
+
+// apiDocsPage renders the OpenAPI document with Swagger UI.
+const apiDocsPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>bookmarkd API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>
+    SwaggerUIBundle({ url: "openapi.json", dom_id: "#swagger-ui" });
+  </script>
+</body>
+</html>
+`
+
+func handleAPIDocs(w http.ResponseWriter, r *http.Request) {
+	if _, ok := securityHeaders["Content-Security-Policy"]; ok && os.Getenv("BOOKMARKD_CSP") == "" {
+		// Swagger UI comes from unpkg
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline' https://unpkg.com; "+
+			"style-src 'unsafe-inline' https://unpkg.com; img-src * data:; object-src 'none'; base-uri 'self'")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, apiDocsPage)
+}
+
+// --- gRPC ---
+
+// The gRPC service described in bookmarkd.proto is served by hand: requests
+// are length-prefixed protobuf messages over HTTP/2 and the outcome is
+// reported in the grpc-status trailer. The protobuf wire format is encoded
+// and decoded directly below.
+
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcNotFound          = 5
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcUnauthenticated   = 16
+	grpcMaxMessageLength  = 4 << 20
+)
+
+const grpcPathPrefix = "/bookmarkd.v1.Bookmarks/"
+
+func protoAppendVarint(b []byte, v uint64) []byte {
+	for v >= 0x80 {
+		b = append(b, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(b, byte(v))
+}
+
+func protoAppendInt(b []byte, field int, v int64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protoAppendVarint(b, uint64(field)<<3)
+	return protoAppendVarint(b, uint64(v))
+}
+
+func protoAppendBytes(b []byte, field int, v []byte) []byte {
+	b = protoAppendVarint(b, uint64(field)<<3|2)
+	b = protoAppendVarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func protoAppendString(b []byte, field int, v string) []byte {
+	if v == "" {
+		return b
+	}
+	return protoAppendBytes(b, field, []byte(v))
+}
+
+// protoMessage is a decoded message: varint fields and length-delimited
+// fields by number. Other wire types are skipped.
+type protoMessage struct {
+	varints map[int]uint64
+	bytes   map[int][][]byte
+}
+
+func decodeProto(data []byte) (protoMessage, error) {
+	m := protoMessage{varints: make(map[int]uint64), bytes: make(map[int][][]byte)}
+	readVarint := func() (uint64, error) {
+		var v uint64
+		for shift := 0; shift < 64; shift += 7 {
+			if len(data) == 0 {
+				return 0, errors.New("truncated varint")
+			}
+			c := data[0]
+			data = data[1:]
+			v |= uint64(c&0x7f) << shift
+			if c < 0x80 {
+				return v, nil
+			}
+		}
+		return 0, errors.New("varint overflow")
+	}
+
+	for len(data) > 0 {
+		key, err := readVarint()
+		if err != nil {
+			return m, err
+		}
+		field, wire := int(key>>3), key&7
+		switch wire {
+		case 0:
+			if m.varints[field], err = readVarint(); err != nil {
+				return m, err
+			}
+		case 1, 5:
+			size := 8
+			if wire == 5 {
+				size = 4
+			}
+			if len(data) < size {
+				return m, errors.New("truncated fixed field")
+			}
+			data = data[size:]
+		case 2:
+			n, err := readVarint()
+			if err != nil {
+				return m, err
+			}
+			if uint64(len(data)) < n {
+				return m, errors.New("truncated field")
+			}
+			m.bytes[field] = append(m.bytes[field], data[:n])
+			data = data[n:]
+		default:
+			return m, fmt.Errorf("unsupported wire type %d", wire)
+		}
+	}
+	return m, nil
+}
+
+func (m protoMessage) str(field int) string {
+	if v := m.bytes[field]; len(v) > 0 {
+		return string(v[len(v)-1])
+	}
+	return ""
+}
+
+func (m protoMessage) strs(field int) []string {
+	var out []string
+	for _, v := range m.bytes[field] {
+		out = append(out, string(v))
+	}
+	return out
+}
+
+func (m protoMessage) int(field int) int {
+	return int(int32(m.varints[field]))
+}
+
+func encodeBookmarkProto(bm Bookmark) []byte {
+	var b []byte
+	b = protoAppendString(b, 1, bm.ID)
+	b = protoAppendString(b, 2, bm.URL)
+	b = protoAppendString(b, 3, bm.Title)
+	b = protoAppendString(b, 4, bm.CategoryID)
+	b = protoAppendString(b, 5, bm.Category)
+	b = protoAppendInt(b, 6, bm.Timestamp)
+	b = protoAppendString(b, 7, bm.Favicon)
+	b = protoAppendInt(b, 8, int64(bm.Order))
+	if bm.LastVisited != nil {
+		b = protoAppendInt(b, 9, *bm.LastVisited)
+	}
+	b = protoAppendInt(b, 10, int64(bm.VisitCount))
+	b = protoAppendString(b, 11, bm.Notes)
+	for _, tag := range bm.Tags {
+		b = protoAppendBytes(b, 12, []byte(tag))
+	}
+	for _, k := range slices.Sorted(maps.Keys(bm.Meta)) {
+		var entry []byte
+		entry = protoAppendString(entry, 1, k)
+		entry = protoAppendString(entry, 2, bm.Meta[k])
+		b = protoAppendBytes(b, 13, entry)
+	}
+	if bm.Private {
+		b = protoAppendInt(b, 14, 1)
+	}
+	b = protoAppendString(b, 15, bm.Description)
+	b = protoAppendString(b, 16, bm.Image)
+	b = protoAppendString(b, 17, bm.CanonicalURL)
+	b = protoAppendString(b, 18, bm.SourceURL)
+	return b
+}
+
+func encodeCategoryProto(c Category) []byte {
+	var b []byte
+	b = protoAppendString(b, 1, c.ID)
+	b = protoAppendString(b, 2, c.Name)
+	b = protoAppendInt(b, 3, int64(c.Order))
+	b = protoAppendString(b, 4, c.Color)
+	return b
+}
+
+func encodeChangeEventProto(ev changeEvent) []byte {
+	var b []byte
+	b = protoAppendString(b, 1, ev.Type)
+	b = protoAppendString(b, 2, ev.Collection)
+	b = protoAppendString(b, 3, ev.ID)
+	if ev.Bookmark != nil {
+		b = protoAppendBytes(b, 4, encodeBookmarkProto(*ev.Bookmark))
+	}
+	if ev.Category != nil {
+		b = protoAppendBytes(b, 5, encodeCategoryProto(*ev.Category))
+	}
+	b = protoAppendInt(b, 6, ev.Time)
+	for _, id := range ev.Order {
+		b = protoAppendString(b, 7, id)
+	}
+	return b
+}
+
+// readGRPCMessage reads the single length-prefixed request message.
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, errors.New("compressed messages are not supported")
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > grpcMaxMessageLength {
+		return nil, errors.New("message too large")
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	w.Write(header[:])
+	w.Write(msg)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func setGRPCStatus(w http.ResponseWriter, code int, message string) {
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(code))
+	if message != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", url.PathEscape(message))
+	}
+}
+
+// handleGRPC serves the bookmarkd.v1.Bookmarks service.
+func handleGRPC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC over HTTP/2 only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+
+	data, err := readGRPCMessage(r.Body)
+	if err != nil {
+		setGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+	req, err := decodeProto(data)
+	if err != nil {
+		setGRPCStatus(w, grpcInvalidArgument, err.Error())
+		return
+	}
+
+	method := strings.TrimPrefix(r.URL.Path, grpcPathPrefix)
+	if method == "WatchChanges" {
+		grpcWatchChanges(w, r, req.str(1))
+		return
+	}
+
+	s := getOwnerStore(requestOwner(r), req.str(1))
+	if s == nil {
+		setGRPCStatus(w, grpcNotFound, "collection not found")
+		return
+	}
+	s = s.visibleTo(r)
+
+	var resp []byte
+	code, message := grpcOK, ""
+	switch method {
+	case "ListBookmarks":
+		resp = grpcListBookmarks(s, req.str(2), req.int(3), req.int(4))
+	case "GetBookmark":
+		s.mu.RLock()
+		bm, exists := s.bookmarks[req.str(2)]
+		bm.Category = s.getCategoryName(bm.CategoryID)
+		s.mu.RUnlock()
+		if !exists {
+			code, message = grpcNotFound, "bookmark not found"
+			break
+		}
+		resp = encodeBookmarkProto(bm)
+	case "CreateBookmark":
+		resp, code, message = grpcCreateBookmark(s, req)
+	case "DeleteBookmark":
+		s.mu.Lock()
+		deleted := s.removeBookmark(req.str(2))
+		if deleted {
+			s.saveDatabase()
+		}
+		s.mu.Unlock()
+		if !deleted {
+			code, message = grpcNotFound, "bookmark not found"
+		}
+	case "ListCategories":
+		s.mu.RLock()
+		for _, cat := range s.categoriesToSortedSlice() {
+			resp = protoAppendBytes(resp, 1, encodeCategoryProto(cat))
+		}
+		s.mu.RUnlock()
+	default:
+		code, message = grpcUnimplemented, "unknown method "+method
+	}
+
+	if code == grpcOK {
+		writeGRPCMessage(w, resp)
+	}
+	setGRPCStatus(w, code, message)
+}
+
+func grpcListBookmarks(s *Store, query string, limit, offset int) []byte {
+	s.mu.RLock()
+	list := s.searchCandidates(query)
+	for i := range list {
+		list[i].Category = s.getCategoryName(list[i].CategoryID)
+	}
+	s.mu.RUnlock()
+	if query != "" {
+		list = searchBookmarks(list, query)
+	}
+
+	var resp []byte
+	for _, bm := range paginate(list, max(limit, 0), max(offset, 0)) {
+		resp = protoAppendBytes(resp, 1, encodeBookmarkProto(bm))
+	}
+	return protoAppendInt(resp, 2, int64(len(list)))
+}
+
+func grpcCreateBookmark(s *Store, req protoMessage) ([]byte, int, string) {
+	pageURL := req.str(2)
+	if pageURL == "" {
+		return nil, grpcInvalidArgument, "url is required"
+	}
+	if !validBookmarkURL(pageURL) {
+		return nil, grpcInvalidArgument, "url must be absolute and use one of the schemes " + strings.Join(urlSchemes, ", ")
+	}
+	pageURL = canonicalURL(pageURL)
+	info := fetchPageInfo(pageURL)
+	sourceURL := ""
+	if final := resolvedURL(pageURL, info); final != "" {
+		sourceURL, pageURL = pageURL, final
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	categoryID := s.resolveOrCreateCategory(req.str(4))
+	bm := Bookmark{
+		ID:           uuid.NewSHA1(uuid.NameSpaceURL, []byte(pageURL)).String(),
+		URL:          pageURL,
+		Title:        titleOrFetched(req.str(3), pageURL, info),
+		CategoryID:   categoryID,
+		Timestamp:    time.Now().Unix(),
+		Favicon:      info.Favicon,
+		Order:        s.maxOrderInCategory(categoryID) + 1,
+		Description:  info.Description,
+		Image:        info.Image,
+		CanonicalURL: info.Canonical,
+		SourceURL:    sourceURL,
+		Notes:        req.str(6),
+		Tags:         cleanTags(req.strs(5)),
+		Private:      req.int(7) != 0,
+	}
+	s.putBookmark(bm)
+	s.saveDatabase()
+
+	bm.Category = s.getCategoryName(categoryID)
+	return encodeBookmarkProto(bm), grpcOK, ""
+}
+
+// grpcWatchChanges streams change events until the client goes away.
+func grpcWatchChanges(w http.ResponseWriter, r *http.Request, collection string) {
+	owner := requestOwner(r)
+	if collection != "" && getOwnerStore(owner, collection) == nil {
+		setGRPCStatus(w, grpcNotFound, "collection not found")
+		return
+	}
+
+	private := canSeePrivate(r)
+
+	events, unsubscribe := changes.subscribe()
+	defer unsubscribe()
+	releaseSettings(r)
+
+	w.WriteHeader(http.StatusOK)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case ev := <-events:
+			if !private {
+				var ok bool
+				if ev, ok = publicEvent(ev); !ok {
+					continue
+				}
+			}
+			if ev.Owner == owner && (collection == "" || ev.Collection == collection) {
+				writeGRPCMessage(w, encodeChangeEventProto(ev))
+			}
+		}
+	}
+}
+
+// --- WebSocket ---
+
+// /ws pushes the change events of the selected collection to browsers as
+// JSON text messages, one event per message, so open dashboards and the
+// extension can refresh without polling. Messages from the client other
+// than ping and close are ignored. The RFC 6455 framing is done by hand.
+
+const (
+	websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xA
+
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 10 * time.Second
+	wsMaxFrame     = 1 << 16
+)
+
+func handleWebSocket(w http.ResponseWriter, r *http.Request, s *Store) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if !headerContains(r.Header, "Connection", "upgrade") || !headerContains(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "WebSocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "WebSocket not supported on this connection", http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	events, unsubscribe := changes.subscribe()
+	defer unsubscribe()
+	releaseSettings(r)
+
+	var writeMu sync.Mutex
+	send := func(op byte, payload []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		return writeWSFrame(conn, op, payload)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			op, payload, err := readWSFrame(rw.Reader)
+			if err != nil {
+				return
+			}
+			switch op {
+			case wsOpPing:
+				send(wsOpPong, payload)
+			case wsOpClose:
+				send(wsOpClose, payload)
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case <-shuttingDown:
+			send(wsOpClose, []byte{0x03, 0xe9}) // 1001 going away
+			return
+		case <-ticker.C:
+			if send(wsOpPing, nil) != nil {
+				return
+			}
+		case ev := <-events:
+			ev, ok := s.published(ev)
+			if !ok {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			if send(wsOpText, data) != nil {
+				return
+			}
+		}
+	}
+}
+
+// headerContains reports whether the comma-separated header has the token,
+// ignoring case.
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// writeWSFrame writes an unmasked, unfragmented server frame.
+func writeWSFrame(w io.Writer, op byte, payload []byte) error {
+	header := []byte{0x80 | op}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, byte(n))
+	case n <= 0xFFFF:
+		header = append(header, 126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, 127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// readWSFrame reads one client frame and unmasks its payload. Fragmented
+// messages come back frame by frame, which is fine since their content is
+// ignored.
+func readWSFrame(r io.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	op := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	n := uint64(header[1] & 0x7F)
+
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if !masked {
+		return 0, nil, errors.New("unmasked client frame")
+	}
+	if n > wsMaxFrame {
+		return 0, nil, errors.New("frame too large")
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return op, payload, nil
+}
+
+// --- Server-Sent Events ---
+
+const sseKeepAlive = 15 * time.Second
+
+// handleEvents streams the change events of the selected collection as
+// Server-Sent Events named after the event type, with the event JSON as
+// data. Event IDs are "<epoch>-<seq>"; a client reconnecting with
+// Last-Event-ID gets the events it missed, or a "reset" event telling it
+// to reload everything if they are no longer available.
+func handleEvents(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+	var since uint64
+	if epoch, seq, ok := strings.Cut(lastID, "-"); ok && epoch == changesEpoch {
+		since, _ = strconv.ParseUint(seq, 10, 64)
+	}
+
+	events, backlog, unsubscribe := changes.subscribeSince(since)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	rc := http.NewResponseController(w)
+
+	io.WriteString(w, "retry: 3000\n\n")
+	if lastID != "" && backlog == nil {
+		fmt.Fprintf(w, "event: reset\nid: %s-%d\ndata: {}\n\n", changesEpoch, changes.lastSeq())
+	}
+	for _, ev := range backlog {
+		if ev, ok := s.published(ev); ok {
+			writeSSE(w, ev)
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+	releaseSettings(r)
+
+	ticker := time.NewTicker(sseKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		case <-ticker.C:
+			io.WriteString(w, ": keep-alive\n\n")
+		case ev := <-events:
+			ev, ok := s.published(ev)
+			if !ok {
+				continue
+			}
+			writeSSE(w, ev)
+		}
+		if rc.Flush() != nil {
+			return
+		}
+	}
+}
+
+func writeSSE(w io.Writer, ev changeEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\nid: %s-%d\ndata: %s\n\n", ev.Type, changesEpoch, ev.Seq, data)
+}
+
+// --- Sync ---
+
+// Two instances (say a laptop and a VPS) mirror each other when one of them
+// has BOOKMARKD_SYNC_PEER set: every interval it pulls the peer's change
+// feed (GET /api/changes) and pushes its own changes to the peer's
+// POST /api/sync, for each of the instance's own collections (users'
+// collections are not mirrored). Both sides resolve conflicts
+// with the same rules, so they converge:
+//
+//   - lww: the version with the later UpdatedAt wins; ties go to the
+//     version that sorts last, so both sides pick the same one.
+//   - merge: like lww, but tags and meta keys of both versions are kept and
+//     visit counts and times take the maximum.
+//
+// An edit newer than a deletion resurrects the item. Categories with the
+// same name but different IDs are treated as the same category.
+
+type syncConfig struct {
+	Peer     string // base URL of the other instance, may contain user:password@
+	Interval time.Duration
+	Strategy string
+	Token    string // API token for the peer
+}
+
+func loadSyncConfig() (syncConfig, error) {
+	cfg := syncConfig{
+		Peer:     strings.TrimSuffix(os.Getenv("BOOKMARKD_SYNC_PEER"), "/"),
+		Token:    os.Getenv("BOOKMARKD_SYNC_TOKEN"),
+		Interval: 5 * time.Minute,
+		Strategy: cmp.Or(os.Getenv("BOOKMARKD_SYNC_STRATEGY"), "lww"),
+	}
+	if v := os.Getenv("BOOKMARKD_SYNC_INTERVAL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 10*time.Second {
+			return cfg, fmt.Errorf("invalid BOOKMARKD_SYNC_INTERVAL %q", v)
+		}
+		cfg.Interval = d
+	}
+	if !validSyncStrategy(cfg.Strategy) {
+		return cfg, fmt.Errorf("invalid BOOKMARKD_SYNC_STRATEGY %q", cfg.Strategy)
+	}
+	return cfg, nil
+}
+
+func validSyncStrategy(strategy string) bool {
+	return strategy == "lww" || strategy == "merge"
+}
+
+// syncState is how far a collection has been synced with the peer. It is
+// saved in the collection file.
+type syncState struct {
+	Peer       string `json:"peer"`
+	PullCursor uint64 `json:"pull_cursor"`
+	PushCursor uint64 `json:"push_cursor"`
+}
+
+type syncRequest struct {
+	Changes  []changeRecord `json:"changes"`
+	Strategy string         `json:"strategy,omitempty"`
+}
+
+type syncReport struct {
+	Applied int      `json:"applied"`           // remote version taken
+	Merged  int      `json:"merged"`            // both versions combined
+	Skipped int      `json:"skipped"`           // identical, or the local version won
+	Invalid []string `json:"invalid,omitempty"` // IDs of bookmarks refused for their URL
+}
+
+func (r *syncReport) add(o syncReport) {
+	r.Applied += o.Applied
+	r.Merged += o.Merged
+	r.Skipped += o.Skipped
+	r.Invalid = append(r.Invalid, o.Invalid...)
+}
+
+func startSync() {
+	cfg, err := loadSyncConfig()
+	if err != nil {
+		slog.Warn("Sync disabled", "err", err)
+		return
+	}
+	if cfg.Peer == "" {
+		return
+	}
+
+	slog.Info("Sync: mirroring with peer", "peer", redactURL(cfg.Peer), "interval", cfg.Interval, "strategy", cfg.Strategy)
+	go func() {
+		for {
+			for _, s := range ownerStores("") {
+				if err := syncWithPeer(cfg, s); err != nil {
+					slog.Error("Sync failed", "collection", s.Name, "err", err)
+				}
+			}
+			time.Sleep(cfg.Interval)
+		}
+	}()
+}
+
+// redactURL hides the password of a URL for logging.
+func redactURL(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		return u.Redacted()
+	}
+	return raw
+}
+
+var syncClient = &http.Client{Timeout: time.Minute}
+
+// do sends a request to the peer, with the API token if one is configured.
+func (cfg syncConfig) do(method, u string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cfg.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Token)
+	}
+	return syncClient.Do(req)
+}
+
+// syncWithPeer pulls the peer's changes to s, then pushes s's changes to
+// the peer. Cursors are saved after every page so an interrupted sync
+// resumes where it stopped.
+func syncWithPeer(cfg syncConfig, s *Store) error {
+	s.mu.Lock()
+	if s.syncState == nil || s.syncState.Peer != cfg.Peer {
+		s.syncState = &syncState{Peer: cfg.Peer}
+	}
+	state := *s.syncState
+	s.mu.Unlock()
+
+	var pulled syncReport
+	for {
+		u := fmt.Sprintf("%s/api/v1/changes?collection=%s&cursor=%d", cfg.Peer, url.QueryEscape(s.Name), state.PullCursor)
+		resp, err := cfg.do("GET", u, nil)
+		if err != nil {
+			return err
+		}
+		var feed changeFeed
+		err = json.NewDecoder(resp.Body).Decode(&feed)
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusGone || (resp.StatusCode == http.StatusBadRequest && state.PullCursor > 0) {
+			// the peer forgot old deletions or was reset; start over
+			state.PullCursor = 0
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("pull: peer returned %s", resp.Status)
+		}
+		if err != nil {
+			return fmt.Errorf("pull: %w", err)
+		}
+
+		s.mu.Lock()
+		pulled.add(s.applyChanges(feed.Changes, cfg.Strategy))
+		state.PullCursor = feed.NextCursor
+		s.syncState.PullCursor = feed.NextCursor
+		s.saveDatabase()
+		s.mu.Unlock()
+
+		if !feed.HasMore {
+			break
+		}
+	}
+
+	pushed := 0
+	for {
+		s.mu.RLock()
+		feed, err := s.changesSince(state.PushCursor, defaultChangesLimit)
+		s.mu.RUnlock()
+		if errors.Is(err, errCursorPruned) || (err != nil && state.PushCursor > 0) {
+			state.PushCursor = 0
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if len(feed.Changes) == 0 {
+			break
+		}
+
+		body, err := json.Marshal(syncRequest{Changes: feed.Changes, Strategy: cfg.Strategy})
+		if err != nil {
+			return err
+		}
+		resp, err := cfg.do("POST", cfg.Peer+"/api/v1/sync?collection="+url.QueryEscape(s.Name), bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("push: peer returned %s", resp.Status)
+		}
+		pushed += len(feed.Changes)
+
+		s.mu.Lock()
+		state.PushCursor = feed.NextCursor
+		s.syncState.PushCursor = feed.NextCursor
+		s.saveDatabase()
+		s.mu.Unlock()
+
+		if !feed.HasMore {
+			break
+		}
+	}
+
+	if len(pulled.Invalid) > 0 {
+		slog.Warn("Sync: skipped bookmarks with invalid URLs", "collection", s.Name, "ids", pulled.Invalid)
+	}
+	if pulled.Applied+pulled.Merged > 0 || pushed > 0 {
+		slog.Info("Sync: done", "collection", s.Name, "applied", pulled.Applied, "merged", pulled.Merged, "pushed", pushed)
+	}
+	return nil
+}
+
+// handleSync applies changes pushed by a peer.
+func handleSync(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var payload syncRequest
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if payload.Strategy == "" {
+		cfg, _ := loadSyncConfig()
+		payload.Strategy = cfg.Strategy
+	}
+	if !validSyncStrategy(payload.Strategy) {
+		http.Error(w, "Invalid strategy", http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	report := s.applyChanges(payload.Changes, payload.Strategy)
+	if report.Applied+report.Merged > 0 {
+		s.saveDatabase()
+	}
+	s.mu.Unlock()
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// applyChanges merges change records from the peer into s. Callers must
+// hold s.mu.
+func (s *Store) applyChanges(records []changeRecord, strategy string) syncReport {
+	var report syncReport
+	for _, rec := range records {
+		var outcome string
+		switch {
+		case rec.Type == "category":
+			outcome = s.applyCategoryChange(rec)
+		case rec.Deleted:
+			outcome = s.applyBookmarkDeletion(rec)
+		case rec.Bookmark != nil:
+			outcome = s.applyBookmarkChange(*rec.Bookmark, strategy)
+		}
+		switch outcome {
+		case "applied":
+			report.Applied++
+		case "merged":
+			report.Merged++
+		case "invalid":
+			report.Invalid = append(report.Invalid, rec.Bookmark.ID)
+		default:
+			report.Skipped++
+		}
+	}
+	return report
+}
+
+func (s *Store) applyBookmarkChange(remote Bookmark, strategy string) string {
+	// peers may allow other schemes, or not check at all
+	if !validBookmarkURL(remote.URL) {
+		return "invalid"
+	}
+	// bookmarks follow their category by name, since IDs of categories
+	// created on both sides differ
+	if _, exists := s.categories[remote.CategoryID]; !exists {
+		remote.CategoryID = s.resolveOrCreateCategory(remote.Category)
+	}
+
+	local, exists := s.bookmarks[remote.ID]
+	if !exists {
+		if t, deleted := s.tombstones[remote.ID]; deleted && t.DeletedAt >= remote.UpdatedAt {
+			return "skipped"
+		}
+		s.putBookmarkAt(remote, remote.UpdatedAt)
+		return "applied"
+	}
+
+	if sameBookmark(local, remote) {
+		return "skipped"
+	}
+	if strategy == "merge" {
+		merged := mergeBookmarks(local, remote)
+		if remoteWins(local, remote) {
+			merged = mergeBookmarks(remote, local)
+		}
+		if sameBookmark(merged, local) {
+			return "skipped"
+		}
+		s.putBookmarkAt(merged, merged.UpdatedAt)
+		return "merged"
+	}
+	if !remoteWins(local, remote) {
+		return "skipped"
+	}
+	s.putBookmarkAt(remote, remote.UpdatedAt)
+	return "applied"
+}
+
+func (s *Store) applyBookmarkDeletion(rec changeRecord) string {
+	local, exists := s.bookmarks[rec.ID]
+	if !exists || local.UpdatedAt > rec.DeletedAt {
+		return "skipped"
+	}
+	s.removeBookmark(rec.ID)
+	return "applied"
+}
+
+func (s *Store) applyCategoryChange(rec changeRecord) string {
+	local, exists := s.categories[rec.ID]
+
+	if rec.Deleted {
+		if !exists || rec.ID == uncategorizedID || local.UpdatedAt > rec.DeletedAt {
+			return "skipped"
+		}
+		for _, bm := range s.bookmarks {
+			if bm.CategoryID == rec.ID {
+				bm.CategoryID = uncategorizedID
+				s.putBookmark(bm)
+			}
+		}
+		s.removeCategory(rec.ID)
+		return "applied"
+	}
+
+	remote := rec.Category
+	if remote == nil {
+		return "skipped"
+	}
+	if existing := s.getCategoryByName(remote.Name); existing != nil && existing.ID != remote.ID {
+		return "skipped"
+	}
+	if !exists {
+		if t, deleted := s.tombstones[remote.ID]; deleted && t.DeletedAt >= remote.UpdatedAt {
+			return "skipped"
+		}
+		s.putCategoryAt(*remote, remote.UpdatedAt)
+		return "applied"
+	}
+	if local.Name == remote.Name && local.Order == remote.Order && local.Color == remote.Color {
+		return "skipped"
+	}
+	if local.UpdatedAt > remote.UpdatedAt || (local.UpdatedAt == remote.UpdatedAt && local.Name+local.Color > remote.Name+remote.Color) {
+		return "skipped"
+	}
+	renamed := local.Name != remote.Name
+	s.putCategoryAt(*remote, remote.UpdatedAt)
+	if renamed {
+		s.reindexCategory(remote.ID)
+	}
+	return "applied"
+}
+
+// syncContent is the part of a bookmark that sync compares; sequence
+// numbers, revisions and the category name are local details.
+func syncContent(bm Bookmark) []byte {
+	bm.Seq, bm.Rev, bm.Category = 0, 0, ""
+	data, _ := json.Marshal(bm)
+	return data
+}
+
+func sameBookmark(a, b Bookmark) bool {
+	return bytes.Equal(syncContent(a), syncContent(b))
+}
+
+// remoteWins reports whether the remote version wins under last writer
+// wins. Both sides of a sync come to the same answer.
+func remoteWins(local, remote Bookmark) bool {
+	if local.UpdatedAt != remote.UpdatedAt {
+		return remote.UpdatedAt > local.UpdatedAt
+	}
+	return bytes.Compare(syncContent(remote), syncContent(local)) > 0
+}
+
+// mergeBookmarks combines two versions: the winner's fields, plus the
+// loser's tags and meta keys, and the larger visit statistics.
+func mergeBookmarks(winner, loser Bookmark) Bookmark {
+	merged := winner
+	merged.Tags = cleanTags(append(slices.Clone(winner.Tags), loser.Tags...))
+	if len(loser.Meta) > 0 {
+		merged.Meta = maps.Clone(loser.Meta)
+		maps.Copy(merged.Meta, winner.Meta)
+	}
+	merged.VisitCount = max(winner.VisitCount, loser.VisitCount)
+	if loser.LastVisited != nil && (merged.LastVisited == nil || *loser.LastVisited > *merged.LastVisited) {
+		merged.LastVisited = loser.LastVisited
+	}
+	return merged
+}
+
+// --- Webhooks ---
+
+// Webhooks receive every change event they subscribe to as a JSON POST.
+// The body is signed with HMAC-SHA256 using the webhook's secret and the
+// hex digest is sent as X-Bookmarkd-Signature: sha256=<digest>. Failed
+// deliveries are retried with growing delays.
+
+// Webhook is a registered receiver of change events. Empty Events means
+// every event type, empty Collection every collection.
+type Webhook struct {
+	ID         string   `json:"id"`
+	URL        string   `json:"url"`
+	Events     []string `json:"events,omitempty"`
+	Collection string   `json:"collection,omitempty"`
+	Secret     string   `json:"secret,omitempty"`
+	Created    int64    `json:"created"`
+}
+
+var (
+	webhooksMu sync.RWMutex
+	webhooks   = make(map[string]Webhook)
+)
+
+// webhookRetryDelays are the waits before the second and later delivery
+// attempts.
+var webhookRetryDelays = []time.Duration{10 * time.Second, time.Minute, 5 * time.Minute, 30 * time.Minute}
+
+var webhookEventTypes = []string{
+	eventBookmarkCreated, eventBookmarkUpdated, eventBookmarkDeleted,
+	eventCategoryCreated, eventCategoryUpdated, eventCategoryDeleted,
+	eventBookmarksReordered, eventCategoriesReordered,
+}
+
+func loadWebhooks() {
+	data, err := loadDataFile(webhooksFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Could not load webhooks", "err", err)
+		}
+		return
+	}
+
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+	if err := json.Unmarshal(data, &webhooks); err != nil {
+		slog.Warn("Could not parse webhooks", "err", err)
+		webhooks = make(map[string]Webhook)
+	}
+}
+
+// saveWebhooks persists all webhooks. Callers must hold webhooksMu.
+func saveWebhooks() {
+	data, err := json.MarshalIndent(webhooks, "", "  ")
+	if err != nil {
+		slog.Error("Could not marshal webhooks", "err", err)
+		return
+	}
+	if err := writeDataFile(webhooksFile, data, 0600); err != nil {
+		slog.Error("Could not save webhooks", "err", err)
+	}
+}
+
+func (wh Webhook) wants(ev changeEvent) bool {
+	return ev.Owner == "" && (wh.Collection == "" || wh.Collection == ev.Collection) &&
+		(len(wh.Events) == 0 || slices.Contains(wh.Events, ev.Type))
+}
+
+// startWebhooks delivers change events to the registered webhooks.
+func startWebhooks() {
+	events, _ := changes.subscribe()
+	go func() {
+		for ev := range events {
+			webhooksMu.RLock()
+			for _, wh := range webhooks {
+				if wh.wants(ev) {
+					go deliverWebhook(wh, ev)
+				}
+			}
+			webhooksMu.RUnlock()
+		}
+	}()
+}
+
+var webhookClient = &http.Client{Timeout: 15 * time.Second}
+
+// deliverWebhook posts ev to wh until it gets a 2xx response or the
+// retries are used up.
+func deliverWebhook(wh Webhook, ev changeEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	mac := hmac.New(sha256.New, []byte(wh.Secret))
+	mac.Write(body)
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	delivery := uuid.New().String()
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("POST", wh.URL, bytes.NewReader(body))
+		if err != nil {
+			slog.Warn("Webhook delivery failed", "webhook", wh.ID, "err", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "bookmarkd")
+		req.Header.Set("X-Bookmarkd-Event", ev.Type)
+		req.Header.Set("X-Bookmarkd-Delivery", delivery)
+		req.Header.Set("X-Bookmarkd-Signature", signature)
+
+		resp, err := webhookClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %s", resp.Status)
+		}
+
+		if attempt == len(webhookRetryDelays) {
+			slog.Error("Webhook: giving up on delivery", "webhook", wh.ID, "event", ev.Type, "delivery", delivery, "err", err)
+			return
+		}
+		time.Sleep(webhookRetryDelays[attempt])
+
+		// stop retrying if the webhook was deleted meanwhile
+		webhooksMu.RLock()
+		_, exists := webhooks[wh.ID]
+		webhooksMu.RUnlock()
+		if !exists {
+			return
+		}
+	}
+}
+
+// validateWebhook checks a webhook from a request and fills in defaults.
+func validateWebhook(wh *Webhook) error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("A valid http(s) URL is required")
+	}
+	for _, ev := range wh.Events {
+		if !slices.Contains(webhookEventTypes, ev) {
+			return fmt.Errorf("Unknown event type: %s", ev)
+		}
+	}
+	if wh.Collection != "" && getStore(wh.Collection) == nil {
+		return fmt.Errorf("Collection not found")
+	}
+	if wh.Secret == "" {
+		secret := make([]byte, 32)
+		rand.Read(secret)
+		wh.Secret = hex.EncodeToString(secret)
+	}
+	return nil
+}
+
+func handleWebhooksAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		webhooksMu.RLock()
+		list := slices.SortedFunc(maps.Values(webhooks), func(a, b Webhook) int { return cmp.Compare(a.Created, b.Created) })
+		webhooksMu.RUnlock()
+		if list == nil {
+			list = []Webhook{}
+		}
+		encodeList(w, r, list)
+		return
+	}
+
+	if r.Method == "POST" {
+		var wh Webhook
+		if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		if err := validateWebhook(&wh); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wh.ID = uuid.New().String()
+		wh.Created = time.Now().Unix()
+
+		webhooksMu.Lock()
+		webhooks[wh.ID] = wh
+		saveWebhooks()
+		webhooksMu.Unlock()
+
+		writeJSON(w, http.StatusCreated, wh)
+		return
+	}
+
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
+
+func handleWebhookAPI(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/webhooks/")
+
+	webhooksMu.Lock()
+	defer webhooksMu.Unlock()
+
+	existing, exists := webhooks[id]
+	if !exists {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		writeJSON(w, http.StatusOK, existing)
+	case "PUT":
+		var wh Webhook
+		if err := json.NewDecoder(r.Body).Decode(&wh); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+		wh.Secret = cmp.Or(wh.Secret, existing.Secret)
+		if err := validateWebhook(&wh); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		wh.ID, wh.Created = existing.ID, existing.Created
+		webhooks[id] = wh
+		saveWebhooks()
+		writeJSON(w, http.StatusOK, wh)
+	case "DELETE":
+		delete(webhooks, id)
+		saveWebhooks()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// --- Authentication ---
+
+// API tokens are sent as "Authorization: Bearer <token>", or as
+// ?access_token= where clients can't set headers (WebSocket, EventSource).
+// Once any token exists, requests that change data need one, and so do the
+// token and webhook endpoints and the archive export, which reveal secrets;
+// with BOOKMARKD_AUTH_READS=true every request does. Tokens are configured
+// in BOOKMARKD_TOKENS or created through /api/tokens, which only stores
+// their SHA-256.
+//
+// With BOOKMARKD_USER and BOOKMARKD_PASSWORD set, every request, UI
+// included, needs those as HTTP Basic credentials, a valid token or a
+// session cookie (see Sessions). The same goes once user accounts exist
+// (see Users); their Basic credentials, tokens and sessions select their
+// own collections. An authenticating reverse proxy can name the user in a
+// header instead (see Proxy Authentication).
+//
+// Every authenticated request has a role: viewers may only read, editors
+// may also change bookmarks, categories and collections, and admins may
+// manage users, webhooks, themes and archive exports as well. The
+// instance's credentials are admin; a user token can be limited to a lower
+// role than its user's. Without any credentials configured, everyone is
+// admin. requiredRole maps routes to roles.
+//
+// The compatibility APIs (Pinboard, linkding, Shaarli, xBrowserSync) keep
+// their own authentication.
+
+type APIToken struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	UserID  string `json:"user_id,omitempty"` // empty for the instance's tokens
+	Role    string `json:"role,omitempty"`    // limits the token below its user's role
+	Token   string `json:"token,omitempty"`   // only when created
+	Hash    string `json:"hash,omitempty"`    // hex SHA-256 of the token; not served
+	Created int64  `json:"created"`
+}
+
+type authConfig struct {
+	Tokens   []string // hex SHA-256 of the BOOKMARKD_TOKENS
+	Reads    bool
+	User     string // Basic auth, if set
+	Password string
+}
+
+var (
+	authCfg   authConfig
+	tokensMu  sync.RWMutex
+	apiTokens map[string]APIToken
+)
+
+func loadAuth() {
+	authCfg = authConfig{
+		Reads:    os.Getenv("BOOKMARKD_AUTH_READS") == "true",
+		User:     os.Getenv("BOOKMARKD_USER"),
+		Password: os.Getenv("BOOKMARKD_PASSWORD"),
+	}
+	if (authCfg.User == "") != (authCfg.Password == "") {
+		slog.Warn("Basic auth disabled: set both BOOKMARKD_USER and BOOKMARKD_PASSWORD")
+		authCfg.User, authCfg.Password = "", ""
+	}
+	if authCfg.User != "" {
+		authCfg.Reads = true
+	}
+	for _, token := range strings.Split(os.Getenv("BOOKMARKD_TOKENS"), ",") {
+		if token = strings.TrimSpace(token); token != "" {
+			authCfg.Tokens = append(authCfg.Tokens, hashToken(token))
+		}
+	}
+}
+
+// loadTokens reads the API tokens created through /api/tokens. Only
+// bookmarkd changes the file, so it is read once at startup.
+func loadTokens() {
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	apiTokens = make(map[string]APIToken)
+	data, err := loadDataFile(tokensFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Could not load API tokens", "err", err)
+		}
+		return
+	}
+	var list []APIToken
+	if err := json.Unmarshal(data, &list); err != nil {
+		slog.Warn("Could not parse API tokens", "err", err)
+		return
+	}
+	for _, t := range list {
+		apiTokens[t.ID] = t
+	}
+}
+
+// saveTokens persists the API tokens. Callers must hold tokensMu.
+func saveTokens() error {
+	list := slices.SortedFunc(maps.Values(apiTokens), func(a, b APIToken) int {
+		return cmp.Or(cmp.Compare(a.Created, b.Created), strings.Compare(a.ID, b.ID))
+	})
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeDataFile(tokensFile, data, 0600)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authEnabled reports whether Basic, proxy or LDAP auth is configured or
+// any API token or user account exists.
+func authEnabled() bool {
+	if authCfg.User != "" || proxyAuthCfg.Header != "" || ldapCfg.URL != nil || hasUsers() {
+		return true
+	}
+	tokensMu.RLock()
+	defer tokensMu.RUnlock()
+	return len(authCfg.Tokens) > 0 || len(apiTokens) > 0
+}
+
+// readsNeedAuth reports whether reads need credentials too.
+func readsNeedAuth() bool {
+	return authCfg.Reads || proxyAuthCfg.Header != "" || ldapCfg.URL != nil || hasUsers()
+}
+
+const (
+	roleViewer = "viewer"
+	roleEditor = "editor"
+	roleAdmin  = "admin"
+)
+
+var roleRank = map[string]int{roleViewer: 1, roleEditor: 2, roleAdmin: 3}
+
+// identity is who a request is authenticated as.
+type identity struct {
+	Owner   string // user ID, "" for the instance
+	Role    string
+	Session bool // signed in by session cookie; writes need a CSRF token
+}
+
+type identityKey struct{}
+
+// requestOwner returns the ID of the user a request is authenticated as,
+// or "" for the instance's own collections. Requests to a tenant without a
+// user of their own get the tenant's.
+func requestOwner(r *http.Request) string {
+	id, _ := r.Context().Value(identityKey{}).(identity)
+	if tenant := requestTenant(r); tenant != "" && id.Owner == "" {
+		return tenantOwner(tenant)
+	}
+	return id.Owner
+}
+
+// requestRole returns the role of the request's credentials. Requests
+// without any are viewers, or admins while no credentials are configured.
+func requestRole(r *http.Request) string {
+	if id, ok := r.Context().Value(identityKey{}).(identity); ok {
+		return id.Role
+	}
+	if !authEnabled() {
+		return roleAdmin
+	}
+	return roleViewer
+}
+
+// authenticate checks the request's token, proxy header, Basic credentials
+// or session cookie.
+func authenticate(r *http.Request) (identity, bool) {
+	if token := requestToken(r); token != "" {
+		return tokenIdentity(token)
+	}
+	if id, ok := proxyIdentity(r); ok {
+		return id, true
+	}
+	if user, password, found := r.BasicAuth(); found {
+		if authCfg.User != "" &&
+			subtle.ConstantTimeCompare([]byte(user), []byte(authCfg.User)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(authCfg.Password)) == 1 {
+			return identity{Role: roleAdmin}, true
+		}
+		if id, ok := userLogin(user, password); ok {
+			return identity{Owner: id, Role: userRole(id)}, true
+		}
+	}
+	return sessionIdentity(r)
+}
+
+func tokenIdentity(token string) (identity, bool) {
+	hash := []byte(hashToken(token))
+	valid := false
+	for _, want := range authCfg.Tokens {
+		valid = subtle.ConstantTimeCompare(hash, []byte(want)) == 1 || valid
+	}
+	if valid {
+		return identity{Role: roleAdmin}, true
+	}
+
+	tokensMu.RLock()
+	var found *APIToken
+	for _, t := range apiTokens {
+		if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) == 1 {
+			found = &t
+		}
+	}
+	tokensMu.RUnlock()
+	if found == nil {
+		return identity{}, false
+	}
+
+	role := roleAdmin
+	if found.UserID != "" {
+		role = userRole(found.UserID)
+	}
+	if found.Role != "" && roleRank[found.Role] < roleRank[role] {
+		role = found.Role
+	}
+	return identity{Owner: found.UserID, Role: role}, true
+}
+
+// requiredRole returns the least role a request needs.
+func requiredRole(r *http.Request, path string) string {
+	switch {
+	case path == "/api/users" || strings.HasPrefix(path, "/api/users/"),
+		path == "/api/webhooks" || strings.HasPrefix(path, "/api/webhooks/"),
+		path == "/api/export/archive",
+		strings.HasPrefix(path, "/api/admin/"),
+		path == "/api/themes" && r.Method != "GET",
+		isProfilingPath(path):
+		return roleAdmin
+	case path == "/api/tokens" || strings.HasPrefix(path, "/api/tokens/"),
+		isReadRequest(r, path):
+		return roleViewer
+	}
+	return roleEditor
+}
+
+// issueToken creates and saves a token; the result holds the token itself.
+func issueToken(owner, name, role string) (APIToken, error) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	token := APIToken{
+		ID:      uuid.New().String(),
+		Name:    name,
+		UserID:  owner,
+		Role:    role,
+		Token:   hex.EncodeToString(secret),
+		Created: time.Now().Unix(),
+	}
+	token.Hash = hashToken(token.Token)
+
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	stored := token
+	stored.Token = ""
+	apiTokens[token.ID] = stored
+	if err := saveTokens(); err != nil {
+		delete(apiTokens, token.ID)
+		return APIToken{}, err
+	}
+	token.Hash = ""
+	return token, nil
+}
+
+func requestToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// withAuth records who a request is authenticated as and refuses requests
+// that need credentials but lack valid ones. Invalid credentials on requests
+// that don't need any are ignored, as they may be meant for a proxy.
+func withAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "OPTIONS" || authExempt(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if hasCredentials(r) {
+			if wait := authLimiter.wait(rateLimitIP(r)); wait > 0 {
+				tooManyRequests(w, r, wait)
+				return
+			}
+		}
+		if id, ok := authenticate(r); ok {
+			if roleRank[id.Role] < roleRank[requiredRole(r, unversionedPath(r.URL.Path))] {
+				forbidden(w, r)
+				return
+			}
+			if id.Session && !validCSRF(r) {
+				setCORSHeaders(w, r)
+				http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+				return
+			}
+			renewSession(w, r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+			return
+		}
+		if !authRequired(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Path == "/" && r.Method == "GET" {
+			http.Redirect(w, r, requestBase(r)+"/auth/login", http.StatusSeeOther)
+			return
+		}
+		if hasCredentials(r) {
+			user, _, _ := r.BasicAuth()
+			authFailed(r, user)
+		}
+
+		if strings.HasPrefix(r.URL.Path, grpcPathPrefix) {
+			w.Header().Set("Content-Type", "application/grpc")
+			setGRPCStatus(w, grpcUnauthenticated, "missing or invalid API token")
+			return
+		}
+		setCORSHeaders(w, r)
+		if authCfg.User != "" || ldapCfg.URL != nil || hasUsers() {
+			w.Header().Set("WWW-Authenticate", `Basic realm="bookmarkd", charset="UTF-8"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="bookmarkd"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	})
+}
+
+// authExempt reports whether a request is left to its handler's own
+// authentication, or needs none.
+func authExempt(r *http.Request) bool {
+	path := r.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/static/"),
+		strings.HasPrefix(path, "/auth/"),
+		isHealthPath(path),
+		strings.HasPrefix(path, "/pinboard/"),
+		strings.HasPrefix(path, "/xbrowsersync/"),
+		isShaarliPath(path),
+		strings.HasPrefix(r.Header.Get("Authorization"), "Token ") && isLinkdingPath(path):
+		return true
+	}
+	path = unversionedPath(path)
+	return path == "/api/signup" || path == "/api/login"
+}
+
+// isLinkdingPath reports whether path is served by withLinkding, which
+// checks the linkding API token itself. /api/tags/cloud is not.
+func isLinkdingPath(path string) bool {
+	path = unversionedPath(path)
+	return path == "/api/bookmarks" || strings.HasPrefix(path, "/api/bookmarks/") ||
+		strings.HasPrefix(path, "/api/tags/") && path != "/api/tags/cloud"
+}
+
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, grpcPathPrefix) {
+		w.Header().Set("Content-Type", "application/grpc")
+		setGRPCStatus(w, grpcPermissionDenied, "permission denied")
+		return
+	}
+	setCORSHeaders(w, r)
+	http.Error(w, "Forbidden", http.StatusForbidden)
+}
+
+// authRequired reports whether a request without valid credentials is
+// refused: everything but reads, or everything with readsNeedAuth.
+func authRequired(r *http.Request) bool {
+	if !authEnabled() {
+		return false
+	}
+	path := unversionedPath(r.URL.Path)
+	if path == "/api/openapi.json" || path == "/api/docs" {
+		return readsNeedAuth()
+	}
+	return readsNeedAuth() || requiredRole(r, path) != roleViewer || path == "/api/tokens" || strings.HasPrefix(path, "/api/tokens/") ||
+		path == "/api/favicon"
+}
+
+// unversionedPath maps an /api/v1/ path to its /api/ alias.
+func unversionedPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, apiVersionPrefix); ok {
+		return "/api/" + rest
+	}
+	return path
+}
+
+// isReadRequest reports whether a request only reads data. A few POST
+// endpoints do.
+func isReadRequest(r *http.Request, path string) bool {
+	if r.Method == "GET" || r.Method == "HEAD" {
+		return true
+	}
+	if method, ok := strings.CutPrefix(path, grpcPathPrefix); ok {
+		return method != "CreateBookmark" && method != "DeleteBookmark"
+	}
+	return r.Method == "POST" && path == "/api/bookmarks/query"
+}
+
+func isShaarliPath(path string) bool {
+	switch {
+	case path == "/api/v1/info", path == "/api/v1/links", path == "/api/v1/tags",
+		strings.HasPrefix(path, "/api/v1/links/"),
+		strings.HasPrefix(path, "/api/v1/tags/") && path != "/api/v1/tags/cloud":
+		return true
+	}
+	return false
+}
+
+// handleTokensAPI lists and creates the tokens of the requesting user, or
+// the instance's.
+func handleTokensAPI(w http.ResponseWriter, r *http.Request) {
+	owner := requestOwner(r)
+	if r.Method == "GET" {
+		tokensMu.RLock()
+		list := slices.SortedFunc(maps.Values(apiTokens), func(a, b APIToken) int {
+			return cmp.Or(cmp.Compare(a.Created, b.Created), strings.Compare(a.ID, b.ID))
+		})
+		tokensMu.RUnlock()
+		list = slices.DeleteFunc(list, func(t APIToken) bool { return t.UserID != owner })
+		for i := range list {
+			list[i].Hash = ""
+		}
+		writeJSON(w, http.StatusOK, list)
+		return
+	}
+
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		http.Error(w, "Name is required", http.StatusBadRequest)
+		return
+	}
+	if req.Role != "" && (roleRank[req.Role] == 0 || roleRank[req.Role] > roleRank[requestRole(r)]) {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	token, err := issueToken(owner, req.Name, req.Role)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Could not save API tokens", "err", err)
+		http.Error(w, "Could not save token", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "API token created", "token", token.Name)
+	writeJSON(w, http.StatusCreated, token)
+}
+
+func handleTokenAPI(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/tokens/")
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tokensMu.Lock()
+	defer tokensMu.Unlock()
+	token, exists := apiTokens[id]
+	if !exists || token.UserID != requestOwner(r) {
+		http.Error(w, "Token not found", http.StatusNotFound)
+		return
+	}
+	delete(apiTokens, id)
+	if err := saveTokens(); err != nil {
+		apiTokens[id] = token
+		slog.ErrorContext(r.Context(), "Could not save API tokens", "err", err)
+		http.Error(w, "Could not delete token", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "API token revoked", "token", token.Name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- Users ---
+
+// User accounts let a family or team share one instance. Each user has
+// collections of their own, persisted below users/<id>/ and reached with the
+// user's Basic credentials or tokens; the instance's collections stay with
+// the instance's credentials. Anyone may sign up with BOOKMARKD_SIGNUP=open,
+// otherwise accounts are created by admins (or by anyone while no
+// credentials are configured). The first user becomes an admin, later ones
+// editors. Passwords are kept as salted PBKDF2-SHA256 hashes.
+
+type User struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	Role         string `json:"role"`
+	PasswordHash string `json:"password_hash,omitempty"` // not served; empty for OIDC-only users
+	OIDCSubject  string `json:"oidc_subject,omitempty"`  // sub claim of the user's OIDC identity
+	Created      int64  `json:"created"`
+}
+
+type userCredentials struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// loginResponse carries a token that authenticates further requests as the
+// user.
+type loginResponse struct {
+	User  User   `json:"user"`
+	Token string `json:"token"`
+}
+
+const (
+	passwordIterations = 600000
+	minPasswordLength  = 8
+)
+
+var usernameRe = regexp.MustCompile(`^[a-z0-9_.-]{1,64}$`)
+
+var (
+	usersMu sync.RWMutex
+	users   map[string]User
+
+	// verifiedLogins remembers Basic credentials that passed the slow
+	// password check, by SHA-256 of username and password.
+	verifiedLogins map[[32]byte]string
+)
+
+func loadUsers() {
+	usersMu.Lock()
+	users = make(map[string]User)
+	verifiedLogins = make(map[[32]byte]string)
+	data, err := loadDataFile(usersFile)
+	if err != nil {
+		usersMu.Unlock()
+		if !os.IsNotExist(err) {
+			slog.Warn("Could not load users", "err", err)
+		}
+		return
+	}
+	var list []User
+	if err := json.Unmarshal(data, &list); err != nil {
+		usersMu.Unlock()
+		slog.Warn("Could not parse users", "err", err)
+		return
+	}
+	for _, u := range list {
+		users[u.ID] = u
+	}
+	usersMu.Unlock()
+
+	for _, u := range list {
+		if err := openOwnerStores(u.ID); err != nil {
+			fatal("Could not read data file", "user", u.ID, "err", err)
+		}
+	}
+}
+
+// saveUsers persists the users. Callers must hold usersMu.
+func saveUsers() error {
+	list := slices.SortedFunc(maps.Values(users), func(a, b User) int {
+		return cmp.Or(cmp.Compare(a.Created, b.Created), strings.Compare(a.ID, b.ID))
+	})
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeDataFile(usersFile, data, 0600)
+}
+
+func hasUsers() bool {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	return len(users) > 0
+}
+
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, 32)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, enc.EncodeToString(salt), enc.EncodeToString(key)), nil
+}
+
+func checkPassword(hash, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+	enc := base64.RawStdEncoding
+	salt, err1 := enc.DecodeString(parts[2])
+	want, err2 := enc.DecodeString(parts[3])
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(want))
+	return err == nil && subtle.ConstantTimeCompare(key, want) == 1
+}
+
+// userLogin checks a user's credentials and returns the user's ID. Users
+// without a local password are checked against the directory (see LDAP).
+func userLogin(username, password string) (string, bool) {
+	cacheKey := sha256.Sum256([]byte(username + "\x00" + password))
+	usersMu.RLock()
+	id, cached := verifiedLogins[cacheKey]
+	var user User
+	found := false
+	for _, u := range users {
+		if u.Username == username {
+			user, found = u, true
+		}
+	}
+	usersMu.RUnlock()
+	if cached {
+		return id, true
+	}
+	if (!found || user.PasswordHash == "") && ldapCfg.URL != nil {
+		return ldapUserLogin(username, password)
+	}
+	if !found || !checkPassword(user.PasswordHash, password) {
+		return "", false
+	}
+
+	usersMu.Lock()
+	if _, exists := users[user.ID]; exists {
+		verifiedLogins[cacheKey] = user.ID
+	}
+	usersMu.Unlock()
+	return user.ID, true
+}
+
+// usernameFrom turns a name from an identity provider into a valid
+// username, or "".
+func usernameFrom(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || strings.ContainsRune("_.-", r) {
+			return r
+		}
+		return -1
+	}, strings.ToLower(strings.TrimSpace(name)))
+	return name[:min(len(name), 64)]
+}
+
+func signupAllowed(r *http.Request) bool {
+	if os.Getenv("BOOKMARKD_SIGNUP") == "open" || !authEnabled() {
+		return true
+	}
+	id, ok := authenticate(r)
+	return ok && id.Role == roleAdmin
+}
+
+// userRole returns a user's role; users saved before roles existed are
+// editors.
+func userRole(id string) string {
+	usersMu.RLock()
+	defer usersMu.RUnlock()
+	return cmp.Or(users[id].Role, roleEditor)
+}
+
+func handleSignup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !signupAllowed(r) {
+		http.Error(w, "Signup is closed", http.StatusForbidden)
+		return
+	}
+
+	var req userCredentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	req.Username = strings.ToLower(strings.TrimSpace(req.Username))
+	if !usernameRe.MatchString(req.Username) {
+		http.Error(w, "Invalid username", http.StatusBadRequest)
+		return
+	}
+	if len(req.Password) < minPasswordLength {
+		http.Error(w, fmt.Sprintf("Password must have at least %d characters", minPasswordLength), http.StatusBadRequest)
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, "Could not hash password", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := createUser(User{Username: req.Username, PasswordHash: hash})
+	if errors.Is(err, errUsernameTaken) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		slog.ErrorContext(r.Context(), "Could not save users", "err", err)
+		http.Error(w, "Could not save user", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "User signed up", "user", user.Username)
+
+	token, err := issueToken(user.ID, "login", "")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Could not save API tokens", "err", err)
+	}
+	user.PasswordHash = ""
+	writeJSON(w, http.StatusCreated, loginResponse{User: user, Token: token.Token})
+}
+
+var errUsernameTaken = errors.New("Username already taken")
+
+// createUser saves a new user and creates their default collection. The
+// first user becomes an admin, later ones editors.
+func createUser(user User) (User, error) {
+	user.ID = uuid.New().String()
+	user.Created = time.Now().Unix()
+
+	usersMu.Lock()
+	user.Role = roleEditor
+	if len(users) == 0 {
+		user.Role = roleAdmin
+	}
+	for _, u := range users {
+		if u.Username == user.Username {
+			usersMu.Unlock()
+			return User{}, errUsernameTaken
+		}
+	}
+	users[user.ID] = user
+	if err := saveUsers(); err != nil {
+		delete(users, user.ID)
+		usersMu.Unlock()
+		return User{}, err
+	}
+	usersMu.Unlock()
+
+	path := storePath(user.ID, defaultCollection)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		slog.Error("Could not create directory for user", "user", user.Username, "err", err)
+	}
+	s := newStore(user.ID, defaultCollection, path)
+	s.mu.Lock()
+	s.saveDatabase()
+	s.mu.Unlock()
+	registerStore(s)
+	return user, nil
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req userCredentials
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	id, ok := userLogin(strings.ToLower(strings.TrimSpace(req.Username)), req.Password)
+	if !ok {
+		authFailed(r, req.Username)
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+
+	token, err := issueToken(id, "login", "")
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Could not save API tokens", "err", err)
+		http.Error(w, "Could not save token", http.StatusInternalServerError)
+		return
+	}
+	usersMu.RLock()
+	user := users[id]
+	usersMu.RUnlock()
+	user.PasswordHash = ""
+	writeJSON(w, http.StatusOK, loginResponse{User: user, Token: token.Token})
+}
+
+func setUserRole(w http.ResponseWriter, r *http.Request, id string) {
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		return
+	}
+	if roleRank[req.Role] == 0 {
+		http.Error(w, "Invalid role", http.StatusBadRequest)
+		return
+	}
+
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	user, exists := users[id]
+	if !exists {
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	old := user.Role
+	user.Role = req.Role
+	users[id] = user
+	if err := saveUsers(); err != nil {
+		user.Role = old
+		users[id] = user
+		slog.ErrorContext(r.Context(), "Could not save users", "err", err)
+		http.Error(w, "Could not save user", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "User role changed", "user", user.Username, "role", user.Role)
+	user.PasswordHash = ""
+	writeJSON(w, http.StatusOK, user)
+}
+
+func handleMe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, _ := r.Context().Value(identityKey{}).(identity)
+	usersMu.RLock()
+	user, exists := users[id.Owner]
+	usersMu.RUnlock()
+	if !exists {
+		http.Error(w, "Not signed in as a user", http.StatusNotFound)
+		return
+	}
+	user.PasswordHash = ""
+	writeJSON(w, http.StatusOK, user)
+}
+
+func handleUsersAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usersMu.RLock()
+	list := slices.SortedFunc(maps.Values(users), func(a, b User) int {
+		return cmp.Or(cmp.Compare(a.Created, b.Created), strings.Compare(a.ID, b.ID))
+	})
+	usersMu.RUnlock()
+	for i := range list {
+		list[i].PasswordHash = ""
+	}
+	encodeList(w, r, list)
+}
+
+// handleUserAPI changes a user's role, or deletes a user together with
+// their collections, tokens and sessions.
+func handleUserAPI(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/users/")
+	if r.Method == "PATCH" {
+		setUserRole(w, r, id)
+		return
+	}
+	if r.Method != "DELETE" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usersMu.Lock()
+	user, exists := users[id]
+	if !exists {
+		usersMu.Unlock()
+		http.Error(w, "User not found", http.StatusNotFound)
+		return
+	}
+	delete(users, id)
+	clear(verifiedLogins)
+	err := saveUsers()
+	usersMu.Unlock()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Could not save users", "err", err)
+		http.Error(w, "Could not delete user", http.StatusInternalServerError)
+		return
+	}
+
+	tokensMu.Lock()
+	maps.DeleteFunc(apiTokens, func(_ string, t APIToken) bool { return t.UserID == id })
+	if err := saveTokens(); err != nil {
+		slog.ErrorContext(r.Context(), "Could not save API tokens", "err", err)
+	}
+	tokensMu.Unlock()
+
+	sessionsMu.Lock()
+	maps.DeleteFunc(sessions, func(_ string, s Session) bool { return s.UserID == id })
+	if err := saveSessions(); err != nil {
+		slog.ErrorContext(r.Context(), "Could not save sessions", "err", err)
+	}
+	sessionsMu.Unlock()
+
+	storesMu.Lock()
+	for key, s := range stores {
+		if s.Owner == id {
+			s.mu.Lock()
+			s.path = ""
+			s.mu.Unlock()
+			delete(stores, key)
+		}
+	}
+	storesMu.Unlock()
+	if err := os.RemoveAll(filepath.Join(usersDir, id)); err != nil {
+		slog.ErrorContext(r.Context(), "Could not delete data of user", "user", user.Username, "err", err)
+	}
+	for _, dir := range bookmarkFileDirs {
+		if err := os.RemoveAll(ownerFilesDir(dir, id)); err != nil {
+			slog.ErrorContext(r.Context(), "Could not delete bookmark files of user", "user", user.Username, "dir", dir, "err", err)
+		}
+	}
+
+	slog.InfoContext(r.Context(), "User deleted", "user", user.Username)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// --- OIDC ---
+
+// Users can sign in through an OpenID Connect provider (Authelia, Keycloak,
+// Google, ...) with the authorization code flow and PKCE:
+// /auth/oidc/login redirects to the provider, which sends the browser back
+// to /auth/oidc/callback. The sub claim of the ID token is mapped to a
+// local user, who is created on first login. The ID token comes straight
+// from the provider's token endpoint over TLS, which OIDC Core 3.1.3.7
+// accepts instead of checking its signature; issuer, audience, expiry and
+// nonce are checked. The callback signs the browser in with a session.
+
+type oidcConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // defaults to /auth/oidc/callback on the request's host
+	Scopes       string
+}
+
+var oidcCfg oidcConfig
+
+func loadOIDCConfig() {
+	oidcMu.Lock()
+	oidcDiscovery = nil // the issuer may have changed
+	oidcMu.Unlock()
+	oidcCfg = oidcConfig{
+		Issuer:       strings.TrimSuffix(os.Getenv("BOOKMARKD_OIDC_ISSUER"), "/"),
+		ClientID:     os.Getenv("BOOKMARKD_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("BOOKMARKD_OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("BOOKMARKD_OIDC_REDIRECT_URL"),
+		Scopes:       cmp.Or(os.Getenv("BOOKMARKD_OIDC_SCOPES"), "openid profile email"),
+	}
+	if oidcCfg.Issuer != "" && oidcCfg.ClientID == "" {
+		slog.Warn("OIDC disabled: BOOKMARKD_OIDC_CLIENT_ID is not set")
+		oidcCfg.Issuer = ""
+	}
+	if oidcCfg.Issuer != "" {
+		slog.Info("OIDC: signing in with provider", "issuer", oidcCfg.Issuer)
+	}
+}
+
+// oidcProvider is the part of the provider's discovery document we use.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+}
+
+// oidcLogin is a login in progress, by state parameter.
+type oidcLogin struct {
+	Nonce    string
+	Verifier string // PKCE code verifier
+	Expires  time.Time
+}
+
+const oidcLoginTimeout = 10 * time.Minute
+
+var (
+	oidcMu        sync.Mutex
+	oidcDiscovery *oidcProvider
+	oidcLogins    = make(map[string]oidcLogin)
+	oidcClient    = &http.Client{Timeout: 15 * time.Second}
+)
+
+// discoverOIDC fetches the provider's endpoints once.
+func discoverOIDC() (*oidcProvider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcDiscovery != nil {
+		return oidcDiscovery, nil
+	}
+
+	resp, err := oidcClient.Get(oidcCfg.Issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("discovery returned %s", resp.Status)
+	}
+	var p oidcProvider
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != oidcCfg.Issuer || p.AuthorizationEndpoint == "" || p.TokenEndpoint == "" {
+		return nil, fmt.Errorf("unexpected discovery document for issuer %q", p.Issuer)
+	}
+	oidcDiscovery = &p
+	return oidcDiscovery, nil
+}
+
+func randomString() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func oidcRedirectURL(r *http.Request) string {
+	if oidcCfg.RedirectURL != "" {
+		return oidcCfg.RedirectURL
+	}
+	scheme := "http"
+	if isHTTPS(r) {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + requestBase(r) + "/auth/oidc/callback"
+}
+
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if oidcCfg.Issuer == "" {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := discoverOIDC()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC: discovery failed", "err", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+
+	state := randomString()
+	login := oidcLogin{Nonce: randomString(), Verifier: randomString(), Expires: time.Now().Add(oidcLoginTimeout)}
+	oidcMu.Lock()
+	now := time.Now()
+	maps.DeleteFunc(oidcLogins, func(_ string, l oidcLogin) bool { return now.After(l.Expires) })
+	oidcLogins[state] = login
+	oidcMu.Unlock()
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcCfg.ClientID},
+		"redirect_uri":          {oidcRedirectURL(r)},
+		"scope":                 {oidcCfg.Scopes},
+		"state":                 {state},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// oidcClaims are the ID token claims we use.
+type oidcClaims struct {
+	Issuer            string          `json:"iss"`
+	Subject           string          `json:"sub"`
+	Audience          json.RawMessage `json:"aud"` // a string or a list
+	Expiry            int64           `json:"exp"`
+	Nonce             string          `json:"nonce"`
+	PreferredUsername string          `json:"preferred_username"`
+	Email             string          `json:"email"`
+}
+
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if oidcCfg.Issuer == "" {
+		http.NotFound(w, r)
+		return
+	}
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		http.Error(w, "Login failed: "+cmp.Or(q.Get("error_description"), e), http.StatusUnauthorized)
+		return
+	}
+
+	oidcMu.Lock()
+	login, exists := oidcLogins[q.Get("state")]
+	delete(oidcLogins, q.Get("state"))
+	oidcMu.Unlock()
+	if !exists || time.Now().After(login.Expires) {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+
+	claims, err := exchangeOIDCCode(r, q.Get("code"), login)
+	if err != nil {
+		slog.WarnContext(r.Context(), "OIDC: login failed", "err", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	user, err := oidcUser(claims)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "OIDC: could not create user", "err", err)
+		http.Error(w, "Could not create user", http.StatusInternalServerError)
+		return
+	}
+	if err := startSession(w, r, identity{Owner: user.ID, Role: userRole(user.ID)}); err != nil {
+		slog.ErrorContext(r.Context(), "Could not save sessions", "err", err)
+		http.Error(w, "Could not start session", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, requestBase(r)+"/", http.StatusSeeOther)
+}
+
+// exchangeOIDCCode redeems the authorization code and checks the ID token.
+func exchangeOIDCCode(r *http.Request, code string, login oidcLogin) (oidcClaims, error) {
+	var claims oidcClaims
+	provider, err := discoverOIDC()
+	if err != nil {
+		return claims, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURL(r)},
+		"client_id":     {oidcCfg.ClientID},
+		"code_verifier": {login.Verifier},
+	}
+	req, err := http.NewRequest("POST", provider.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return claims, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if oidcCfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oidcCfg.ClientID), url.QueryEscape(oidcCfg.ClientSecret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return claims, err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return claims, fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK || result.IDToken == "" {
+		return claims, fmt.Errorf("token endpoint returned %s %s", resp.Status, result.Error)
+	}
+
+	parts := strings.Split(result.IDToken, ".")
+	if len(parts) != 3 {
+		return claims, errors.New("malformed ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return claims, fmt.Errorf("malformed ID token: %w", err)
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return claims, fmt.Errorf("malformed ID token: %w", err)
+	}
+
+	var audience []string
+	if json.Unmarshal(claims.Audience, &audience) != nil {
+		audience = []string{""}
+		json.Unmarshal(claims.Audience, &audience[0])
+	}
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != oidcCfg.Issuer:
+		return claims, fmt.Errorf("ID token from unexpected issuer %q", claims.Issuer)
+	case !slices.Contains(audience, oidcCfg.ClientID):
+		return claims, errors.New("ID token for another client")
+	case time.Now().Unix() > claims.Expiry:
+		return claims, errors.New("ID token expired")
+	case subtle.ConstantTimeCompare([]byte(claims.Nonce), []byte(login.Nonce)) != 1:
+		return claims, errors.New("ID token nonce mismatch")
+	case claims.Subject == "":
+		return claims, errors.New("ID token without subject")
+	}
+	return claims, nil
+}
+
+// oidcUser returns the local user of an OIDC identity, creating one named
+// after the preferred_username or email claim on first login.
+func oidcUser(claims oidcClaims) (User, error) {
+	usersMu.RLock()
+	for _, u := range users {
+		if u.OIDCSubject == claims.Subject {
+			usersMu.RUnlock()
+			return u, nil
+		}
+	}
+	usersMu.RUnlock()
+
+	base := usernameFrom(cmp.Or(claims.PreferredUsername, strings.Split(claims.Email, "@")[0]))
+	base = cmp.Or(base[:min(len(base), 56)], "user")
+	for i := 1; ; i++ {
+		name := base
+		if i > 1 {
+			name = fmt.Sprintf("%s-%d", base, i)
+		}
+		user, err := createUser(User{Username: name, OIDCSubject: claims.Subject})
+		if errors.Is(err, errUsernameTaken) {
+			continue
+		}
+		if err == nil {
+			slog.Info("OIDC: created user", "user", user.Username)
+		}
+		return user, err
+	}
+}
+
+// --- Sessions ---
+
+// The dashboard signs in at /auth/login, with a user's or the instance's
+// credentials, an API token or through OIDC, and gets an HttpOnly session
+// cookie instead of a token it would have to keep in localStorage. A
+// session expires after BOOKMARKD_SESSION_TTL without use (7 days by
+// default) and is renewed once half of that has passed; POST /auth/logout
+// ends it. Like tokens, sessions are stored as SHA-256 hashes.
+//
+// As browsers send the cookie along with requests other sites make, writes
+// signed in by it also need the session's CSRF token in the X-CSRF-Token
+// header (or a csrf_token field for the logout form). The token is an HMAC
+// keyed with the cookie, so a page that can't read the cookie can't forge
+// it. The dashboard gets it in a meta tag.
+
+type Session struct {
+	Hash    string `json:"hash"`
+	UserID  string `json:"user_id,omitempty"` // empty for the instance
+	Role    string `json:"role,omitempty"`    // of the token signed in with, if any
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"`
+}
+
+const (
+	sessionCookie     = "bookmarkd_session"
+	csrfHeader        = "X-CSRF-Token"
+	defaultSessionTTL = 7 * 24 * time.Hour
+)
+
+var (
+	sessionsMu sync.Mutex
+	sessions   map[string]Session // by hash
+	sessionTTL = defaultSessionTTL
+)
+
+func loadSessions() {
+	if v := os.Getenv("BOOKMARKD_SESSION_TTL"); v != "" {
+		if ttl, err := time.ParseDuration(v); err == nil && ttl > 0 {
+			sessionTTL = ttl
+		} else {
+			slog.Warn("Invalid BOOKMARKD_SESSION_TTL, using default", "value", v, "default", defaultSessionTTL)
+		}
+	}
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	sessions = make(map[string]Session)
+	data, err := loadDataFile(sessionsFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Could not load sessions", "err", err)
+		}
+		return
+	}
+	var list []Session
+	if err := json.Unmarshal(data, &list); err != nil {
+		slog.Warn("Could not parse sessions", "err", err)
+		return
+	}
+	now := time.Now().Unix()
+	for _, s := range list {
+		if s.Expires > now {
+			sessions[s.Hash] = s
+		}
+	}
+}
+
+// saveSessions persists the sessions, dropping expired ones. Callers must
+// hold sessionsMu.
+func saveSessions() error {
+	now := time.Now().Unix()
+	maps.DeleteFunc(sessions, func(_ string, s Session) bool { return s.Expires <= now })
+	list := slices.SortedFunc(maps.Values(sessions), func(a, b Session) int {
+		return cmp.Or(cmp.Compare(a.Created, b.Created), strings.Compare(a.Hash, b.Hash))
+	})
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeDataFile(sessionsFile, data, 0600)
+}
+
+func isHTTPS(r *http.Request) bool {
+	return r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https"
+}
+
+func setSessionCookie(w http.ResponseWriter, r *http.Request, value string, expires time.Time) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     requestBase(r) + "/",
+		Expires:  expires,
+		MaxAge:   max(int(time.Until(expires).Seconds()), -1),
+		Secure:   isHTTPS(r),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// startSession signs the browser in with a new session.
+func startSession(w http.ResponseWriter, r *http.Request, id identity) error {
+	secret := randomString()
+	now := time.Now()
+	session := Session{Hash: hashToken(secret), UserID: id.Owner, Created: now.Unix(), Expires: now.Add(sessionTTL).Unix()}
+	if id.Owner == "" && id.Role != roleAdmin || id.Owner != "" && id.Role != userRole(id.Owner) {
+		session.Role = id.Role
+	}
+
+	sessionsMu.Lock()
+	sessions[session.Hash] = session
+	err := saveSessions()
+	if err != nil {
+		delete(sessions, session.Hash)
+	}
+	sessionsMu.Unlock()
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, r, secret, now.Add(sessionTTL))
+	return nil
+}
+
+// requestSession returns the request's unexpired session.
+func requestSession(r *http.Request) (Session, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return Session{}, false
+	}
+	sessionsMu.Lock()
+	session, exists := sessions[hashToken(cookie.Value)]
+	sessionsMu.Unlock()
+	if !exists || time.Now().Unix() >= session.Expires {
+		return Session{}, false
+	}
+	return session, true
+}
+
+func sessionIdentity(r *http.Request) (identity, bool) {
+	session, ok := requestSession(r)
+	if !ok {
+		return identity{}, false
+	}
+	role := roleAdmin
+	if session.UserID != "" {
+		usersMu.RLock()
+		_, exists := users[session.UserID]
+		usersMu.RUnlock()
+		if !exists {
+			return identity{}, false
+		}
+		role = userRole(session.UserID)
+	}
+	if session.Role != "" && roleRank[session.Role] < roleRank[role] {
+		role = session.Role
+	}
+	return identity{Owner: session.UserID, Role: role, Session: true}, true
+}
+
+// renewSession extends the request's session once half of its lifetime
+// has passed.
+func renewSession(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return
+	}
+	hash := hashToken(cookie.Value)
+	now := time.Now()
+	expires := now.Add(sessionTTL)
+
+	sessionsMu.Lock()
+	defer sessionsMu.Unlock()
+	session, exists := sessions[hash]
+	if !exists || session.Expires <= now.Unix() || time.Unix(session.Expires, 0).After(now.Add(sessionTTL/2)) {
+		return
+	}
+	session.Expires = expires.Unix()
+	sessions[hash] = session
+	if err := saveSessions(); err != nil {
+		slog.ErrorContext(r.Context(), "Could not save sessions", "err", err)
+	}
+	setSessionCookie(w, r, cookie.Value, expires)
+}
+
+// csrfToken returns the CSRF token of the session with the given cookie.
+func csrfToken(cookie string) string {
+	mac := hmac.New(sha256.New, []byte(cookie))
+	mac.Write([]byte("csrf"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// requestCSRFToken returns the CSRF token of the request's session, if any.
+func requestCSRFToken(r *http.Request) string {
+	if _, ok := requestSession(r); !ok {
+		return ""
+	}
+	cookie, _ := r.Cookie(sessionCookie)
+	return csrfToken(cookie.Value)
+}
+
+// validCSRF reports whether a request signed in by session cookie may go
+// ahead: reads always, writes only with the session's CSRF token.
+func validCSRF(r *http.Request) bool {
+	switch r.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return true
+	}
+	want := requestCSRFToken(r)
+	return want != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get(csrfHeader)), []byte(want)) == 1
+}
+
+// loginRedirect returns where to go after signing in: a local path only.
+func loginRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// handleLoginPage shows the sign-in form and signs in with its
+// credentials: a user's or the instance's username and password, or an API
+// token without username.
+func handleLoginPage(w http.ResponseWriter, r *http.Request) {
+	data := struct {
+		Error    string
+		Next     string
+		Username string
+		OIDC     bool
+		Nonce    string
+		BasePath string
+	}{
+		Next:     loginRedirect(r.FormValue("next")),
+		OIDC:     oidcCfg.Issuer != "",
+		Nonce:    cspNonce(r),
+		BasePath: requestBase(r),
+	}
+
+	status := http.StatusOK
+	if r.Method == "POST" {
+		username := strings.TrimSpace(r.PostFormValue("username"))
+		password := r.PostFormValue("password")
+		var id identity
+		ok := false
+		switch {
+		case username == "":
+			id, ok = tokenIdentity(password)
+		case authCfg.User != "" &&
+			subtle.ConstantTimeCompare([]byte(username), []byte(authCfg.User)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(authCfg.Password)) == 1:
+			id, ok = identity{Role: roleAdmin}, true
+		default:
+			var owner string
+			if owner, ok = userLogin(strings.ToLower(username), password); ok {
+				id = identity{Owner: owner, Role: userRole(owner)}
+			}
+		}
+		if ok {
+			if err := startSession(w, r, id); err != nil {
+				slog.ErrorContext(r.Context(), "Could not save sessions", "err", err)
+				http.Error(w, "Could not start session", http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, requestBase(r)+data.Next, http.StatusSeeOther)
+			return
+		}
+		authFailed(r, username)
+		data.Error = "Invalid username or password"
+		data.Username = username
+		status = http.StatusUnauthorized
+	} else if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := loginTmpl.Execute(w, data); err != nil {
+		slog.ErrorContext(r.Context(), "Could not render template", "err", err)
+	}
+}
+
+// handleLogout ends the request's session and clears its cookie.
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf_token")), []byte(csrfToken(cookie.Value))) != 1 {
+			http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		sessionsMu.Lock()
+		hash := hashToken(cookie.Value)
+		if _, exists := sessions[hash]; exists {
+			delete(sessions, hash)
+			if err := saveSessions(); err != nil {
+				slog.ErrorContext(r.Context(), "Could not save sessions", "err", err)
+			}
+		}
+		sessionsMu.Unlock()
+	}
+	setSessionCookie(w, r, "", time.Unix(0, 0))
+	http.Redirect(w, r, requestBase(r)+"/auth/login", http.StatusSeeOther)
+}
+
+// --- Proxy Authentication ---
+
+// Behind an authenticating reverse proxy (Authelia, authentik, oauth2-proxy,
+// ...) bookmarkd can take the user from a header the proxy sets, e.g.
+// BOOKMARKD_AUTH_PROXY_HEADER=Remote-User. The header is only trusted on
+// connections from BOOKMARKD_AUTH_PROXY_IPS (addresses or CIDR ranges,
+// loopback by default); elsewhere it is ignored. Each username maps to a
+// local user, who is created on first sight. The X-Forwarded-For of these
+// proxies is also believed for client addresses, e.g. for rate limits.
+
+type proxyAuthConfig struct {
+	Header  string
+	Trusted []netip.Prefix
+}
+
+var proxyAuthCfg proxyAuthConfig
+
+func loadProxyAuthConfig() {
+	proxyAuthCfg = proxyAuthConfig{
+		Header:  strings.TrimSpace(os.Getenv("BOOKMARKD_AUTH_PROXY_HEADER")),
+		Trusted: parsePrefixes(cmp.Or(os.Getenv("BOOKMARKD_AUTH_PROXY_IPS"), "127.0.0.1,::1"), "proxy address"),
+	}
+	if proxyAuthCfg.Header == "" {
+		return
+	}
+	slog.Info("Proxy auth: trusting user header", "header", proxyAuthCfg.Header, "proxies", proxyAuthCfg.Trusted)
+}
+
+// parsePrefixes parses a comma-separated list of addresses and CIDR ranges,
+// warning about invalid ones.
+func parsePrefixes(list, what string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(list, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			addr, err2 := netip.ParseAddr(s)
+			if err2 != nil {
+				slog.Warn("Ignoring invalid "+what, "value", s, "err", err)
+				continue
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes
+}
+
+// fromTrustedProxy reports whether the request's connection comes from a
+// trusted proxy.
+func fromTrustedProxy(r *http.Request) bool {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	return err == nil && trustedProxy(addrPort.Addr().Unmap())
+}
+
+func trustedProxy(addr netip.Addr) bool {
+	return prefixesContain(proxyAuthCfg.Trusted, addr)
+}
+
+func prefixesContain(prefixes []netip.Prefix, addr netip.Addr) bool {
+	return slices.ContainsFunc(prefixes, func(p netip.Prefix) bool { return p.Contains(addr) })
+}
+
+// clientIP returns the address a request comes from: the connection's, or
+// behind trusted proxies the last untrusted one in X-Forwarded-For.
+func clientIP(r *http.Request) netip.Addr {
+	addrPort, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}
+	}
+	addr := addrPort.Addr().Unmap()
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0 && trustedProxy(addr); i-- {
+		next, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		addr = next.Unmap()
+	}
+	return addr
+}
+
+// proxyIdentity returns the user named in the proxy's header.
+func proxyIdentity(r *http.Request) (identity, bool) {
+	if proxyAuthCfg.Header == "" {
+		return identity{}, false
+	}
+	name := usernameFrom(r.Header.Get(proxyAuthCfg.Header))
+	if name == "" || !fromTrustedProxy(r) {
+		return identity{}, false
+	}
+	user, err := proxyUser(name)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Proxy auth: could not create user", "user", name, "err", err)
+		return identity{}, false
+	}
+	return identity{Owner: user.ID, Role: userRole(user.ID)}, true
+}
+
+func proxyUser(name string) (User, error) {
+	for {
+		usersMu.RLock()
+		for _, u := range users {
+			if u.Username == name {
+				usersMu.RUnlock()
+				return u, nil
+			}
+		}
+		usersMu.RUnlock()
+
+		user, err := createUser(User{Username: name})
+		if errors.Is(err, errUsernameTaken) {
+			continue // created concurrently
+		}
+		if err == nil {
+			slog.Info("Proxy auth: created user", "user", user.Username)
+		}
+		return user, err
+	}
+}
+
+// --- Read-only Mode ---
+
+// With BOOKMARKD_READONLY=true every request that would change data is
+// refused with 403, while the dashboard and reads keep working, e.g. for a
+// public mirror of a curated collection. Signing in still works, through
+// /auth/ as well as /api/login, but signing up doesn't, as it creates a user
+// and their collection. Syncs pulled from a peer (BOOKMARKD_SYNC_PEER) still
+// apply, so a mirror can follow its upstream.
+
+var readOnly bool
+
+func loadReadOnly() {
+	readOnly = os.Getenv("BOOKMARKD_READONLY") == "true"
+	if readOnly {
+		slog.Info("Read-only mode: refusing changes")
+	}
+}
+
+// changesData reports whether a request may change data.
+func changesData(r *http.Request) bool {
+	path := unversionedPath(r.URL.Path)
+	switch {
+	case r.Method == "OPTIONS", strings.HasPrefix(path, "/auth/"), path == "/api/login",
+		path == "/api/admin/reload": // reads the file, never writes it
+		return false
+	case strings.HasPrefix(path, "/pinboard/v1/"):
+		// Pinboard changes data with GET too
+		op := strings.Trim(strings.TrimPrefix(path, "/pinboard/v1/"), "/")
+		return op == "posts/add" || op == "posts/delete"
+	}
+	return !isReadRequest(r, path)
+}
+
+// withReadOnly refuses requests that change data in read-only mode.
+func withReadOnly(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !readOnly || !changesData(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if strings.HasPrefix(r.URL.Path, grpcPathPrefix) {
+			w.Header().Set("Content-Type", "application/grpc")
+			setGRPCStatus(w, grpcPermissionDenied, "server is read-only")
+			return
+		}
+		setCORSHeaders(w, r)
+		http.Error(w, "Server is read-only", http.StatusForbidden)
+	})
+}
+
+// --- Security Headers ---
+
+// Every response carries a Content-Security-Policy, X-Content-Type-Options,
+// Referrer-Policy and X-Frame-Options, so that markup slipping through
+// escaping in a title or note can't run scripts or frame the dashboard.
+// Inline scripts of the pages carry the request's nonce (cspNonce). The
+// headers can be replaced with BOOKMARKD_CSP (where {nonce} is the nonce),
+// BOOKMARKD_REFERRER_POLICY and BOOKMARKD_FRAME_OPTIONS, or dropped with
+// "off".
+
+type cspNonceKey struct{}
+
+var securityHeaders map[string]string
+
+func loadSecurityHeaders() {
+	frameOptions := cmp.Or(os.Getenv("BOOKMARKD_FRAME_OPTIONS"), "DENY")
+	frameAncestors := ""
+	switch strings.ToUpper(frameOptions) {
+	case "DENY":
+		frameAncestors = " frame-ancestors 'none';"
+	case "SAMEORIGIN":
+		frameAncestors = " frame-ancestors 'self';"
+	}
+	securityHeaders = map[string]string{
+		"Content-Security-Policy": cmp.Or(os.Getenv("BOOKMARKD_CSP"),
+			"default-src 'self'; script-src 'self' 'nonce-{nonce}'; style-src 'self' 'unsafe-inline'; "+
+				"img-src * data: blob:; connect-src 'self'; object-src 'none'; base-uri 'self'; form-action 'self';"+frameAncestors),
+		"X-Content-Type-Options": "nosniff",
+		"Referrer-Policy":        cmp.Or(os.Getenv("BOOKMARKD_REFERRER_POLICY"), "no-referrer"),
+		"X-Frame-Options":        frameOptions,
+	}
+	maps.DeleteFunc(securityHeaders, func(_, v string) bool { return strings.EqualFold(v, "off") })
+}
+
+// cspNonce returns the nonce inline scripts need in the request's response.
+func cspNonce(r *http.Request) string {
+	nonce, _ := r.Context().Value(cspNonceKey{}).(string)
+	return nonce
+}
+
+// withSecurityHeaders sets the security headers on every response.
+func withSecurityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonce := make([]byte, 16)
+		rand.Read(nonce)
+		value := base64.StdEncoding.EncodeToString(nonce)
+		for name, header := range securityHeaders {
+			w.Header().Set(name, strings.ReplaceAll(header, "{nonce}", value))
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), cspNonceKey{}, value)))
+	})
+}
+
+// --- IP Allowlist ---
+
+// BOOKMARKD_ALLOW_IPS restricts the whole server, and
+// BOOKMARKD_ALLOW_WRITE_IPS requests that change data, to clients from the
+// listed addresses and CIDR ranges, e.g. to show the dashboard publicly but
+// only edit from home or a VPN. Client addresses come from clientIP, so
+// behind a reverse proxy list it in BOOKMARKD_AUTH_PROXY_IPS. Empty lists
+// allow everyone.
+
+var allowIPs, allowWriteIPs []netip.Prefix
+
+func loadIPAllowlist() {
+	allowIPs = parsePrefixes(os.Getenv("BOOKMARKD_ALLOW_IPS"), "allowed address")
+	allowWriteIPs = parsePrefixes(os.Getenv("BOOKMARKD_ALLOW_WRITE_IPS"), "allowed address")
+	if len(allowIPs) > 0 {
+		slog.Info("Allowing requests only from listed addresses", "allowed", allowIPs)
+	}
+	if len(allowWriteIPs) > 0 {
+		slog.Info("Allowing changes only from listed addresses", "allowed", allowWriteIPs)
+	}
+}
+
+// ipAllowed reports whether the request's client may make it.
+func ipAllowed(r *http.Request) bool {
+	if len(allowIPs) == 0 && len(allowWriteIPs) == 0 {
+		return true
+	}
+	addr := clientIP(r)
+	if len(allowIPs) > 0 && !prefixesContain(allowIPs, addr) {
+		return false
+	}
+	return len(allowWriteIPs) == 0 || !changesData(r) || prefixesContain(allowWriteIPs, addr)
+}
+
+// withIPAllowlist refuses requests from clients outside the allowlists.
+func withIPAllowlist(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isHealthPath(r.URL.Path) || ipAllowed(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		forbidden(w, r)
+	})
+}
+
+// --- Request Size Limits ---
+
+// Request bodies are capped at BOOKMARKD_MAX_BODY_MB (1 MB by default), and
+// imports, syncs and batch creation at BOOKMARKD_MAX_IMPORT_MB (64 MB), so a
+// single huge request can't exhaust memory. Bodies announced as larger are
+// refused with 413 up front; others fail once they pass the limit. gRPC
+// limits each message instead.
+
+const (
+	defaultMaxBodySize   = 1 << 20
+	defaultMaxImportSize = 64 << 20
+)
+
+var maxBodySize, maxImportSize int64 = defaultMaxBodySize, defaultMaxImportSize
+
+func loadBodyLimits() {
+	maxBodySize = sizeFromEnv("BOOKMARKD_MAX_BODY_MB", defaultMaxBodySize)
+	maxImportSize = sizeFromEnv("BOOKMARKD_MAX_IMPORT_MB", defaultMaxImportSize)
+}
+
+// sizeFromEnv returns the size in megabytes set in env, in bytes.
+func sizeFromEnv(env string, def int64) int64 {
+	v := os.Getenv(env)
+	if v == "" {
+		return def
+	}
+	mb, err := strconv.ParseFloat(v, 64)
+	if err != nil || mb <= 0 {
+		slog.Warn("Invalid "+env+", using default", "value", v, "default_mb", def>>20)
+		return def
+	}
+	return int64(mb * (1 << 20))
+}
+
+// bodyLimit returns the largest body accepted for a request.
+func bodyLimit(r *http.Request) int64 {
+	path := unversionedPath(r.URL.Path)
+	switch {
+	case path == "/api/import" || strings.HasPrefix(path, "/api/import/"),
+		path == "/api/sync",
+		path == "/api/bookmarks/batch":
+		return maxImportSize
+	}
+	return maxBodySize
+}
+
+// withBodyLimit caps the size of request bodies.
+func withBodyLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, grpcPathPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		limit := bodyLimit(r)
+		if r.ContentLength > limit {
+			setCORSHeaders(w, r)
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, limit)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// --- Rate Limiting ---
+
+// Clients are rate limited with token buckets: per API token or user once
+// authenticated, per IP address otherwise (IPv6 per /64). Limits are per
+// minute and allow a minute's worth at once: BOOKMARKD_RATE_LIMIT for all
+// requests (off by default), BOOKMARKD_RATE_LIMIT_EXPENSIVE for searches,
+// imports, exports, syncs and link checks (30), and BOOKMARKD_RATE_LIMIT_AUTH
+// for failed sign-ins and signups per IP address (10); once that is used up,
+// requests with credentials are refused without checking them. 0 turns a
+// limit off. Refused requests get 429 with Retry-After.
+
+type rateLimiter struct {
+	mu      sync.Mutex
+	perSec  float64
+	burst   float64
+	buckets map[string]rateBucket
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// maxRateBuckets is how many buckets a limiter keeps before dropping full
+// ones.
+const maxRateBuckets = 10000
+
+var requestLimiter, expensiveLimiter, authLimiter *rateLimiter
+
+func loadRateLimits() {
+	requestLimiter = newRateLimiter("BOOKMARKD_RATE_LIMIT", 0)
+	expensiveLimiter = newRateLimiter("BOOKMARKD_RATE_LIMIT_EXPENSIVE", 30)
+	authLimiter = newRateLimiter("BOOKMARKD_RATE_LIMIT_AUTH", 10)
+}
+
+// newRateLimiter returns a limiter for the per-minute limit in env, nil if
+// it is off.
+func newRateLimiter(env string, perMinute int) *rateLimiter {
+	if v := os.Getenv(env); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 {
+			perMinute = n
+		} else {
+			slog.Warn("Invalid "+env+", using default", "value", v, "default", perMinute)
+		}
+	}
+	if perMinute == 0 {
+		return nil
+	}
+	return &rateLimiter{
+		perSec:  float64(perMinute) / 60,
+		burst:   float64(perMinute),
+		buckets: make(map[string]rateBucket),
+	}
+}
+
+// refill returns the key's bucket as of now. Callers must hold l.mu.
+func (l *rateLimiter) refill(key string, now time.Time) rateBucket {
+	b, ok := l.buckets[key]
+	if !ok {
+		return rateBucket{tokens: l.burst, last: now}
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.perSec)
+	b.last = now
+	return b
+}
+
+// take uses up one request of the key's allowance, or returns how long
+// until there is one again.
+func (l *rateLimiter) take(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	b := l.refill(key, now)
+	if b.tokens < 1 {
+		l.buckets[key] = b
+		return time.Duration((1 - b.tokens) / l.perSec * float64(time.Second))
+	}
+	b.tokens--
+	l.buckets[key] = b
+	if len(l.buckets) > maxRateBuckets {
+		maps.DeleteFunc(l.buckets, func(_ string, b rateBucket) bool {
+			return b.tokens+now.Sub(b.last).Seconds()*l.perSec >= l.burst
+		})
+	}
+	return 0
+}
+
+// wait returns how long until the key has allowance left, without using
+// any.
+func (l *rateLimiter) wait(key string) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b := l.refill(key, time.Now())
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.perSec * float64(time.Second))
+}
+
+// rateLimitIP returns the key of the request's address.
+func rateLimitIP(r *http.Request) string {
+	addr := clientIP(r)
+	if addr.Is6() {
+		return netip.PrefixFrom(addr, 64).Masked().String()
+	}
+	return addr.String()
+}
+
+// rateLimitKey returns whose allowance a request uses: its token's, its
+// user's or its address's.
+func rateLimitKey(r *http.Request) string {
+	id, ok := r.Context().Value(identityKey{}).(identity)
+	switch {
+	case !ok:
+		return "ip:" + rateLimitIP(r)
+	case requestToken(r) != "":
+		return "token:" + hashToken(requestToken(r))
+	}
+	return "user:" + id.Owner
+}
+
+func hasCredentials(r *http.Request) bool {
+	_, _, basic := r.BasicAuth()
+	return basic || requestToken(r) != ""
+}
+
+func isExpensiveRequest(r *http.Request, path string) bool {
+	switch {
+	case path == "/api/import" || strings.HasPrefix(path, "/api/import/"),
+		strings.HasPrefix(path, "/api/export/"),
+		path == "/api/sync",
+		path == "/api/watch/check",
+		path == "/api/bookmarks/query":
+		return true
+	case path == "/api/bookmarks" && r.Method == "GET":
+		return strings.TrimSpace(r.URL.Query().Get("q")) != ""
+	}
+	return false
+}
+
+// withRateLimit refuses requests beyond their client's limits.
+func withRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a page loads the favicons and thumbnails of all its bookmarks at once
+		if r.Method == "OPTIONS" || strings.HasPrefix(r.URL.Path, "/static/") ||
+			strings.HasPrefix(r.URL.Path, "/favicons/") || strings.HasPrefix(r.URL.Path, "/thumbnails/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path := unversionedPath(r.URL.Path)
+		if r.Method == "POST" && path == "/api/signup" {
+			if wait := authLimiter.take(rateLimitIP(r)); wait > 0 {
+				tooManyRequests(w, r, wait)
+				return
+			}
+		} else if r.Method == "POST" && (path == "/api/login" || r.URL.Path == "/auth/login") {
+			if wait := authLimiter.wait(rateLimitIP(r)); wait > 0 {
+				tooManyRequests(w, r, wait)
+				return
+			}
+		}
+		key := rateLimitKey(r)
+		if wait := requestLimiter.take(key); wait > 0 {
+			tooManyRequests(w, r, wait)
+			return
+		}
+		if isExpensiveRequest(r, path) {
+			if wait := expensiveLimiter.take(key); wait > 0 {
+				tooManyRequests(w, r, wait)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func tooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	if strings.HasPrefix(r.URL.Path, grpcPathPrefix) {
+		w.Header().Set("Content-Type", "application/grpc")
+		setGRPCStatus(w, grpcResourceExhausted, "rate limit exceeded")
+		return
+	}
+	setCORSHeaders(w, r)
+	http.Error(w, "Too many requests", http.StatusTooManyRequests)
+}
+
+// --- Auth Failure Log ---
+
+// Failed sign-ins and requests with invalid credentials are logged as an
+// "auth failure" warning with the user and the request's fields, and, for
+// fail2ban or CrowdSec, appended to BOOKMARKD_AUTH_LOG in a stable format:
+//
+//	2026-01-02T15:04:05Z auth failure: ip=203.0.113.7 user="alice" path=/api/v1/bookmarks
+//
+// user is empty for tokens; a fail2ban failregex is
+// `auth failure: ip=<HOST> `. Each failure also counts against the
+// address's BOOKMARKD_RATE_LIMIT_AUTH.
+
+var (
+	authLogMu sync.Mutex
+	authLog   *os.File
+)
+
+func loadAuthLog() {
+	if authLog != nil {
+		authLog.Close()
+		authLog = nil
+	}
+	path := os.Getenv("BOOKMARKD_AUTH_LOG")
+	if path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		slog.Warn("Could not open auth log", "err", err)
+		return
+	}
+	authLog = f
+}
+
+// authFailed logs a failed authentication and counts it against the
+// request's address.
+func authFailed(r *http.Request, user string) {
+	authLimiter.take(rateLimitIP(r))
+	slog.WarnContext(r.Context(), "auth failure", "user", user)
+	if authLog == nil {
+		return
+	}
+	authLogMu.Lock()
+	defer authLogMu.Unlock()
+	line := fmt.Sprintf("auth failure: ip=%s user=%q path=%s", clientIP(r), user, r.URL.EscapedPath())
+	if _, err := fmt.Fprintf(authLog, "%s %s\n", time.Now().Format(time.RFC3339), line); err != nil {
+		slog.Error("Could not write auth log", "err", err)
+	}
+}
+
+// --- LDAP ---
+
+// Users can sign in with their directory (OpenLDAP, Active Directory,
+// lldap, ...) credentials wherever a username and password are accepted:
+// Basic auth, /api/login and the login page. bookmarkd looks the user up
+// with BOOKMARKD_LDAP_USER_FILTER below BOOKMARKD_LDAP_BASE_DN (bound as
+// BOOKMARKD_LDAP_BIND_DN, or anonymously), then binds as the user to check
+// the password. The user's groups come from the memberOf attribute; with
+// BOOKMARKD_LDAP_{ADMIN,EDITOR,VIEWER}_GROUP set, the highest matching
+// group sets the role on every login and users in none of them are turned
+// away. Each directory user maps to a local user of the same name, created
+// on first login; local accounts with a password keep precedence.
+
+type ldapConfig struct {
+	URL          *url.URL
+	StartTLS     bool
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	UserFilter   string // %s is the escaped username
+	GroupAttr    string
+	Groups       map[string]string // role by group DN
+}
+
+// ldapLoginCache is how long a directory login is remembered before the
+// directory is asked again.
+const ldapLoginCache = 5 * time.Minute
+
+type ldapLogin struct {
+	UserID  string
+	Expires time.Time
+}
+
+var (
+	ldapCfg    ldapConfig
+	ldapMu     sync.Mutex
+	ldapLogins = make(map[[32]byte]ldapLogin)
+)
+
+func loadLDAPConfig() {
+	ldapCfg = ldapConfig{}
+	raw := os.Getenv("BOOKMARKD_LDAP_URL")
+	if raw == "" {
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Host == "" {
+		slog.Warn("LDAP disabled: invalid BOOKMARKD_LDAP_URL", "value", raw)
+		return
+	}
+	cfg := ldapConfig{
+		URL:          u,
+		StartTLS:     os.Getenv("BOOKMARKD_LDAP_STARTTLS") == "true",
+		BindDN:       os.Getenv("BOOKMARKD_LDAP_BIND_DN"),
+		BindPassword: os.Getenv("BOOKMARKD_LDAP_BIND_PASSWORD"),
+		BaseDN:       os.Getenv("BOOKMARKD_LDAP_BASE_DN"),
+		UserFilter:   cmp.Or(os.Getenv("BOOKMARKD_LDAP_USER_FILTER"), "(uid=%s)"),
+		GroupAttr:    cmp.Or(os.Getenv("BOOKMARKD_LDAP_GROUP_ATTR"), "memberOf"),
+		Groups:       make(map[string]string),
+	}
+	if _, err := parseLDAPFilter(strings.ReplaceAll(cfg.UserFilter, "%s", "x")); err != nil {
+		slog.Warn("LDAP disabled: invalid BOOKMARKD_LDAP_USER_FILTER", "err", err)
+		return
+	}
+	for role, env := range map[string]string{
+		roleAdmin:  "BOOKMARKD_LDAP_ADMIN_GROUP",
+		roleEditor: "BOOKMARKD_LDAP_EDITOR_GROUP",
+		roleViewer: "BOOKMARKD_LDAP_VIEWER_GROUP",
+	} {
+		if dn := strings.TrimSpace(os.Getenv(env)); dn != "" {
+			cfg.Groups[strings.ToLower(dn)] = role
+		}
+	}
+	ldapCfg = cfg
+	slog.Info("LDAP: signing in with directory", "url", redactURL(raw))
+}
+
+// ldapRole returns the role of the highest group a user is in. Without
+// any groups configured, the user keeps their local role.
+func ldapRole(groups []string) (string, bool) {
+	if len(ldapCfg.Groups) == 0 {
+		return "", true
+	}
+	role := ""
+	for _, g := range groups {
+		if r, ok := ldapCfg.Groups[strings.ToLower(g)]; ok && roleRank[r] > roleRank[role] {
+			role = r
+		}
+	}
+	return role, role != ""
+}
+
+// ldapUserLogin checks a username and password against the directory and
+// returns the ID of the matching local user.
+func ldapUserLogin(username, password string) (string, bool) {
+	if password == "" {
+		return "", false // would be an unauthenticated bind
+	}
+	cacheKey := sha256.Sum256([]byte(username + "\x00" + password))
+	ldapMu.Lock()
+	cached, exists := ldapLogins[cacheKey]
+	ldapMu.Unlock()
+	if exists && time.Now().Before(cached.Expires) {
+		usersMu.RLock()
+		_, exists = users[cached.UserID]
+		usersMu.RUnlock()
+		if exists {
+			return cached.UserID, true
+		}
+	}
+
+	groups, err := ldapAuthenticate(username, password)
+	if err != nil {
+		slog.Warn("LDAP: login failed", "user", username, "err", err)
+		return "", false
+	}
+	role, ok := ldapRole(groups)
+	if !ok {
+		slog.Warn("LDAP: user is in none of the configured groups", "user", username)
+		return "", false
+	}
+	user, err := ldapUser(usernameFrom(username), role)
+	if err != nil {
+		slog.Error("LDAP: could not create user", "user", username, "err", err)
+		return "", false
+	}
+
+	ldapMu.Lock()
+	now := time.Now()
+	maps.DeleteFunc(ldapLogins, func(_ [32]byte, l ldapLogin) bool { return now.After(l.Expires) })
+	ldapLogins[cacheKey] = ldapLogin{UserID: user.ID, Expires: now.Add(ldapLoginCache)}
+	ldapMu.Unlock()
+	return user.ID, true
+}
+
+// ldapUser returns the local user of a directory user, creating them on
+// first login, and applies the role from the directory groups.
+func ldapUser(name, role string) (User, error) {
+	if name == "" {
+		return User{}, errors.New("invalid username")
+	}
+	for {
+		if user, found, err := applyLDAPRole(name, role); found || err != nil {
+			return user, err
+		}
+		_, err := createUser(User{Username: name})
+		if err == nil {
+			slog.Info("LDAP: created user", "user", name)
+		} else if !errors.Is(err, errUsernameTaken) {
+			return User{}, err
+		}
+		// look it up again to apply the role
+	}
+}
+
+func applyLDAPRole(name, role string) (User, bool, error) {
+	usersMu.Lock()
+	defer usersMu.Unlock()
+	for id, u := range users {
+		if u.Username != name {
+			continue
+		}
+		if u.PasswordHash != "" {
+			return User{}, true, errors.New("a local user has that name")
+		}
+		if role != "" && u.Role != role {
+			u.Role = role
+			users[id] = u
+			if err := saveUsers(); err != nil {
+				return User{}, true, err
+			}
+			slog.Info("LDAP: user role changed", "user", u.Username, "role", role)
+		}
+		return u, true, nil
+	}
+	return User{}, false, nil
+}
+
+// ldapAuthenticate finds the user's entry, binds as it to check the
+// password and returns the user's groups.
+func ldapAuthenticate(username, password string) ([]string, error) {
+	conn, err := dialLDAP(ldapCfg)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if ldapCfg.BindDN != "" {
+		if err := conn.bind(ldapCfg.BindDN, ldapCfg.BindPassword); err != nil {
+			return nil, fmt.Errorf("service bind: %w", err)
+		}
+	}
+	filter, err := parseLDAPFilter(strings.ReplaceAll(ldapCfg.UserFilter, "%s", ldapEscape(username)))
+	if err != nil {
+		return nil, err
+	}
+	entries, err := conn.search(ldapCfg.BaseDN, filter, ldapCfg.GroupAttr)
+	if err != nil {
+		return nil, fmt.Errorf("search: %w", err)
+	}
+	if len(entries) != 1 {
+		return nil, fmt.Errorf("%d entries match", len(entries))
+	}
+	if err := conn.bind(entries[0].DN, password); err != nil {
+		return nil, err
+	}
+	return entries[0].Attrs[strings.ToLower(ldapCfg.GroupAttr)], nil
+}
+
+// ldapEscape escapes a value for use in a search filter (RFC 4515).
+func ldapEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '*', '(', ')', '\\', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ldapConn is a connection speaking just enough LDAPv3 (RFC 4511) for
+// simple binds and searches.
+type ldapConn struct {
+	conn   net.Conn
+	nextID int64
+}
+
+type ldapEntry struct {
+	DN    string
+	Attrs map[string][]string // by lower-case attribute name
+}
+
+// BER tags of the LDAP messages we use
+const (
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapUnbindRequest    = 0x42
+	ldapSearchRequest    = 0x63
+	ldapSearchEntry      = 0x64
+	ldapSearchDone       = 0x65
+	ldapSearchReference  = 0x73
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+)
+
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+func dialLDAP(cfg ldapConfig) (*ldapConn, error) {
+	host := cfg.URL.Host
+	if cfg.URL.Port() == "" {
+		port := "389"
+		if cfg.URL.Scheme == "ldaps" {
+			port = "636"
+		}
+		host = net.JoinHostPort(cfg.URL.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	tlsConfig := &tls.Config{ServerName: cfg.URL.Hostname()}
+	var conn net.Conn
+	var err error
+	if cfg.URL.Scheme == "ldaps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+	c := &ldapConn{conn: conn}
+
+	if cfg.StartTLS && cfg.URL.Scheme == "ldap" {
+		_, err := c.request(berTLV(ldapExtendedRequest, berTLV(0x80, []byte(ldapStartTLSOID))), ldapExtendedResponse)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("StartTLS: %w", err)
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn = tlsConn
+	}
+	return c, nil
+}
+
+func (c *ldapConn) Close() error {
+	c.send(berTLV(ldapUnbindRequest, nil))
+	return c.conn.Close()
+}
+
+func (c *ldapConn) send(op []byte) (int64, error) {
+	c.nextID++
+	msg := berTLV(0x30, append(berInt(0x02, c.nextID), op...))
+	_, err := c.conn.Write(msg)
+	return c.nextID, err
+}
+
+// receive reads the next message of the given request and returns its
+// protocol op.
+func (c *ldapConn) receive(id int64) (berElement, error) {
+	for {
+		tag, body, err := readBER(c.conn)
+		if err != nil {
+			return berElement{}, err
+		}
+		parts, err := parseBER(body)
+		if tag != 0x30 || err != nil || len(parts) < 2 {
+			return berElement{}, errors.New("malformed LDAP message")
+		}
+		if parts[0].int() == id {
+			return parts[1], nil
+		}
+	}
+}
+
+// request sends an operation and checks the LDAPResult of its response.
+func (c *ldapConn) request(op []byte, responseTag byte) (berElement, error) {
+	id, err := c.send(op)
+	if err != nil {
+		return berElement{}, err
+	}
+	resp, err := c.receive(id)
+	if err != nil {
+		return berElement{}, err
+	}
+	if resp.Tag != responseTag {
+		return berElement{}, fmt.Errorf("unexpected LDAP response 0x%02x", resp.Tag)
+	}
+	return resp, ldapResultError(resp)
+}
+
+func ldapResultError(resp berElement) error {
+	parts, err := parseBER(resp.Value)
+	if err != nil || len(parts) < 3 {
+		return errors.New("malformed LDAP result")
+	}
+	if code := parts[0].int(); code != 0 {
+		return fmt.Errorf("LDAP result %d: %s", code, cmp.Or(string(parts[2].Value), "error"))
+	}
+	return nil
+}
+
+func (c *ldapConn) bind(dn, password string) error {
+	req := berInt(0x02, 3)
+	req = append(req, berTLV(0x04, []byte(dn))...)
+	req = append(req, berTLV(0x80, []byte(password))...)
+	_, err := c.request(berTLV(ldapBindRequest, req), ldapBindResponse)
+	return err
+}
+
+func (c *ldapConn) search(base string, filter []byte, attrs ...string) ([]ldapEntry, error) {
+	req := berTLV(0x04, []byte(base))
+	req = append(req, berInt(0x0a, 2)...) // wholeSubtree
+	req = append(req, berInt(0x0a, 0)...) // neverDerefAliases
+	req = append(req, berInt(0x02, 2)...) // size limit: we want exactly one
+	req = append(req, berInt(0x02, 10)...)
+	req = append(req, berTLV(0x01, []byte{0})...)
+	req = append(req, filter...)
+	var list []byte
+	for _, a := range attrs {
+		list = append(list, berTLV(0x04, []byte(a))...)
+	}
+	req = append(req, berTLV(0x30, list)...)
+
+	id, err := c.send(berTLV(ldapSearchRequest, req))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		resp, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch resp.Tag {
+		case ldapSearchEntry:
+			entry, err := parseLDAPEntry(resp.Value)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case ldapSearchReference:
+		case ldapSearchDone:
+			if err := ldapResultError(resp); err != nil && len(entries) == 0 {
+				return nil, err
+			}
+			return entries, nil // a size limit error still returns the entries
+		default:
+			return nil, fmt.Errorf("unexpected LDAP response 0x%02x", resp.Tag)
+		}
+	}
+}
+
+func parseLDAPEntry(data []byte) (ldapEntry, error) {
+	parts, err := parseBER(data)
+	if err != nil || len(parts) < 2 {
+		return ldapEntry{}, errors.New("malformed search entry")
+	}
+	entry := ldapEntry{DN: string(parts[0].Value), Attrs: make(map[string][]string)}
+	attrs, err := parseBER(parts[1].Value)
+	if err != nil {
+		return ldapEntry{}, err
+	}
+	for _, a := range attrs {
+		fields, err := parseBER(a.Value)
+		if err != nil || len(fields) < 2 {
+			return ldapEntry{}, errors.New("malformed search entry")
+		}
+		vals, err := parseBER(fields[1].Value)
+		if err != nil {
+			return ldapEntry{}, err
+		}
+		name := strings.ToLower(string(fields[0].Value))
+		for _, v := range vals {
+			entry.Attrs[name] = append(entry.Attrs[name], string(v.Value))
+		}
+	}
+	return entry, nil
+}
+
+// parseLDAPFilter encodes a search filter in its string form (RFC 4515):
+// &, |, !, equality, presence and substring matches.
+func parseLDAPFilter(s string) ([]byte, error) {
+	filter, rest, err := parseLDAPFilterAt(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q after filter", rest)
+	}
+	return filter, nil
+}
+
+func parseLDAPFilterAt(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") {
+		return nil, s, errors.New("filter must start with (")
+	}
+	s = s[1:]
+	if s == "" {
+		return nil, s, errors.New("unterminated filter")
+	}
+
+	switch s[0] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if s[0] == '|' {
+			tag = 0xa1
+		}
+		s = s[1:]
+		var set []byte
+		for strings.HasPrefix(s, "(") {
+			sub, rest, err := parseLDAPFilterAt(s)
+			if err != nil {
+				return nil, rest, err
+			}
+			set, s = append(set, sub...), rest
+		}
+		if !strings.HasPrefix(s, ")") {
+			return nil, s, errors.New("unterminated filter")
+		}
+		return berTLV(tag, set), s[1:], nil
+	case '!':
+		sub, rest, err := parseLDAPFilterAt(s[1:])
+		if err != nil {
+			return nil, rest, err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, rest, errors.New("unterminated filter")
+		}
+		return berTLV(0xa2, sub), rest[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, s, errors.New("unterminated filter")
+	}
+	attr, value, ok := strings.Cut(s[:end], "=")
+	if !ok || attr == "" || strings.ContainsAny(attr, "<>~:") {
+		return nil, s, fmt.Errorf("unsupported filter item %q", s[:end])
+	}
+	rest := s[end+1:]
+	if value == "*" {
+		return berTLV(0x87, []byte(attr)), rest, nil
+	}
+
+	pieces := strings.Split(value, "*")
+	decoded := make([][]byte, len(pieces))
+	for i, p := range pieces {
+		v, err := ldapUnescape(p)
+		if err != nil {
+			return nil, rest, err
+		}
+		decoded[i] = v
+	}
+	if len(pieces) == 1 {
+		return berTLV(0xa3, append(berTLV(0x04, []byte(attr)), berTLV(0x04, decoded[0])...)), rest, nil
+	}
+	var subs []byte
+	for i, v := range decoded {
+		switch {
+		case len(v) == 0:
+		case i == 0:
+			subs = append(subs, berTLV(0x80, v)...)
+		case i == len(decoded)-1:
+			subs = append(subs, berTLV(0x82, v)...)
+		default:
+			subs = append(subs, berTLV(0x81, v)...)
+		}
+	}
+	return berTLV(0xa4, append(berTLV(0x04, []byte(attr)), berTLV(0x30, subs)...)), rest, nil
+}
+
+func ldapUnescape(s string) ([]byte, error) {
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+3 > len(s) {
+			return nil, errors.New("invalid escape in filter")
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return nil, errors.New("invalid escape in filter")
+		}
+		b = append(b, c...)
+		i += 2
+	}
+	return b, nil
+}
+
+// berElement is one BER-encoded value; constructed values keep their
+// encoded children in Value.
+type berElement struct {
+	Tag   byte
+	Value []byte
+}
+
+func (e berElement) int() int64 {
+	var n int64
+	for i, b := range e.Value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+func berTLV(tag byte, value []byte) []byte {
+	b := []byte{tag}
+	switch n := len(value); {
+	case n < 0x80:
+		b = append(b, byte(n))
+	case n <= 0xff:
+		b = append(b, 0x81, byte(n))
+	case n <= 0xffff:
+		b = append(b, 0x82, byte(n>>8), byte(n))
+	default:
+		b = append(b, 0x84)
+		b = binary.BigEndian.AppendUint32(b, uint32(n))
+	}
+	return append(b, value...)
+}
+
+func berInt(tag byte, n int64) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		if (n == 0 && b[0]&0x80 == 0) || (n == -1 && b[0]&0x80 != 0) {
+			break
+		}
+	}
+	return berTLV(tag, b)
+}
+
+// parseBER splits encoded values.
+func parseBER(data []byte) ([]berElement, error) {
+	var list []berElement
+	r := bytes.NewReader(data)
+	for r.Len() > 0 {
+		tag, value, err := readBER(r)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, berElement{Tag: tag, Value: value})
+	}
+	return list, nil
+}
+
+const maxBERLength = 1 << 20
+
+func readBER(r io.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	n := int(hdr[1])
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 4 {
+			return 0, nil, errors.New("unsupported BER length")
+		}
+		var lb [4]byte
+		if _, err := io.ReadFull(r, lb[4-size:]); err != nil {
+			return 0, nil, err
+		}
+		n = int(binary.BigEndian.Uint32(lb[:]))
+	}
+	if n > maxBERLength {
+		return 0, nil, errors.New("BER value too long")
+	}
+	value := make([]byte, n)
+	_, err := io.ReadFull(r, value)
+	return hdr[0], value, err
+}
+
+// --- MQTT ---
+
+// Change events can be published to an MQTT broker, one message per event
+// on <topic>/<collection>/<event type> (e.g. bookmarkd/default/
+// bookmark.created) with the event JSON as payload. Messages are sent with
+// QoS 0; events that occur while the broker is unreachable are dropped.
+// The few MQTT 3.1.1 packets needed are encoded by hand.
+
+type mqttConfig struct {
+	URL       *url.URL // mqtt://[user:pass@]host[:1883] or mqtts://...[:8883]
+	Topic     string
+	ClientID  string
+	Retain    bool
+	KeepAlive time.Duration
+}
+
+func loadMQTTConfig() (mqttConfig, error) {
+	cfg := mqttConfig{
+		Topic:     strings.Trim(cmp.Or(os.Getenv("BOOKMARKD_MQTT_TOPIC"), "bookmarkd"), "/"),
+		ClientID:  cmp.Or(os.Getenv("BOOKMARKD_MQTT_CLIENT_ID"), "bookmarkd"),
+		Retain:    os.Getenv("BOOKMARKD_MQTT_RETAIN") == "true",
+		KeepAlive: time.Minute,
+	}
+	raw := os.Getenv("BOOKMARKD_MQTT_URL")
+	if raw == "" {
+		return cfg, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "mqtt" && u.Scheme != "mqtts" && u.Scheme != "tcp" && u.Scheme != "ssl") || u.Host == "" {
+		return cfg, fmt.Errorf("invalid BOOKMARKD_MQTT_URL %q", redactURL(raw))
+	}
+	cfg.URL = u
+	return cfg, nil
+}
+
+func startMQTT() {
+	cfg, err := loadMQTTConfig()
+	if err != nil {
+		slog.Warn("MQTT disabled", "err", err)
+		return
+	}
+	if cfg.URL == nil {
+		return
+	}
+
+	slog.Info("MQTT: publishing change events", "broker", cfg.URL.Redacted(), "topic", cfg.Topic+"/")
+	events, _ := changes.subscribe()
+	go func() {
+		delay := time.Second
+		for {
+			conn, err := dialMQTT(cfg)
+			if err == nil {
+				delay = time.Second
+				err = publishMQTT(conn, cfg, events)
+				conn.Close()
+			}
+			slog.Warn("MQTT: connection failed, reconnecting", "err", err, "delay", delay)
+			time.Sleep(delay)
+			delay = min(delay*2, 5*time.Minute)
+		}
+	}()
+}
+
+// dialMQTT connects and logs in to the broker.
+func dialMQTT(cfg mqttConfig) (net.Conn, error) {
+	secure := cfg.URL.Scheme == "mqtts" || cfg.URL.Scheme == "ssl"
+	host := cfg.URL.Host
+	if cfg.URL.Port() == "" {
+		port := "1883"
+		if secure {
+			port = "8883"
+		}
+		host = net.JoinHostPort(cfg.URL.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if secure {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: cfg.URL.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var flags byte = 0x02 // clean session
+	payload := mqttString(nil, cfg.ClientID)
+	if user := cfg.URL.User; user != nil {
+		flags |= 0x80
+		payload = mqttString(payload, user.Username())
+		if password, ok := user.Password(); ok {
+			flags |= 0x40
+			payload = mqttString(payload, password)
+		}
+	}
+	header := mqttString(nil, "MQTT")
+	header = append(header, 4, flags) // protocol level 3.1.1
+	header = binary.BigEndian.AppendUint16(header, uint16(cfg.KeepAlive/time.Second))
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttPacket(0x10, append(header, payload...))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	typ, body, err := readMQTTPacket(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if typ != 0x20 || len(body) != 2 || body[1] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused by broker (code %v)", body)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// publishMQTT sends events until the connection fails, pinging the broker
+// when idle so it doesn't drop the connection.
+func publishMQTT(conn net.Conn, cfg mqttConfig, events <-chan changeEvent) error {
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := readMQTTPacket(conn); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+
+	var fixed byte = 0x30 // PUBLISH, QoS 0
+	if cfg.Retain {
+		fixed |= 0x01
+	}
+	ping := time.NewTicker(cfg.KeepAlive / 2)
+	defer ping.Stop()
+	for {
+		var packet []byte
+		select {
+		case err := <-readErr:
+			return err
+		case <-ping.C:
+			packet = mqttPacket(0xC0, nil)
+		case ev := <-events:
+			if ev.Owner != "" {
+				continue
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				continue
+			}
+			topic := cfg.Topic + "/" + ev.Collection + "/" + ev.Type
+			packet = mqttPacket(fixed, append(mqttString(nil, topic), data...))
+		}
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+}
+
+// mqttPacket frames a control packet with its remaining length.
+func mqttPacket(fixed byte, body []byte) []byte {
+	packet := []byte{fixed}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func mqttString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// readMQTTPacket reads one control packet and returns its type (the high
+// nibble of the fixed header) and body.
+func readMQTTPacket(r io.Reader) (byte, []byte, error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, nil, err
+	}
+	typ := b[0] & 0xF0
+
+	n, shift := 0, 0
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n |= int(b[0]&0x7F) << shift
+		if b[0]&0x80 == 0 {
+			break
+		}
+		if shift += 7; shift > 21 {
+			return 0, nil, errors.New("malformed packet length")
+		}
+	}
+	body := make([]byte, n)
+	_, err := io.ReadFull(r, body)
+	return typ, body, err
+}
+
+// --- Watch ---
+
+func fetchAndStoreInitialHash(bookmarkID string, s *Store) {
+	s.mu.RLock()
+	bm, exists := s.bookmarks[bookmarkID]
+	s.mu.RUnlock()
+	if !exists {
+		return
+	}
+
+	hash, err := fetchPageHash(bm.URL)
+	if err != nil {
+		slog.Warn("Watch: could not fetch initial hash", "url", bm.URL, "err", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bm, exists = s.bookmarks[bookmarkID]
+	if !exists {
+		return
+	}
+	now := time.Now().Unix()
+	bm.ContentHash = hash
+	bm.LastChecked = &now
+	s.putBookmark(bm)
+	s.saveDatabase()
+}
+
+func fetchPageHash(pageURL string) (string, error) {
+	req, err := http.NewRequest("GET", pageURL, nil)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := fetch(req, 30*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, resp.Body); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
+func handleWatchCheck(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	go checkWatchedBookmarks(true, s)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "check started"})
+}
+
+// startWatcher registers the "watch" job, which checks the watched
+// bookmarks that are due.
+func startWatcher() {
+	registerJob("watch", "@every 15m", func(ctx context.Context) error {
+		for _, s := range allStores() {
+			checkWatchedBookmarks(false, s)
+		}
+		return nil
+	})
+}
+
+func checkWatchedBookmarks(force bool, s *Store) {
+	s.mu.RLock()
+	var watched []Bookmark
+	now := time.Now().Unix()
+	for _, bm := range s.bookmarks {
+		if !bm.Watched {
+			continue
+		}
+		if !force {
+			interval := bm.WatchInterval
+			if interval <= 0 {
+				interval = 360 // default 6 hours
+			}
+			intervalSec := int64(interval) * 60
+			if bm.LastChecked != nil && (now - *bm.LastChecked) < intervalSec {
+				continue
+			}
+		}
+		watched = append(watched, bm)
+	}
+	s.mu.RUnlock()
+
+	slog.Info("Watch: checking watched bookmarks", "collection", s.Name, "count", len(watched))
+
+	changed := 0
+	for _, bm := range watched {
+		hash, err := fetchPageHash(bm.URL)
+		if err != nil {
+			slog.Warn("Watch: check failed", "url", bm.URL, "err", err)
+			continue
+		}
+
+		s.mu.Lock()
+		current, exists := s.bookmarks[bm.ID]
+		if exists && current.Watched {
+			now := time.Now().Unix()
+			current.LastChecked = &now
+			if current.ContentHash != "" && current.ContentHash != hash {
+				current.Changed = true
+				changedAt := time.Now().Unix()
+				current.ChangedAt = &changedAt
+				changed++
+				slog.Info("Watch: change detected", "url", current.URL)
+			}
+			current.ContentHash = hash
+			s.putBookmark(current)
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.Lock()
+	s.saveDatabase()
+	s.mu.Unlock()
+
+	slog.Info("Watch: check complete", "changed", changed, "checked", len(watched))
+}
+
+// --- Link Checker ---
+
+// linkCheckConfig paces the "link_check" job, which is off unless
+// BOOKMARKD_JOBS_LINK_CHECK_SCHEDULE is set.
+var linkCheckConfig struct {
+	Delay   time.Duration // between two checks
+	Timeout time.Duration // for one check
+}
+
+func loadLinkCheck() {
+	linkCheckConfig.Delay, linkCheckConfig.Timeout = time.Second, 15*time.Second
+	if v := os.Getenv("BOOKMARKD_LINK_CHECK_DELAY"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d >= 0 {
+			linkCheckConfig.Delay = d
+		} else {
+			slog.Warn("Invalid BOOKMARKD_LINK_CHECK_DELAY, using 1s", "value", v)
+		}
+	}
+	if v := os.Getenv("BOOKMARKD_LINK_CHECK_TIMEOUT"); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			linkCheckConfig.Timeout = d
+		} else {
+			slog.Warn("Invalid BOOKMARKD_LINK_CHECK_TIMEOUT, using 15s", "value", v)
+		}
+	}
+}
+
+func startLinkChecker() {
+	registerJob("link_check", "", func(ctx context.Context) error {
+		for _, s := range allStores() {
+			if err := checkLinks(ctx, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// linkDead reports whether a check result means the page is gone, rather
+// than e.g. refusing robots or being briefly down.
+func linkDead(status int, err error) bool {
+	return err != nil || status == http.StatusNotFound || status == http.StatusGone
+}
+
+// checkLinks checks the bookmarks of a collection one at a time, those
+// checked longest ago first, so that an interrupted run still makes
+// progress. Dead links get a fallback_url from the Wayback Machine, which
+// is dropped again once they work.
+func checkLinks(ctx context.Context, s *Store) error {
+	s.mu.RLock()
+	var due []Bookmark
+	for _, bm := range s.bookmarks {
+		if u, err := url.Parse(bm.URL); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			due = append(due, bm)
+		}
+	}
+	s.mu.RUnlock()
+	slices.SortFunc(due, func(a, b Bookmark) int { return cmp.Compare(a.LinkCheckedAt, b.LinkCheckedAt) })
+
+	slog.Info("Link check: checking bookmarks", "collection", s.Name, "owner", s.Owner, "count", len(due))
+	dead := 0
+	for i, bm := range due {
+		if i > 0 {
+			select {
+			case <-time.After(linkCheckConfig.Delay):
+			case <-ctx.Done():
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		status, final, err := checkLink(ctx, bm.URL)
+		if ctx.Err() != nil {
+			break
+		}
+		fallback := ""
+		if linkDead(status, err) {
+			dead++
+			fallback = bm.FallbackURL
+			if fallback == "" {
+				var lookupErr error
+				if fallback, lookupErr = findFallback(ctx, bm); lookupErr != nil {
+					slog.Warn("Link check: could not look up a fallback", "url", bm.URL, "err", lookupErr)
+				}
+			}
+		}
+		recordLinkCheck(s, bm.ID, status, final, err, fallback)
+	}
+
+	s.mu.Lock()
+	s.saveDatabase()
+	s.mu.Unlock()
+	slog.Info("Link check: check complete", "collection", s.Name, "owner", s.Owner, "dead", dead)
+	return ctx.Err()
+}
+
+// checkLink asks for a page with HEAD, and with GET if that fails with an
+// error status, since some servers refuse or mishandle HEAD. It returns the final status
+// and where redirects led if that isn't pageURL.
+func checkLink(ctx context.Context, pageURL string) (int, string, error) {
+	var resp *http.Response
+	for _, method := range []string{"HEAD", "GET"} {
+		req, err := http.NewRequestWithContext(ctx, method, pageURL, nil)
+		if err != nil {
+			return 0, "", err
+		}
+		if resp, err = fetch(req, linkCheckConfig.Timeout); err != nil {
+			return 0, "", err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 400 {
+			break
+		}
+	}
+
+	final := ""
+	if to := canonicalURL(resp.Request.URL.String()); to != canonicalURL(pageURL) {
+		final = to
+	}
+	return resp.StatusCode, final, nil
+}
+
+// recordLinkCheck stores the result of a check. Only a different outcome
+// is a change of the bookmark; the time of a check that found what the last
+// one did is stored without a new revision, so clients don't sync every
+// bookmark after each run.
+func recordLinkCheck(s *Store, id string, status int, final string, checkErr error, fallback string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bm, exists := s.bookmarks[id]
+	if !exists {
+		return
+	}
+
+	before := bm
+	bm.LinkStatus, bm.LinkRedirect, bm.LinkError = status, final, ""
+	if checkErr != nil {
+		bm.LinkError = checkErr.Error()
+	}
+	bm.FallbackURL = fallback
+	bm.LinkCheckedAt = time.Now().Unix()
+	if bm.LinkStatus != before.LinkStatus || bm.LinkRedirect != before.LinkRedirect ||
+		bm.LinkError != before.LinkError || bm.FallbackURL != before.FallbackURL {
+		s.putBookmark(bm)
+	} else {
+		s.bookmarks[id] = bm
+	}
+}
+
+// Link health, as the last check left it.
+const (
+	linkOK         = "ok"
+	linkRedirected = "redirected"
+	linkBroken     = "broken" // an error status, or no answer at all
+	linkUnchecked  = "unchecked"
+)
+
+func linkHealth(bm Bookmark) string {
+	switch {
+	case bm.LinkCheckedAt == 0:
+		return linkUnchecked
+	case bm.LinkStatus == 0 || bm.LinkStatus >= 400:
+		return linkBroken
+	case bm.LinkRedirect != "":
+		return linkRedirected
+	}
+	return linkOK
+}
+
+type linkHealthEntry struct {
+	Bookmark
+	Health string `json:"link_health"`
+}
+
+type linkHealthReport struct {
+	OK         int               `json:"ok"`
+	Redirected int               `json:"redirected"`
+	Broken     int               `json:"broken"`
+	Unchecked  int               `json:"unchecked"`
+	Bookmarks  []linkHealthEntry `json:"bookmarks"`
+}
+
+// handleLinksHealth counts the bookmarks by link health and lists the broken
+// and redirected ones (or those with ?status=), broken first. ?category_id=
+// restricts it to a category.
+func handleLinksHealth(w http.ResponseWriter, r *http.Request, s *Store) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	categoryID, status := r.URL.Query().Get("category_id"), r.URL.Query().Get("status")
+	if status != "" && !slices.Contains([]string{linkOK, linkRedirected, linkBroken, linkUnchecked}, status) {
+		http.Error(w, "Invalid status: must be ok, redirected, broken or unchecked", http.StatusBadRequest)
+		return
+	}
+
+	report := linkHealthReport{Bookmarks: []linkHealthEntry{}}
+	s.mu.RLock()
+	if _, exists := s.categories[categoryID]; categoryID != "" && !exists {
+		s.mu.RUnlock()
+		http.Error(w, "Category not found", http.StatusNotFound)
+		return
+	}
+	for _, bm := range s.bookmarks {
+		if categoryID != "" && bm.CategoryID != categoryID {
+			continue
+		}
+		health := linkHealth(bm)
+		switch health {
+		case linkOK:
+			report.OK++
+		case linkRedirected:
+			report.Redirected++
+		case linkBroken:
+			report.Broken++
+		default:
+			report.Unchecked++
+		}
+		if health == status || status == "" && (health == linkBroken || health == linkRedirected) {
+			bm.Category = s.getCategoryName(bm.CategoryID)
+			report.Bookmarks = append(report.Bookmarks, linkHealthEntry{bm, health})
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.SortFunc(report.Bookmarks, func(a, b linkHealthEntry) int {
+		// "broken" before "redirected"
+		return cmp.Or(cmp.Compare(a.Health, b.Health), cmp.Compare(a.Title, b.Title), cmp.Compare(a.ID, b.ID))
+	})
+	writeJSON(w, http.StatusOK, report)
+}
+
+// --- Command Line ---
+
+// Flags override the variables they stand for, wherever those are set;
+// relative paths given as flags are taken from the working directory.
+
+// version is set at build time with -ldflags "-X main.version=v1.2.3".
+var version string
+
+var settingFlags = []struct {
+	name, env, usage string
+	path             bool
+}{
+	{"host", "BOOKMARKD_HOST", "address to listen on (default localhost)", false},
+	{"port", "BOOKMARKD_PORT", "port to listen on (default 8080)", false},
+	{"db", "BOOKMARKD_DB", "bookmarks file (default bookmarks.json)", true},
+	{"themes", "BOOKMARKD_THEMES", "directory for custom themes (default themes)", true},
+	{"static", "BOOKMARKD_STATIC", "directory the dashboard's static files are served from (default static)", true},
+	{"pprof", "BOOKMARKD_PPROF", "true serves profiles at /debug/pprof/ to admins", false},
+}
+
+func parseFlags() {
+	values := make([]*string, len(settingFlags))
+	for i, f := range settingFlags {
+		values[i] = flag.String(f.name, "", f.usage)
+	}
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "unexpected argument %q\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *showVersion {
+		fmt.Println("bookmarkd", buildVersion())
+		os.Exit(0)
+	}
+
+	for i, f := range settingFlags {
+		value := *values[i]
+		if value == "" {
+			continue
+		}
+		if f.path {
+			if abs, err := filepath.Abs(value); err == nil {
+				value = abs
+			}
+		}
+		os.Setenv(f.env, value)
+	}
+}
+
+// buildVersion is the version set at build time, or else the module version
+// Go records from version control.
+func buildVersion() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	return "dev"
+}
+
+// --- Config File ---
+
+// Settings can also come from a TOML file: BOOKMARKD_CONFIG, or else the
+// first that exists of bookmarkd.toml in the working directory and
+// config.toml in $XDG_CONFIG_HOME/bookmarkd (~/.config/bookmarkd). A key is
+// the name of a BOOKMARKD_ variable without the prefix, in lower case, and a
+// [table] prefixes the keys below it:
+//
+//	port = 8080
+//	data_dir = "/var/lib/bookmarkd"
+//	[backup]
+//	interval = "24h"
+//	[cors]
+//	origins = ["https://a.example", "https://b.example"]
+//
+// sets BOOKMARKD_PORT, BOOKMARKD_DATA_DIR, BOOKMARKD_BACKUP_INTERVAL and
+// BOOKMARKD_CORS_ORIGINS; arrays, on one line, are joined with commas.
+// Variables from the environment win over .env, which wins over the file.
+
+const defaultConfigFile = "bookmarkd.toml"
+
+var configKeyRe = regexp.MustCompile(`^[A-Za-z0-9_]+(\.[A-Za-z0-9_]+)*$`)
+
+// loadConfigFile sets the variables from the config file that aren't set
+// yet, returning the file's path, or "" without one.
+func loadConfigFile() (string, error) {
+	path := os.Getenv("BOOKMARKD_CONFIG")
+	if path == "" {
+		candidates := []string{defaultConfigFile}
+		if dir := xdgDir("XDG_CONFIG_HOME", ".config"); dir != "" {
+			candidates = append(candidates, filepath.Join(dir, "config.toml"))
+		}
+		for _, candidate := range candidates {
+			if _, err := os.Stat(candidate); err == nil {
+				path = candidate
+				break
+			}
+		}
+		if path == "" {
+			return "", nil
+		}
+	}
+	settings, err := readConfigFile(path)
+	if err != nil {
+		return "", err
+	}
+	for name, value := range settings {
+		if _, set := os.LookupEnv(name); !set {
+			os.Setenv(name, value)
+		}
+	}
+	if configFile, err = filepath.Abs(path); err != nil {
+		configFile = path
+	}
+	return path, nil
+}
+
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings, err := parseConfig(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return settings, nil
+}
+
+// parseConfig reads the TOML subset described above into variables.
+func parseConfig(data []byte) (map[string]string, error) {
+	settings := map[string]string{}
+	table := ""
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name, ok := strings.CutPrefix(line, "["); ok {
+			name, _, _ = strings.Cut(name, "#")
+			name, ok = strings.CutSuffix(strings.TrimSpace(name), "]")
+			if !ok || !configKeyRe.MatchString(name) {
+				return nil, fmt.Errorf("line %d: invalid table header", n+1)
+			}
+			table = name + "."
+			continue
+		}
+		key, raw, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !configKeyRe.MatchString(key) {
+			return nil, fmt.Errorf("line %d: expected key = value", n+1)
+		}
+		value, rest, err := configValue(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n+1, err)
+		}
+		if rest = strings.TrimSpace(rest); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmt.Errorf("line %d: unexpected %q after value", n+1, rest)
+		}
+		settings["BOOKMARKD_"+strings.ToUpper(strings.ReplaceAll(table+key, ".", "_"))] = value
+	}
+	return settings, nil
+}
+
+// configValue parses the value at the start of s: a string, number, boolean
+// or array of those. It returns the value as a variable would hold it and
+// the rest of s.
+func configValue(s string) (string, string, error) {
+	s = strings.TrimLeft(s, " \t")
+	switch {
+	case strings.HasPrefix(s, `"`):
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				value, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return value, s[i+1:], nil
+			}
+		}
+		return "", "", errors.New("unterminated string")
+	case strings.HasPrefix(s, "'"):
+		value, rest, ok := strings.Cut(s[1:], "'")
+		if !ok {
+			return "", "", errors.New("unterminated string")
+		}
+		return value, rest, nil
+	case strings.HasPrefix(s, "["):
+		var items []string
+		s = s[1:]
+		for {
+			s = strings.TrimLeft(s, " \t")
+			if rest, ok := strings.CutPrefix(s, "]"); ok {
+				return strings.Join(items, ","), rest, nil
+			}
+			item, rest, err := configValue(s)
+			if err != nil {
+				return "", "", err
+			}
+			items = append(items, item)
+			rest = strings.TrimLeft(rest, " \t")
+			if after, ok := strings.CutPrefix(rest, ","); ok {
+				rest = after
+			} else if !strings.HasPrefix(rest, "]") {
+				return "", "", errors.New("unterminated array")
+			}
+			s = rest
+		}
+	}
+	end := strings.IndexAny(s, " \t#,]")
+	if end < 0 {
+		end = len(s)
+	}
+	value := s[:end]
+	if value == "true" || value == "false" {
+		return value, s[end:], nil
+	}
+	value = strings.ReplaceAll(value, "_", "")
+	if _, err := strconv.ParseFloat(value, 64); err != nil {
+		return "", "", fmt.Errorf("invalid value %q (quote strings)", s[:end])
+	}
+	return value, s[end:], nil
+}
+
+// BOOKMARKD_DATA_DIR, created if missing, holds bookmarks.json (or
+// BOOKMARKD_DB), the other data files, themes and backups. It defaults to
+// $XDG_DATA_HOME/bookmarkd (~/.local/share/bookmarkd), unless the working
+// directory already has the bookmarks file. The server changes into it at
+// startup, so relative paths in other settings are taken from there.
+
+func loadDataDir() {
+	dbFile = cmp.Or(os.Getenv("BOOKMARKD_DB"), dbFile)
+	dir := os.Getenv("BOOKMARKD_DATA_DIR")
+	if dir == "" {
+		if _, err := os.Stat(dbFile); err == nil {
+			return // data from before XDG locations
+		}
+		if dir = xdgDir("XDG_DATA_HOME", ".local/share"); dir == "" {
+			return
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fatal("Could not create data directory", "err", err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		fatal("Could not use data directory", "err", err)
+	}
+	slog.Info("Using data directory", "dir", dir)
+}
+
+// xdgDir is bookmarkd's directory in the XDG base directory named by env,
+// or in fallback below the home directory when that isn't set; "" without
+// a home directory.
+func xdgDir(env, fallback string) string {
+	base := os.Getenv(env)
+	if !filepath.IsAbs(base) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		base = filepath.Join(home, fallback)
+	}
+	return filepath.Join(base, "bookmarkd")
+}
+
+// --- Assets ---
+
+// The templates and static/ are built into the binary. BOOKMARKD_ASSETS
+// names a directory with index.html, login.html and static/ to use instead,
+// e.g. the checkout while working on the dashboard; BOOKMARKD_STATIC one
+// with just the static files. Relative paths are taken from the working
+// directory the server was started in.
+
+//go:embed index.html login.html static extension/components.js
+var embeddedAssets embed.FS
+
+var (
+	assetFS  fs.FS // index.html, login.html and static/
+	staticFS fs.FS // served at /static/
+)
+
+// embeddedFS serves the extension's components.js, which static/ links to
+// but go:embed skips as a symlink, as static/components.js.
+type embeddedFS struct{ embed.FS }
+
+func (f embeddedFS) Open(name string) (fs.File, error) {
+	if name == "static/components.js" {
+		name = "extension/components.js"
+	}
+	return f.FS.Open(name)
+}
+
+func loadAssets() {
+	assetFS = embeddedFS{embeddedAssets}
+	if dir := os.Getenv("BOOKMARKD_ASSETS"); dir != "" {
+		assetFS = os.DirFS(assetPath(dir))
+		if _, err := fs.Stat(assetFS, "index.html"); err != nil {
+			fatal("Could not use assets directory", "err", err)
+		}
+		slog.Info("Using assets directory", "dir", dir)
+	}
+	if dir := os.Getenv("BOOKMARKD_STATIC"); dir != "" {
+		staticFS = os.DirFS(assetPath(dir))
+		return
+	}
+	var err error
+	if staticFS, err = fs.Sub(assetFS, "static"); err != nil {
+		fatal("Could not load static files", "err", err)
+	}
+}
+
+func assetPath(dir string) string {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		fatal("Could not resolve assets directory", "err", err)
+	}
+	return abs
+}
+
+// --- Logging ---
+
+// Logs go through log/slog, as text or with BOOKMARKD_LOG_FORMAT=json as
+// JSON, from BOOKMARKD_LOG_LEVEL up (debug, info, warn or error; info by
+// default). Every request gets an ID, from its X-Request-ID header or made
+// up, which is sent back in that header; records logged with a request's
+// context carry the ID, method, path and client address.
+
+type logAttrsKey struct{}
+
+var requestIDRe = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// contextHandler adds the request fields in a record's context.
+type contextHandler struct{ slog.Handler }
+
+func (h contextHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		rec.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, rec)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+func setupLogging() {
+	var level slog.Level
+	levelErr := level.UnmarshalText([]byte(cmp.Or(os.Getenv("BOOKMARKD_LOG_LEVEL"), "info")))
+	opts := &slog.HandlerOptions{Level: level}
+
+	format := os.Getenv("BOOKMARKD_LOG_FORMAT")
+	var handler slog.Handler
+	if format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(contextHandler{handler}))
+
+	if levelErr != nil {
+		slog.Warn("Invalid BOOKMARKD_LOG_LEVEL, using info", "value", os.Getenv("BOOKMARKD_LOG_LEVEL"))
+	}
+	if format != "" && format != "json" && format != "text" {
+		slog.Warn("Invalid BOOKMARKD_LOG_FORMAT, using text", "value", format)
+	}
+}
+
+// fatal logs an error and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// withRequestID gives each request an ID and its log fields.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRe.MatchString(id) {
+			id = uuid.NewString()
+		}
+		w.Header().Set("X-Request-ID", id)
+		attrs := []slog.Attr{
+			slog.String("request_id", id),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("ip", clientIP(r).String()),
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), logAttrsKey{}, attrs)))
+	})
+}
+
+// --- Access Log ---
+
+// With BOOKMARKD_ACCESS_LOG=on every request is logged as a "Request" record
+// with its status, response bytes and duration next to the request fields;
+// with "combined" as an Apache combined format line for existing log
+// pipelines, to BOOKMARKD_ACCESS_LOG_FILE or stdout. The remote address
+// honors X-Forwarded-For from BOOKMARKD_AUTH_PROXY_IPS. Health checks are
+// left out, and token query parameters are redacted.
+
+var (
+	accessLogMode string // "", "on" or "combined"
+	accessLogMu   sync.Mutex
+	accessLogOut  io.Writer = os.Stdout
+)
+
+func loadAccessLog() {
+	if f, ok := accessLogOut.(*os.File); ok && f != os.Stdout {
+		f.Close()
+	}
+	accessLogMode, accessLogOut = "", os.Stdout
+	switch mode := os.Getenv("BOOKMARKD_ACCESS_LOG"); mode {
+	case "", "off":
+	case "on", "combined":
+		accessLogMode = mode
+	default:
+		slog.Warn("Invalid BOOKMARKD_ACCESS_LOG, access log disabled", "value", mode)
+		return
+	}
+	path := os.Getenv("BOOKMARKD_ACCESS_LOG_FILE")
+	if accessLogMode != "combined" || path == "" {
+		return
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		slog.Warn("Could not open access log, using stdout", "err", err)
+		return
+	}
+	accessLogOut = f
+}
+
+// accessLogWriter records the status and size of a response. Flushing and
+// hijacking reach the underlying writer through Unwrap.
+type accessLogWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessLogWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= 200 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessLogWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessLogWriter) Flush() {
+	http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+func (w *accessLogWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// redactedURI is the request URI with token query parameters blanked out.
+func redactedURI(r *http.Request) string {
+	query := r.URL.Query()
+	redacted := false
+	for _, key := range []string{"access_token", "auth_token"} {
+		if query.Has(key) {
+			query.Set(key, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return r.URL.RequestURI()
+	}
+	return r.URL.EscapedPath() + "?" + query.Encode()
+}
+
+func withAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if accessLogMode == "" || isHealthPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		// read before the handler, which may release the settings
+		mode, out, ip := accessLogMode, accessLogOut, clientIP(r)
+		start := time.Now()
+		uri := redactedURI(r)
+		lw := &accessLogWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			// Nothing written, or the connection was hijacked.
+			lw.status = http.StatusOK
+			if r.Header.Get("Upgrade") != "" {
+				lw.status = http.StatusSwitchingProtocols
+			}
+		}
+
+		if mode == "on" {
+			slog.InfoContext(r.Context(), "Request", "uri", uri, "status", lw.status, "bytes", lw.bytes, "duration", time.Since(start))
+			return
+		}
+		user := "-"
+		if name, _, ok := r.BasicAuth(); ok && name != "" {
+			user = name
+		}
+		size := "-"
+		if lw.bytes > 0 {
+			size = strconv.FormatInt(lw.bytes, 10)
+		}
+		referer, agent := cmp.Or(r.Referer(), "-"), cmp.Or(r.UserAgent(), "-")
+		line := fmt.Sprintf("%s - %s [%s] %s %d %s %s %s\n",
+			ip, strings.ReplaceAll(user, " ", "%20"), start.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(r.Method+" "+uri+" "+r.Proto), lw.status, size, strconv.Quote(referer), strconv.Quote(agent))
+		accessLogMu.Lock()
+		defer accessLogMu.Unlock()
+		if _, err := io.WriteString(out, line); err != nil {
+			slog.Error("Could not write access log", "err", err)
+		}
+	})
+}
+
+// --- Tracing ---
+
+// With OTEL_EXPORTER_OTLP_ENDPOINT (or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT for
+// the full URL) every request gets a server span, continuing the trace of
+// its W3C traceparent header, and loading and saving a collection get spans
+// of their own. Spans are sent in batches as OTLP over HTTP with JSON, with
+// the headers in OTEL_EXPORTER_OTLP_HEADERS, as service OTEL_SERVICE_NAME
+// (bookmarkd by default). Records logged with a traced request's context
+// carry trace_id and span_id.
+
+const (
+	traceQueueSize     = 2048
+	traceBatchSize     = 512
+	traceFlushInterval = 5 * time.Second
+)
+
+// OTLP span kinds and status codes.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanStatusError  = 2
+)
+
+type spanKey struct{}
+
+// span is a timed operation in a trace. Its methods accept nil, which
+// startSpan returns while tracing is off.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // zero for the root of a trace
+	sampled  bool
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    []slog.Attr
+	err      string
+}
+
+// traceExporter sends finished spans to the collector.
+type traceExporter struct {
+	endpoint string
+	headers  http.Header
+	service  string
+	queue    chan *span
+	flush    chan chan struct{}
+	dropped  atomic.Int64
+}
+
+var (
+	tracer      *traceExporter // nil while tracing is off
+	traceClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+func loadTracing() {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint == "" && base != "" {
+		endpoint = strings.TrimSuffix(base, "/") + "/v1/traces"
+	}
+	if endpoint == "" || os.Getenv("OTEL_SDK_DISABLED") == "true" || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return
+	}
+	if u, err := url.Parse(endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		slog.Warn("Invalid OTLP endpoint, tracing disabled", "endpoint", endpoint)
+		return
+	}
+	protocol := cmp.Or(os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL"), os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"))
+	if protocol != "" && protocol != "http/json" {
+		slog.Warn("Only OTLP over HTTP with JSON is supported, using it", "protocol", protocol)
+	}
+
+	headers := make(http.Header)
+	for _, list := range []string{os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), os.Getenv("OTEL_EXPORTER_OTLP_TRACES_HEADERS")} {
+		for _, pair := range strings.Split(list, ",") {
+			key, value, ok := strings.Cut(pair, "=")
+			if !ok {
+				continue
+			}
+			if unescaped, err := url.PathUnescape(strings.TrimSpace(value)); err == nil {
+				value = unescaped
+			}
+			headers.Set(strings.TrimSpace(key), value)
+		}
+	}
+
+	tracer = &traceExporter{
+		endpoint: endpoint,
+		headers:  headers,
+		service:  cmp.Or(os.Getenv("OTEL_SERVICE_NAME"), "bookmarkd"),
+		queue:    make(chan *span, traceQueueSize),
+		flush:    make(chan chan struct{}),
+	}
+	go tracer.run()
+	slog.Info("Exporting traces", "endpoint", endpoint)
+}
+
+// startSpan starts a span in the trace of ctx's span, or a new trace.
+func startSpan(ctx context.Context, name string, attrs ...slog.Attr) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	sp := &span{name: name, kind: spanKindInternal, start: time.Now(), attrs: attrs, sampled: true}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		sp.traceID, sp.parentID, sp.sampled = parent.traceID, parent.spanID, parent.sampled
+	} else {
+		rand.Read(sp.traceID[:])
+	}
+	rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+func (sp *span) setAttrs(attrs ...slog.Attr) {
+	if sp != nil {
+		sp.attrs = append(sp.attrs, attrs...)
+	}
+}
+
+// fail marks the span as failed with err, if any.
+func (sp *span) fail(err error) {
+	if sp != nil && err != nil {
+		sp.err = err.Error()
+	}
+}
+
+// finish ends the span and queues it for export. A full queue drops it.
+func (sp *span) finish() {
+	if sp == nil || !sp.sampled {
+		return
+	}
+	sp.end = time.Now()
+	select {
+	case tracer.queue <- sp:
+	default:
+		tracer.dropped.Add(1)
+	}
+}
+
+// parseTraceparent reads a W3C traceparent header into a remote parent span.
+func parseTraceparent(header string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) ||
+		len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	var parent span
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil, false
+	}
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil || parent.traceID == [16]byte{} {
+		return nil, false
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil || parent.spanID == [8]byte{} {
+		return nil, false
+	}
+	parent.sampled = flags[0]&1 == 1
+	return &parent, true
+}
+
+// withTracing runs each request in a server span named after its route.
+func withTracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, parent)
+		}
+		_, route := http.DefaultServeMux.Handler(r)
+		if _, path, ok := strings.Cut(route, " "); ok {
+			route = path
+		}
+		ctx, sp := startSpan(ctx, strings.TrimSpace(r.Method+" "+route),
+			slog.String("http.request.method", r.Method),
+			slog.String("url.path", r.URL.Path),
+			slog.String("http.route", route),
+			slog.String("client.address", clientIP(r).String()),
+			slog.String("user_agent.original", r.UserAgent()),
+		)
+		sp.kind = spanKindServer
+		if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+			attrs = append(slices.Clip(attrs),
+				slog.String("trace_id", hex.EncodeToString(sp.traceID[:])),
+				slog.String("span_id", hex.EncodeToString(sp.spanID[:])))
+			ctx = context.WithValue(ctx, logAttrsKey{}, attrs)
+		}
+		if name := collectionFromRequest(r); name != "" {
+			sp.setAttrs(slog.String("bookmarkd.collection", name))
+		}
+
+		lw := &accessLogWriter{ResponseWriter: w}
+		defer func() {
+			status := lw.status
+			if status == 0 {
+				status = http.StatusOK
+				if r.Header.Get("Upgrade") != "" {
+					status = http.StatusSwitchingProtocols
+				}
+			}
+			sp.setAttrs(slog.Int("http.response.status_code", status), slog.Int64("http.response.body.size", lw.bytes))
+			if status >= 500 {
+				sp.err = http.StatusText(status)
+			}
+			sp.finish()
+		}()
+		next.ServeHTTP(lw, r.WithContext(ctx))
+	})
+}
+
+func (t *traceExporter) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case sp := <-t.queue:
+			if batch = append(batch, sp); len(batch) >= traceBatchSize {
+				t.send(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			t.send(batch)
+			batch = nil
+		case done := <-t.flush:
+			for len(t.queue) > 0 {
+				batch = append(batch, <-t.queue)
+			}
+			t.send(batch)
+			batch = nil
+			close(done)
+		}
+	}
+}
+
+// stopTracing sends the spans still queued, giving up when ctx is done.
+func stopTracing(ctx context.Context) {
+	if tracer == nil {
+		return
+	}
+	done := make(chan struct{})
+	select {
+	case tracer.flush <- done:
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	case <-ctx.Done():
+	}
+}
+
+// send posts a batch of spans to the collector.
+func (t *traceExporter) send(batch []*span) {
+	if dropped := t.dropped.Swap(0); dropped > 0 {
+		slog.Warn("Dropped spans, export queue full", "count", dropped)
+	}
+	if len(batch) == 0 {
+		return
+	}
+	spans := make([]map[string]any, len(batch))
+	for i, sp := range batch {
+		s := map[string]any{
+			"traceId":           hex.EncodeToString(sp.traceID[:]),
+			"spanId":            hex.EncodeToString(sp.spanID[:]),
+			"name":              sp.name,
+			"kind":              sp.kind,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(sp.attrs),
+		}
+		if sp.parentID != [8]byte{} {
+			s["parentSpanId"] = hex.EncodeToString(sp.parentID[:])
+		}
+		if sp.err != "" {
+			s["status"] = map[string]any{"code": spanStatusError, "message": sp.err}
+		}
+		spans[i] = s
+	}
+	body, err := json.Marshal(map[string]any{"resourceSpans": []any{map[string]any{
+		"resource": map[string]any{"attributes": otlpAttributes([]slog.Attr{
+			slog.String("service.name", t.service),
+			slog.String("service.version", buildVersion()),
+		})},
+		"scopeSpans": []any{map[string]any{
+			"scope": map[string]any{"name": "bookmarkd", "version": buildVersion()},
+			"spans": spans,
+		}},
+	}}})
+	if err != nil {
+		slog.Error("Could not marshal spans", "err", err)
+		return
+	}
+
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		slog.Warn("Could not export spans", "err", err)
+		return
+	}
+	maps.Copy(req.Header, t.headers)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := traceClient.Do(req)
+	if err != nil {
+		slog.Warn("Could not export spans", "err", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		slog.Warn("Could not export spans", "status", resp.StatusCode)
+	}
+}
+
+// otlpAttributes converts attributes to OTLP's JSON form.
+func otlpAttributes(attrs []slog.Attr) []map[string]any {
+	result := make([]map[string]any, 0, len(attrs))
+	for _, a := range attrs {
+		var value map[string]any
+		switch v := a.Value.Resolve(); v.Kind() {
+		case slog.KindBool:
+			value = map[string]any{"boolValue": v.Bool()}
+		case slog.KindInt64:
+			value = map[string]any{"intValue": strconv.FormatInt(v.Int64(), 10)}
+		case slog.KindUint64:
+			value = map[string]any{"intValue": strconv.FormatUint(v.Uint64(), 10)}
+		case slog.KindFloat64:
+			value = map[string]any{"doubleValue": v.Float64()}
+		default:
+			value = map[string]any{"stringValue": v.String()}
+		}
+		result = append(result, map[string]any{"key": a.Key, "value": value})
+	}
+	return result
+}
+
+// --- Base Path ---
+
+// BOOKMARKD_BASE_PATH (e.g. /bookmarks) serves everything under a prefix, so
+// a reverse proxy can mount bookmarkd at example.com/bookmarks without
+// rewriting paths. Handlers see paths without it; links, redirects and the
+// session cookie add it back. Health checks also answer at the root.
+
+var basePath string // "" or e.g. "/bookmarks", without trailing slash
+
+func loadBasePath() {
+	p := strings.Trim(os.Getenv("BOOKMARKD_BASE_PATH"), "/")
+	if p == "" {
+		return
+	}
+	if strings.ContainsAny(p, "?#%\\") || slices.ContainsFunc(strings.Split(p, "/"), func(seg string) bool {
+		return seg == "" || seg == "." || seg == ".."
+	}) {
+		fatal("Invalid BOOKMARKD_BASE_PATH", "value", os.Getenv("BOOKMARKD_BASE_PATH"))
+	}
+	basePath = "/" + p
+}
+
+// withBasePath strips basePath from the request path and answers 404
+// outside of it.
+func withBasePath(next http.Handler) http.Handler {
+	if basePath == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			target := basePath + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+		rest, ok := strings.CutPrefix(r.URL.Path, basePath+"/")
+		if !ok {
+			if isHealthPath(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			http.NotFound(w, r)
+			return
+		}
+
+		r2 := r.WithContext(r.Context())
+		r2.URL = new(url.URL)
+		*r2.URL = *r.URL
+		r2.URL.Path = "/" + rest
+		r2.URL.RawPath = ""
+		next.ServeHTTP(w, r2)
+	})
+}
+
+// --- Tenants ---
+
+// BOOKMARKD_TENANTS=host serves each directory below tenantsDir to requests
+// for the host it is named after (tenants/alice.example.com/), and
+// BOOKMARKD_TENANTS=path to requests below /t/<name>/. A tenant directory is
+// laid out like the data directory, with collections and a themes directory
+// of its own; other hosts and paths reach the instance's. Creating the
+// directory creates the tenant, which is picked up at startup and on reload.
+//
+// A tenant's collections belong to tenantOwner(name), which keeps them apart
+// like a user's: requests with the instance's credentials, or none, act on
+// the tenant they were sent to, while users and tokens created for a tenant
+// only reach their own collections. Settings, users, webhooks, MQTT and sync
+// stay the instance's.
+
+var (
+	tenantMode   string // "", "host" or "path"
+	tenantsMu    sync.RWMutex
+	tenants      = make(map[string]bool)
+	tenantNameRe = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?(\.[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?)*$`)
+)
+
+type tenantKey struct{}
+
+// tenantOwnerPrefix marks the owner IDs of tenants; user IDs are UUIDs.
+const tenantOwnerPrefix = "tenant-"
+
+func tenantOwner(name string) string {
+	return tenantOwnerPrefix + name
+}
+
+// ownerTenant returns the tenant an owner ID stands for.
+func ownerTenant(owner string) (string, bool) {
+	return strings.CutPrefix(owner, tenantOwnerPrefix)
+}
+
+func loadTenantMode() {
+	switch mode := os.Getenv("BOOKMARKD_TENANTS"); mode {
+	case "", "off":
+	case "host", "path":
+		tenantMode = mode
+	default:
+		fatal("Invalid BOOKMARKD_TENANTS", "value", mode)
+	}
+}
+
+// loadTenants opens the collections of every tenant directory not opened
+// yet.
+func loadTenants() {
+	if tenantMode == "" {
+		return
+	}
+	entries, err := os.ReadDir(tenantsDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Warn("Could not read tenants directory", "err", err)
+		}
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() || len(name) > 253 || !tenantNameRe.MatchString(name) || tenantExists(name) {
+			continue
+		}
+		if err := openOwnerStores(tenantOwner(name)); err != nil {
+			slog.Error("Could not load tenant", "tenant", name, "err", err)
+			continue
+		}
+		tenantsMu.Lock()
+		tenants[name] = true
+		tenantsMu.Unlock()
+		slog.Info("Loaded tenant", "tenant", name)
+	}
+}
+
+func tenantExists(name string) bool {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	return tenants[name]
+}
+
+// tenantNames returns the loaded tenants, sorted.
+func tenantNames() []string {
+	tenantsMu.RLock()
+	defer tenantsMu.RUnlock()
+	return slices.Sorted(maps.Keys(tenants))
+}
+
+// requestTenant returns the tenant a request was sent to, "" for the
+// instance.
+func requestTenant(r *http.Request) string {
+	tenant, _ := r.Context().Value(tenantKey{}).(string)
+	return tenant
+}
+
+// requestBase is the path the request's pages are served below: basePath,
+// and /t/<name> for a tenant selected by path.
+func requestBase(r *http.Request) string {
+	if tenant := requestTenant(r); tenant != "" && tenantMode == "path" {
+		return basePath + "/t/" + tenant
+	}
+	return basePath
+}
+
+// withTenant records the tenant a request was sent to in its context,
+// stripping the /t/<name> prefix in path mode.
+func withTenant(next http.Handler) http.Handler {
+	if tenantMode == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var name string
+		switch tenantMode {
+		case "host":
+			name = r.Host
+			if host, _, err := net.SplitHostPort(name); err == nil {
+				name = host
+			}
+			name = strings.ToLower(strings.TrimSuffix(name, "."))
+			if !tenantExists(name) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		case "path":
+			rest, ok := strings.CutPrefix(r.URL.Path, "/t/")
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			name, rest, ok = strings.Cut(rest, "/")
+			if !tenantExists(name) {
+				http.Error(w, "Tenant not found", http.StatusNotFound)
+				return
+			}
+			if !ok {
+				http.Redirect(w, r, basePath+r.URL.Path+"/", http.StatusMovedPermanently)
+				return
+			}
+			r2 := r.WithContext(r.Context())
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/" + rest
+			r2.URL.RawPath = ""
+			r = r2
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tenantKey{}, name)))
+	})
+}
+
+// --- Health ---
+
+// GET /healthz answers while the process is up; GET /readyz once the
+// databases are loaded and the data directory is writable, and with 503 and
+// the failing checks otherwise. Both need no credentials, for Docker
+// HEALTHCHECK and Kubernetes probes.
+
+type healthStatus struct {
+	Status string            `json:"status"`           // "ok" or "unavailable"
+	Checks map[string]string `json:"checks,omitempty"` // "ok" or what failed
+}
+
+func isHealthPath(path string) bool {
+	return path == "/healthz" || path == "/readyz"
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, healthStatus{Status: "ok"})
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	health := healthStatus{Status: "ok", Checks: map[string]string{
+		"database": "ok",
+		"storage":  "ok",
+	}}
+	if getStore(defaultCollection) == nil {
+		health.Checks["database"] = "not loaded"
+	}
+	if f, err := os.CreateTemp(".", ".readyz*"); err != nil {
+		health.Checks["storage"] = err.Error()
+	} else {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	status := http.StatusOK
+	for _, result := range health.Checks {
+		if result != "ok" {
+			health.Status, status = "unavailable", http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, health)
+}
+
+// --- Admin Stats ---
+
+// GET /api/admin/stats reports sizes and counts for dashboards and capacity
+// checks: per collection and in total, plus disk usage of the data
+// directory and the favicon cache, and uptime. Admins only.
+
+var startTime = time.Now()
+
+type collectionStats struct {
+	Name       string `json:"name"`
+	Owner      string `json:"owner,omitempty"`
+	Bookmarks  int    `json:"bookmarks"`
+	Categories int    `json:"categories"`
+	Tags       int    `json:"tags"`
+	Bytes      int64  `json:"bytes"`                // size of the file on disk
+	LastSaved  int64  `json:"last_saved,omitempty"` // Unix time the file was last written
+}
+
+type adminStats struct {
+	Collections       []collectionStats `json:"collections"`
+	Bookmarks         int               `json:"bookmarks"`
+	Categories        int               `json:"categories"`
+	Tags              int               `json:"tags"` // distinct tags over all collections
+	DatabaseBytes     int64             `json:"database_bytes"`
+	DataDirBytes      int64             `json:"data_dir_bytes"`
+	FaviconCacheBytes int64             `json:"favicon_cache_bytes"`
+	ThumbnailBytes    int64             `json:"thumbnail_bytes"`
+	LastSaved         int64             `json:"last_saved,omitempty"`
+	StartedAt         int64             `json:"started_at"`
+	Uptime            int64             `json:"uptime"` // seconds
+	Version           string            `json:"version"`
+}
+
+// stats counts the collection; its tags are also added to allTags.
+func (s *Store) stats(allTags map[string]bool) collectionStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tags := make(map[string]bool)
+	for _, bm := range s.bookmarks {
+		for _, tag := range bm.Tags {
+			tags[tag] = true
+			allTags[tag] = true
+		}
+	}
+	st := collectionStats{
+		Name:       s.Name,
+		Owner:      s.Owner,
+		Bookmarks:  len(s.bookmarks),
+		Categories: len(s.categories),
+		Tags:       len(tags),
+	}
+	if !s.modTime.IsZero() {
+		st.LastSaved = s.modTime.Unix()
+	}
+	if info, err := os.Stat(s.path); err == nil {
+		st.Bytes = info.Size()
+	}
+	return st
+}
+
+// dirSize is the total size of the files below dir.
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	stats := adminStats{
+		Collections:       []collectionStats{},
+		DataDirBytes:      dirSize("."),
+		FaviconCacheBytes: dirSize(faviconCacheDir),
+		ThumbnailBytes:    dirSize(thumbnailsDir),
+		StartedAt:         startTime.Unix(),
+		Uptime:            int64(time.Since(startTime).Seconds()),
+		Version:           buildVersion(),
+	}
+	tags := make(map[string]bool)
+	for _, s := range allStores() {
+		st := s.stats(tags)
+		stats.Collections = append(stats.Collections, st)
+		stats.Bookmarks += st.Bookmarks
+		stats.Categories += st.Categories
+		stats.DatabaseBytes += st.Bytes
+		stats.LastSaved = max(stats.LastSaved, st.LastSaved)
+	}
+	stats.Tags = len(tags)
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// --- Profiling ---
+
+// BOOKMARKD_PPROF=true serves net/http/pprof's profiles at /debug/pprof/, to
+// admins only (requiredRole), for profiling large collections in place.
+// Importing the package registers its routes on http.DefaultServeMux, so
+// withProfiling hides them while profiling is off.
+
+var pprofEnabled bool
+
+func loadProfiling() {
+	pprofEnabled = os.Getenv("BOOKMARKD_PPROF") == "true"
+}
+
+func isProfilingPath(path string) bool {
+	return path == "/debug/pprof" || strings.HasPrefix(path, "/debug/pprof/")
+}
+
+// withProfiling answers 404 for the profiling routes while they are off. It
+// runs after withAuth, and releases the settings for CPU profiles and traces,
+// which take their time.
+func withProfiling(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isProfilingPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !pprofEnabled {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Path == "/debug/pprof" {
+			http.Redirect(w, r, requestBase(r)+"/debug/pprof/", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		releaseSettings(r)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// --- Listeners ---
+
+// The server listens on BOOKMARKD_HOST:BOOKMARKD_PORT, or with
+// BOOKMARKD_SOCKET on that Unix socket instead, for a reverse proxy on the
+// same machine. The socket gets BOOKMARKD_SOCKET_MODE (octal, 660 by
+// default) and BOOKMARKD_SOCKET_GROUP, so that the proxy's group can
+// connect. Connections on it count as coming from 127.0.0.1, which makes the
+// proxy's X-Forwarded-For trusted with the default BOOKMARKD_AUTH_PROXY_IPS.
+//
+// Started by systemd socket activation, the server takes the sockets it
+// passes instead (see systemd/): the one with FileDescriptorName=redirect
+// for the BOOKMARKD_TLS_REDIRECT listener, and the first other one for
+// everything else. systemd keeps them open across restarts, so connections
+// made meanwhile wait instead of failing.
+
+// systemdListeners are the sockets systemd passed, as "server" and
+// "redirect".
+var systemdListeners = map[string]net.Listener{}
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+func loadSystemdListeners() {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() {
+		return
+	}
+	for i := range count {
+		role := "server"
+		if i < len(names) && names[i] == "redirect" {
+			role = "redirect"
+		}
+		if systemdListeners[role] != nil {
+			slog.Warn("Ignoring extra systemd socket", "fd", listenFDsStart+i)
+			continue
+		}
+		fd := listenFDsStart + i
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "systemd socket")
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			fatal("Could not use systemd socket", "fd", fd, "err", err)
+		}
+		if ln.Addr().Network() == "unix" {
+			ln = socketListener{ln}
+		}
+		systemdListeners[role] = ln
+	}
+}
+
+func listen(addr string) net.Listener {
+	if ln := systemdListeners["server"]; ln != nil {
+		return ln
+	}
+	path := os.Getenv("BOOKMARKD_SOCKET")
+	if path == "" {
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			fatal("Could not listen", "err", err)
+		}
+		return ln
+	}
+	mode, err := strconv.ParseUint(cmp.Or(os.Getenv("BOOKMARKD_SOCKET_MODE"), "660"), 8, 32)
+	if err != nil || mode > 0777 {
+		fatal("Invalid BOOKMARKD_SOCKET_MODE", "value", os.Getenv("BOOKMARKD_SOCKET_MODE"))
+	}
+	if info, err := os.Lstat(path); err == nil && info.Mode().Type() == fs.ModeSocket {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			fatal("Socket is in use", "path", path)
+		}
+		os.Remove(path) // left behind by a server that didn't shut down
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		fatal("Could not listen", "err", err)
+	}
+	if err := os.Chmod(path, fs.FileMode(mode)); err != nil {
+		fatal("Could not set socket permissions", "err", err)
+	}
+	if name := os.Getenv("BOOKMARKD_SOCKET_GROUP"); name != "" {
+		group, err := user.LookupGroup(name)
+		if err != nil {
+			fatal("Could not find socket group", "err", err)
+		}
+		gid, _ := strconv.Atoi(group.Gid)
+		if err := os.Chown(path, -1, gid); err != nil {
+			fatal("Could not set socket group", "err", err)
+		}
+	}
+	return socketListener{ln}
+}
+
+// socketListener gives its connections a loopback remote address.
+type socketListener struct{ net.Listener }
+
+type socketConn struct{ net.Conn }
+
+func (l socketListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return socketConn{conn}, nil
+}
+
+func (c socketConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// --- TLS ---
+
+// With BOOKMARKD_TLS_CERT and BOOKMARKD_TLS_KEY, PEM files with the
+// certificate chain and its key, the server speaks HTTPS itself: TLS 1.2 or
+// later, with only forward-secret AEAD cipher suites for 1.2, and HTTP/2 for
+// browsers and gRPC. BOOKMARKD_TLS_REDIRECT, an address like ":80", adds a
+// plain HTTP listener that redirects everything to HTTPS.
+
+// With BOOKMARKD_ACME_DOMAIN instead, a comma-separated list of the names
+// the server is reached by, certificates come from Let's Encrypt (or the
+// ACME directory in BOOKMARKD_ACME_CA) and are renewed before they expire.
+// They are obtained on the first HTTPS request for a name, answering the
+// TLS-ALPN challenge on port 443 or the HTTP one on the redirect listener on
+// port 80, so one of those must be reachable from the internet. Account key
+// and certificates are kept in BOOKMARKD_ACME_DIR ("acme" in the data
+// directory), encrypted like the data files; BOOKMARKD_ACME_EMAIL is given
+// to the CA for expiry notices.
 
-		if oldCategoryID == newCategoryID {
-			shiftOrdersInCategory(oldCategoryID, oldOrder, newOrder, id)
-		} else {
-			shiftOrdersAfter(oldCategoryID, oldOrder, -1, id)
-			shiftOrdersFrom(newCategoryID, newOrder, 1, id)
+// acmeManager obtains certificates in ACME mode; nil otherwise.
+var acmeManager *autocert.Manager
+
+// tlsCert is the certificate from BOOKMARKD_TLS_CERT, replaced by reloads.
+var tlsCert atomic.Pointer[tls.Certificate]
+
+func loadTLSConfig() *tls.Config {
+	certFile, keyFile := os.Getenv("BOOKMARKD_TLS_CERT"), os.Getenv("BOOKMARKD_TLS_KEY")
+	domains := os.Getenv("BOOKMARKD_ACME_DOMAIN")
+	var config *tls.Config
+	switch {
+	case domains != "" && (certFile != "" || keyFile != ""):
+		fatal("Set either BOOKMARKD_TLS_CERT and BOOKMARKD_TLS_KEY or BOOKMARKD_ACME_DOMAIN")
+	case domains != "":
+		var names []string
+		for name := range strings.SplitSeq(domains, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, name)
+			}
+		}
+		acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(names...),
+			Cache:      acmeCache(cmp.Or(os.Getenv("BOOKMARKD_ACME_DIR"), "acme")),
+			Email:      os.Getenv("BOOKMARKD_ACME_EMAIL"),
+		}
+		if ca := os.Getenv("BOOKMARKD_ACME_CA"); ca != "" {
+			acmeManager.Client = &acme.Client{DirectoryURL: ca}
+		}
+		config = acmeManager.TLSConfig()
+		slog.Info("Using ACME certificates", "domains", names)
+	case certFile != "" || keyFile != "":
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			fatal("Could not load TLS certificate", "err", err)
 		}
+		tlsCert.Store(&cert)
+		config = &tls.Config{GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return tlsCert.Load(), nil
+		}}
+	default:
+		return nil
+	}
+	config.MinVersion = tls.VersionTLS12
+	config.CipherSuites = []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+	}
+	return config
+}
 
-		bm.CategoryID = newCategoryID
-		bm.Order = newOrder
+// reloadTLSCertificate reads the certificate files again, reporting whether
+// there are any.
+func reloadTLSCertificate() (bool, error) {
+	if tlsCert.Load() == nil {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(os.Getenv("BOOKMARKD_TLS_CERT"), os.Getenv("BOOKMARKD_TLS_KEY"))
+	if err != nil {
+		return false, err
 	}
+	tlsCert.Store(&cert)
+	return true, nil
+}
 
-	bookmarks[id] = bm
-	saveDatabase()
+// acmeCache is an autocert.Cache storing entries as data files in a
+// directory.
+type acmeCache string
 
-	w.WriteHeader(http.StatusOK)
+func (dir acmeCache) Get(ctx context.Context, key string) ([]byte, error) {
+	data, err := readDataFile(filepath.Join(string(dir), key))
+	if os.IsNotExist(err) {
+		return nil, autocert.ErrCacheMiss
+	}
+	return data, err
 }
 
-func maxOrderInCategory(categoryID string) int {
-	maxOrder := -1
-	for _, bm := range bookmarks {
-		if bm.CategoryID == categoryID && bm.Order > maxOrder {
-			maxOrder = bm.Order
-		}
+func (dir acmeCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := os.MkdirAll(string(dir), 0700); err != nil {
+		return err
 	}
-	return maxOrder
+	return writeDataFile(filepath.Join(string(dir), key), data, 0600)
 }
 
-func shiftOrdersInCategory(categoryID string, oldOrder, newOrder int, excludeID string) {
-	if oldOrder == newOrder {
-		return
-	}
-	for id, bm := range bookmarks {
-		if bm.CategoryID != categoryID || id == excludeID {
-			continue
-		}
-		if oldOrder < newOrder {
-			if bm.Order > oldOrder && bm.Order <= newOrder {
-				bm.Order--
-				bookmarks[id] = bm
-			}
-		} else {
-			if bm.Order >= newOrder && bm.Order < oldOrder {
-				bm.Order++
-				bookmarks[id] = bm
-			}
-		}
+func (dir acmeCache) Delete(ctx context.Context, key string) error {
+	if err := os.Remove(filepath.Join(string(dir), key)); err != nil && !os.IsNotExist(err) {
+		return err
 	}
+	return nil
 }
 
-func shiftOrdersAfter(categoryID string, threshold, delta int, excludeID string) {
-	for id, bm := range bookmarks {
-		if bm.CategoryID != categoryID || id == excludeID {
-			continue
+// startHTTPSRedirect starts the BOOKMARKD_TLS_REDIRECT listener, sending
+// requests on to port over HTTPS; nil without one.
+func startHTTPSRedirect(server *http.Server, port string) *http.Server {
+	addr := os.Getenv("BOOKMARKD_TLS_REDIRECT")
+	ln := systemdListeners["redirect"]
+	if ln != nil {
+		addr = ln.Addr().String()
+	}
+	if addr == "" {
+		return nil
+	}
+	if server.TLSConfig == nil {
+		slog.Warn("Redirecting to HTTPS needs BOOKMARKD_TLS_CERT and BOOKMARKD_TLS_KEY or BOOKMARKD_ACME_DOMAIN, not redirecting")
+		return nil
+	}
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
 		}
-		if bm.Order > threshold {
-			bm.Order += delta
-			bookmarks[id] = bm
+		if host == "" {
+			http.Error(w, "Missing host", http.StatusBadRequest)
+			return
 		}
+		target := "https://" + strings.TrimSuffix(net.JoinHostPort(host, port), ":443") + r.URL.RequestURI()
+		code := http.StatusMovedPermanently
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			code = http.StatusPermanentRedirect
+		}
+		http.Redirect(w, r, target, code)
+	})
+	if acmeManager != nil {
+		handler = acmeManager.HTTPHandler(handler)
 	}
-}
-
-func shiftOrdersFrom(categoryID string, threshold, delta int, excludeID string) {
-	for id, bm := range bookmarks {
-		if bm.CategoryID != categoryID || id == excludeID {
-			continue
+	redirect := &http.Server{Addr: addr, Handler: handler}
+	go func() {
+		var err error
+		if ln != nil {
+			err = redirect.Serve(ln)
+		} else {
+			err = redirect.ListenAndServe()
 		}
-		if bm.Order >= threshold {
-			bm.Order += delta
-			bookmarks[id] = bm
+		if !errors.Is(err, http.ErrServerClosed) {
+			fatal("HTTPS redirect failed", "err", err)
 		}
-	}
+	}()
+	slog.Info("Redirecting HTTP to HTTPS", "addr", addr)
+	return redirect
 }
 
-// --- Watch ---
+// --- Reload ---
 
-func fetchAndStoreInitialHash(bookmarkID string) {
-	mu.RLock()
-	bm, exists := bookmarks[bookmarkID]
-	mu.RUnlock()
-	if !exists {
-		return
-	}
+// On SIGHUP the server reloads without restarting: .env and the config file
+// are read again (variables from the environment and flags stay as they
+// were), the settings derived from them are reloaded, as are the TLS
+// certificate files and themes, collections whose files were changed by
+// something else are read again, and new tenant directories are opened.
+// Listen addresses, the data directory, encryption, ACME, the tenant mode
+// and the background jobs' schedules need a restart.
+//
+// Requests hold settingsMu for reading while they run, so a reload swaps the
+// settings between requests; streams release it once they're established.
 
-	hash, err := fetchPageHash(bm.URL)
-	if err != nil {
-		log.Printf("Watch: failed to fetch initial hash for %s: %v", bm.URL, err)
-		return
-	}
+var settingsMu sync.RWMutex
 
-	mu.Lock()
-	defer mu.Unlock()
-	bm, exists = bookmarks[bookmarkID]
-	if !exists {
-		return
+type settingsKey struct{}
+
+// reloadTimeout bounds how long a reload waits for a moment without
+// requests.
+const reloadTimeout = 10 * time.Second
+
+var (
+	startupEnv map[string]bool // variables set before .env and the config file were read
+	envFile    string          // absolute path of .env
+	configFile string          // absolute path of the config file, "" without one
+)
+
+func recordStartupEnv() {
+	startupEnv = make(map[string]bool)
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		startupEnv[name] = true
+	}
+	var err error
+	if envFile, err = filepath.Abs(".env"); err != nil {
+		envFile = ".env"
 	}
-	now := time.Now().Unix()
-	bm.ContentHash = hash
-	bm.LastChecked = &now
-	bookmarks[bookmarkID] = bm
-	saveDatabase()
 }
 
-func fetchPageHash(pageURL string) (string, error) {
-	client := &http.Client{Timeout: 30 * time.Second}
-	req, err := http.NewRequest("GET", pageURL, nil)
-	if err != nil {
-		return "", err
-	}
-	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; Bookmarkd/1.0)")
+func withSettings(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settingsMu.RLock()
+		release := sync.OnceFunc(settingsMu.RUnlock)
+		defer release()
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), settingsKey{}, release)))
+	})
+}
 
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", err
+// releaseSettings lets a long-lived stream stop holding up reloads; it may
+// not use any settings afterwards.
+func releaseSettings(r *http.Request) {
+	if release, ok := r.Context().Value(settingsKey{}).(func()); ok {
+		release()
 	}
-	defer resp.Body.Close()
+}
 
-	hasher := sha256.New()
-	if _, err := io.Copy(hasher, resp.Body); err != nil {
-		return "", err
+func startReloader() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reload()
+		}
+	}()
+}
+
+// reload reloads what it can and returns what it reloaded.
+func reload() []string {
+	var reloaded []string
+	if err := reloadSettings(); err != nil {
+		slog.Error("Could not reload settings", "err", err)
+	} else {
+		reloaded = append(reloaded, "settings")
 	}
-	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+	if ok, err := reloadTLSCertificate(); err != nil {
+		slog.Error("Could not reload TLS certificate", "err", err)
+	} else if ok {
+		reloaded = append(reloaded, "certificate")
+	}
+	loadTenants()
+	loadThemes()
+	reloaded = append(reloaded, "themes")
+	for _, s := range allStores() {
+		changed, err := s.reloadIfChanged()
+		if err != nil {
+			slog.Error("Could not reload collection", "collection", s.Name, "owner", s.Owner, "err", err)
+		} else if changed {
+			reloaded = append(reloaded, "collection "+s.Name)
+		}
+	}
+	restoreArchivedFavicons()
+	slog.Info("Reloaded", "reloaded", reloaded)
+	return reloaded
 }
 
-func handleWatchCheck(w http.ResponseWriter, r *http.Request) {
+// handleAdminReload reads the request's collection from its file again, for
+// files edited by hand or synced by another tool, and answers what changed.
+func handleAdminReload(w http.ResponseWriter, r *http.Request, s *Store) {
 	if r.Method != "POST" {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-	go checkWatchedBookmarks(true)
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{"status": "check started"})
+	diff, err := s.reloadFromDisk()
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Could not reload collection", "collection", s.Name, "owner", s.Owner, "err", err)
+		http.Error(w, "Could not reload collection", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Reloaded collection", "collection", s.Name, "owner", s.Owner,
+		"bookmarks_added", diff.Bookmarks.Added, "bookmarks_changed", diff.Bookmarks.Changed, "bookmarks_removed", diff.Bookmarks.Removed)
+	writeJSON(w, http.StatusOK, diff)
 }
 
-func startWatcher() {
-	go func() {
-		for {
-			time.Sleep(15 * time.Minute)
-			checkWatchedBookmarks(false)
+func reloadSettings() error {
+	values := map[string]string{}
+	if configFile != "" {
+		settings, err := readConfigFile(configFile)
+		if err != nil {
+			return err
 		}
-	}()
-}
+		maps.Copy(values, settings)
+	}
+	if dotenv, err := godotenv.Read(envFile); err == nil {
+		maps.Copy(values, dotenv)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
 
-func checkWatchedBookmarks(force bool) {
-	mu.RLock()
-	var watched []Bookmark
-	now := time.Now().Unix()
-	for _, bm := range bookmarks {
-		if !bm.Watched {
-			continue
+	deadline := time.Now().Add(reloadTimeout)
+	for !settingsMu.TryLock() {
+		if time.Now().After(deadline) {
+			return errors.New("requests kept running")
 		}
-		if !force {
-			interval := bm.WatchInterval
-			if interval <= 0 {
-				interval = 360 // default 6 hours
-			}
-			intervalSec := int64(interval) * 60
-			if bm.LastChecked != nil && (now - *bm.LastChecked) < intervalSec {
-				continue
-			}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer settingsMu.Unlock()
+
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, ok := values[name]; !ok && !startupEnv[name] {
+			os.Unsetenv(name)
+		}
+	}
+	for name, value := range values {
+		if !startupEnv[name] {
+			os.Setenv(name, value)
 		}
-		watched = append(watched, bm)
 	}
-	mu.RUnlock()
 
-	log.Printf("Watch: starting check for %d watched bookmarks", len(watched))
+	setupLogging()
+	loadCORSConfig()
+	loadURLSchemes()
+	loadTrackingParams()
+	loadRedirectHosts()
+	loadAuth()
+	loadOIDCConfig()
+	loadProxyAuthConfig()
+	loadLDAPConfig()
+	loadRateLimits()
+	loadBodyLimits()
+	loadReadOnly()
+	loadIPAllowlist()
+	loadSecurityHeaders()
+	loadAuthLog()
+	loadAccessLog()
+	loadProfiling()
+	loadFetchPool()
+	loadLinkCheck()
+	loadFaviconRefresh()
+	loadJobs()
+	return nil
+}
 
-	changed := 0
-	for _, bm := range watched {
-		hash, err := fetchPageHash(bm.URL)
-		if err != nil {
-			log.Printf("Watch: failed to check %s: %v", bm.URL, err)
-			continue
-		}
+// --- Shutdown ---
 
-		mu.Lock()
-		current, exists := bookmarks[bm.ID]
-		if exists && current.Watched {
-			now := time.Now().Unix()
-			current.LastChecked = &now
-			if current.ContentHash != "" && current.ContentHash != hash {
-				current.Changed = true
-				changedAt := time.Now().Unix()
-				current.ChangedAt = &changedAt
-				changed++
-				log.Printf("Watch: change detected on %s", current.URL)
-			}
-			current.ContentHash = hash
-			bookmarks[bm.ID] = current
+// On SIGINT or SIGTERM the server stops accepting connections, ends event
+// streams and waits up to shutdownTimeout for requests in flight. It then
+// locks every store, so that saves by background jobs finish and no new ones
+// start, and exits. Data files are replaced atomically, so even a hard kill
+// never leaves a half-written one.
+
+// shutdownTimeout stays within Docker's default 10 second stop timeout.
+const shutdownTimeout = 8 * time.Second
+
+// shuttingDown is closed when the server shuts down; long-lived streams
+// end then.
+var shuttingDown = make(chan struct{})
+
+func shutdown(servers ...*http.Server) {
+	slog.Info("Shutting down")
+	close(shuttingDown)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Warn("Requests still running at shutdown", "err", err)
 		}
-		mu.Unlock()
 	}
 
-	mu.Lock()
-	saveDatabase()
-	mu.Unlock()
-
-	log.Printf("Watch: check complete, %d/%d bookmarks changed", changed, len(watched))
+	locked := make(chan struct{})
+	go func() {
+		for _, s := range allStores() {
+			s.mu.Lock()
+		}
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-ctx.Done():
+		slog.Warn("Stores still busy at shutdown")
+	}
+	stopTracing(ctx)
+	slog.Info("Stopped")
 }
 
 // --- Persistence ---
 
-func loadDatabase() error {
-	file, err := os.ReadFile(dbFile)
+func (s *Store) loadDatabase() (err error) {
+	_, sp := startSpan(context.Background(), "Store.load", slog.String("bookmarkd.collection", s.Name))
+	defer func() {
+		if !os.IsNotExist(err) {
+			sp.fail(err)
+		}
+		sp.finish()
+	}()
+	file, err := readDataFile(s.path)
 	if err != nil {
 		return err
 	}
 
+	sp.setAttrs(slog.Int("bookmarkd.bytes", len(file)))
 	var rawData json.RawMessage
 	if err := json.Unmarshal(file, &rawData); err != nil {
 		return err
@@ -1044,18 +15881,34 @@ func loadDatabase() error {
 
 	var db Database
 	if err := json.Unmarshal(rawData, &db); err == nil && db.Categories != nil {
-		mu.Lock()
-		categories = sliceToCategoryMap(db.Categories)
-		bookmarks = sliceToBookmarkMap(db.Bookmarks)
+		s.mu.Lock()
+		s.categories = sliceToCategoryMap(db.Categories)
+		s.bookmarks = sliceToBookmarkMap(db.Bookmarks)
+		s.searches = db.SavedSearches
+		s.tombstones = make(map[string]Tombstone, len(db.Tombstones))
+		for _, t := range db.Tombstones {
+			s.tombstones[t.ID] = t
+		}
+		s.unpublished = make(map[string]Tombstone, len(db.Unpublished))
+		for _, t := range db.Unpublished {
+			s.unpublished[t.ID] = t
+		}
+		s.seq = db.Seq
+		s.prunedSeq = db.PrunedSeq
+		s.syncState = db.Sync
+		s.activity = db.Activity
+		s.pruneTombstones(time.Now())
+		s.assignMissingSeqs()
 
-		if _, exists := categories[uncategorizedID]; !exists {
-			categories[uncategorizedID] = Category{
+		if _, exists := s.categories[uncategorizedID]; !exists {
+			s.categories[uncategorizedID] = Category{
 				ID:    uncategorizedID,
 				Name:  "Uncategorized",
 				Order: 0,
 			}
 		}
-		mu.Unlock()
+		s.rebuildIndex()
+		s.mu.Unlock()
 		return nil
 	}
 
@@ -1072,13 +15925,15 @@ func loadDatabase() error {
 		return err
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	categories = make(map[string]Category)
-	bookmarks = make(map[string]Bookmark)
+	s.categories = make(map[string]Category)
+	s.bookmarks = make(map[string]Bookmark)
+	s.tombstones = make(map[string]Tombstone)
+	s.unpublished = nil
 
-	categories[uncategorizedID] = Category{
+	s.categories[uncategorizedID] = Category{
 		ID:    uncategorizedID,
 		Name:  "Uncategorized",
 		Order: 0,
@@ -1099,7 +15954,7 @@ func loadDatabase() error {
 			categoryID = existingID
 		} else {
 			categoryID = uuid.New().String()
-			categories[categoryID] = Category{
+			s.categories[categoryID] = Category{
 				ID:    categoryID,
 				Name:  catName,
 				Order: categoryOrder,
@@ -1108,7 +15963,7 @@ func loadDatabase() error {
 			categoryOrder++
 		}
 
-		bookmarks[oldBM.ID] = Bookmark{
+		s.bookmarks[oldBM.ID] = Bookmark{
 			ID:         oldBM.ID,
 			URL:        oldBM.URL,
 			Title:      oldBM.Title,
@@ -1119,36 +15974,277 @@ func loadDatabase() error {
 		}
 	}
 
-	saveDatabase()
+	s.rebuildIndex()
+	s.saveDatabase()
 	return nil
 }
 
-func saveDatabase() {
-	db := Database{
-		Categories: categoriesToSortedSlice(),
-		Bookmarks:  bookmarksToSortedSlice(),
+// database returns the persisted form of the store. Callers must hold s.mu.
+func (s *Store) database() Database {
+	return Database{
+		Categories:    s.categoriesToSortedSlice(),
+		Bookmarks:     s.bookmarksToSortedSlice(),
+		SavedSearches: s.searches,
+		Tombstones:    tombstoneSlice(s.tombstones),
+		Unpublished:   tombstoneSlice(s.unpublished),
+		Seq:           s.seq,
+		PrunedSeq:     s.prunedSeq,
+		Sync:          s.syncState,
+		Activity:      s.activity,
+	}
+}
+
+func tombstoneSlice(tombstones map[string]Tombstone) []Tombstone {
+	result := slices.Collect(maps.Values(tombstones))
+	slices.SortFunc(result, func(a, b Tombstone) int {
+		return cmp.Or(cmp.Compare(a.DeletedAt, b.DeletedAt), strings.Compare(a.ID, b.ID))
+	})
+	return result
+}
+
+func (s *Store) saveDatabase() {
+	s.viewMu.Lock()
+	s.view = nil
+	s.viewMu.Unlock()
+	if s.path == "" {
+		return
 	}
+	_, sp := startSpan(context.Background(), "Store.save",
+		slog.String("bookmarkd.collection", s.Name), slog.Int("bookmarkd.bookmarks", len(s.bookmarks)))
+	defer sp.finish()
 
-	data, err := json.MarshalIndent(db, "", "  ")
+	data, err := json.MarshalIndent(s.database(), "", "  ")
 	if err != nil {
-		log.Printf("Error marshaling database: %v", err)
+		sp.fail(err)
+		slog.Error("Could not marshal database", "collection", s.Name, "err", err)
+		return
+	}
+	sp.setAttrs(slog.Int("bookmarkd.bytes", len(data)))
+	if err := writeDataFile(s.path, data, 0644); err != nil {
+		sp.fail(err)
+		slog.Error("Could not save database", "collection", s.Name, "err", err)
+	}
+	s.modTime = s.fileModTime()
+}
+
+// fileModTime is the modification time of the store's file, zero without
+// one.
+func (s *Store) fileModTime() time.Time {
+	if info, err := os.Stat(s.path); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+// reloadIfChanged loads the store's file again if it has been modified since
+// it was last loaded or saved, reporting whether it did.
+func (s *Store) reloadIfChanged() (bool, error) {
+	if s.path == "" {
+		return false, nil
+	}
+	modTime := s.fileModTime()
+	s.mu.RLock()
+	changed := !modTime.IsZero() && !modTime.Equal(s.modTime)
+	s.mu.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	if _, err := s.reloadFromDisk(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// reloadDiff counts what reading a collection's file again changed.
+type reloadDiff struct {
+	Collection string    `json:"collection"`
+	Bookmarks  diffCount `json:"bookmarks"`
+	Categories diffCount `json:"categories"`
+}
+
+type diffCount struct {
+	Added   int `json:"added"`
+	Changed int `json:"changed"`
+	Removed int `json:"removed"`
+}
+
+// reloadFromDisk reads the store's file again, replacing what is in memory,
+// and publishes the differences as change events so open dashboards and
+// webhooks follow edits made to the file directly.
+func (s *Store) reloadFromDisk() (reloadDiff, error) {
+	diff := reloadDiff{Collection: s.Name}
+	if s.path == "" {
+		return diff, errors.New("collection has no file")
+	}
+	modTime := s.fileModTime()
+	s.mu.RLock()
+	oldBookmarks, oldCategories := maps.Clone(s.bookmarks), maps.Clone(s.categories)
+	s.mu.RUnlock()
+	if err := s.loadDatabase(); err != nil {
+		return diff, err
+	}
+	s.viewMu.Lock()
+	s.view = nil
+	s.viewMu.Unlock()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modTime = modTime
+	for id, cat := range s.categories {
+		if old, ok := oldCategories[id]; !ok {
+			diff.Categories.Added++
+			s.emit(eventCategoryCreated, id, nil, &cat)
+		} else if old != cat {
+			diff.Categories.Changed++
+			s.emit(eventCategoryUpdated, id, nil, &cat)
+		}
+	}
+	for id, bm := range s.bookmarks {
+		if old, ok := oldBookmarks[id]; !ok {
+			diff.Bookmarks.Added++
+			s.emit(eventBookmarkCreated, id, &bm, nil)
+		} else if !reflect.DeepEqual(old, bm) {
+			diff.Bookmarks.Changed++
+			s.emit(eventBookmarkUpdated, id, &bm, nil)
+		}
+	}
+	for id := range oldBookmarks {
+		if _, ok := s.bookmarks[id]; !ok {
+			diff.Bookmarks.Removed++
+			s.emit(eventBookmarkDeleted, id, nil, nil)
+		}
+	}
+	for id := range oldCategories {
+		if _, ok := s.categories[id]; !ok {
+			diff.Categories.Removed++
+			s.emit(eventCategoryDeleted, id, nil, nil)
+		}
+	}
+	return diff, nil
+}
+
+// --- Encryption at Rest ---
+
+// With BOOKMARKD_ENCRYPTION_KEY, or BOOKMARKD_ENCRYPTION_KEY_FILE naming a
+// file that holds it, the bookmark databases, the other data files and
+// scheduled backups (which get an .enc suffix) are encrypted with
+// AES-256-GCM. The key is 32 random bytes in base64, as made by
+// `openssl rand -base64 32`. Encrypted files start with encryptedMagic;
+// files without it are read as plain JSON, so existing data is encrypted on
+// its next save. Without the right key bookmarkd refuses to start rather
+// than replace encrypted files.
+
+const encryptedMagic = "bookmarkd-aes256gcm\n"
+
+var (
+	dataCipher   cipher.AEAD // nil without a key
+	errEncrypted = errors.New("file is encrypted")
+)
+
+func loadEncryptionKey() {
+	encoded := os.Getenv("BOOKMARKD_ENCRYPTION_KEY")
+	if path := os.Getenv("BOOKMARKD_ENCRYPTION_KEY_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			fatal("Could not read encryption key", "err", err)
+		}
+		encoded = string(data)
+	}
+	if encoded = strings.TrimSpace(encoded); encoded == "" {
 		return
 	}
-	if err := os.WriteFile(dbFile, data, 0644); err != nil {
-		log.Printf("Error saving database: %v", err)
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		fatal("Invalid encryption key: need 32 bytes in base64, e.g. from `openssl rand -base64 32`")
+	}
+	block, err := aes.NewCipher(key)
+	if err == nil {
+		dataCipher, err = cipher.NewGCMWithRandomNonce(block)
+	}
+	if err != nil {
+		fatal("Could not set up encryption", "err", err)
+	}
+	slog.Info("Encrypting data files at rest")
+}
+
+// sealData encrypts data to be written, if a key is set.
+func sealData(data []byte) []byte {
+	if dataCipher == nil {
+		return data
+	}
+	return dataCipher.Seal([]byte(encryptedMagic), nil, data, []byte(encryptedMagic))
+}
+
+// openData decrypts data that was read, passing unencrypted data through.
+func openData(data []byte) ([]byte, error) {
+	sealed, ok := bytes.CutPrefix(data, []byte(encryptedMagic))
+	if !ok {
+		return data, nil
+	}
+	if dataCipher == nil {
+		return nil, fmt.Errorf("%w, but BOOKMARKD_ENCRYPTION_KEY is not set", errEncrypted)
+	}
+	plain, err := dataCipher.Open(nil, nil, sealed, []byte(encryptedMagic))
+	if err != nil {
+		return nil, fmt.Errorf("%w with another key or damaged", errEncrypted)
+	}
+	return plain, nil
+}
+
+// readDataFile reads and decrypts a data file. A file it can't decrypt
+// gives an error wrapping errEncrypted; callers must not overwrite it then.
+func readDataFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return openData(data)
+}
+
+// loadDataFile is readDataFile for the startup loaders, which stop
+// bookmarkd rather than start over without a file they cannot decrypt.
+func loadDataFile(path string) ([]byte, error) {
+	data, err := readDataFile(path)
+	if errors.Is(err, errEncrypted) {
+		fatal("Could not read data file", "file", path, "err", err)
+	}
+	return data, err
+}
+
+// writeDataFile encrypts and writes a data file. The file is replaced
+// atomically, so readers and crashes never see it half-written.
+func writeDataFile(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(sealData(data))
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
 	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
 }
 
 // --- Time Tracking ---
 
 func loadTimeTracking() {
-	file, err := os.ReadFile(timeTrackingFile)
+	file, err := loadDataFile(timeTrackingFile)
 	if err != nil {
 		if os.IsNotExist(err) {
 			timeTracking = make(map[string]*DomainTimeData)
 			return
 		}
-		log.Printf("Warning: Could not load time tracking: %v", err)
+		slog.Warn("Could not load time tracking", "err", err)
 		timeTracking = make(map[string]*DomainTimeData)
 		return
 	}
@@ -1157,7 +16253,7 @@ func loadTimeTracking() {
 	defer timeMu.Unlock()
 
 	if err := json.Unmarshal(file, &timeTracking); err != nil {
-		log.Printf("Warning: Could not parse time tracking: %v", err)
+		slog.Warn("Could not parse time tracking", "err", err)
 		timeTracking = make(map[string]*DomainTimeData)
 		return
 	}
@@ -1170,11 +16266,11 @@ func loadTimeTracking() {
 func saveTimeTracking() {
 	data, err := json.MarshalIndent(timeTracking, "", "  ")
 	if err != nil {
-		log.Printf("Error marshaling time tracking: %v", err)
+		slog.Error("Could not marshal time tracking", "err", err)
 		return
 	}
-	if err := os.WriteFile(timeTrackingFile, data, 0644); err != nil {
-		log.Printf("Error saving time tracking: %v", err)
+	if err := writeDataFile(timeTrackingFile, data, 0644); err != nil {
+		slog.Error("Could not save time tracking", "err", err)
 	}
 }
 
@@ -1249,7 +16345,12 @@ func postTimeTracking(w http.ResponseWriter, r *http.Request, domain string) {
 
 // --- Theme Management ---
 
-func getThemesDir() string {
+// getThemesDir returns the themes directory of a tenant, or the instance's
+// for "".
+func getThemesDir(tenant string) string {
+	if tenant != "" {
+		return filepath.Join(tenantsDir, tenant, "themes")
+	}
 	dir := os.Getenv("BOOKMARKD_THEMES")
 	if dir == "" {
 		dir = "themes"
@@ -1257,21 +16358,28 @@ func getThemesDir() string {
 	return dir
 }
 
+// loadThemes loads the themes of the instance and of every tenant.
 func loadThemes() {
 	themeMu.Lock()
 	defer themeMu.Unlock()
 
-	customThemes = nil
-	themesDir := getThemesDir()
+	customThemes = make(map[string][]CustomTheme)
+	for _, tenant := range append([]string{""}, tenantNames()...) {
+		customThemes[tenant] = readThemes(getThemesDir(tenant))
+	}
+}
 
+// readThemes parses the theme files in dir.
+func readThemes(themesDir string) []CustomTheme {
 	files, err := os.ReadDir(themesDir)
 	if err != nil {
 		if !os.IsNotExist(err) {
-			log.Printf("Warning: Could not read themes directory: %v", err)
+			slog.Warn("Could not read themes directory", "err", err)
 		}
-		return
+		return nil
 	}
 
+	var themes []CustomTheme
 	for _, file := range files {
 		if file.IsDir() || !strings.HasSuffix(file.Name(), ".css") {
 			continue
@@ -1279,16 +16387,17 @@ func loadThemes() {
 
 		content, err := os.ReadFile(filepath.Join(themesDir, file.Name()))
 		if err != nil {
-			log.Printf("Warning: Could not read theme file %s: %v", file.Name(), err)
+			slog.Warn("Could not read theme file", "file", file.Name(), "err", err)
 			continue
 		}
 
 		theme := parseThemeCSS(string(content))
 		if theme != nil {
-			customThemes = append(customThemes, *theme)
-			log.Printf("Loaded custom theme: %s", theme.Name)
+			themes = append(themes, *theme)
+			slog.Info("Loaded custom theme", "theme", theme.Name, "dir", themesDir)
 		}
 	}
+	return themes
 }
 
 func parseThemeCSS(cssText string) *CustomTheme {
@@ -1322,8 +16431,9 @@ func parseThemeCSS(cssText string) *CustomTheme {
 func handleThemesAPI(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "GET" {
 		themeMu.RLock()
-		themes := make([]map[string]string, len(customThemes))
-		for i, t := range customThemes {
+		tenantThemes := customThemes[requestTenant(r)]
+		themes := make([]map[string]string, len(tenantThemes))
+		for i, t := range tenantThemes {
 			themes[i] = map[string]string{"name": t.Name}
 		}
 		themeMu.RUnlock()
@@ -1348,7 +16458,7 @@ func handleThemesAPI(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		themesDir := getThemesDir()
+		themesDir := getThemesDir(requestTenant(r))
 		if err := os.MkdirAll(themesDir, 0755); err != nil {
 			http.Error(w, "Could not create themes directory", http.StatusInternalServerError)
 			return
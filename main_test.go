@@ -0,0 +1,213 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestLinkdingTokenOnlyExemptsLinkdingRoutes(t *testing.T) {
+	saved := authCfg
+	t.Cleanup(func() { authCfg = saved })
+	authCfg.Tokens = []string{hashToken("secret")}
+	authCfg.Reads = true
+	t.Setenv("BOOKMARKD_API_TOKEN", "linkding")
+
+	handler := withAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{"POST", "/api/categories/Evil", http.StatusUnauthorized},
+		{"DELETE", "/api/v1/categories/Evil", http.StatusUnauthorized},
+		{"POST", "/api/admin/reload", http.StatusUnauthorized},
+		{"POST", "/api/bookmarks", http.StatusNoContent},
+		{"POST", "/api/v1/bookmarks/", http.StatusNoContent},
+		{"GET", "/api/tags/cloud", http.StatusUnauthorized},
+		{"GET", "/api/v1/tags/cloud", http.StatusUnauthorized},
+		{"GET", "/api/tags/", http.StatusNoContent},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		r.Header.Set("Authorization", "Token junk")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s %s with a junk Token header: got %d, want %d", tc.method, tc.path, w.Code, tc.want)
+		}
+	}
+}
+
+func TestReadOnlyAllowsSigningIn(t *testing.T) {
+	saved := readOnly
+	t.Cleanup(func() { readOnly = saved })
+	readOnly = true
+
+	handler := withReadOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	for _, tc := range []struct {
+		method, path string
+		want         int
+	}{
+		{"POST", "/api/login", http.StatusNoContent},
+		{"POST", "/api/v1/login", http.StatusNoContent},
+		{"POST", "/auth/login", http.StatusNoContent},
+		{"POST", "/api/signup", http.StatusForbidden},
+		{"POST", "/api/bookmarks", http.StatusForbidden},
+		{"GET", "/api/bookmarks", http.StatusNoContent},
+	} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(tc.method, tc.path, nil))
+		if w.Code != tc.want {
+			t.Errorf("%s %s in read-only mode: got %d, want %d", tc.method, tc.path, w.Code, tc.want)
+		}
+	}
+}
+
+func TestSearchIndexMatchesTermScore(t *testing.T) {
+	ix := newSearchIndex()
+	words := []string{"github", "gitlab", "git", "hub", "golang", "go", "documentation", "docs",
+		"über", "uber", "straße", "kubernetes", "kubectl", "aaaa", "a", "ab", "recipes", "recipe"}
+	for i, w := range words {
+		ix.add(fmt.Sprint(i), []string{w})
+	}
+	ix.remove("0")
+	ix.add("0", []string{"github"})
+
+	for _, term := range []string{"git", "githb", "hub", "gthub", "g", "it", "documnetation", "docu",
+		"uber", "ubr", "strasse", "kubern", "kubctl", "aaab", "aaaa", "recipies", "xyz", "lab"} {
+		want := make(map[string]struct{})
+		for token := range ix.tokens {
+			if termScore(token, term) > 0 {
+				want[token] = struct{}{}
+			}
+		}
+		if got := ix.matchingTokens(term); !maps.Equal(got, want) {
+			t.Errorf("matchingTokens(%q) = %v, want %v", term, slices.Sorted(maps.Keys(got)), slices.Sorted(maps.Keys(want)))
+		}
+	}
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.215.14":        true,
+		"2606:4700::6810:85e5": true,
+		"127.0.0.1":            false,
+		"10.1.2.3":             false,
+		"172.16.0.1":           false,
+		"192.168.1.10":         false,
+		"169.254.169.254":      false,
+		"100.100.100.200":      false,
+		"0.0.0.0":              false,
+		"::1":                  false,
+		"fd00::1":              false,
+		"fe80::1":              false,
+		"::ffff:127.0.0.1":     false,
+	} {
+		if got := isPublicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
+
+func newTestStore() *Store {
+	s := &Store{Name: "test"}
+	s.initializeDefaults()
+	return s
+}
+
+// drainEvents returns the events published so far to events.
+func drainEvents(events <-chan changeEvent) []changeEvent {
+	var list []changeEvent
+	for {
+		select {
+		case ev := <-events:
+			list = append(list, ev)
+		default:
+			return list
+		}
+	}
+}
+
+func TestPublicViewHidesPrivateTombstones(t *testing.T) {
+	s := newTestStore()
+	s.mu.Lock()
+	s.putBookmark(Bookmark{ID: "public", URL: "https://example.com/"})
+	s.putBookmark(Bookmark{ID: "secret", URL: "https://example.org/", Private: true})
+	s.removeBookmark("public")
+	s.removeBookmark("secret")
+	s.mu.Unlock()
+
+	view := s.publicView()
+	if _, ok := view.tombstones["public"]; !ok {
+		t.Error("public view lacks the tombstone of a public bookmark")
+	}
+	if _, ok := view.tombstones["secret"]; ok {
+		t.Error("public view has the tombstone of a private bookmark")
+	}
+}
+
+func TestPublicViewHidesPrivateDeleteEvents(t *testing.T) {
+	s := newTestStore()
+	events, unsubscribe := changes.subscribe()
+	defer unsubscribe()
+	s.mu.Lock()
+	s.putBookmark(Bookmark{ID: "secret", URL: "https://example.org/", Private: true})
+	s.removeBookmark("secret")
+	s.mu.Unlock()
+
+	view := s.publicView()
+	list := drainEvents(events)
+	if len(list) != 2 {
+		t.Fatalf("got %d events, want 2", len(list))
+	}
+	for _, ev := range list {
+		if _, ok := view.published(ev); ok {
+			t.Errorf("public view was sent %s of a private bookmark", ev.Type)
+		}
+	}
+}
+
+func TestBookmarkMadePrivateIsDeletedForPublicViews(t *testing.T) {
+	s := newTestStore()
+	s.mu.Lock()
+	s.putBookmark(Bookmark{ID: "b", URL: "https://example.com/"})
+	s.mu.Unlock()
+
+	events, unsubscribe := changes.subscribe()
+	defer unsubscribe()
+	s.mu.Lock()
+	bm := s.bookmarks["b"]
+	bm.Private = true
+	s.putBookmark(bm)
+	s.saveDatabase()
+	s.mu.Unlock()
+
+	view := s.publicView()
+	list := drainEvents(events)
+	if len(list) != 1 {
+		t.Fatalf("got %d events, want 1", len(list))
+	}
+	if ev, ok := view.published(list[0]); !ok || ev.Type != eventBookmarkDeleted || ev.Bookmark != nil {
+		t.Errorf("public view got %+v (%v), want a deletion", ev, ok)
+	}
+	if ts, ok := view.tombstones["b"]; !ok || ts.Seq != s.bookmarks["b"].Seq {
+		t.Errorf("public view tombstones = %v, want one for b", view.tombstones)
+	}
+
+	s.mu.Lock()
+	bm = s.bookmarks["b"]
+	bm.Private = false
+	s.putBookmark(bm)
+	s.saveDatabase()
+	s.mu.Unlock()
+	if _, ok := s.publicView().tombstones["b"]; ok {
+		t.Error("public view keeps the tombstone of a bookmark made public again")
+	}
+}